@@ -26,6 +26,14 @@ type AdditionalDisk struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Type          string                 `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
 	VolName       string                 `protobuf:"bytes,3,opt,name=volName,proto3" json:"volName,omitempty"`
+	Serial        string                 `protobuf:"bytes,4,opt,name=serial,proto3" json:"serial,omitempty"`
+	Wwn           string                 `protobuf:"bytes,5,opt,name=wwn,proto3" json:"wwn,omitempty"`
+	Existing      bool                   `protobuf:"varint,6,opt,name=existing,proto3" json:"existing,omitempty"`                         // attached, but neither created nor deleted by the provider
+	PoolName      string                 `protobuf:"bytes,7,opt,name=pool_name,json=poolName,proto3" json:"pool_name,omitempty"`          // storage pool of the existing volume
+	BlockDevice   string                 `protobuf:"bytes,8,opt,name=block_device,json=blockDevice,proto3" json:"block_device,omitempty"` // host block device attached instead of a volume
+	Format        string                 `protobuf:"bytes,9,opt,name=format,proto3" json:"format,omitempty"`                              // disk format of the existing or encrypted volume
+	Retain        string                 `protobuf:"bytes,10,opt,name=retain,proto3" json:"retain,omitempty"`                             // retain policy of the volume on deprovision
+	SecretUuid    string                 `protobuf:"bytes,11,opt,name=secret_uuid,json=secretUuid,proto3" json:"secret_uuid,omitempty"`   // libvirt secret of the LUKS passphrase of the encrypted volume
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -74,6 +82,62 @@ func (x *AdditionalDisk) GetVolName() string {
 	return ""
 }
 
+func (x *AdditionalDisk) GetSerial() string {
+	if x != nil {
+		return x.Serial
+	}
+	return ""
+}
+
+func (x *AdditionalDisk) GetWwn() string {
+	if x != nil {
+		return x.Wwn
+	}
+	return ""
+}
+
+func (x *AdditionalDisk) GetExisting() bool {
+	if x != nil {
+		return x.Existing
+	}
+	return false
+}
+
+func (x *AdditionalDisk) GetPoolName() string {
+	if x != nil {
+		return x.PoolName
+	}
+	return ""
+}
+
+func (x *AdditionalDisk) GetBlockDevice() string {
+	if x != nil {
+		return x.BlockDevice
+	}
+	return ""
+}
+
+func (x *AdditionalDisk) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *AdditionalDisk) GetRetain() string {
+	if x != nil {
+		return x.Retain
+	}
+	return ""
+}
+
+func (x *AdditionalDisk) GetSecretUuid() string {
+	if x != nil {
+		return x.SecretUuid
+	}
+	return ""
+}
+
 type NetworkInterfaces struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Driver        string                 `protobuf:"bytes,1,opt,name=driver,proto3" json:"driver,omitempty"`
@@ -129,15 +193,17 @@ func (x *NetworkInterfaces) GetNetwork() string {
 // MachineSpec is stored in Omni in the infra provisioner state.
 type MachineSpec struct {
 	state             protoimpl.MessageState `protogen:"open.v1"`
-	Uuid              string                 `protobuf:"bytes,1,opt,name=uuid,proto3" json:"uuid,omitempty"` // required?
+	Uuid              string                 `protobuf:"bytes,1,opt,name=uuid,proto3" json:"uuid,omitempty"` // derived from the provider ID and the machine request ID
 	SchematicId       string                 `protobuf:"bytes,2,opt,name=schematic_id,json=schematicId,proto3" json:"schematic_id,omitempty"`
 	TalosVersion      string                 `protobuf:"bytes,3,opt,name=talos_version,json=talosVersion,proto3" json:"talos_version,omitempty"`
 	VmVolName         string                 `protobuf:"bytes,10,opt,name=vm_vol_name,json=vmVolName,proto3" json:"vm_vol_name,omitempty"`
 	AdditionalDisks   []*AdditionalDisk      `protobuf:"bytes,11,rep,name=additional_disks,json=additionalDisks,proto3" json:"additional_disks,omitempty"`
 	NetworkInterfaces []*NetworkInterfaces   `protobuf:"bytes,12,rep,name=network_interfaces,json=networkInterfaces,proto3" json:"network_interfaces,omitempty"`
 	CidataVolName     string                 `protobuf:"bytes,13,opt,name=cidata_vol_name,json=cidataVolName,proto3" json:"cidata_vol_name,omitempty"`
+	VmVolRetain       string                 `protobuf:"bytes,14,opt,name=vm_vol_retain,json=vmVolRetain,proto3" json:"vm_vol_retain,omitempty"` // retain policy of the primary disk volume on deprovision
 	PoolName          string                 `protobuf:"bytes,20,opt,name=pool_name,json=poolName,proto3" json:"pool_name,omitempty"`
 	VmName            string                 `protobuf:"bytes,21,opt,name=vm_name,json=vmName,proto3" json:"vm_name,omitempty"`
+	Host              string                 `protobuf:"bytes,22,opt,name=host,proto3" json:"host,omitempty"` // name of the libvirt host the machine is placed on
 	unknownFields     protoimpl.UnknownFields
 	sizeCache         protoimpl.SizeCache
 }
@@ -221,6 +287,13 @@ func (x *MachineSpec) GetCidataVolName() string {
 	return ""
 }
 
+func (x *MachineSpec) GetVmVolRetain() string {
+	if x != nil {
+		return x.VmVolRetain
+	}
+	return ""
+}
+
 func (x *MachineSpec) GetPoolName() string {
 	if x != nil {
 		return x.PoolName
@@ -235,17 +308,34 @@ func (x *MachineSpec) GetVmName() string {
 	return ""
 }
 
+func (x *MachineSpec) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
 var File_specs_specs_proto protoreflect.FileDescriptor
 
 const file_specs_specs_proto_rawDesc = "" +
 	"\n" +
-	"\x11specs/specs.proto\x12\bemuspecs\">\n" +
+	"\x11specs/specs.proto\x12\bemuspecs\"\x95\x02\n" +
 	"\x0eAdditionalDisk\x12\x12\n" +
 	"\x04type\x18\x01 \x01(\tR\x04type\x12\x18\n" +
-	"\avolName\x18\x03 \x01(\tR\avolName\"E\n" +
+	"\avolName\x18\x03 \x01(\tR\avolName\x12\x16\n" +
+	"\x06serial\x18\x04 \x01(\tR\x06serial\x12\x10\n" +
+	"\x03wwn\x18\x05 \x01(\tR\x03wwn\x12\x1a\n" +
+	"\bexisting\x18\x06 \x01(\bR\bexisting\x12\x1b\n" +
+	"\tpool_name\x18\a \x01(\tR\bpoolName\x12!\n" +
+	"\fblock_device\x18\b \x01(\tR\vblockDevice\x12\x16\n" +
+	"\x06format\x18\t \x01(\tR\x06format\x12\x16\n" +
+	"\x06retain\x18\n" +
+	" \x01(\tR\x06retain\x12\x1f\n" +
+	"\vsecret_uuid\x18\v \x01(\tR\n" +
+	"secretUuid\"E\n" +
 	"\x11NetworkInterfaces\x12\x16\n" +
 	"\x06driver\x18\x01 \x01(\tR\x06driver\x12\x18\n" +
-	"\anetwork\x18\x02 \x01(\tR\anetwork\"\xf8\x02\n" +
+	"\anetwork\x18\x02 \x01(\tR\anetwork\"\xb0\x03\n" +
 	"\vMachineSpec\x12\x12\n" +
 	"\x04uuid\x18\x01 \x01(\tR\x04uuid\x12!\n" +
 	"\fschematic_id\x18\x02 \x01(\tR\vschematicId\x12#\n" +
@@ -254,9 +344,11 @@ const file_specs_specs_proto_rawDesc = "" +
 	" \x01(\tR\tvmVolName\x12C\n" +
 	"\x10additional_disks\x18\v \x03(\v2\x18.emuspecs.AdditionalDiskR\x0fadditionalDisks\x12J\n" +
 	"\x12network_interfaces\x18\f \x03(\v2\x1b.emuspecs.NetworkInterfacesR\x11networkInterfaces\x12&\n" +
-	"\x0fcidata_vol_name\x18\r \x01(\tR\rcidataVolName\x12\x1b\n" +
+	"\x0fcidata_vol_name\x18\r \x01(\tR\rcidataVolName\x12\"\n" +
+	"\rvm_vol_retain\x18\x0e \x01(\tR\vvmVolRetain\x12\x1b\n" +
 	"\tpool_name\x18\x14 \x01(\tR\bpoolName\x12\x17\n" +
-	"\avm_name\x18\x15 \x01(\tR\x06vmNameB=Z;github.com/siderolabs/omni-infra-provider-libvirt/api/specsb\x06proto3"
+	"\avm_name\x18\x15 \x01(\tR\x06vmName\x12\x12\n" +
+	"\x04host\x18\x16 \x01(\tR\x04hostB=Z;github.com/siderolabs/omni-infra-provider-libvirt/api/specsb\x06proto3"
 
 var (
 	file_specs_specs_proto_rawDescOnce sync.Once
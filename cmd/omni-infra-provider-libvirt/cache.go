@@ -0,0 +1,121 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+var cacheCmdFlags struct {
+	olderThan time.Duration
+	all       bool
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and prune the image cache",
+	Long: `Inspects the image cache directory, the one of the config file if --config-file is set.
+
+The images are re-downloaded by the provider when they are needed again.`,
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the cached images, the least recently used first",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		imageCache, _, err := openImageCache(cmd)
+		if err != nil {
+			return err
+		}
+
+		images, err := imageCache.Images()
+		if err != nil {
+			return err
+		}
+
+		return printOutput(cmd.OutOrStdout(), images, imagesTable(images))
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove the cached images which were not used recently",
+	Long: `Removes the cached images which were not used for longer than --older-than, which defaults to cache.max_age of the config file.
+
+The images in use by a running provider sharing the cache directory are kept: the provider holds a lock on them.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		imageCache, maxAge, err := openImageCache(cmd)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case cacheCmdFlags.all:
+			maxAge = 0
+		case cmd.Flags().Changed("older-than"):
+			maxAge = cacheCmdFlags.olderThan
+		}
+
+		pruned, err := imageCache.Prune(maxAge)
+		if err != nil {
+			return err
+		}
+
+		if pruned == nil {
+			pruned = []provider.CachedImage{}
+		}
+
+		return printOutput(cmd.OutOrStdout(), pruned, imagesTable(pruned))
+	},
+}
+
+// openImageCache returns the image cache of the config file, or of the image-cache-path flag without one,
+// and the maximum age of the unused images.
+func openImageCache(cmd *cobra.Command) (*provider.ImageCache, time.Duration, error) {
+	cfg.imageCachePathSet = cmd.Flags().Changed("image-cache-path")
+
+	path, maxAge := cfg.imageCachePath, provider.DefaultMaxAge
+
+	if cfg.configFile != "" {
+		conf, err := loadConfig(cfg.configFile)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid libvirt config file %q: %w", cfg.configFile, err)
+		}
+
+		path, maxAge = cachePath(conf), cmp.Or(conf.Cache.MaxAge, maxAge)
+	}
+
+	return provider.NewImageCache(zap.NewNop(), path), maxAge, nil
+}
+
+func imagesTable(images []provider.CachedImage) table {
+	t := table{header: []string{"SCHEMATIC ID", "TALOS VERSION", "FORMAT", "SIZE", "LAST USED"}}
+
+	for _, image := range images {
+		t.add(image.SchematicID, image.TalosVersion, string(image.Format), humanize.IBytes(uint64(image.Size)), humanize.Time(image.LastUsed))
+	}
+
+	return t
+}
+
+func init() {
+	addOutputFlag(cacheCmd)
+
+	cachePruneCmd.Flags().DurationVar(&cacheCmdFlags.olderThan, "older-than", provider.DefaultMaxAge, "remove the images which were not used for longer than this")
+	cachePruneCmd.Flags().BoolVar(&cacheCmdFlags.all, "all", false, "remove all the cached images")
+
+	cacheCmd.AddCommand(cacheListCmd, cachePruneCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// outputFormat is the output format of the operator commands.
+var outputFormat string
+
+// addOutputFlag adds the output format flag to the command and its subcommands.
+func addOutputFlag(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", outputTable, "output format, table or json")
+
+	cmd.PersistentPreRunE = func(*cobra.Command, []string) error {
+		if outputFormat != outputTable && outputFormat != outputJSON {
+			return fmt.Errorf("unknown output format %q, must be %s or %s", outputFormat, outputTable, outputJSON)
+		}
+
+		return nil
+	}
+}
+
+// table is the table output of an operator command.
+type table struct {
+	header []string
+	rows   [][]string
+}
+
+func (t *table) add(row ...string) {
+	t.rows = append(t.rows, row)
+}
+
+// printOutput writes the value as JSON, or the table.
+func printOutput(w io.Writer, value any, t table) error {
+	if outputFormat == outputJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(value)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+
+	fmt.Fprintln(tw, strings.Join(t.header, "\t"))
+
+	for _, row := range t.rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// cliLogger returns the logger of the operator commands, which only reports warnings.
+func cliLogger() (*zap.Logger, error) {
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zapcore.WarnLevel)
+	loggerConfig.Encoding = "console"
+
+	return loggerConfig.Build()
+}
+
+// withProvisioner connects to the libvirt hosts of the config file, and runs the function with a provisioner using them.
+//
+// The hosts which can't be connected to are reported by the provisioner calls, the other hosts are still inspected.
+func withProvisioner(ctx context.Context, run func(*provider.Provisioner) error) error {
+	logger, err := cliLogger()
+	if err != nil {
+		return fmt.Errorf("failed to create logger: %w", err)
+	}
+
+	conf, err := loadConfig(cfg.configFile)
+	if err != nil {
+		return fmt.Errorf("invalid libvirt config file %q: %w", cfg.configFile, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	hostSet := newHostSet(logger, conf.LibVirt.Connection)
+
+	// the connections are closed once the context is canceled
+	defer hostSet.wait()
+	defer cancel()
+
+	hosts, _, err := hostSet.apply(ctx, conf, false)
+	if err != nil {
+		return err
+	}
+
+	provisioner := provider.NewProvisioner(hosts, placement.NewScheduler(conf.strategy), nil)
+	provisioner.SetPolicy(conf.policy)
+
+	return run(provisioner)
+}
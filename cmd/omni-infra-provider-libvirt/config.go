@@ -0,0 +1,130 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/spf13/cobra"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
+)
+
+// defaultConcurrency is the number of machine requests provisioned in parallel, unless configured.
+const defaultConcurrency = 5
+
+// providerConfig is the provider config file, with the settings derived from it.
+type providerConfig struct {
+	strategy placement.Strategy
+	hosts    []config.HostConfig
+	policy   provider.Policy
+	config.Config
+}
+
+// loadConfig reads and validates the config file.
+//
+// All the problems found are returned as config.Problems.
+func loadConfig(path string) (*providerConfig, error) {
+	if path == "" {
+		return nil, errors.New("config-file flag is not set")
+	}
+
+	conf, err := config.Load(path)
+
+	var problems config.Problems
+
+	if err != nil && !errors.As(err, &problems) {
+		return nil, err
+	}
+
+	loaded := &providerConfig{
+		Config: conf,
+		policy: provider.Policy{
+			AllowedPools:        conf.Allowed.StoragePools,
+			AllowedNetworks:     conf.Allowed.Networks,
+			AllowedBlockDevices: conf.Allowed.BlockDevices,
+		},
+	}
+
+	loaded.hosts, _ = conf.LibVirt.HostList() //nolint:errcheck // reported by config.Load
+
+	if loaded.strategy, err = placement.ParseStrategy(conf.Placement.Strategy); err != nil {
+		problems = append(problems, conf.Problem("placement.strategy", "%s", err))
+	}
+
+	var defaults provider.Data
+
+	if err = conf.DecodeDefaults(&defaults); err != nil {
+		var defaultsProblems config.Problems
+
+		if !errors.As(err, &defaultsProblems) {
+			return nil, err
+		}
+
+		problems = append(problems, defaultsProblems...)
+	}
+
+	if err = conf.DecodeDefaults(&loaded.policy.Defaults); err != nil {
+		return nil, err
+	}
+
+	if err = loaded.policy.CheckDefaults(); err != nil {
+		problems = append(problems, conf.Problem("defaults", "%s", err))
+	}
+
+	if err = problems.Err(); err != nil {
+		return nil, err
+	}
+
+	return loaded, nil
+}
+
+// concurrency returns the number of machine requests provisioned in parallel.
+func (c *providerConfig) concurrency() uint {
+	if c.Concurrency.Provision == 0 {
+		return defaultConcurrency
+	}
+
+	return c.Concurrency.Provision
+}
+
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate-config <config-file>",
+	Short: "Validate the provider config file",
+	Long:  `Reads the provider config file, and reports all the problems found with their YAML path.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, err := loadConfig(args[0])
+
+		var problems config.Problems
+
+		if errors.As(err, &problems) {
+			slices.SortStableFunc(problems, func(a, b config.Problem) int { return cmp.Compare(a.Line, b.Line) })
+
+			for _, problem := range problems {
+				fmt.Fprintln(cmd.OutOrStdout(), problem.Error())
+			}
+
+			return fmt.Errorf("found %d problem(s) in %q", len(problems), args[0])
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "%s is valid\n", args[0])
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateConfigCmd)
+}
@@ -11,23 +11,30 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"net/url"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 
 	"github.com/digitalocean/go-libvirt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/siderolabs/omni/client/pkg/client"
+	"github.com/siderolabs/omni/client/pkg/client/omni"
 	"github.com/siderolabs/omni/client/pkg/infra"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"go.yaml.in/yaml/v3"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
 	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
 	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/meta"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/tracing"
 	"github.com/siderolabs/omni-infra-provider-libvirt/internal/version"
 )
 
@@ -44,6 +51,12 @@ var rootCmd = &cobra.Command{
 	Long:         `Connects to Omni as an infra provider and manages VMs in Libvirt`,
 	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, _ []string) error {
+		// registered first: the default action of SIGHUP terminates the process, e.g. while connecting to the hosts
+		hup := make(chan os.Signal, 1)
+
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
 		loggerConfig := zap.NewProductionConfig()
 
 		logger, err := loggerConfig.Build(
@@ -57,63 +70,88 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("omni-api-endpoint flag is not set")
 		}
 
-		var config config.Config
-
-		configRaw, err := os.Open(cfg.configFile)
+		conf, err := loadConfig(cfg.configFile)
 		if err != nil {
-			return fmt.Errorf("failed to read libvirt config file %q", cfg.configFile)
+			return fmt.Errorf("invalid libvirt config file %q: %w", cfg.configFile, err)
 		}
 
-		decoder := yaml.NewDecoder(configRaw)
+		if conf.Tracing.Endpoint != "" {
+			exporter, err := tracing.NewExporter(cmd.Context(), conf.Tracing)
+			if err != nil {
+				return err
+			}
 
-		if err = decoder.Decode(&config); err != nil {
-			return fmt.Errorf("failed to read libvirt config file %q", cfg.configFile)
-		}
+			tracerProvider := tracing.NewTracerProvider(exporter, conf.Tracing.SampleRatio)
 
-		libvirtConfig := config.LibVirt
+			defer func() {
+				shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer shutdownCancel()
 
-		//nolint:errcheck
-		uri, _ := url.Parse(string(libvirt.QEMUSystem))
-		if libvirtConfig.URI != "" {
-			uri, err = url.Parse(libvirtConfig.URI)
-			if err != nil {
-				return fmt.Errorf("bad libvirt connection URI: %s", libvirtConfig.URI)
-			}
-		}
+				if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+					logger.Warn("failed to flush the traces", zap.Error(err))
+				}
+			}()
 
-		logger.Info("libvirt URI", zap.String("URI", uri.String()))
+			otel.SetTracerProvider(tracerProvider)
 
-		libvirtClient, err := libvirt.ConnectToURI(uri)
-		if err != nil {
-			return fmt.Errorf("error connecting to libvirt: %w", err)
+			logger.Info("exporting traces", zap.String("endpoint", conf.Tracing.Endpoint))
 		}
 
-		if !libvirtClient.IsConnected() {
-			return errors.New("client is not connected")
+		ctx, cancel := context.WithCancel(cmd.Context())
+
+		hostSet := newHostSet(logger, conf.LibVirt.Connection)
+
+		// the connections are closed once the context is canceled
+		defer hostSet.wait()
+		defer cancel()
+
+		hosts, _, err := hostSet.apply(ctx, conf, true)
+		if err != nil {
+			return err
 		}
 
-		ver, err := libvirtClient.ConnectGetVersion()
+		hostSchema, err := provider.Schema(schema, hosts, conf.policy)
 		if err != nil {
-			return fmt.Errorf("error fetching version: %w", err)
-		} else {
-			logger.Info(fmt.Sprintf("libvirtVersion: %d", ver))
+			return fmt.Errorf("failed to generate provider data schema: %w", err)
 		}
 
+		cfg.imageCachePathSet = cmd.Flags().Changed("image-cache-path")
+		imageCachePath := cachePath(conf)
+
 		// Ensure cache directory exists
-		err = os.MkdirAll(cfg.imageCachePath, 0o755)
+		err = os.MkdirAll(imageCachePath, 0o755)
 		if err != nil {
 			return fmt.Errorf("failed to create cache directory: %w", err)
 		}
 
-		imageCache := provider.NewImageCache(logger, cfg.imageCachePath)
+		imageCache := provider.NewImageCache(logger, imageCachePath)
+		imageCache.Reconfigure(cacheSettings(conf))
+
+		scheduler := placement.NewScheduler(conf.strategy)
+
+		provisioner := provider.NewProvisioner(hosts, scheduler, imageCache)
+		provisioner.SetPolicy(conf.policy)
+
+		health := provider.NewHealth(provisioner, imageCache)
 
-		provisioner := provider.NewProvisioner(libvirtClient, imageCache)
+		reloader := &reloader{
+			logger:      logger,
+			hosts:       hostSet,
+			provisioner: provisioner,
+			scheduler:   scheduler,
+			imageCache:  imageCache,
+			conf:        conf,
+			path:        cfg.configFile,
+			schema:      hostSchema,
+			cachePath:   imageCachePath,
+			hup:         hup,
+		}
 
 		ip, err := infra.NewProvider(meta.ProviderID, provisioner, infra.ProviderConfig{
 			Name:        cfg.providerName,
 			Description: cfg.providerDescription,
 			Icon:        base64.RawStdEncoding.EncodeToString(icon),
-			Schema:      schema,
+			Schema:      hostSchema,
 		})
 		if err != nil {
 			return fmt.Errorf("failed to create infra provider: %w", err)
@@ -129,20 +167,66 @@ var rootCmd = &cobra.Command{
 			clientOptions = append(clientOptions, client.WithServiceAccount(cfg.serviceAccountKey))
 		}
 
+		// the health status written by the infra provider controllers is read back through a connection of its own,
+		// see provider.Health.WatchOmni
+		omniClient, err := client.New(cfg.omniAPIEndpoint, append(slices.Clone(clientOptions),
+			client.WithOmniClientOptions(omni.WithProviderID(meta.ProviderID)))...)
+		if err != nil {
+			return fmt.Errorf("failed to create Omni client: %w", err)
+		}
+
+		defer omniClient.Close() //nolint:errcheck
+
 		// as we run to concurrent goroutines here that can fail each in their own way,
 		// we use an errGroup to account for that.
 		// see errgroup.Group.Go() for further details.
 
-		eg, ctx := errgroup.WithContext(cmd.Context())
+		eg, ctx := errgroup.WithContext(ctx)
 
 		eg.Go(func() error {
 			return imageCache.Run(ctx)
 		})
 
+		eg.Go(func() error {
+			return reloader.run(ctx)
+		})
+
+		eg.Go(func() error {
+			return provisioner.RunSnapshots(ctx, logger)
+		})
+
+		eg.Go(func() error {
+			return health.WatchOmni(ctx, omniClient.Omni().State(), meta.ProviderID, logger)
+		})
+
+		if cfg.httpListenAddress != "" {
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(
+				collectors.NewGoCollector(),
+				collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+				provisioner,
+				imageCache,
+			)
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+			mux.Handle("/healthz", health.Handler(true))
+			mux.Handle("/readyz", health.Handler(false))
+
+			eg.Go(func() error {
+				return provisioner.RunDomainCounts(ctx)
+			})
+
+			eg.Go(func() error {
+				return serveHTTP(ctx, logger, cfg.httpListenAddress, mux)
+			})
+		}
+
 		eg.Go(func() error {
 			return ip.Run(ctx, logger, infra.WithOmniEndpoint(cfg.omniAPIEndpoint), infra.WithClientOptions(
 				clientOptions...,
-			), infra.WithConcurrency(5), infra.WithVersion(version.Tag))
+			), infra.WithConcurrency(conf.concurrency()), infra.WithVersion(version.Tag),
+				infra.WithHealthCheckFunc(health.HealthCheck))
 		})
 
 		// this blocks until all goroutines are done
@@ -150,6 +234,40 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// dialer returns the function opening new connections to the libvirt host.
+func dialer(logger *zap.Logger, hostConfig config.HostConfig) (provider.DialFunc, error) {
+	uri, err := hostConfig.ConnectionURI()
+	if err != nil {
+		return nil, err
+	}
+
+	logger = logger.With(zap.String("host", hostConfig.Name))
+
+	logger.Info("libvirt URI", zap.String("URI", uri.Redacted()))
+
+	return func(context.Context) (provider.Conn, error) {
+		libvirtClient, err := libvirt.ConnectToURI(uri)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to libvirt: %w", err)
+		}
+
+		if !libvirtClient.IsConnected() {
+			return nil, errors.New("client is not connected")
+		}
+
+		ver, err := libvirtClient.ConnectGetVersion()
+		if err != nil {
+			libvirtClient.Disconnect() //nolint:errcheck
+
+			return nil, fmt.Errorf("error fetching version: %w", err)
+		}
+
+		logger.Info(fmt.Sprintf("libvirtVersion: %d", ver))
+
+		return libvirtClient, nil
+	}, nil
+}
+
 var cfg struct {
 	omniAPIEndpoint     string
 	serviceAccountKey   string
@@ -157,6 +275,8 @@ var cfg struct {
 	providerDescription string
 	configFile          string
 	imageCachePath      string
+	imageCachePathSet   bool
+	httpListenAddress   string
 	insecureSkipVerify  bool
 }
 
@@ -167,7 +287,7 @@ func main() {
 }
 
 func app() error {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGHUP, syscall.SIGTERM)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	return rootCmd.ExecuteContext(ctx)
@@ -181,6 +301,7 @@ func init() {
 	rootCmd.Flags().StringVar(&cfg.providerName, "provider-name", "libvirt", "provider name as it appears in Omni")
 	rootCmd.Flags().StringVar(&cfg.providerDescription, "provider-description", "libVirt infrastructure provider", "Provider description as it appears in Omni")
 	rootCmd.Flags().BoolVar(&cfg.insecureSkipVerify, "insecure-skip-verify", false, "ignores untrusted certs on Omni side")
-	rootCmd.Flags().StringVar(&cfg.configFile, "config-file", "", "libvirt provider config")
-	rootCmd.Flags().StringVar(&cfg.imageCachePath, "image-cache-path", provider.DefaultCachePath, "the path to write cached images to")
+	rootCmd.PersistentFlags().StringVar(&cfg.configFile, "config-file", "", "libvirt provider config")
+	rootCmd.PersistentFlags().StringVar(&cfg.imageCachePath, "image-cache-path", provider.DefaultCachePath, "the path to write cached images to")
+	rootCmd.Flags().StringVar(&cfg.httpListenAddress, "http-listen-address", "", "the address of the HTTP listener serving the /metrics, /healthz and /readyz endpoints, disabled if empty, e.g. :8080")
 }
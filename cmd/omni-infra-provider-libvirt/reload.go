@@ -0,0 +1,283 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
+)
+
+// hostConnection is the running connection to a libvirt host.
+type hostConnection struct {
+	connection *provider.Connection
+	cancel     context.CancelFunc
+	done       chan struct{}
+	config     config.HostConfig
+}
+
+// sameEndpoint reports whether the host is reached the same way with the given config.
+func (h *hostConnection) sameEndpoint(hostConfig config.HostConfig) bool {
+	return h.config.URI == hostConfig.URI && h.config.Credentials == hostConfig.Credentials
+}
+
+// hostSet runs the connections to the configured libvirt hosts.
+type hostSet struct {
+	logger   *zap.Logger
+	running  map[string]*hostConnection
+	settings config.ConnectionConfig
+	wg       sync.WaitGroup
+}
+
+func newHostSet(logger *zap.Logger, settings config.ConnectionConfig) *hostSet {
+	return &hostSet{
+		logger:   logger,
+		running:  map[string]*hostConnection{},
+		settings: settings,
+	}
+}
+
+// apply connects to the hosts of the config, and returns them with the connections which are no longer used.
+//
+// The connection of a host is kept unless its URI or credentials were changed. With failFast, a host which can't be
+// connected to is an error, otherwise its connection is retried in the background.
+// On error, the connections started for the config are closed, and the running ones are kept.
+func (s *hostSet) apply(ctx context.Context, conf *providerConfig, failFast bool) ([]provider.Host, []*hostConnection, error) {
+	hosts := make([]provider.Host, 0, len(conf.hosts))
+	running := make(map[string]*hostConnection, len(conf.hosts))
+
+	for _, hostConfig := range conf.hosts {
+		host, ok := s.running[hostConfig.Name]
+		if !ok || !host.sameEndpoint(hostConfig) {
+			var err error
+
+			if host, err = s.start(ctx, hostConfig, failFast); err != nil {
+				s.stop(s.started(running))
+
+				return nil, nil, fmt.Errorf("libvirt host %q: %w", hostConfig.Name, err)
+			}
+		}
+
+		host.config = hostConfig
+		running[hostConfig.Name] = host
+
+		overcommit := hostConfig.Overcommit.Merge(conf.Admission.Overcommit)
+
+		hosts = append(hosts, provider.Host{
+			Name:       hostConfig.Name,
+			Labels:     hostConfig.Labels,
+			Connection: host.connection,
+			Overcommit: provider.Overcommit{
+				CPU:    overcommit.CPU,
+				Memory: overcommit.Memory,
+				Disk:   overcommit.Disk,
+			},
+		})
+	}
+
+	var retired []*hostConnection
+
+	for name, host := range s.running {
+		if running[name] != host {
+			retired = append(retired, host)
+		}
+	}
+
+	s.running = running
+
+	return hosts, retired, nil
+}
+
+// start opens the connection to the host, and keeps it alive until the context is canceled.
+func (s *hostSet) start(ctx context.Context, hostConfig config.HostConfig, failFast bool) (*hostConnection, error) {
+	dial, err := dialer(s.logger, hostConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	connection := provider.NewConnection(s.logger, hostConfig.Name, dial)
+
+	if s.settings.KeepaliveInterval > 0 {
+		connection.KeepaliveInterval = s.settings.KeepaliveInterval
+	}
+
+	if s.settings.KeepaliveTimeout > 0 {
+		connection.KeepaliveTimeout = s.settings.KeepaliveTimeout
+	}
+
+	if s.settings.MaxBackoff > 0 {
+		connection.MaxBackoff = s.settings.MaxBackoff
+	}
+
+	if err = connection.Connect(ctx); err != nil {
+		if failFast {
+			return nil, err
+		}
+
+		s.logger.Warn("failed to connect to libvirt host, retrying in the background", zap.String("host", hostConfig.Name), zap.Error(err))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	host := &hostConnection{
+		connection: connection,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		config:     hostConfig,
+	}
+
+	s.wg.Go(func() {
+		defer close(host.done)
+
+		connection.Run(ctx) //nolint:errcheck // only returns once the context is canceled
+	})
+
+	return host, nil
+}
+
+// started returns the connections of the hosts which were started, but aren't running yet.
+func (s *hostSet) started(running map[string]*hostConnection) []*hostConnection {
+	var started []*hostConnection
+
+	for name, host := range running {
+		if s.running[name] != host {
+			started = append(started, host)
+		}
+	}
+
+	return started
+}
+
+// stop closes the connections which are no longer used.
+func (s *hostSet) stop(hosts []*hostConnection) {
+	for _, host := range hosts {
+		host.cancel()
+		<-host.done
+	}
+}
+
+// wait blocks until all the connections are closed, once the context passed to apply is canceled.
+func (s *hostSet) wait() {
+	s.wg.Wait()
+}
+
+// reloader applies the changes of the config file to the running provider.
+type reloader struct {
+	logger      *zap.Logger
+	hosts       *hostSet
+	provisioner *provider.Provisioner
+	scheduler   *placement.Scheduler
+	imageCache  *provider.ImageCache
+	conf        *providerConfig
+	path        string
+	schema      string
+	cachePath   string
+	// hup receives SIGHUP, a signal received before run is called is buffered
+	hup <-chan os.Signal
+}
+
+// run reloads the config file on SIGHUP until the context is canceled.
+func (r *reloader) run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.hup:
+			r.reload(ctx)
+		}
+	}
+}
+
+// reload re-reads the config file, and applies the settings which can be changed live.
+//
+// An invalid config file is ignored, the provider keeps running with the current one.
+func (r *reloader) reload(ctx context.Context) {
+	r.logger.Info("reloading config", zap.String("path", r.path))
+
+	conf, err := loadConfig(r.path)
+	if err != nil {
+		r.logger.Error("invalid config file, keeping the current config", zap.String("path", r.path), zap.Error(err))
+
+		return
+	}
+
+	hosts, retired, err := r.hosts.apply(ctx, conf, false)
+	if err != nil {
+		r.logger.Error("failed to apply the hosts, keeping the current config", zap.Error(err))
+
+		return
+	}
+
+	r.provisioner.SetHosts(hosts)
+	r.provisioner.SetPolicy(conf.policy)
+	r.scheduler.SetStrategy(conf.strategy)
+	r.imageCache.Reconfigure(cacheSettings(conf))
+
+	for _, host := range retired {
+		r.logger.Info("disconnecting from libvirt host", zap.String("host", host.config.Name))
+	}
+
+	r.hosts.stop(retired)
+
+	r.logRestartRequired(conf, hosts)
+
+	r.conf = conf
+
+	r.logger.Info("reloaded config", zap.Int("hosts", len(hosts)))
+}
+
+// logRestartRequired logs the changed settings which only take effect after a restart.
+func (r *reloader) logRestartRequired(conf *providerConfig, hosts []provider.Host) {
+	warn := func(setting string) {
+		r.logger.Warn("setting can't be changed without a restart, keeping the current value", zap.String("setting", setting))
+	}
+
+	if cachePath(conf) != r.cachePath {
+		warn("cache.path")
+	}
+
+	if conf.concurrency() != r.conf.concurrency() {
+		warn("concurrency.provision")
+	}
+
+	if conf.LibVirt.Connection != r.conf.LibVirt.Connection {
+		warn("libvirt.connection")
+	}
+
+	if conf.Tracing != r.conf.Tracing {
+		warn("tracing")
+	}
+
+	// the schema is published to Omni once when the provider starts
+	if hostSchema, err := provider.Schema(schema, hosts, conf.policy); err == nil && hostSchema != r.schema {
+		r.logger.Warn("provider data schema changed, restart the provider to publish it to Omni")
+	}
+}
+
+// cachePath returns the image cache directory, the config file overrides the default of the image-cache-path flag.
+func cachePath(conf *providerConfig) string {
+	if conf.Cache.Path != "" && !cfg.imageCachePathSet {
+		return conf.Cache.Path
+	}
+
+	return cfg.imageCachePath
+}
+
+// cacheSettings returns the image cache settings of the config.
+func cacheSettings(conf *providerConfig) provider.CacheSettings {
+	return provider.CacheSettings{
+		ImageFactoryURL: conf.Image.FactoryURL,
+		CleanupInterval: conf.Cache.CleanupInterval,
+		MaxAge:          conf.Cache.MaxAge,
+		MaxSize:         conf.Cache.MaxSize * provider.GiB,
+	}
+}
@@ -0,0 +1,274 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+const outputText = "text"
+
+var renderCmdFlags struct {
+	requestID    string
+	cluster      string
+	machineSet   string
+	machineClass string
+	storagePool  string
+	output       string
+}
+
+var renderCmd = &cobra.Command{
+	Use:   "render <file>",
+	Short: "Print the domain XML, the volume XML and the cidata files the provider would create for a machine class",
+	Long: `Renders the provider data of a machine class, read from the file or from stdin with "-".
+
+The file holds either the provider data, or MachineClass documents such as the ones of test/machineclass.yaml,
+the machine class to render is picked with --machine-class when there are several.
+
+The provider data is validated against the provider data schema, the defaults and the allowlists of the config file apply
+if --config-file is set. Neither libvirt nor the image factory are accessed: the primary disk is filled with the Talos image
+when a machine is provisioned, and the UUID is changed if it collides with an existing domain.
+
+The storage pool is assumed to be a directory pool, unless --storage-pool-xml is set to the output of virsh pool-dumpxml.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if renderCmdFlags.output != outputText && renderCmdFlags.output != outputJSON {
+			return fmt.Errorf("unknown output format %q, must be %s or %s", renderCmdFlags.output, outputText, outputJSON)
+		}
+
+		providerData, err := readProviderData(cmd.InOrStdin(), args[0], renderCmdFlags.machineClass)
+		if err != nil {
+			return err
+		}
+
+		// without a config file, the host and the host selector fields are not checked against the hosts
+		var policy provider.Policy
+
+		providerSchema := schema
+
+		if cfg.configFile != "" {
+			conf, loadErr := loadConfig(cfg.configFile)
+			if loadErr != nil {
+				return fmt.Errorf("invalid libvirt config file %q: %w", cfg.configFile, loadErr)
+			}
+
+			policy = conf.policy
+
+			hosts := make([]provider.Host, 0, len(conf.hosts))
+
+			for _, hostConfig := range conf.hosts {
+				hosts = append(hosts, provider.Host{Name: hostConfig.Name, Labels: hostConfig.Labels})
+			}
+
+			if providerSchema, err = provider.Schema(schema, hosts, policy); err != nil {
+				return fmt.Errorf("failed to generate provider data schema: %w", err)
+			}
+		}
+
+		if err = validateProviderData(providerData, providerSchema); err != nil {
+			return err
+		}
+
+		var poolXML []byte
+
+		if renderCmdFlags.storagePool != "" {
+			if poolXML, err = os.ReadFile(renderCmdFlags.storagePool); err != nil {
+				return fmt.Errorf("error reading storage pool XML: %w", err)
+			}
+		}
+
+		rendered, err := provider.Render(policy, provider.RenderRequest{
+			ProviderData:   providerData,
+			RequestID:      renderCmdFlags.requestID,
+			Cluster:        renderCmdFlags.cluster,
+			MachineSet:     renderCmdFlags.machineSet,
+			StoragePoolXML: string(poolXML),
+		})
+		if err != nil {
+			return err
+		}
+
+		if renderCmdFlags.output == outputJSON {
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			encoder.SetEscapeHTML(false)
+
+			return encoder.Encode(rendered)
+		}
+
+		return printRendered(cmd.OutOrStdout(), rendered)
+	},
+}
+
+// readProviderData reads the provider data of the file, or of the machine class in it.
+func readProviderData(stdin io.Reader, path, machineClass string) (string, error) {
+	var (
+		raw []byte
+		err error
+	)
+
+	if path == "-" {
+		raw, err = io.ReadAll(stdin)
+	} else {
+		raw, err = os.ReadFile(path)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("error reading provider data: %w", err)
+	}
+
+	type machineClassDocument struct {
+		Metadata struct {
+			ID string `yaml:"id"`
+		} `yaml:"metadata"`
+		Spec *struct {
+			Autoprovision struct {
+				ProviderData string `yaml:"providerdata"`
+			} `yaml:"autoprovision"`
+		} `yaml:"spec"`
+	}
+
+	var classes []machineClassDocument
+
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+
+	for {
+		var doc machineClassDocument
+
+		if err = decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return "", fmt.Errorf("error parsing %q: %w", path, err)
+		}
+
+		if doc.Spec == nil {
+			if len(classes) > 0 {
+				return "", fmt.Errorf("%q mixes machine classes with other documents", path)
+			}
+
+			// not a machine class, the file is the provider data
+			if machineClass != "" {
+				return "", fmt.Errorf("%q holds provider data, not machine classes", path)
+			}
+
+			return string(raw), nil
+		}
+
+		classes = append(classes, doc)
+	}
+
+	ids := make([]string, 0, len(classes))
+
+	for _, class := range classes {
+		if (machineClass == "" && len(classes) == 1) || class.Metadata.ID == machineClass {
+			return class.Spec.Autoprovision.ProviderData, nil
+		}
+
+		ids = append(ids, class.Metadata.ID)
+	}
+
+	switch {
+	case len(classes) == 0:
+		return "", fmt.Errorf("%q is empty", path)
+	case machineClass == "":
+		return "", fmt.Errorf("%q holds several machine classes, pick one with --machine-class: %s", path, strings.Join(ids, ", "))
+	default:
+		return "", fmt.Errorf("machine class %q not found in %q, it holds: %s", machineClass, path, strings.Join(ids, ", "))
+	}
+}
+
+// validateProviderData validates the provider data against the schema Omni validates the machine classes with.
+func validateProviderData(providerData, providerSchema string) error {
+	schemaDoc, err := jsonschema.UnmarshalJSON(strings.NewReader(providerSchema))
+	if err != nil {
+		return fmt.Errorf("error parsing provider data schema: %w", err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+
+	if err = compiler.AddResource("schema.json", schemaDoc); err != nil {
+		return fmt.Errorf("error loading provider data schema: %w", err)
+	}
+
+	compiled, err := compiler.Compile("schema.json")
+	if err != nil {
+		return fmt.Errorf("error compiling provider data schema: %w", err)
+	}
+
+	var fields map[string]any
+
+	if err = yaml.Unmarshal([]byte(providerData), &fields); err != nil {
+		return fmt.Errorf("error parsing provider data: %w", err)
+	}
+
+	// the YAML values are converted to the JSON ones the validator expects
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf("error parsing provider data: %w", err)
+	}
+
+	value, err := jsonschema.UnmarshalJSON(bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("error parsing provider data: %w", err)
+	}
+
+	if err = compiled.Validate(value); err != nil {
+		return fmt.Errorf("invalid provider data: %w", err)
+	}
+
+	return nil
+}
+
+// printRendered writes the volumes, the cidata files and the domain, in the order the provisioner creates them.
+func printRendered(w io.Writer, rendered provider.Rendered) error {
+	for _, vol := range rendered.Volumes {
+		fmt.Fprintf(w, "# volume %s/%s\n", vol.Pool, vol.Name)
+
+		if vol.Content != "" {
+			fmt.Fprintf(w, "# content: %s\n", vol.Content)
+		}
+
+		if vol.ResizeTo != 0 {
+			fmt.Fprintf(w, "# resized to %d bytes after the upload\n", vol.ResizeTo)
+		}
+
+		fmt.Fprintf(w, "%s\n\n", strings.TrimSpace(vol.XML))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(rendered.Cidata)) {
+		fmt.Fprintf(w, "# cidata %s\n%s\n\n", name, strings.TrimSpace(rendered.Cidata[name]))
+	}
+
+	_, err := fmt.Fprintf(w, "# domain\n%s\n", strings.TrimSpace(rendered.DomainXML))
+
+	return err
+}
+
+func init() {
+	renderCmd.Flags().StringVar(&renderCmdFlags.requestID, "request-id", "machine-request", "machine request ID, the domain and its volumes are named after it")
+	renderCmd.Flags().StringVar(&renderCmdFlags.cluster, "cluster", "", "cluster of the machine request")
+	renderCmd.Flags().StringVar(&renderCmdFlags.machineSet, "machine-set", "", "machine set of the machine request")
+	renderCmd.Flags().StringVar(&renderCmdFlags.machineClass, "machine-class", "", "ID of the machine class to render, when the file holds several")
+	renderCmd.Flags().StringVar(&renderCmdFlags.storagePool, "storage-pool-xml", "", "XML of the storage pool of the machine class, as printed by virsh pool-dumpxml")
+	renderCmd.Flags().StringVarP(&renderCmdFlags.output, "output", "o", outputText, "output format, text or json")
+
+	rootCmd.AddCommand(renderCmd)
+}
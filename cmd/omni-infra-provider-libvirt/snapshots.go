@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+var snapshotsCmdFlags struct {
+	name   string
+	memory bool
+}
+
+var snapshotsCmd = &cobra.Command{
+	Use:   "snapshots",
+	Short: "Take, list and delete the snapshots of the VMs managed by the provider",
+	Long: `Manages the external snapshots of the VMs, the domains are named after the machine request ID.
+
+The snapshots require libvirt 9.0 or later to be deleted, and the disks of the VMs in a storage pool of files, e.g. dir.`,
+}
+
+var snapshotsListCmd = &cobra.Command{
+	Use:   "list <request-id>",
+	Short: "List the snapshots of a VM, the oldest first",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withProvisioner(cmd.Context(), func(provisioner *provider.Provisioner) error {
+			snapshots, err := provisioner.Snapshots(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+
+			return printOutput(cmd.OutOrStdout(), snapshots, snapshotsTable(snapshots))
+		})
+	},
+}
+
+var snapshotsCreateCmd = &cobra.Command{
+	Use:   "create <request-id>",
+	Short: "Take a snapshot of a VM",
+	Long: `Takes an external snapshot of the disks of the VM, and of its memory with --memory.
+
+The disks continue on new overlay files next to their images. The cidata cdrom, and the disks which are not
+files, are left out of the snapshot.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withProvisioner(cmd.Context(), func(provisioner *provider.Provisioner) error {
+			snapshot, err := provisioner.CreateSnapshot(cmd.Context(), args[0], provider.SnapshotOptions{
+				Name:   snapshotsCmdFlags.name,
+				Memory: snapshotsCmdFlags.memory,
+			})
+			if err != nil {
+				return err
+			}
+
+			return printOutput(cmd.OutOrStdout(), snapshot, snapshotsTable([]provider.VMSnapshot{snapshot}))
+		})
+	},
+}
+
+var snapshotsDeleteCmd = &cobra.Command{
+	Use:   "delete <request-id> <snapshot>",
+	Short: "Delete a snapshot of a VM",
+	Long:  `Deletes the snapshot, libvirt merges its overlay files into the images below.`,
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withProvisioner(cmd.Context(), func(provisioner *provider.Provisioner) error {
+			return provisioner.DeleteSnapshot(cmd.Context(), args[0], args[1])
+		})
+	},
+}
+
+func snapshotsTable(snapshots []provider.VMSnapshot) table {
+	t := table{header: []string{"NAME", "HOST", "CREATED", "STATE", "MEMORY", "DISKS", "PARENT"}}
+
+	for _, snapshot := range snapshots {
+		t.add(
+			snapshot.Name,
+			snapshot.Host,
+			snapshot.CreationTime.Format(time.RFC3339),
+			snapshot.State,
+			strconv.FormatBool(snapshot.Memory),
+			strings.Join(snapshot.Disks, ","),
+			cmp.Or(snapshot.Parent, "-"),
+		)
+	}
+
+	return t
+}
+
+func init() {
+	addOutputFlag(snapshotsCmd)
+
+	snapshotsCreateCmd.Flags().StringVar(&snapshotsCmdFlags.name, "name", "", "name of the snapshot, defaults to manual-<time>")
+	snapshotsCreateCmd.Flags().BoolVar(&snapshotsCmdFlags.memory, "memory", false, "save the memory of the running VM along with its disks")
+
+	snapshotsCmd.AddCommand(snapshotsListCmd, snapshotsCreateCmd, snapshotsDeleteCmd)
+	rootCmd.AddCommand(snapshotsCmd)
+}
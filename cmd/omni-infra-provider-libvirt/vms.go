@@ -0,0 +1,130 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+var vmsCmd = &cobra.Command{
+	Use:   "vms",
+	Short: "Inspect the VMs managed by the provider",
+}
+
+var vmsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the VMs managed by the provider on all the libvirt hosts",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		return withProvisioner(cmd.Context(), func(provisioner *provider.Provisioner) error {
+			// the VMs of the reachable hosts are listed, before the hosts which failed are reported
+			vms, listErr := provisioner.VMs(cmd.Context())
+
+			t := table{header: []string{"REQUEST ID", "HOST", "STATE", "CLUSTER", "MACHINE SET", "DISKS"}}
+
+			for _, vm := range vms {
+				disks := make([]string, 0, len(vm.Disks))
+
+				for _, disk := range vm.Disks {
+					disks = append(disks, diskSource(disk))
+				}
+
+				t.add(vm.RequestID, vm.Host, vm.State, cmp.Or(vm.Cluster, "-"), cmp.Or(vm.MachineSet, "-"), strings.Join(disks, ","))
+			}
+
+			if vms == nil {
+				vms = []provider.VM{}
+			}
+
+			return errors.Join(printOutput(cmd.OutOrStdout(), vms, t), listErr)
+		})
+	},
+}
+
+var vmsShowCmd = &cobra.Command{
+	Use:   "show <request-id>",
+	Short: "Show a VM managed by the provider",
+	Long:  `Shows the VM of the machine request, the domains are named after the machine request ID.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withProvisioner(cmd.Context(), func(provisioner *provider.Provisioner) error {
+			vm, err := provisioner.VM(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+
+			if outputFormat == outputJSON {
+				return printOutput(cmd.OutOrStdout(), vm, table{})
+			}
+
+			return printVM(cmd.OutOrStdout(), vm)
+		})
+	},
+}
+
+// printVM writes the details of the VM, and the table of its disks.
+func printVM(w io.Writer, vm provider.VM) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+
+	for _, field := range [][2]string{
+		{"Name", vm.Name},
+		{"Request ID", vm.RequestID},
+		{"Host", vm.Host},
+		{"State", vm.State},
+		{"UUID", vm.UUID},
+		{"Cluster", cmp.Or(vm.Cluster, "-")},
+		{"Machine set", cmp.Or(vm.MachineSet, "-")},
+		{"vCPUs", strconv.FormatUint(uint64(vm.VCPUs), 10)},
+		{"Memory", humanize.IBytes(vm.Memory)},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", field[0], field[1])
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "Disks:")
+
+	t := table{header: []string{"  TARGET", "BUS", "DEVICE", "SOURCE", "CAPACITY"}}
+
+	for _, disk := range vm.Disks {
+		capacity := "-"
+		if disk.Capacity > 0 {
+			capacity = humanize.IBytes(disk.Capacity)
+		}
+
+		t.add("  "+disk.Target, cmp.Or(disk.Bus, "-"), disk.Device, diskSource(disk), capacity)
+	}
+
+	return printOutput(w, nil, t)
+}
+
+// diskSource returns the volume of the disk as pool/volume, or its path.
+func diskSource(disk provider.VMDisk) string {
+	if disk.Volume != "" {
+		return disk.Pool + "/" + disk.Volume
+	}
+
+	return cmp.Or(disk.Path, "-")
+}
+
+func init() {
+	addOutputFlag(vmsCmd)
+
+	vmsCmd.AddCommand(vmsListCmd, vmsShowCmd)
+	rootCmd.AddCommand(vmsCmd)
+}
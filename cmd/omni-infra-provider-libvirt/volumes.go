@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+var volumesCmd = &cobra.Command{
+	Use:   "volumes",
+	Short: "Inspect the storage volumes created by the provider",
+}
+
+var volumesOrphansCmd = &cobra.Command{
+	Use:   "orphans",
+	Short: "List the volumes named like the ones of a machine request, which no domain uses",
+	Long: `Lists the volumes of the allowed and the default storage pools, and of the pools used by the managed domains,
+which are named like the disks or the cidata ISO of a machine request but are not attached to any domain.
+
+The volumes are not removed, check that they are no longer needed before deleting them with virsh vol-delete.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		return withProvisioner(cmd.Context(), func(provisioner *provider.Provisioner) error {
+			orphans, listErr := provisioner.OrphanVolumes(cmd.Context())
+
+			t := table{header: []string{"HOST", "POOL", "VOLUME", "REQUEST ID", "CAPACITY"}}
+
+			for _, vol := range orphans {
+				t.add(vol.Host, vol.Pool, vol.Name, vol.RequestID, humanize.IBytes(vol.Capacity))
+			}
+
+			if orphans == nil {
+				orphans = []provider.OrphanVolume{}
+			}
+
+			return errors.Join(printOutput(cmd.OutOrStdout(), orphans, t), listErr)
+		})
+	},
+}
+
+func init() {
+	addOutputFlag(volumesCmd)
+
+	volumesCmd.AddCommand(volumesOrphansCmd)
+	rootCmd.AddCommand(volumesCmd)
+}
@@ -5,11 +5,370 @@
 // Package config implements config data used by omni-infra-provider-libvirt
 package config
 
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"go.yaml.in/yaml/v3"
+)
+
+// DefaultHostName is the name of the host defined by the top level libvirt URI.
+const DefaultHostName = "default"
+
 // Config describes libvirt provider configuration.
 type Config struct {
-	LibVirt LibVirtConfig `yaml:"libvirt"`
+	// root is the parsed config file, it is used to look up the lines of the problems.
+	root *yaml.Node
+	// Defaults is the provider data merged under the provider data of each machine class.
+	Defaults    yaml.Node         `yaml:"defaults,omitempty"`
+	Image       ImageConfig       `yaml:"image,omitempty"`
+	Cache       CacheConfig       `yaml:"cache,omitempty"`
+	Allowed     AllowedConfig     `yaml:"allowed,omitempty"`
+	LibVirt     LibVirtConfig     `yaml:"libvirt"`
+	Placement   PlacementConfig   `yaml:"placement,omitempty"`
+	Admission   AdmissionConfig   `yaml:"admission,omitempty"`
+	Concurrency ConcurrencyConfig `yaml:"concurrency,omitempty"`
+	Tracing     TracingConfig     `yaml:"tracing,omitempty"`
+}
+
+// ImageConfig describes where the Talos images are downloaded from.
+type ImageConfig struct {
+	// FactoryURL is the base URL of the image factory, defaults to the public one.
+	FactoryURL string `yaml:"factory_url,omitempty"`
+}
+
+// CacheConfig describes the local cache of the downloaded images.
+//
+// Unset values fall back to the provider defaults.
+type CacheConfig struct {
+	// Path is the cache directory, the --image-cache-path flag takes precedence.
+	Path string `yaml:"path,omitempty"`
+	// MaxAge is how long an unused image is kept.
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+	// CleanupInterval is how often the unused images are removed.
+	CleanupInterval time.Duration `yaml:"cleanup_interval,omitempty"`
+	// MaxSize is the size in GiB above which the least recently used images are removed, even if they are not old enough.
+	MaxSize uint64 `yaml:"max_size,omitempty"`
+}
+
+// ConcurrencyConfig limits the work done in parallel.
+type ConcurrencyConfig struct {
+	// Provision is the number of machine requests provisioned in parallel.
+	Provision uint `yaml:"provision,omitempty"`
+}
+
+// TracingConfig describes the export of the OpenTelemetry traces.
+type TracingConfig struct {
+	// Endpoint is the host:port of the OTLP gRPC collector, tracing is disabled if empty.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// SampleRatio is the ratio of the machine requests which are traced, all if unset.
+	SampleRatio float64 `yaml:"sample_ratio,omitempty"`
+	// Insecure disables TLS for the connection to the collector.
+	Insecure bool `yaml:"insecure,omitempty"`
+}
+
+// AllowedConfig limits the libvirt resources the machine classes can use.
+//
+// Empty lists of storage pools and networks allow all of them.
+type AllowedConfig struct {
+	StoragePools []string `yaml:"storage_pools,omitempty"`
+	Networks     []string `yaml:"networks,omitempty"`
+	// BlockDevices are the path prefixes of the host block devices the machines can attach, e.g. /dev/vg1.
+	// An empty list allows none.
+	BlockDevices []string `yaml:"block_devices,omitempty"`
+}
+
+// Validate checks the whole config, and returns all the problems found.
+func (c Config) Validate() Problems {
+	var problems Problems
+
+	if _, err := c.LibVirt.HostList(); err != nil {
+		problems.addErr("", err)
+	}
+
+	if err := c.LibVirt.Connection.validate(); err != nil {
+		problems.addErr("libvirt.connection", err)
+	}
+
+	if err := c.Admission.Overcommit.Validate(); err != nil {
+		problems.addErr("admission", err)
+	}
+
+	if c.Image.FactoryURL != "" {
+		if u, err := url.Parse(c.Image.FactoryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems.add("image", "factory_url", "must be an absolute http or https URL")
+		}
+	}
+
+	if c.Cache.MaxAge < 0 {
+		problems.add("cache", "max_age", "must not be negative")
+	}
+
+	if c.Cache.CleanupInterval < 0 {
+		problems.add("cache", "cleanup_interval", "must not be negative")
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problems.add("tracing", "sample_ratio", "must be between 0 and 1")
+	}
+
+	if !c.Defaults.IsZero() && c.Defaults.Kind != yaml.MappingNode {
+		problems.add("defaults", "", "must be a mapping of provider data fields")
+	}
+
+	for _, allowed := range []struct {
+		key   string
+		names []string
+	}{{"storage_pools", c.Allowed.StoragePools}, {"networks", c.Allowed.Networks}} {
+		seen := make(map[string]struct{}, len(allowed.names))
+
+		for i, name := range allowed.names {
+			path := fmt.Sprintf("allowed.%s[%d]", allowed.key, i)
+
+			if name == "" {
+				problems.add(path, "", "name is not set")
+			}
+
+			if _, ok := seen[name]; ok {
+				problems.add(path, "", "duplicate name %q", name)
+			}
+
+			seen[name] = struct{}{}
+		}
+	}
+
+	seenPrefixes := make(map[string]struct{}, len(c.Allowed.BlockDevices))
+
+	for i, prefix := range c.Allowed.BlockDevices {
+		field := fmt.Sprintf("allowed.block_devices[%d]", i)
+
+		if !path.IsAbs(prefix) {
+			problems.add(field, "", "%q is not an absolute path", prefix)
+		}
+
+		if _, ok := seenPrefixes[prefix]; ok {
+			problems.add(field, "", "duplicate path %q", prefix)
+		}
+
+		seenPrefixes[prefix] = struct{}{}
+	}
+
+	return problems
+}
+
+// AdmissionConfig describes the capacity checks done before a machine is created.
+type AdmissionConfig struct {
+	// Overcommit applies to all hosts, unless overridden by the host.
+	Overcommit OvercommitConfig `yaml:"overcommit,omitempty"`
+}
+
+// OvercommitConfig are the ratios of the host capacity which can be allocated to the machines.
+//
+// Unset ratios fall back to the provider defaults.
+type OvercommitConfig struct {
+	CPU    float64 `yaml:"cpu,omitempty"`
+	Memory float64 `yaml:"memory,omitempty"`
+	Disk   float64 `yaml:"disk,omitempty"`
+}
+
+// Merge returns the ratios with the unset ones taken from defaults.
+func (o OvercommitConfig) Merge(defaults OvercommitConfig) OvercommitConfig {
+	if o.CPU == 0 {
+		o.CPU = defaults.CPU
+	}
+
+	if o.Memory == 0 {
+		o.Memory = defaults.Memory
+	}
+
+	if o.Disk == 0 {
+		o.Disk = defaults.Disk
+	}
+
+	return o
+}
+
+// Validate checks the ratios.
+func (o OvercommitConfig) Validate() error {
+	var problems Problems
+
+	for _, ratio := range []struct {
+		name  string
+		value float64
+	}{{"cpu", o.CPU}, {"memory", o.Memory}, {"disk", o.Disk}} {
+		if ratio.value < 0 {
+			problems.add("overcommit", ratio.name, "ratio must not be negative")
+		}
+	}
+
+	return problems.Err()
 }
 
+// PlacementConfig describes how machines are placed on the libvirt hosts.
+type PlacementConfig struct {
+	// Strategy is one of "spread" (default), "bin-pack" or "weighted-random".
+	Strategy string `yaml:"strategy,omitempty"`
+}
+
+// LibVirtConfig describes the libvirt connections.
+//
+// Either a single URI, or a list of named hosts can be set.
 type LibVirtConfig struct {
-	URI string `yaml:"uri"`
+	URI        string           `yaml:"uri"`
+	Hosts      []HostConfig     `yaml:"hosts,omitempty"`
+	Connection ConnectionConfig `yaml:"connection,omitempty"`
+}
+
+// ConnectionConfig describes how the connections to the hosts are kept alive.
+//
+// Unset values fall back to the provider defaults.
+type ConnectionConfig struct {
+	// KeepaliveInterval is how often the connection is checked.
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval,omitempty"`
+	// KeepaliveTimeout is how long to wait for a response before the connection is considered lost.
+	KeepaliveTimeout time.Duration `yaml:"keepalive_timeout,omitempty"`
+	// MaxBackoff is the maximum delay between the reconnection attempts.
+	MaxBackoff time.Duration `yaml:"max_backoff,omitempty"`
+}
+
+func (c ConnectionConfig) validate() error {
+	var problems Problems
+
+	for _, duration := range []struct {
+		name  string
+		value time.Duration
+	}{{"keepalive_interval", c.KeepaliveInterval}, {"keepalive_timeout", c.KeepaliveTimeout}, {"max_backoff", c.MaxBackoff}} {
+		if duration.value < 0 {
+			problems.add("", duration.name, "must not be negative")
+		}
+	}
+
+	return problems.Err()
+}
+
+// HostConfig describes a single libvirt host.
+type HostConfig struct {
+	// Labels are matched by the host selectors of the machine classes.
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Name        string            `yaml:"name"`
+	URI         string            `yaml:"uri"`
+	Credentials Credentials       `yaml:"credentials,omitempty"`
+	Overcommit  OvercommitConfig  `yaml:"overcommit,omitempty"`
+}
+
+// Credentials are merged into the host URI when connecting.
+//
+// They are an alternative to embedding them in the URI query, see https://libvirt.org/uri.html.
+type Credentials struct {
+	Username       string `yaml:"username,omitempty"`
+	PasswordFile   string `yaml:"password_file,omitempty"`
+	SSHKeyFile     string `yaml:"ssh_key_file,omitempty"`
+	KnownHostsFile string `yaml:"known_hosts_file,omitempty"`
+	PKIPath        string `yaml:"pki_path,omitempty"`
+}
+
+// HostList returns the configured hosts.
+//
+// If no hosts are configured, a single host named "default" is returned, using the top level URI.
+// All the problems with the hosts are returned as Problems.
+func (c LibVirtConfig) HostList() ([]HostConfig, error) {
+	if len(c.Hosts) == 0 {
+		return []HostConfig{{Name: DefaultHostName, URI: c.URI}}, nil
+	}
+
+	var problems Problems
+
+	if c.URI != "" {
+		problems.add("libvirt", "", "uri and hosts are mutually exclusive")
+	}
+
+	seen := make(map[string]struct{}, len(c.Hosts))
+
+	for i, host := range c.Hosts {
+		path := fmt.Sprintf("libvirt.hosts[%d]", i)
+
+		if host.Name == "" {
+			problems.add(path, "name", "is not set")
+		}
+
+		if _, ok := seen[host.Name]; ok && host.Name != "" {
+			problems.add(path, "name", "duplicate host name %q", host.Name)
+		}
+
+		seen[host.Name] = struct{}{}
+
+		for key := range host.Labels {
+			if key == "" {
+				problems.add(path, "labels", "empty label key")
+			}
+		}
+
+		if err := host.Overcommit.Validate(); err != nil {
+			problems.addErr(path, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return c.Hosts, nil
+}
+
+// ConnectionURI returns the URI to connect to the host, with the credentials merged in.
+//
+// An empty URI connects to the local system libvirtd.
+func (h HostConfig) ConnectionURI() (*url.URL, error) {
+	rawURI := h.URI
+	if rawURI == "" {
+		rawURI = string(libvirt.QEMUSystem)
+	}
+
+	uri, err := url.Parse(rawURI)
+	if err != nil {
+		return nil, fmt.Errorf("bad libvirt connection URI %q: %w", rawURI, err)
+	}
+
+	creds := h.Credentials
+
+	if creds.Username != "" || creds.PasswordFile != "" {
+		username := creds.Username
+		if username == "" {
+			username = uri.User.Username()
+		}
+
+		uri.User = url.User(username)
+
+		if creds.PasswordFile != "" {
+			password, err := os.ReadFile(creds.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read password file: %w", err)
+			}
+
+			uri.User = url.UserPassword(username, strings.TrimSpace(string(password)))
+		}
+	}
+
+	if creds.SSHKeyFile != "" || creds.KnownHostsFile != "" || creds.PKIPath != "" {
+		query := uri.Query()
+
+		for key, value := range map[string]string{
+			"keyfile":     creds.SSHKeyFile,
+			"known_hosts": creds.KnownHostsFile,
+			"pkipath":     creds.PKIPath,
+		} {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+
+		uri.RawQuery = query.Encode()
+	}
+
+	return uri, nil
 }
@@ -0,0 +1,179 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
+)
+
+const fullConfig = `libvirt:
+  hosts:
+    - name: hv1
+      uri: qemu+ssh://hv1/system
+      labels:
+        rack: a
+    - name: hv2
+      uri: qemu+ssh://hv2/system
+  connection:
+    keepalive_interval: 30s
+image:
+  factory_url: https://factory.example.com
+cache:
+  path: /var/cache/libvirt-provider
+  max_age: 24h
+  max_size: 50
+concurrency:
+  provision: 10
+allowed:
+  storage_pools: [default, fast]
+  networks: [default]
+  block_devices: [/dev/vg1]
+defaults:
+  cores: 2
+  memory: 4096
+  storage_pool: default
+`
+
+func TestParse(t *testing.T) {
+	conf, err := config.Parse([]byte(fullConfig))
+	require.NoError(t, err)
+
+	hosts, err := conf.LibVirt.HostList()
+	require.NoError(t, err)
+	require.Len(t, hosts, 2)
+	assert.Equal(t, map[string]string{"rack": "a"}, hosts[0].Labels)
+
+	assert.Equal(t, 30*time.Second, conf.LibVirt.Connection.KeepaliveInterval)
+	assert.Equal(t, "https://factory.example.com", conf.Image.FactoryURL)
+	assert.Equal(t, 24*time.Hour, conf.Cache.MaxAge)
+	assert.EqualValues(t, 50, conf.Cache.MaxSize)
+	assert.EqualValues(t, 10, conf.Concurrency.Provision)
+	assert.Equal(t, []string{"default", "fast"}, conf.Allowed.StoragePools)
+	assert.Equal(t, []string{"/dev/vg1"}, conf.Allowed.BlockDevices)
+
+	var defaults map[string]any
+
+	require.NoError(t, conf.DecodeDefaults(&defaults))
+	assert.Equal(t, map[string]any{"cores": 2, "memory": 4096, "storage_pool": "default"}, defaults)
+}
+
+func TestParseDefaultHost(t *testing.T) {
+	conf, err := config.Parse([]byte("libvirt:\n  uri: qemu:///system\n"))
+	require.NoError(t, err)
+
+	hosts, err := conf.LibVirt.HostList()
+	require.NoError(t, err)
+	assert.Equal(t, []config.HostConfig{{Name: config.DefaultHostName, URI: "qemu:///system"}}, hosts)
+}
+
+func TestParseProblems(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name:   "unknown fields",
+			config: "libvirt:\n  url: qemu:///system\n  hosts:\n    - name: hv1\n      labls:\n        rack: a\n",
+			want: []string{
+				"line 2: libvirt.url: unknown field",
+				"line 5: libvirt.hosts[0].labls: unknown field",
+			},
+		},
+		{
+			name:   "wrong types",
+			config: "cache:\n  max_age: soon\nconcurrency:\n  provision: -1\n",
+			want: []string{
+				"line 2: cache.max_age: cannot unmarshal !!str `soon` into time.Duration",
+				"line 4: concurrency.provision: cannot unmarshal !!int `-1` into uint",
+			},
+		},
+		{
+			name:   "syntax error",
+			config: "libvirt:\n  uri: [\n",
+			want:   []string{"line 2: did not find expected node content"},
+		},
+		{
+			name: "semantic problems",
+			config: `libvirt:
+  uri: qemu:///system
+  hosts:
+    - uri: qemu:///system
+    - name: hv1
+    - name: hv1
+      overcommit:
+        memory: -1
+  connection:
+    max_backoff: -1s
+image:
+  factory_url: factory.example.com
+cache:
+  max_age: -1h
+allowed:
+  networks: [default, default]
+  block_devices: [dev/vg1, /dev/vg2, /dev/vg2]
+defaults: [cores]
+tracing:
+  sample_ratio: 2
+`,
+			want: []string{
+				"line 1: libvirt: uri and hosts are mutually exclusive",
+				"line 4: libvirt.hosts[0].name: is not set",
+				"line 6: libvirt.hosts[2].name: duplicate host name \"hv1\"",
+				"line 8: libvirt.hosts[2].overcommit.memory: ratio must not be negative",
+				"line 10: libvirt.connection.max_backoff: must not be negative",
+				"line 12: image.factory_url: must be an absolute http or https URL",
+				"line 14: cache.max_age: must not be negative",
+				"line 20: tracing.sample_ratio: must be between 0 and 1",
+				"line 18: defaults: must be a mapping of provider data fields",
+				"line 16: allowed.networks[1]: duplicate name \"default\"",
+				"line 17: allowed.block_devices[0]: \"dev/vg1\" is not an absolute path",
+				"line 17: allowed.block_devices[2]: duplicate path \"/dev/vg2\"",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := config.Parse([]byte(tt.config))
+			require.Error(t, err)
+
+			var problems config.Problems
+
+			require.ErrorAs(t, err, &problems)
+
+			messages := make([]string, 0, len(problems))
+
+			for _, problem := range problems {
+				messages = append(messages, problem.Error())
+			}
+
+			assert.Equal(t, tt.want, messages)
+		})
+	}
+}
+
+func TestDecodeDefaults(t *testing.T) {
+	conf, err := config.Parse([]byte("libvirt:\n  uri: qemu:///system\ndefaults:\n  cores: 2\n  memroy: 4096\n"))
+	require.NoError(t, err)
+
+	var defaults struct {
+		Cores  uint `yaml:"cores"`
+		Memory uint `yaml:"memory"`
+	}
+
+	err = conf.DecodeDefaults(&defaults)
+
+	var problems config.Problems
+
+	require.ErrorAs(t, err, &problems)
+	assert.Equal(t, config.Problems{{Path: "defaults.memroy", Message: "unknown field", Line: 5}}, problems)
+
+	assert.Equal(t, config.Problem{Path: "libvirt.uri", Message: "bad", Line: 2}, conf.Problem("libvirt.uri", "bad"))
+}
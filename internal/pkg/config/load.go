@@ -0,0 +1,303 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Problem is a configuration problem found at a YAML path, e.g. "libvirt.hosts[0].name".
+type Problem struct {
+	Path    string
+	Message string
+	// Line is the line of the problem in the config file, zero if unknown.
+	Line int
+}
+
+// Error implements error.
+func (p Problem) Error() string {
+	var sb strings.Builder
+
+	if p.Line > 0 {
+		fmt.Fprintf(&sb, "line %d: ", p.Line)
+	}
+
+	if p.Path != "" {
+		sb.WriteString(p.Path)
+		sb.WriteString(": ")
+	}
+
+	sb.WriteString(p.Message)
+
+	return sb.String()
+}
+
+// Problems are all the problems found in a config.
+type Problems []Problem
+
+// Error implements error.
+func (p Problems) Error() string {
+	messages := make([]string, 0, len(p))
+
+	for _, problem := range p {
+		messages = append(messages, problem.Error())
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Err returns the problems as an error, or nil if there are none.
+func (p Problems) Err() error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	return p
+}
+
+// add records a problem at the path; the path is joined with the key if not empty.
+func (p *Problems) add(path, key, format string, args ...any) {
+	*p = append(*p, Problem{Path: joinPath(path, key), Message: fmt.Sprintf(format, args...)})
+}
+
+// addErr records a problem from an error, keeping the path of the problems it contains.
+func (p *Problems) addErr(path string, err error) {
+	var problems Problems
+
+	if errors.As(err, &problems) {
+		for _, problem := range problems {
+			problem.Path = joinPath(path, problem.Path)
+			*p = append(*p, problem)
+		}
+
+		return
+	}
+
+	*p = append(*p, Problem{Path: path, Message: err.Error()})
+}
+
+func joinPath(path, key string) string {
+	switch {
+	case path == "":
+		return key
+	case key == "":
+		return path
+	case strings.HasPrefix(key, "["):
+		return path + key
+	default:
+		return path + "." + key
+	}
+}
+
+// Load reads the config file, and validates it.
+//
+// Unknown fields are rejected. All the problems found are returned as Problems.
+func Load(path string) (Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config file %q: %w", path, err)
+	}
+
+	return Parse(raw)
+}
+
+// Parse decodes the config, and validates it.
+func Parse(raw []byte) (Config, error) {
+	var config Config
+
+	if err := decodeStrict(raw, &config); err != nil {
+		return Config{}, err
+	}
+
+	config.root = &yaml.Node{}
+
+	if err := yaml.Unmarshal(raw, config.root); err != nil {
+		return Config{}, err
+	}
+
+	problems := config.Validate()
+
+	for i := range problems {
+		problems[i].Line = lineOf(config.root, problems[i].Path)
+	}
+
+	return config, problems.Err()
+}
+
+// Problem returns a problem at the path, with the line of the path in the config file if it was parsed.
+func (c Config) Problem(path, format string, args ...any) Problem {
+	problem := Problem{Path: path, Message: fmt.Sprintf(format, args...)}
+
+	if c.root != nil {
+		problem.Line = lineOf(c.root, path)
+	}
+
+	return problem
+}
+
+// DecodeDefaults decodes the default provider data into out, rejecting unknown fields.
+//
+// The paths of the problems are relative to the config file.
+func (c Config) DecodeDefaults(out any) error {
+	if c.Defaults.IsZero() {
+		return nil
+	}
+
+	raw, err := yaml.Marshal(&c.Defaults)
+	if err != nil {
+		return err
+	}
+
+	if err = decodeStrict(raw, out); err != nil {
+		var problems Problems
+
+		errors.As(err, &problems)
+
+		// the lines are relative to the re-encoded defaults, they are looked up in the config
+		for i := range problems {
+			problems[i].Line = lineOf(&c.Defaults, problems[i].Path)
+			problems[i].Path = joinPath("defaults", problems[i].Path)
+		}
+
+		return problems
+	}
+
+	return nil
+}
+
+var (
+	errorLineRegexp    = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	unknownFieldRegexp = regexp.MustCompile(`^field \S+ not found in type `)
+)
+
+// decodeStrict decodes the YAML document into out, rejecting unknown fields.
+//
+// The decoding errors are returned as Problems, with the YAML path of the line they are reported at.
+func decodeStrict(raw []byte, out any) error {
+	var root yaml.Node
+
+	if err := yaml.Unmarshal(raw, &root); err != nil {
+		return Problems{parseProblem(err.Error(), nil)}
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+
+	err := decoder.Decode(out)
+	if err == nil || errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	var typeErr *yaml.TypeError
+
+	if !errors.As(err, &typeErr) {
+		return Problems{parseProblem(err.Error(), &root)}
+	}
+
+	problems := make(Problems, 0, len(typeErr.Errors))
+
+	for _, message := range typeErr.Errors {
+		problems = append(problems, parseProblem(message, &root))
+	}
+
+	return problems
+}
+
+// parseProblem converts a YAML error message to a problem, looking up the path of its line in the document.
+func parseProblem(message string, root *yaml.Node) Problem {
+	match := errorLineRegexp.FindStringSubmatch(message)
+	if match == nil {
+		return Problem{Message: strings.TrimPrefix(message, "yaml: ")}
+	}
+
+	line, _ := strconv.Atoi(match[1]) //nolint:errcheck
+	problem := Problem{Line: line, Message: match[2]}
+
+	if root != nil {
+		problem.Path = pathAt(root, line)
+	}
+
+	if unknownFieldRegexp.MatchString(problem.Message) {
+		problem.Message = "unknown field"
+	}
+
+	return problem
+}
+
+// pathAt returns the path of the innermost node at the line.
+func pathAt(root *yaml.Node, line int) string {
+	var found string
+
+	walk(root, "", func(path string, nodeLine int) {
+		if nodeLine == line {
+			found = path
+		}
+	})
+
+	return found
+}
+
+// lineOf returns the line of the node at the path.
+//
+// If there's no such node, e.g. for a missing field, the line of the closest parent is returned.
+func lineOf(root *yaml.Node, path string) int {
+	lines := map[string]int{}
+
+	walk(root, "", func(nodePath string, nodeLine int) {
+		if _, ok := lines[nodePath]; !ok {
+			lines[nodePath] = nodeLine
+		}
+	})
+
+	for path != "" {
+		if line, ok := lines[path]; ok {
+			return line
+		}
+
+		path = path[:max(strings.LastIndexAny(path, ".["), 0)]
+	}
+
+	return 0
+}
+
+// walk calls fn with the path and the lines of all the mapping values and sequence items, parents first.
+func walk(node *yaml.Node, path string, fn func(path string, line int)) {
+	switch node.Kind { //nolint:exhaustive
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			walk(child, path, fn)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			childPath := joinPath(path, key.Value)
+
+			fn(childPath, key.Line)
+
+			if value.Line != key.Line {
+				fn(childPath, value.Line)
+			}
+
+			walk(value, childPath, fn)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+
+			fn(childPath, item.Line)
+
+			walk(item, childPath, fn)
+		}
+	}
+}
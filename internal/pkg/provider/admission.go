@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
+)
+
+// Overcommit are the ratios of the host capacity which can be allocated to the machines.
+//
+// Zero ratios fall back to the defaults.
+type Overcommit struct {
+	// CPU is the ratio of the vCPUs to the host CPUs.
+	CPU float64
+	// Memory is the ratio of the memory of the domains to the host memory.
+	Memory float64
+	// Disk is the ratio of the capacity of the volumes to the storage pool capacity.
+	Disk float64
+}
+
+// DefaultOvercommit allows overcommitting the CPUs, but neither the memory nor the storage.
+var DefaultOvercommit = Overcommit{
+	CPU:    4,
+	Memory: 1,
+	Disk:   1,
+}
+
+func (o Overcommit) withDefaults() Overcommit {
+	if o.CPU == 0 {
+		o.CPU = DefaultOvercommit.CPU
+	}
+
+	if o.Memory == 0 {
+		o.Memory = DefaultOvercommit.Memory
+	}
+
+	if o.Disk == 0 {
+		o.Disk = DefaultOvercommit.Disk
+	}
+
+	return o
+}
+
+// admit checks that the machine fits into the capacity left on the host.
+//
+// It reports all the resources the machine doesn't fit in.
+func admit(usage hostUsage, overcommit Overcommit, data Data) error {
+	overcommit = overcommit.withDefaults()
+	req := placement.Request{
+		Cores:  data.Cores,
+		Memory: uint64(data.Memory) * MiB,
+		Disk:   data.totalDiskSize() * GiB,
+	}
+
+	var problems []string
+
+	cpuLimit := uint(float64(usage.cpus) * overcommit.CPU)
+
+	switch {
+	case req.Cores > usage.cpus:
+		problems = append(problems, fmt.Sprintf("requested %d cores, but the host has %d CPUs", req.Cores, usage.cpus))
+	case usage.allocatedCores+req.Cores > cpuLimit:
+		problems = append(problems, fmt.Sprintf("requested %d cores, but %d of %d vCPUs are allocated (%d CPUs, overcommit ratio %g)",
+			req.Cores, usage.allocatedCores, cpuLimit, usage.cpus, overcommit.CPU))
+	}
+
+	memoryLimit := uint64(float64(usage.memory) * overcommit.Memory)
+
+	if usage.allocatedMemory+req.Memory > memoryLimit {
+		problems = append(problems, fmt.Sprintf("requested %d MiB of memory, but %d of %d MiB are allocated (overcommit ratio %g)",
+			req.Memory/MiB, usage.allocatedMemory/MiB, memoryLimit/MiB, overcommit.Memory))
+	}
+
+	diskLimit := uint64(float64(usage.poolCapacity) * overcommit.Disk)
+
+	if usage.poolCommitted+req.Disk > diskLimit {
+		problems = append(problems, fmt.Sprintf("requested %d GiB of disks, but %d of %d GiB of the storage pool %q are allocated (overcommit ratio %g)",
+			req.Disk/GiB, usage.poolCommitted/GiB, diskLimit/GiB, data.StoragePool, overcommit.Disk))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("machine doesn't fit on host %q: %s", usage.name, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+
+	"libvirt.org/go/libvirtxml"
+)
+
+// Additional disk types, i.e. the bus they are attached to.
+const (
+	diskTypeVirtioBlk  = "virtio-blk"
+	diskTypeVirtioSCSI = "virtio-scsi"
+	diskTypeSATA       = "sata"
+	diskTypeNVMe       = "nvme"
+)
+
+// Bus limits of the q35 machine type.
+const (
+	// sataPorts are the ports of the AHCI controller built into the q35 chipset, the first one is the cidata cdrom's.
+	sataPorts = 6
+	// scsiLUNs are the LUNs of the target of the virtio-scsi controller.
+	scsiLUNs = 16384
+	// pcieRootPorts are the root ports libvirt can add to the 8 functions of the free slots of the root complex:
+	// slot 0 is the host bridge, slot 1 the video and slot 31 the chipset devices.
+	pcieRootPorts = 29 * 8
+	// fixedPCIeDevices are the PCIe devices of every domain: the primary disk, the memory balloon,
+	// the virtio-serial controller of the guest agent channel and the USB controller.
+	fixedPCIeDevices = 4
+)
+
+// diskTargets assigns the device names and the addresses of the additional disks, in the order of the disks.
+//
+// The primary disk is vda and the cidata cdrom is sda, on the first SATA port.
+// The SATA and the SCSI disks share the sd names, like in the guest.
+type diskTargets struct {
+	virtio int
+	sd     int
+	nvme   int
+	sata   int
+	scsi   int
+}
+
+func newDiskTargets() *diskTargets {
+	return &diskTargets{
+		virtio: 1,
+		sd:     1,
+		sata:   1,
+	}
+}
+
+// next returns the target and the address of the next disk of the type.
+func (t *diskTargets) next(diskType string) (*libvirtxml.DomainDiskTarget, *libvirtxml.DomainAddress, error) {
+	switch diskType {
+	case diskTypeVirtioBlk:
+		dev := diskName("vd", t.virtio)
+		t.virtio++
+
+		return &libvirtxml.DomainDiskTarget{Dev: dev, Bus: "virtio"}, nil, nil
+	case diskTypeNVMe:
+		dev := fmt.Sprintf("nvme%dn1", t.nvme)
+		t.nvme++
+
+		return &libvirtxml.DomainDiskTarget{Dev: dev, Bus: "nvme"}, nil, nil
+	case diskTypeSATA:
+		if t.sata >= sataPorts {
+			return nil, nil, fmt.Errorf("more than %d sata disks, the q35 machine type has %d sata ports and the first one is used by the cidata cdrom", sataPorts-1, sataPorts)
+		}
+
+		dev := diskName("sd", t.sd)
+		unit := uint(t.sata)
+
+		t.sd++
+		t.sata++
+
+		return &libvirtxml.DomainDiskTarget{Dev: dev, Bus: "sata"}, driveAddress(unit), nil
+	case diskTypeVirtioSCSI:
+		if t.scsi >= scsiLUNs {
+			return nil, nil, fmt.Errorf("more than %d virtio-scsi disks", scsiLUNs)
+		}
+
+		dev := diskName("sd", t.sd)
+		unit := uint(t.scsi)
+
+		t.sd++
+		t.scsi++
+
+		return &libvirtxml.DomainDiskTarget{Dev: dev, Bus: "scsi"}, driveAddress(unit), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown disk type: %q", diskType)
+	}
+}
+
+// controllers returns the controllers of the disks, other than the ones of the machine type.
+func (t *diskTargets) controllers() []libvirtxml.DomainController {
+	if t.scsi == 0 {
+		return nil
+	}
+
+	index := uint(0)
+
+	return []libvirtxml.DomainController{
+		{
+			Type:  "scsi",
+			Index: &index,
+			Model: "virtio-scsi",
+		},
+	}
+}
+
+// checkPCIe verifies that the PCIe devices of the domain fit the root ports of the machine type.
+func (t *diskTargets) checkPCIe(networkInterfaces int) error {
+	devices := fixedPCIeDevices + networkInterfaces + t.virtio - 1 + t.nvme
+
+	if t.scsi > 0 {
+		devices++
+	}
+
+	if devices > pcieRootPorts {
+		return fmt.Errorf("the domain has %d PCIe devices, more than the %d root ports of the q35 machine type", devices, pcieRootPorts)
+	}
+
+	return nil
+}
+
+// driveAddress is the address of the disk on the unit of the first controller of its bus.
+func driveAddress(unit uint) *libvirtxml.DomainAddress {
+	var controller, bus, target uint
+
+	return &libvirtxml.DomainAddress{
+		Drive: &libvirtxml.DomainAddressDrive{
+			Controller: &controller,
+			Bus:        &bus,
+			Target:     &target,
+			Unit:       &unit,
+		},
+	}
+}
+
+// diskName returns the name of the disk with the index, named like the kernel does: vda, ..., vdz, vdaa, ...
+func diskName(prefix string, idx int) string {
+	var suffix string
+
+	for idx >= 0 {
+		suffix = string(rune('a'+idx%26)) + suffix
+		idx = idx/26 - 1
+	}
+
+	return prefix + suffix
+}
@@ -0,0 +1,209 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
+)
+
+// placementRequest returns the capacity and the placement rules requested by the provider data.
+//
+// Rules scoped to a group the machine is not part of, e.g. a machine without a cluster, are ignored.
+func placementRequest(data Data, owner domainOwner) (placement.Request, error) {
+	req := placement.Request{
+		Groups: owner.placementGroups(),
+		Cores:  data.Cores,
+		Memory: uint64(data.Memory) * MiB,
+		Disk:   data.totalDiskSize() * GiB,
+	}
+
+	for i, rule := range data.PlacementRules {
+		var group string
+
+		switch rule.Scope {
+		case placementScopeCluster:
+			if owner.Cluster != "" {
+				group = clusterGroup(owner.Cluster)
+			}
+		case placementScopeMachineSet:
+			if owner.MachineSet != "" {
+				group = machineSetGroup(owner.MachineSet)
+			}
+		default:
+			return placement.Request{}, fmt.Errorf("placement_rules[%d]: unknown scope %q", i, rule.Scope)
+		}
+
+		var affinity bool
+
+		switch rule.Type {
+		case placementRuleAffinity:
+			affinity = true
+		case placementRuleAntiAffinity:
+		default:
+			return placement.Request{}, fmt.Errorf("placement_rules[%d]: unknown type %q", i, rule.Type)
+		}
+
+		if group == "" {
+			continue
+		}
+
+		req.Rules = append(req.Rules, placement.Rule{
+			Group:    group,
+			Affinity: affinity,
+			Required: rule.Required,
+		})
+	}
+
+	return req, nil
+}
+
+// hostUsage is the capacity of a host and of a storage pool on it, and how much of it is in use.
+//
+// Memory and disk sizes are in bytes.
+type hostUsage struct {
+	// groups is the number of machines on the host in each placement group
+	groups          map[string]int
+	name            string
+	memory          uint64
+	freeMemory      uint64
+	allocatedMemory uint64
+	poolCapacity    uint64
+	poolAvailable   uint64
+	poolCommitted   uint64
+	cpus            uint
+	allocatedCores  uint
+}
+
+// reserve accounts for the capacity reserved on the host by the in-flight requests, their machines aren't defined yet.
+func (u hostUsage) reserve(reserved placement.Request) hostUsage {
+	u.allocatedCores += reserved.Cores
+	u.allocatedMemory += reserved.Memory
+	u.poolCommitted += reserved.Disk
+
+	return u
+}
+
+// placementHost returns the host as a placement candidate.
+func (u hostUsage) placementHost() placement.Host {
+	return placement.Host{
+		Name:           u.name,
+		Memory:         u.memory,
+		FreeMemory:     u.freeMemory,
+		FreeDisk:       u.poolAvailable,
+		Groups:         u.groups,
+		Cores:          u.cpus,
+		AllocatedCores: u.allocatedCores,
+	}
+}
+
+// collectHostUsage collects the capacity of the host, and of the storage pool on it.
+//
+// The domain and the volumes of the given request are not counted, they are being provisioned.
+//
+//nolint:gocognit,gocyclo,cyclop
+func collectHostUsage(ctx context.Context, host Host, poolName, requestID string) (hostUsage, error) {
+	lc, err := hostClient(ctx, host)
+	if err != nil {
+		return hostUsage{}, err
+	}
+
+	usage := hostUsage{
+		name:   host.Name,
+		groups: map[string]int{},
+	}
+
+	_, memory, cpus, _, _, _, _, _, err := lc.NodeGetInfo() //nolint:dogsled
+	if err != nil {
+		return hostUsage{}, fmt.Errorf("error fetching node info: %w", err)
+	}
+
+	// NodeGetInfo reports the memory in KiB
+	usage.memory = memory * 1024
+	usage.cpus = uint(cpus)
+
+	if usage.freeMemory, err = lc.NodeGetFreeMemory(); err != nil {
+		return hostUsage{}, fmt.Errorf("error fetching free memory: %w", err)
+	}
+
+	domains, _, err := lc.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive|libvirt.ConnectListDomainsInactive)
+	if err != nil {
+		return hostUsage{}, fmt.Errorf("error listing domains: %w", err)
+	}
+
+	for _, dom := range domains {
+		if dom.Name == requestID {
+			continue
+		}
+
+		_, maxMemory, _, vcpus, _, err := lc.DomainGetInfo(dom)
+		if err != nil {
+			if libvirt.IsNotFound(err) {
+				// removed in the meantime
+				continue
+			}
+
+			return hostUsage{}, fmt.Errorf("error fetching domain info of %q: %w", dom.Name, err)
+		}
+
+		usage.allocatedCores += uint(vcpus)
+		usage.allocatedMemory += maxMemory * 1024
+
+		owner, ok, err := domainOwnerOf(lc, dom)
+		if err != nil {
+			if libvirt.IsNotFound(err) {
+				continue
+			}
+
+			return hostUsage{}, fmt.Errorf("error fetching ownership of %q: %w", dom.Name, err)
+		}
+
+		if !ok || owner.RequestID == requestID {
+			continue
+		}
+
+		for _, group := range owner.placementGroups() {
+			usage.groups[group]++
+		}
+	}
+
+	pool, err := lc.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return hostUsage{}, fmt.Errorf("error looking up storage pool %q: %w", poolName, err)
+	}
+
+	_, usage.poolCapacity, _, usage.poolAvailable, err = lc.StoragePoolGetInfo(pool)
+	if err != nil {
+		return hostUsage{}, fmt.Errorf("error fetching info of storage pool %q: %w", poolName, err)
+	}
+
+	volumes, _, err := lc.StoragePoolListAllVolumes(pool, 1, 0)
+	if err != nil {
+		return hostUsage{}, fmt.Errorf("error listing volumes of storage pool %q: %w", poolName, err)
+	}
+
+	for _, vol := range volumes {
+		if isRequestVolume(vol.Name, requestID) {
+			continue
+		}
+
+		_, capacity, _, err := lc.StorageVolGetInfo(vol)
+		if err != nil {
+			if libvirt.IsNotFound(err) {
+				continue
+			}
+
+			return hostUsage{}, fmt.Errorf("error fetching info of volume %q: %w", vol.Name, err)
+		}
+
+		usage.poolCommitted += capacity
+	}
+
+	return usage, nil
+}
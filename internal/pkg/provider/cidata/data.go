@@ -10,6 +10,11 @@ func MetaData(hostname string) []byte {
 	return fmt.Appendf(nil, "local-hostname: %s\n", hostname)
 }
 
+// UserData is empty, the machine config is provided by Omni.
+func UserData() []byte {
+	return []byte("#cloud-config\n")
+}
+
 const defaultNetworkData = `version: 2
 ethernets:
   all-en:
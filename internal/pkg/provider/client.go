@@ -0,0 +1,58 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"io"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// LibvirtClient is the subset of the libvirt RPC API used by the provisioner.
+//
+// It is implemented by *libvirt.Libvirt, and by the in-memory fake in the libvirtfake package.
+type LibvirtClient interface {
+	ConnectGetLibVersion() (uint64, error)
+	NodeGetInfo() (rModel [32]int8, rMemory uint64, rCpus int32, rMhz int32, rNodes int32, rSockets int32, rCores int32, rThreads int32, err error)
+	NodeGetFreeMemory() (uint64, error)
+
+	ConnectListAllDomains(NeedResults int32, Flags libvirt.ConnectListAllDomainsFlags) ([]libvirt.Domain, uint32, error)
+	DomainLookupByUUID(UUID libvirt.UUID) (libvirt.Domain, error)
+	DomainLookupByName(Name string) (libvirt.Domain, error)
+	DomainGetState(Dom libvirt.Domain, Flags uint32) (int32, int32, error)
+	DomainGetMetadata(Dom libvirt.Domain, Type int32, URI libvirt.OptString, Flags libvirt.DomainModificationImpact) (string, error)
+	DomainGetInfo(Dom libvirt.Domain) (rState uint8, rMaxMem uint64, rMemory uint64, rNrVirtCPU uint16, rCPUTime uint64, err error)
+	DomainGetXMLDesc(Dom libvirt.Domain, Flags libvirt.DomainXMLFlags) (string, error)
+	DomainDefineXML(XML string) (libvirt.Domain, error)
+	DomainCreate(Dom libvirt.Domain) error
+	DomainDestroy(Dom libvirt.Domain) error
+	DomainUndefine(Dom libvirt.Domain) error
+
+	DomainSnapshotCreateXML(Dom libvirt.Domain, XMLDesc string, Flags uint32) (libvirt.DomainSnapshot, error)
+	DomainListAllSnapshots(Dom libvirt.Domain, NeedResults int32, Flags uint32) ([]libvirt.DomainSnapshot, int32, error)
+	DomainSnapshotLookupByName(Dom libvirt.Domain, Name string, Flags uint32) (libvirt.DomainSnapshot, error)
+	DomainSnapshotGetXMLDesc(Snap libvirt.DomainSnapshot, Flags uint32) (string, error)
+	DomainSnapshotDelete(Snap libvirt.DomainSnapshot, Flags libvirt.DomainSnapshotDeleteFlags) error
+
+	StoragePoolLookupByName(Name string) (libvirt.StoragePool, error)
+	StoragePoolGetInfo(Pool libvirt.StoragePool) (rState uint8, rCapacity uint64, rAllocation uint64, rAvailable uint64, err error)
+	StoragePoolGetXMLDesc(Pool libvirt.StoragePool, Flags libvirt.StorageXMLFlags) (string, error)
+	StoragePoolListAllVolumes(Pool libvirt.StoragePool, NeedResults int32, Flags uint32) ([]libvirt.StorageVol, uint32, error)
+	StorageVolLookupByName(Pool libvirt.StoragePool, Name string) (libvirt.StorageVol, error)
+	StorageVolCreateXML(Pool libvirt.StoragePool, XML string, Flags libvirt.StorageVolCreateFlags) (libvirt.StorageVol, error)
+	StorageVolCreateXMLFrom(Pool libvirt.StoragePool, XML string, Clonevol libvirt.StorageVol, Flags libvirt.StorageVolCreateFlags) (libvirt.StorageVol, error)
+	StorageVolGetInfo(Vol libvirt.StorageVol) (rType int8, rCapacity uint64, rAllocation uint64, err error)
+	StorageVolGetXMLDesc(Vol libvirt.StorageVol, Flags uint32) (string, error)
+	StorageVolDelete(Vol libvirt.StorageVol, Flags libvirt.StorageVolDeleteFlags) error
+	StorageVolUpload(Vol libvirt.StorageVol, outStream io.Reader, Offset uint64, Length uint64, Flags libvirt.StorageVolUploadFlags) error
+	StorageVolResize(Vol libvirt.StorageVol, Capacity uint64, Flags libvirt.StorageVolResizeFlags) error
+
+	SecretLookupByUUID(UUID libvirt.UUID) (libvirt.Secret, error)
+	SecretDefineXML(XML string, Flags uint32) (libvirt.Secret, error)
+	SecretSetValue(OptSecret libvirt.Secret, Value []byte, Flags uint32) error
+	SecretUndefine(OptSecret libvirt.Secret) error
+}
+
+var _ LibvirtClient = (*libvirt.Libvirt)(nil)
@@ -0,0 +1,241 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultKeepaliveInterval is the default interval between the connection health checks.
+	DefaultKeepaliveInterval = 15 * time.Second
+
+	// DefaultKeepaliveTimeout is the default time to wait for a health check response.
+	DefaultKeepaliveTimeout = 10 * time.Second
+
+	// DefaultMinBackoff is the default delay before the first reconnection attempt.
+	DefaultMinBackoff = time.Second
+
+	// DefaultMaxBackoff is the default maximum delay between reconnection attempts.
+	DefaultMaxBackoff = time.Minute
+
+	// disconnectedRetryInterval is how soon a step is retried while its host is disconnected.
+	disconnectedRetryInterval = 10 * time.Second
+)
+
+// Connector provides the client connected to a libvirt host.
+type Connector interface {
+	// Client returns the current client, or a retry error while the host is disconnected.
+	Client() (LibvirtClient, error)
+}
+
+// Connected returns a Connector which always provides the given client.
+func Connected(client LibvirtClient) Connector {
+	return staticConnector{client: client}
+}
+
+type staticConnector struct {
+	client LibvirtClient
+}
+
+func (c staticConnector) Client() (LibvirtClient, error) {
+	return c.client, nil
+}
+
+// Conn is an established libvirt connection.
+//
+// It is implemented by *libvirt.Libvirt.
+type Conn interface {
+	LibvirtClient
+
+	Disconnected() <-chan struct{}
+	Disconnect() error
+}
+
+// DialFunc opens a new connection to a libvirt host.
+type DialFunc func(ctx context.Context) (Conn, error)
+
+var errConnectionClosed = errors.New("connection closed")
+
+// Connection keeps the connection to a libvirt host alive.
+//
+// A lost connection is detected through Conn.Disconnected, and through periodic keepalive
+// requests which catch connections that hang without being closed, e.g. a dropped SSH tunnel.
+// The connection is then reopened with an exponential backoff, and Client fails with a retry error
+// until it is back.
+type Connection struct {
+	conn    Conn
+	lastErr error
+	dial    DialFunc
+	logger  *zap.Logger
+	name    string
+	// How often to check the connection
+	KeepaliveInterval time.Duration
+	// How long to wait for the keepalive response before the connection is considered lost
+	KeepaliveTimeout time.Duration
+	// Delays between the reconnection attempts, doubled after each failed attempt
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	mu         sync.Mutex
+}
+
+// NewConnection creates a new Connection to the host with the given name with default settings.
+//
+// The connection is opened by Connect or Run.
+func NewConnection(logger *zap.Logger, name string, dial DialFunc) *Connection {
+	return &Connection{
+		name:              name,
+		dial:              dial,
+		logger:            logger.With(zap.String("host", name)),
+		lastErr:           errors.New("not connected yet"),
+		KeepaliveInterval: DefaultKeepaliveInterval,
+		KeepaliveTimeout:  DefaultKeepaliveTimeout,
+		MinBackoff:        DefaultMinBackoff,
+		MaxBackoff:        DefaultMaxBackoff,
+	}
+}
+
+// Client implements Connector.
+func (c *Connection) Client() (LibvirtClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil, provision.NewRetryErrorf(disconnectedRetryInterval, "libvirt host %q is disconnected: %s", c.name, c.lastErr)
+	}
+
+	return c.conn, nil
+}
+
+// Connect opens the connection, it is used to fail early on a misconfigured host.
+func (c *Connection) Connect(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		c.setDisconnected(err)
+
+		return err
+	}
+
+	c.setConnected(conn)
+
+	return nil
+}
+
+// Run watches the connection and reconnects until the context is canceled.
+func (c *Connection) Run(ctx context.Context) error {
+	backoff := c.MinBackoff
+
+	for {
+		conn := c.current()
+
+		if conn == nil {
+			var err error
+
+			conn, err = c.dial(ctx)
+			if err != nil {
+				c.setDisconnected(err)
+
+				c.logger.Warn("failed to connect to libvirt", zap.Duration("retry_in", backoff), zap.Error(err))
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(backoff):
+				}
+
+				backoff = min(2*backoff, c.MaxBackoff)
+
+				continue
+			}
+
+			backoff = c.MinBackoff
+
+			c.setConnected(conn)
+			c.logger.Info("connected to libvirt")
+		}
+
+		err := c.watch(ctx, conn)
+
+		c.setDisconnected(err)
+		conn.Disconnect() //nolint:errcheck
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		c.logger.Warn("lost connection to libvirt", zap.Error(err))
+	}
+}
+
+// watch blocks until the connection is lost, or the context is canceled.
+func (c *Connection) watch(ctx context.Context, conn Conn) error {
+	ticker := time.NewTicker(c.KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-conn.Disconnected():
+			return errConnectionClosed
+		case <-ticker.C:
+			if err := c.keepalive(conn); err != nil {
+				return fmt.Errorf("keepalive failed: %w", err)
+			}
+		}
+	}
+}
+
+// keepalive sends a request over the connection, and waits for the response at most KeepaliveTimeout.
+//
+// A request on a hanging connection is unblocked once the connection is closed.
+func (c *Connection) keepalive(conn Conn) error {
+	errCh := make(chan error, 1)
+
+	go func() {
+		_, err := conn.ConnectGetLibVersion()
+
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-conn.Disconnected():
+		return errConnectionClosed
+	case <-time.After(c.KeepaliveTimeout):
+		return fmt.Errorf("no response in %s", c.KeepaliveTimeout)
+	}
+}
+
+func (c *Connection) current() Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn
+}
+
+func (c *Connection) setConnected(conn Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn = conn
+	c.lastErr = nil
+}
+
+func (c *Connection) setDisconnected(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn = nil
+	c.lastErr = err
+}
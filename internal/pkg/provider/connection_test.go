@@ -0,0 +1,194 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/libvirtfake"
+)
+
+// newTestConnection creates a connection with short intervals, which reconnects to lv, and counts the dials.
+func newTestConnection(t *testing.T, lv *libvirtfake.Libvirt, dialErrs ...error) (*provider.Connection, *atomic.Int32) {
+	t.Helper()
+
+	var (
+		dials atomic.Int32
+		mu    sync.Mutex
+	)
+
+	connection := provider.NewConnection(zaptest.NewLogger(t), config.DefaultHostName, func(context.Context) (provider.Conn, error) {
+		dials.Add(1)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if len(dialErrs) > 0 {
+			err := dialErrs[0]
+			dialErrs = dialErrs[1:]
+
+			return nil, err
+		}
+
+		lv.Reconnect()
+
+		return lv, nil
+	})
+
+	connection.KeepaliveInterval = 10 * time.Millisecond
+	connection.KeepaliveTimeout = time.Second
+	connection.MinBackoff = time.Millisecond
+	connection.MaxBackoff = 10 * time.Millisecond
+
+	return connection, &dials
+}
+
+// run runs the connection in the background until the test ends.
+func run(t *testing.T, connection *provider.Connection) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		assert.NoError(t, connection.Run(ctx))
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func connected(connection *provider.Connection) func() bool {
+	return func() bool {
+		_, err := connection.Client()
+
+		return err == nil
+	}
+}
+
+func TestConnectionNotConnected(t *testing.T) {
+	connection, _ := newTestConnection(t, libvirtfake.New(testPool), errors.New("connection refused"))
+
+	_, err := connection.Client()
+	require.Error(t, err)
+	assert.True(t, isRetry(err), "expected retry error, got %v", err)
+
+	require.ErrorContains(t, connection.Connect(t.Context()), "connection refused")
+
+	_, err = connection.Client()
+	require.ErrorContains(t, err, `libvirt host "default" is disconnected: connection refused`)
+	assert.True(t, isRetry(err), "expected retry error, got %v", err)
+
+	require.NoError(t, connection.Connect(t.Context()))
+
+	client, err := connection.Client()
+	require.NoError(t, err)
+	assert.NotNil(t, client)
+}
+
+func TestConnectionReconnects(t *testing.T) {
+	lv := libvirtfake.New(testPool)
+	connection, dials := newTestConnection(t, lv)
+
+	require.NoError(t, connection.Connect(t.Context()))
+
+	run(t, connection)
+
+	require.NoError(t, lv.Disconnect())
+
+	assert.Eventually(t, func() bool { return dials.Load() == 2 }, time.Second, time.Millisecond)
+	assert.Eventually(t, connected(connection), time.Second, time.Millisecond)
+}
+
+func TestConnectionKeepalive(t *testing.T) {
+	lv := libvirtfake.New(testPool)
+	connection, dials := newTestConnection(t, lv)
+
+	require.NoError(t, connection.Connect(t.Context()))
+
+	lv.InjectError("ConnectGetLibVersion", 2, errors.New("timeout"))
+
+	run(t, connection)
+
+	assert.Eventually(t, func() bool { return dials.Load() == 2 }, time.Second, time.Millisecond)
+	assert.Eventually(t, connected(connection), time.Second, time.Millisecond)
+	assert.GreaterOrEqual(t, lv.Calls("ConnectGetLibVersion"), 3)
+}
+
+func TestConnectionBackoff(t *testing.T) {
+	lv := libvirtfake.New(testPool)
+	connection, dials := newTestConnection(t, lv, errors.New("refused"), errors.New("refused"), errors.New("refused"))
+
+	run(t, connection)
+
+	assert.Eventually(t, connected(connection), time.Second, time.Millisecond)
+	assert.EqualValues(t, 4, dials.Load())
+}
+
+// flakyConnector provides the client once, and then fails like a lost connection.
+type flakyConnector struct {
+	client provider.LibvirtClient
+	calls  atomic.Int32
+}
+
+func (c *flakyConnector) Client() (provider.LibvirtClient, error) {
+	if c.calls.Add(1) == 1 {
+		return c.client, nil
+	}
+
+	return nil, provision.NewRetryErrorf(time.Second, "disconnected")
+}
+
+func TestProvisionDisconnected(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "provisionCidata")
+
+	connection, _ := newTestConnection(t, env.lv)
+
+	env.provisioner = provider.NewProvisioner([]provider.Host{{Name: config.DefaultHostName, Connection: connection}}, env.scheduler, nil)
+
+	err := env.runStep(t, "createVM")
+	require.Error(t, err)
+	assert.True(t, isRetry(err), "expected retry error, got %v", err)
+
+	// the connection is lost in the middle of the step
+	require.NoError(t, env.lv.Disconnect())
+
+	env.provisioner = provider.NewProvisioner([]provider.Host{{Name: config.DefaultHostName, Connection: &flakyConnector{client: env.lv}}}, env.scheduler, nil)
+
+	err = env.runStep(t, "createVM")
+	require.Error(t, err)
+	assert.True(t, isRetry(err), "expected retry error, got %v", err)
+
+	// the machine state is kept for the next attempt, nothing is rolled back
+	assert.NotEmpty(t, env.spec().Value.CidataVolName)
+	assert.Empty(t, env.spec().Value.VmName)
+
+	env.lv.Reconnect()
+
+	require.NoError(t, connection.Connect(t.Context()))
+
+	env.provisioner = provider.NewProvisioner([]provider.Host{{Name: config.DefaultHostName, Connection: connection}}, env.scheduler, nil)
+
+	require.NoError(t, env.runStep(t, "createVM"))
+	assert.Equal(t, []string{testRequestID}, env.lv.Domains())
+}
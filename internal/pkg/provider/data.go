@@ -4,19 +4,414 @@
 
 package provider
 
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+)
+
 // Data is the provider custom machine config.
 type Data struct {
+	HostSelector      *hostSelector      `yaml:"host_selector,omitempty"`
+	Host              string             `yaml:"host,omitempty"`
 	StoragePool       string             `yaml:"storage_pool"`
 	NetworkInterfaces []networkInterface `yaml:"network_interfaces,omitempty"`
 	AdditionalDisks   []additionalDisk   `yaml:"additional_disks,omitempty"`
+	DiskDriver        diskDriver         `yaml:"disk_driver,omitempty"`
+	DiskIOTune        diskIOTune         `yaml:"disk_iotune,omitempty"`
+	PlacementRules    []placementRule    `yaml:"placement_rules,omitempty"`
+	Snapshots         *snapshotSchedule  `yaml:"snapshots,omitempty"`
+	Retain            string             `yaml:"retain,omitempty"`
 	DiskSize          uint64             `yaml:"disk_size"`
 	Cores             uint               `yaml:"cores"`
 	Memory            uint               `yaml:"memory"`
 }
 
+// totalDiskSize returns the summed size of the primary and the additional disks in GiB.
+func (d Data) totalDiskSize() uint64 {
+	size := d.DiskSize
+
+	for _, additionalDisk := range d.AdditionalDisks {
+		// the existing disks don't take space from the storage pool
+		if !additionalDisk.isExisting() {
+			size += additionalDisk.Size
+		}
+	}
+
+	return size
+}
+
+// additionalDisk is a new empty volume of the machine pool, or an existing volume or host block device.
 type additionalDisk struct {
 	Type string `yaml:"type"`
-	Size uint64 `yaml:"size"` // GiB
+	// Volume is the name of an existing volume of Pool, which defaults to the storage pool of the machine.
+	Volume string `yaml:"volume,omitempty"`
+	Pool   string `yaml:"pool,omitempty"`
+	// BlockDevice is the path of an existing block device of the host, e.g. an LVM logical volume.
+	BlockDevice string     `yaml:"block_device,omitempty"`
+	Driver      diskDriver `yaml:"driver,omitempty"`
+	IOTune      diskIOTune `yaml:"iotune,omitempty"`
+	Retain      string     `yaml:"retain,omitempty"`
+	Size        uint64     `yaml:"size,omitempty"` // GiB, ignored for the existing disks
+	// Encrypted creates the volume with LUKS encryption, its passphrase is a libvirt secret of the host.
+	Encrypted bool `yaml:"encrypted,omitempty"`
+}
+
+// isExisting reports whether the disk is attached, but neither created nor deleted by the provider.
+func (d additionalDisk) isExisting() bool {
+	return d.Volume != "" || d.BlockDevice != ""
+}
+
+// format returns the format of the volume created for the disk in the pool: the encrypted volumes are raw.
+func (d additionalDisk) format(pool storagePool) string {
+	if d.Encrypted {
+		return diskFormatRaw
+	}
+
+	return pool.diskFormat()
+}
+
+// pool returns the storage pool of the existing volume.
+func (d additionalDisk) pool(data Data) string {
+	return cmp.Or(d.Pool, data.StoragePool)
+}
+
+func (d additionalDisk) validate() error {
+	switch {
+	case d.Volume != "" && d.BlockDevice != "":
+		return errors.New("volume and block_device can't be both set")
+	case d.Pool != "" && d.Volume == "":
+		return errors.New("pool requires volume")
+	case d.BlockDevice != "" && !path.IsAbs(d.BlockDevice):
+		return fmt.Errorf("block_device %q is not an absolute path", d.BlockDevice)
+	case !d.isExisting() && d.Size == 0:
+		return errors.New("size is not set")
+	case d.isExisting() && d.Retain != "":
+		return errors.New("retain can't be set for the existing disks, they are never deleted")
+	case d.isExisting() && d.Encrypted:
+		return errors.New("encrypted can't be set for the existing disks, they are attached as is")
+	case d.Encrypted && d.Retain != "" && d.Retain != retainDelete:
+		return errors.New("retain can't be set for the encrypted disks, their passphrase is deleted on deprovision")
+	}
+
+	return validateRetain(d.Retain)
+}
+
+// Retain policies of the volumes of the disks on deprovision.
+const (
+	retainDelete   = "delete"
+	retainKeep     = "retain"
+	retainSnapshot = "snapshot-then-delete"
+)
+
+// validateRetain verifies the retain policy of a disk, an empty one is delete.
+func validateRetain(policy string) error {
+	switch policy {
+	case "", retainDelete, retainKeep, retainSnapshot:
+		return nil
+	default:
+		return fmt.Errorf("unknown retain policy %q", policy)
+	}
+}
+
+// minSnapshotInterval is the shortest interval of the snapshot schedules, the schedules are checked every minute.
+const minSnapshotInterval = time.Minute
+
+// snapshotSchedule takes snapshots of the running machine at a fixed interval, and keeps the last ones.
+//
+// It is stored in the domain metadata, where the snapshot scheduler reads it.
+type snapshotSchedule struct {
+	Interval string `yaml:"interval" xml:"interval,attr"`
+	Keep     uint   `yaml:"keep" xml:"keep,attr"`
+	Memory   bool   `yaml:"memory,omitempty" xml:"memory,attr,omitempty"`
+}
+
+// interval returns the interval between the snapshots.
+func (s snapshotSchedule) interval() (time.Duration, error) {
+	interval, err := time.ParseDuration(s.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval: %w", err)
+	}
+
+	return interval, nil
+}
+
+func (s snapshotSchedule) validate() error {
+	interval, err := s.interval()
+	if err != nil {
+		return err
+	}
+
+	if interval < minSnapshotInterval {
+		return fmt.Errorf("interval %s is shorter than %s", s.Interval, minSnapshotInterval)
+	}
+
+	if s.Keep == 0 {
+		return errors.New("keep must be at least 1")
+	}
+
+	return nil
+}
+
+// Disk driver cache, io, discard and detect zeroes modes, see https://libvirt.org/formatdomain.html#hard-drives-floppy-disks-cdroms.
+const (
+	diskCacheNone         = "none"
+	diskCacheWritethrough = "writethrough"
+	diskCacheWriteback    = "writeback"
+	diskCacheDirectSync   = "directsync"
+	diskCacheUnsafe       = "unsafe"
+
+	diskIONative  = "native"
+	diskIOThreads = "threads"
+	diskIOUring   = "io_uring"
+
+	diskDiscardUnmap  = "unmap"
+	diskDiscardIgnore = "ignore"
+
+	diskDetectZeroesOff   = "off"
+	diskDetectZeroesOn    = "on"
+	diskDetectZeroesUnmap = "unmap"
+)
+
+// diskDriver tunes the qemu driver of a disk.
+//
+// The zero value is the driver the disks had before it was configurable: no cache, native io and no discard.
+type diskDriver struct {
+	Cache        string `yaml:"cache,omitempty"`
+	IO           string `yaml:"io,omitempty"`
+	Discard      string `yaml:"discard,omitempty"`
+	DetectZeroes string `yaml:"detect_zeroes,omitempty"`
+	IOThreads    uint   `yaml:"iothreads,omitempty"`
+}
+
+// cache returns the cache mode of the disk, none by default.
+func (d diskDriver) cache() string {
+	if d.Cache == "" {
+		return diskCacheNone
+	}
+
+	return d.Cache
+}
+
+// io returns the io mode of the disk.
+//
+// It is native by default, unless the cache mode requires the host page cache, which native io bypasses.
+func (d diskDriver) io() string {
+	if d.IO != "" {
+		return d.IO
+	}
+
+	if d.bypassesPageCache() {
+		return diskIONative
+	}
+
+	return diskIOThreads
+}
+
+func (d diskDriver) bypassesPageCache() bool {
+	switch d.cache() {
+	case diskCacheNone, diskCacheDirectSync:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d diskDriver) validate() error {
+	if !slices.Contains([]string{diskCacheNone, diskCacheWritethrough, diskCacheWriteback, diskCacheDirectSync, diskCacheUnsafe}, d.cache()) {
+		return fmt.Errorf("unknown cache mode %q", d.Cache)
+	}
+
+	if !slices.Contains([]string{diskIONative, diskIOThreads, diskIOUring}, d.io()) {
+		return fmt.Errorf("unknown io mode %q", d.IO)
+	}
+
+	if d.io() == diskIONative && !d.bypassesPageCache() {
+		return fmt.Errorf("io mode %q requires the cache mode %q or %q", diskIONative, diskCacheNone, diskCacheDirectSync)
+	}
+
+	if !slices.Contains([]string{"", diskDiscardUnmap, diskDiscardIgnore}, d.Discard) {
+		return fmt.Errorf("unknown discard mode %q", d.Discard)
+	}
+
+	if !slices.Contains([]string{"", diskDetectZeroesOff, diskDetectZeroesOn, diskDetectZeroesUnmap}, d.DetectZeroes) {
+		return fmt.Errorf("unknown detect_zeroes mode %q", d.DetectZeroes)
+	}
+
+	if d.DetectZeroes == diskDetectZeroesUnmap && d.Discard != diskDiscardUnmap {
+		return fmt.Errorf("detect_zeroes %q requires the discard mode %q", diskDetectZeroesUnmap, diskDiscardUnmap)
+	}
+
+	return nil
+}
+
+// diskIOTune throttles the io of a disk, the zero value doesn't limit it.
+//
+// The limits are in bytes or operations per second, the _max ones are the bursts allowed for _max_length seconds.
+type diskIOTune struct {
+	TotalBytesSec          uint64 `yaml:"total_bytes_sec,omitempty"`
+	ReadBytesSec           uint64 `yaml:"read_bytes_sec,omitempty"`
+	WriteBytesSec          uint64 `yaml:"write_bytes_sec,omitempty"`
+	TotalIOPSSec           uint64 `yaml:"total_iops_sec,omitempty"`
+	ReadIOPSSec            uint64 `yaml:"read_iops_sec,omitempty"`
+	WriteIOPSSec           uint64 `yaml:"write_iops_sec,omitempty"`
+	TotalBytesSecMax       uint64 `yaml:"total_bytes_sec_max,omitempty"`
+	ReadBytesSecMax        uint64 `yaml:"read_bytes_sec_max,omitempty"`
+	WriteBytesSecMax       uint64 `yaml:"write_bytes_sec_max,omitempty"`
+	TotalIOPSSecMax        uint64 `yaml:"total_iops_sec_max,omitempty"`
+	ReadIOPSSecMax         uint64 `yaml:"read_iops_sec_max,omitempty"`
+	WriteIOPSSecMax        uint64 `yaml:"write_iops_sec_max,omitempty"`
+	TotalBytesSecMaxLength uint64 `yaml:"total_bytes_sec_max_length,omitempty"`
+	ReadBytesSecMaxLength  uint64 `yaml:"read_bytes_sec_max_length,omitempty"`
+	WriteBytesSecMaxLength uint64 `yaml:"write_bytes_sec_max_length,omitempty"`
+	TotalIOPSSecMaxLength  uint64 `yaml:"total_iops_sec_max_length,omitempty"`
+	ReadIOPSSecMaxLength   uint64 `yaml:"read_iops_sec_max_length,omitempty"`
+	WriteIOPSSecMaxLength  uint64 `yaml:"write_iops_sec_max_length,omitempty"`
+}
+
+// iotuneLimit is a limit of a disk, with its burst.
+type iotuneLimit struct {
+	name      string
+	rate      uint64
+	max       uint64
+	maxLength uint64
+}
+
+func (l iotuneLimit) isSet() bool {
+	return l.rate != 0 || l.max != 0 || l.maxLength != 0
+}
+
+// limits returns the total, read and write limits of the bytes, then the ones of the operations.
+func (t diskIOTune) limits() []iotuneLimit {
+	return []iotuneLimit{
+		{"total_bytes_sec", t.TotalBytesSec, t.TotalBytesSecMax, t.TotalBytesSecMaxLength},
+		{"read_bytes_sec", t.ReadBytesSec, t.ReadBytesSecMax, t.ReadBytesSecMaxLength},
+		{"write_bytes_sec", t.WriteBytesSec, t.WriteBytesSecMax, t.WriteBytesSecMaxLength},
+		{"total_iops_sec", t.TotalIOPSSec, t.TotalIOPSSecMax, t.TotalIOPSSecMaxLength},
+		{"read_iops_sec", t.ReadIOPSSec, t.ReadIOPSSecMax, t.ReadIOPSSecMaxLength},
+		{"write_iops_sec", t.WriteIOPSSec, t.WriteIOPSSecMax, t.WriteIOPSSecMaxLength},
+	}
+}
+
+// validate verifies the limits the way qemu does, so an invalid one doesn't fail the start of the domain.
+func (t diskIOTune) validate() error {
+	limits := t.limits()
+
+	for _, limit := range limits {
+		switch {
+		case limit.max != 0 && limit.rate == 0:
+			return fmt.Errorf("%s_max requires %s", limit.name, limit.name)
+		case limit.max != 0 && limit.max < limit.rate:
+			return fmt.Errorf("%s_max is lower than %s", limit.name, limit.name)
+		case limit.maxLength != 0 && limit.max == 0:
+			return fmt.Errorf("%s_max_length requires %s_max", limit.name, limit.name)
+		}
+	}
+
+	for group := range slices.Chunk(limits, 3) {
+		total, read, write := group[0], group[1], group[2]
+
+		if total.isSet() && (read.isSet() || write.isSet()) {
+			return fmt.Errorf("%s can't be combined with %s and %s", total.name, read.name, write.name)
+		}
+	}
+
+	return nil
+}
+
+// Host selector operators.
+const (
+	selectorOpIn           = "In"
+	selectorOpNotIn        = "NotIn"
+	selectorOpExists       = "Exists"
+	selectorOpDoesNotExist = "DoesNotExist"
+)
+
+// hostSelector limits the placement to the hosts with matching labels.
+//
+// All labels and expressions must match, like Kubernetes label selectors.
+type hostSelector struct {
+	MatchLabels      map[string]string `yaml:"match_labels,omitempty"`
+	MatchExpressions []matchExpression `yaml:"match_expressions,omitempty"`
+}
+
+type matchExpression struct {
+	Key      string   `yaml:"key"`
+	Operator string   `yaml:"operator"`
+	Values   []string `yaml:"values,omitempty"`
+}
+
+func (s *hostSelector) validate() error {
+	for i, expr := range s.MatchExpressions {
+		if expr.Key == "" {
+			return fmt.Errorf("match_expressions[%d]: key is not set", i)
+		}
+
+		switch expr.Operator {
+		case selectorOpIn, selectorOpNotIn:
+			if len(expr.Values) == 0 {
+				return fmt.Errorf("match_expressions[%d]: operator %s requires values", i, expr.Operator)
+			}
+		case selectorOpExists, selectorOpDoesNotExist:
+			if len(expr.Values) > 0 {
+				return fmt.Errorf("match_expressions[%d]: operator %s doesn't take values", i, expr.Operator)
+			}
+		default:
+			return fmt.Errorf("match_expressions[%d]: unknown operator %q", i, expr.Operator)
+		}
+	}
+
+	return nil
+}
+
+func (s *hostSelector) matches(labels map[string]string) bool {
+	for key, value := range s.MatchLabels {
+		if actual, ok := labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+
+	for _, expr := range s.MatchExpressions {
+		value, ok := labels[expr.Key]
+
+		var matches bool
+
+		switch expr.Operator {
+		case selectorOpIn:
+			matches = ok && slices.Contains(expr.Values, value)
+		case selectorOpNotIn:
+			matches = !ok || !slices.Contains(expr.Values, value)
+		case selectorOpExists:
+			matches = ok
+		case selectorOpDoesNotExist:
+			matches = !ok
+		}
+
+		if !matches {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Placement rule types and scopes.
+const (
+	placementRuleAffinity     = "affinity"
+	placementRuleAntiAffinity = "anti_affinity"
+
+	placementScopeCluster    = "cluster"
+	placementScopeMachineSet = "machine_set"
+)
+
+// placementRule places the machine together with, or apart from, the other machines of its cluster or machine set.
+type placementRule struct {
+	Type     string `yaml:"type"`
+	Scope    string `yaml:"scope"`
+	Required bool   `yaml:"required,omitempty"`
 }
 
 type networkInterface struct {
@@ -5,6 +5,7 @@
 package provider
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
@@ -14,6 +15,8 @@ import (
 	"github.com/digitalocean/go-libvirt"
 	"github.com/siderolabs/omni/client/pkg/infra/provision"
 	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/resources"
@@ -21,13 +24,41 @@ import (
 
 // Deprovision implements infra.Provisioner.
 func (p *Provisioner) Deprovision(ctx context.Context, logger *zap.Logger, machine *resources.Machine, machineRequest *infra.MachineRequest) error {
+	requestID := machineRequest.Metadata().ID()
+	start := time.Now()
+
+	opts := []trace.SpanStartOption{trace.WithNewRoot(), trace.WithAttributes(attribute.String(attrRequestID, requestID))}
+
+	// the deprovisioning is a trace of its own, linked to the provisioning of the request if it is still traced
+	if provisioning := p.spans.end(requestID, nil); provisioning.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: provisioning}))
+	}
+
+	ctx, span := tracer().Start(ctx, "deprovision", opts...)
+
+	err := p.deprovision(ctx, logger, machine, machineRequest)
+
+	endSpan(span, err)
+	p.metrics.observeDeprovision(requestID, start, err)
+
+	return err
+}
+
+func (p *Provisioner) deprovision(ctx context.Context, logger *zap.Logger, machine *resources.Machine, machineRequest *infra.MachineRequest) error {
 	vmName := machineRequest.Metadata().ID()
 
 	if vmName == "" {
 		return provision.NewRetryError(errors.New("empty vmName"), time.Second*10)
 	}
 
-	if err := removeDomain(p.libvirtClient, vmName, logger); err != nil {
+	p.scheduler.Release(vmName)
+
+	lc, err := p.client(ctx, machine.TypedSpec().Value.Host)
+	if err != nil {
+		return err
+	}
+
+	if err = removeDomain(lc, vmName, logger); err != nil {
 		return err
 	}
 
@@ -43,23 +74,23 @@ func (p *Provisioner) Deprovision(ctx context.Context, logger *zap.Logger, machi
 	if volName == "" {
 		logger.Warn("vol name is empty, skip main disk removal")
 	} else {
-		if err := removeVolMain(p.libvirtClient, volName, poolName, logger); err != nil {
+		if err := removeVol(lc, poolName, volName, machine.TypedSpec().Value.VmVolRetain, machine.Metadata().Created(), logger); err != nil {
 			return err
 		}
 	}
 
-	if err := removeVolAdditionalDisks(p.libvirtClient, machine, poolName, logger); err != nil {
+	if err := removeVolAdditionalDisks(lc, machine, poolName, logger); err != nil {
 		return fmt.Errorf("remove additional volumes: %w", err)
 	}
 
-	if err := removeVolCidata(p.libvirtClient, machine, poolName, logger); err != nil {
+	if err := removeVolCidata(lc, machine, poolName, logger); err != nil {
 		return fmt.Errorf("remove cidata volume: %w", err)
 	}
 
 	return nil
 }
 
-func removeDomain(lc *libvirt.Libvirt, vmName string, logger *zap.Logger) error {
+func removeDomain(lc LibvirtClient, vmName string, logger *zap.Logger) error {
 	dom, err := lc.DomainLookupByName(vmName)
 	if err != nil {
 		if strings.Contains(err.Error(), "Domain not found") {
@@ -92,6 +123,11 @@ func removeDomain(lc *libvirt.Libvirt, vmName string, logger *zap.Logger) error
 			return provision.NewRetryInterval(time.Second * 10)
 		case int32(libvirt.DomainShutoff):
 			{
+				// the domain can't be undefined with snapshots
+				if err = removeSnapshots(lc, dom, logger); err != nil {
+					return err
+				}
+
 				// in libvirt, "undefine" translates to "delete a VM"
 				err = lc.DomainUndefine(dom)
 				if err != nil {
@@ -108,51 +144,30 @@ func removeDomain(lc *libvirt.Libvirt, vmName string, logger *zap.Logger) error
 	return nil
 }
 
-func removeVolMain(lc *libvirt.Libvirt, volName, poolName string, logger *zap.Logger) error {
-	vol, err := getVol(lc, poolName, volName)
-	if err != nil {
-		if !errors.Is(err, errVolNoExist) {
-			return fmt.Errorf("fetching volume: %w", err)
-		}
-
-		logger.Info("volume was removed already: " + volName)
-	} else {
-		err = lc.StorageVolDelete(vol, 0)
-		if err != nil {
-			return fmt.Errorf("deleting volume: %w", err)
-		}
-
-		logger.Info("removed volume: " + volName)
-	}
-
-	return nil
-}
-
-func removeVolAdditionalDisks(lc *libvirt.Libvirt, machine *resources.Machine, poolName string, logger *zap.Logger) error {
+func removeVolAdditionalDisks(lc LibvirtClient, machine *resources.Machine, poolName string, logger *zap.Logger) error {
 	for _, additionalDisk := range machine.TypedSpec().Value.AdditionalDisks {
-		additionalVolume, err := getVol(lc, poolName, additionalDisk.VolName)
-		if err != nil {
-			if !errors.Is(err, errVolNoExist) {
-				return fmt.Errorf("fetching volume %s: %w", additionalDisk.VolName, err)
-			}
-
-			logger.Info("volume was removed already: " + additionalDisk.VolName)
+		if additionalDisk.Existing {
+			logger.Info("keeping existing disk: " + cmp.Or(additionalDisk.VolName, additionalDisk.BlockDevice))
 
 			continue
 		}
 
-		err = lc.StorageVolDelete(additionalVolume, 0)
-		if err != nil {
-			return fmt.Errorf("deleting volume: %w", err)
+		if err := removeVol(lc, poolName, additionalDisk.VolName, additionalDisk.Retain, machine.Metadata().Created(), logger); err != nil {
+			return err
 		}
 
-		logger.Info("removed volume: " + additionalDisk.VolName)
+		// the secret goes after the volume, which stays readable if it can't be deleted
+		if additionalDisk.SecretUuid != "" {
+			if err := removeVolumeSecret(lc, additionalDisk.SecretUuid, logger); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
-func removeVolCidata(lc *libvirt.Libvirt, machine *resources.Machine, poolName string, logger *zap.Logger) error {
+func removeVolCidata(lc LibvirtClient, machine *resources.Machine, poolName string, logger *zap.Logger) error {
 	if cidataVolName := machine.TypedSpec().Value.CidataVolName; cidataVolName != "" {
 		cidataVol, err := getVol(lc, poolName, cidataVolName)
 		if err != nil {
@@ -0,0 +1,306 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/libvirtfake"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/resources"
+)
+
+func TestDeprovision(t *testing.T) {
+	const withDisks = testProviderData + `
+additional_disks:
+  - type: nvme
+    size: 20
+  - type: sata
+    size: 30
+`
+
+	provisioned := func(t *testing.T, env *testEnv) {
+		env.runSteps(t, "startVM")
+	}
+
+	for _, tt := range []struct {
+		setup func(t *testing.T, env *testEnv)
+		// called after each retry
+		retried func(env *testEnv)
+		check   func(t *testing.T, env *testEnv)
+		name    string
+		wantErr string
+		// number of retries expected before Deprovision succeeds
+		retries int
+	}{
+		{
+			name:    "running domain",
+			setup:   provisioned,
+			retries: 1,
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, 1, env.lv.Calls("DomainDestroy"))
+				assert.Equal(t, 1, env.lv.Calls("DomainUndefine"))
+			},
+		},
+		{
+			name: "stopped domain",
+			setup: func(t *testing.T, env *testEnv) {
+				env.runSteps(t, "createVM")
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Zero(t, env.lv.Calls("DomainDestroy"))
+			},
+		},
+		{
+			name: "shutting down domain",
+			setup: func(t *testing.T, env *testEnv) {
+				provisioned(t, env)
+
+				env.lv.SetDomainState(testRequestID, libvirt.DomainShutdown)
+			},
+			retries: 2,
+			retried: func(env *testEnv) {
+				// the guest ignored the shutdown request
+				if dom, ok := env.lv.Domain(testRequestID); ok && dom.State == libvirt.DomainShutdown {
+					env.lv.SetDomainState(testRequestID, libvirt.DomainRunning)
+				}
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, 1, env.lv.Calls("DomainDestroy"))
+			},
+		},
+		{
+			name: "canceled during provisioning",
+			setup: func(t *testing.T, env *testEnv) {
+				env.runSteps(t, "provisionAdditionalDisks")
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, 3, env.lv.Calls("StorageVolDelete"))
+			},
+		},
+		{
+			name: "nothing provisioned",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Zero(t, env.lv.Calls("StorageVolDelete"))
+			},
+		},
+		{
+			name: "resources removed out of band",
+			setup: func(t *testing.T, env *testEnv) {
+				env.runSteps(t, "createVM")
+
+				// drop everything from libvirt, keeping the machine state intact
+				env.lv = libvirtfake.New(testPool)
+				env.provisioner = env.newProvisioner(nil)
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Zero(t, env.lv.Calls("StorageVolDelete"))
+			},
+		},
+		{
+			name: "empty pool name",
+			setup: func(t *testing.T, env *testEnv) {
+				provisioned(t, env)
+
+				env.spec().Value.PoolName = ""
+			},
+			retries: 1,
+			check: func(t *testing.T, env *testEnv) {
+				assert.Len(t, env.lv.Volumes(testPool), 4)
+			},
+		},
+		{
+			name: "volume delete failure",
+			setup: func(t *testing.T, env *testEnv) {
+				env.runSteps(t, "createVM")
+
+				env.lv.InjectError("StorageVolDelete", 1, errors.New("device or resource busy"))
+			},
+			wantErr: "remove additional volumes: deleting volume: device or resource busy",
+		},
+		{
+			name: "destroy failure",
+			setup: func(t *testing.T, env *testEnv) {
+				provisioned(t, env)
+
+				env.lv.InjectError("DomainDestroy", 0, errors.New("timed out"))
+			},
+			wantErr: "destroy domain: timed out",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, withDisks)
+
+			if tt.setup != nil {
+				tt.setup(t, env)
+			}
+
+			deprovision := func() error {
+				return env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request)
+			}
+
+			var err error
+
+			for range tt.retries {
+				err = deprovision()
+				require.Error(t, err)
+				require.True(t, isRetry(err), "expected retry error, got %v", err)
+
+				if tt.retried != nil {
+					tt.retried(env)
+				}
+			}
+
+			err = deprovision()
+
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+
+				// the next attempt picks up where the failed one stopped
+				err = deprovision()
+				for isRetry(err) {
+					err = deprovision()
+				}
+			}
+
+			require.NoError(t, err)
+
+			if tt.check != nil {
+				tt.check(t, env)
+			}
+
+			if env.spec().Value.PoolName != "" {
+				assert.Empty(t, env.lv.Volumes(testPool))
+			}
+
+			assert.Empty(t, env.lv.Domains())
+
+			// deprovisioning is idempotent
+			require.NoError(t, deprovision())
+		})
+	}
+}
+
+func TestDeprovisionRetain(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, testProviderData+`
+retain: snapshot-then-delete
+additional_disks:
+  - type: nvme
+    size: 20
+    retain: retain
+  - type: sata
+    size: 30
+    retain: delete
+`)
+
+	env.machine.Metadata().SetCreated(time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC))
+	env.runSteps(t, "createVM")
+
+	deprovision := func() error {
+		return env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request)
+	}
+
+	primaryName := testRequestID + ".qcow2"
+	snapshotName := primaryName + ".snapshot-20261018T123000Z"
+	retainedName := testRequestID + "-0-nvme.qcow2.retained-20261018T123000Z"
+
+	// the primary disk volume is copied, but not deleted
+	env.lv.InjectError("StorageVolDelete", 0, errors.New("device or resource busy"))
+	require.ErrorContains(t, deprovision(), "deleting volume: device or resource busy")
+
+	// the copy of the failed attempt is kept
+	require.NoError(t, deprovision())
+	assert.Equal(t, 2, env.lv.Calls("StorageVolCreateXMLFrom"))
+
+	// the original volumes are deleted
+	assert.ElementsMatch(t, []string{snapshotName, retainedName}, env.lv.Volumes(testPool))
+
+	snapshot, ok := env.lv.Volume(testPool, snapshotName)
+	require.True(t, ok)
+	assert.Equal(t, "qcow2", snapshot.Format)
+	assert.NotEmpty(t, snapshot.Data, "the volume is copied with the image")
+
+	retained, ok := env.lv.Volume(testPool, retainedName)
+	require.True(t, ok)
+	assert.Equal(t, "qcow2", retained.Format)
+	assert.Equal(t, 20*provider.GiB, retained.Capacity)
+
+	// the kept volumes are not named like the volumes of a machine request
+	orphans, err := env.provisioner.OrphanVolumes(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+
+	require.NoError(t, deprovision())
+	assert.Len(t, env.lv.Volumes(testPool), 2)
+
+	// a later machine request with the same ID creates its own volumes
+	env.machine = resources.NewMachine("", testRequestID)
+
+	env.runSteps(t, "provisionPrimaryDisk")
+	assert.ElementsMatch(t, []string{primaryName, snapshotName, retainedName}, env.lv.Volumes(testPool))
+}
+
+func TestDeprovisionRetainRawVolume(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withStoragePool(testLogicalPool.Name)+"retain: retain\n")
+	env.lv.DefinePool(testLogicalPool)
+
+	env.machine.Metadata().SetCreated(time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC))
+	env.runSteps(t, "createVM")
+
+	require.NoError(t, env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request))
+
+	// the retained copy keeps the format of the volume
+	retained, ok := env.lv.Volume(testLogicalPool.Name, testRequestID+".raw.retained-20261018T123000Z")
+	require.True(t, ok)
+	assert.Equal(t, "raw", retained.Format)
+
+	_, ok = env.lv.Volume(testLogicalPool.Name, testRequestID+".raw")
+	assert.False(t, ok)
+}
+
+func TestDeprovisionWithoutRecordedHost(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, testProviderData)
+	env.runSteps(t, "createVM")
+
+	// provisioned before multiple hosts were supported
+	env.spec().Value.Host = ""
+
+	hosts := env.hosts()
+
+	deprovision := func() error {
+		return env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request)
+	}
+
+	// the host of the top level URI isn't configured anymore
+	env.provisioner.SetHosts(hosts[1:])
+	require.EqualError(t, deprovision(), `the machine has no libvirt host recorded, and no libvirt host named "default" is configured`)
+
+	// the order of the hosts doesn't matter
+	env.provisioner.SetHosts([]provider.Host{hosts[1], hosts[0]})
+	require.NoError(t, deprovision())
+	assert.Empty(t, env.lv.Domains())
+}
+
+func TestDeprovisionEmptyRequestID(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	err := env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, infra.NewMachineRequest(""))
+	require.Error(t, err)
+	assert.True(t, isRetry(err))
+}
@@ -0,0 +1,335 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/api/specs"
+)
+
+// buildDomain assembles the domain of the machine from the provider data and the volumes recorded in the machine state.
+//
+// The pools are the storage pools of the volumes of the machine by name, see machinePools.
+//
+//nolint:gocognit,gocyclo,cyclop,maintidx
+func buildDomain(vmName string, owner domainOwner, data Data, pools map[string]storagePool, spec *specs.MachineSpec) (libvirtxml.Domain, error) {
+	pool, ok := pools[spec.PoolName]
+	if !ok {
+		return libvirtxml.Domain{}, fmt.Errorf("storage pool %q of the machine is unknown", spec.PoolName)
+	}
+
+	if data.Snapshots != nil {
+		if err := data.Snapshots.validate(); err != nil {
+			return libvirtxml.Domain{}, fmt.Errorf("snapshots: %w", err)
+		}
+
+		owner.Snapshots = data.Snapshots
+	}
+
+	// the iothreads dedicated to the disks, numbered from 1
+	var iothreads uint
+
+	// assemble primary disk volume
+
+	primaryDriver, err := domainDiskDriver(data.DiskDriver, pool.diskFormat(), "virtio", &iothreads)
+	if err != nil {
+		return libvirtxml.Domain{}, fmt.Errorf("disk_driver: %w", err)
+	}
+
+	if err = data.DiskIOTune.validate(); err != nil {
+		return libvirtxml.Domain{}, fmt.Errorf("disk_iotune: %w", err)
+	}
+
+	disks := []libvirtxml.DomainDisk{
+		{
+			Device: "disk",
+			Driver: primaryDriver,
+			IOTune: data.DiskIOTune.domainIOTune(),
+			Source: pool.diskSource(spec.VmVolName),
+			Target: &libvirtxml.DomainDiskTarget{
+				Dev: "vda",
+				Bus: "virtio",
+			},
+		},
+	}
+
+	// assemble additional disk volumes
+
+	targets := newDiskTargets()
+
+	for idx, diskSpec := range spec.AdditionalDisks {
+		target, address, err := targets.next(diskSpec.Type)
+		if err != nil {
+			return libvirtxml.Domain{}, fmt.Errorf("additional_disks[%d]: %w", idx, err)
+		}
+
+		serial, wwn := diskSpec.Serial, diskSpec.Wwn
+		if serial == "" {
+			// provisioned by an older version, which didn't record the disk identity
+			serial, wwn = diskIdentity(spec.Uuid, idx)
+		}
+
+		// only the SCSI disks have a WWN in qemu
+		if target.Bus != "scsi" {
+			wwn = ""
+		}
+
+		// the additional disks are provisioned in the order of the provider data
+		var diskData additionalDisk
+
+		if idx < len(data.AdditionalDisks) {
+			diskData = data.AdditionalDisks[idx]
+		}
+
+		source, format := pool.diskSource(diskSpec.VolName), pool.diskFormat()
+
+		switch {
+		case diskSpec.BlockDevice != "":
+			source = blockDiskSource(diskSpec.BlockDevice)
+		case diskSpec.Existing:
+			volumePool, ok := pools[diskSpec.PoolName]
+			if !ok {
+				return libvirtxml.Domain{}, fmt.Errorf("storage pool %q of additional disk %q is unknown", diskSpec.PoolName, diskSpec.VolName)
+			}
+
+			source = volumePool.diskSource(diskSpec.VolName)
+		}
+
+		if diskSpec.Format != "" {
+			format = diskSpec.Format
+		}
+
+		if diskSpec.SecretUuid != "" {
+			source.Encryption = diskEncryption(diskSpec.SecretUuid)
+		}
+
+		driver, err := domainDiskDriver(diskData.Driver, format, target.Bus, &iothreads)
+		if err != nil {
+			return libvirtxml.Domain{}, fmt.Errorf("additional_disks[%d].driver: %w", idx, err)
+		}
+
+		if err = diskData.IOTune.validate(); err != nil {
+			return libvirtxml.Domain{}, fmt.Errorf("additional_disks[%d].iotune: %w", idx, err)
+		}
+
+		domainDisk := libvirtxml.DomainDisk{
+			Device:  "disk",
+			Driver:  driver,
+			IOTune:  diskData.IOTune.domainIOTune(),
+			Source:  source,
+			Target:  target,
+			Serial:  serial,
+			WWN:     wwn,
+			Address: address,
+		}
+
+		disks = append(disks, domainDisk)
+	}
+
+	if err = targets.checkPCIe(len(data.NetworkInterfaces)); err != nil {
+		return libvirtxml.Domain{}, err
+	}
+
+	// add cidata ISO as cdrom, if present
+	cidataVolName := spec.CidataVolName
+	if cidataVolName != "" {
+		cidataDisk := libvirtxml.DomainDisk{
+			Device: "cdrom",
+			Driver: &libvirtxml.DomainDiskDriver{
+				Name: "qemu",
+				Type: "raw",
+			},
+			Source: pool.diskSource(cidataVolName),
+			Target: &libvirtxml.DomainDiskTarget{
+				Dev: "sda",
+				Bus: "sata",
+			},
+			ReadOnly: &libvirtxml.DomainDiskReadOnly{},
+		}
+
+		disks = append(disks, cidataDisk)
+	}
+
+	// assemble network interfaces
+
+	var networkInterfaces []libvirtxml.DomainInterface
+
+	for _, ifaceData := range data.NetworkInterfaces {
+		iface := libvirtxml.DomainInterface{
+			Model: &libvirtxml.DomainInterfaceModel{
+				Type: ifaceData.Driver,
+			},
+			Source: &libvirtxml.DomainInterfaceSource{
+				Network: &libvirtxml.DomainInterfaceSourceNetwork{
+					Network: ifaceData.NetworkName,
+				},
+			},
+		}
+
+		networkInterfaces = append(networkInterfaces, iface)
+	}
+
+	// generate libvirt XML spec
+	// https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainCreateXML
+	return libvirtxml.Domain{
+		Type: "kvm",
+		Name: vmName,
+		// this one is really important, it has to match the UUID in omni
+		UUID: spec.Uuid,
+		Metadata: &libvirtxml.DomainMetadata{
+			XML: owner.metadata(),
+		},
+		Memory: &libvirtxml.DomainMemory{
+			Unit:  "MiB",
+			Value: data.Memory,
+		},
+		VCPU: &libvirtxml.DomainVCPU{
+			Placement: "static",
+			Value:     data.Cores,
+		},
+		IOThreads: iothreads,
+		OS: &libvirtxml.DomainOS{
+			Type: &libvirtxml.DomainOSType{
+				Arch:    "x86_64",
+				Machine: "q35",
+				Type:    "hvm",
+			},
+			BootDevices: []libvirtxml.DomainBootDevice{
+				{Dev: "hd"},
+			},
+		},
+		CPU: &libvirtxml.DomainCPU{
+			Mode: "host-passthrough",
+		},
+		Features: &libvirtxml.DomainFeatureList{
+			ACPI: &libvirtxml.DomainFeature{},
+			APIC: &libvirtxml.DomainFeatureAPIC{},
+		},
+		Devices: &libvirtxml.DomainDeviceList{
+			Channels: []libvirtxml.DomainChannel{
+				{
+					Source: &libvirtxml.DomainChardevSource{
+						UNIX: &libvirtxml.DomainChardevSourceUNIX{
+							Mode: "bind",
+							Path: "/var/lib/libvirt/qemu/channel/target/omni-node-001.org.qemu.guest_agent.0",
+						},
+					},
+					Target: &libvirtxml.DomainChannelTarget{
+						VirtIO: &libvirtxml.DomainChannelTargetVirtIO{
+							Name: "org.qemu.guest_agent.0",
+						},
+					},
+				},
+			},
+			Emulator:    "", // let libvirt pick qemu-system-x86_64
+			Controllers: targets.controllers(),
+			Disks:       disks,
+			Interfaces:  networkInterfaces,
+			MemBalloon: &libvirtxml.DomainMemBalloon{
+				Model: "virtio",
+			},
+			Serials: []libvirtxml.DomainSerial{
+				// { Target: &libvirtxml.DomainSerialTarget{Type: "pty",}},
+			},
+			Consoles: []libvirtxml.DomainConsole{
+				{
+					Target: &libvirtxml.DomainConsoleTarget{
+						Type: "serial",
+					},
+				},
+				// {Target: &libvirtxml.DomainConsoleTarget{Type: "virtio"}},
+			},
+			Videos: []libvirtxml.DomainVideo{
+				{
+					Model: libvirtxml.DomainVideoModel{
+						Type: "virtio",
+						Resolution: &libvirtxml.DomainVideoResolution{
+							X: 1920,
+							Y: 1080,
+						},
+					},
+				},
+			},
+			Graphics: []libvirtxml.DomainGraphic{
+				{
+					Spice: &libvirtxml.DomainGraphicSpice{
+						AutoPort: "yes",
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// domainDiskDriver returns the qemu driver of a disk on the bus.
+//
+// The iothreads of the disk are the next ones after the given count of the iothreads of the domain, which is updated.
+func domainDiskDriver(driver diskDriver, format, bus string, iothreads *uint) (*libvirtxml.DomainDiskDriver, error) {
+	if err := driver.validate(); err != nil {
+		return nil, err
+	}
+
+	domainDriver := &libvirtxml.DomainDiskDriver{
+		Name:        "qemu",
+		Type:        format,
+		Cache:       driver.cache(),
+		IO:          driver.io(),
+		Discard:     driver.Discard,
+		DetectZeros: driver.DetectZeroes,
+	}
+
+	switch {
+	case driver.IOThreads == 0:
+	case bus != "virtio":
+		return nil, fmt.Errorf("iothreads are only supported on the virtio bus, not on %s", bus)
+	case driver.IOThreads == 1:
+		*iothreads++
+
+		iothread := *iothreads
+		domainDriver.IOThread = &iothread
+	default:
+		// the queues of the disk are spread over its iothreads, which requires libvirt 10.0 or later
+		domainDriver.IOThreads = &libvirtxml.DomainDiskIOThreads{}
+
+		for range driver.IOThreads {
+			*iothreads++
+
+			domainDriver.IOThreads.IOThread = append(domainDriver.IOThreads.IOThread, libvirtxml.DomainDiskIOThread{ID: *iothreads})
+		}
+	}
+
+	return domainDriver, nil
+}
+
+// domainIOTune returns the iotune of the disk, nil if it isn't limited.
+func (t diskIOTune) domainIOTune() *libvirtxml.DomainDiskIOTune {
+	if t == (diskIOTune{}) {
+		return nil
+	}
+
+	return &libvirtxml.DomainDiskIOTune{
+		TotalBytesSec:          t.TotalBytesSec,
+		ReadBytesSec:           t.ReadBytesSec,
+		WriteBytesSec:          t.WriteBytesSec,
+		TotalIopsSec:           t.TotalIOPSSec,
+		ReadIopsSec:            t.ReadIOPSSec,
+		WriteIopsSec:           t.WriteIOPSSec,
+		TotalBytesSecMax:       t.TotalBytesSecMax,
+		ReadBytesSecMax:        t.ReadBytesSecMax,
+		WriteBytesSecMax:       t.WriteBytesSecMax,
+		TotalIopsSecMax:        t.TotalIOPSSecMax,
+		ReadIopsSecMax:         t.ReadIOPSSecMax,
+		WriteIopsSecMax:        t.WriteIOPSSecMax,
+		TotalBytesSecMaxLength: t.TotalBytesSecMaxLength,
+		ReadBytesSecMaxLength:  t.ReadBytesSecMaxLength,
+		WriteBytesSecMaxLength: t.WriteBytesSecMaxLength,
+		TotalIopsSecMaxLength:  t.TotalIOPSSecMaxLength,
+		ReadIopsSecMaxLength:   t.ReadIOPSSecMaxLength,
+		WriteIopsSecMaxLength:  t.WriteIOPSSecMaxLength,
+	}
+}
@@ -0,0 +1,246 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+func TestDiskDriverDefaults(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withStoragePool(testPool))
+	env.runSteps(t, "createVM")
+
+	for _, disk := range domainDisks(t, env.lv)[:2] {
+		assert.Equal(t, &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2", Cache: "none", IO: "native"}, disk.Driver)
+	}
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+	assert.Zero(t, dom.Definition.IOThreads)
+}
+
+func TestDiskDriver(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, testProviderData+`
+disk_driver:
+  discard: unmap
+  detect_zeroes: unmap
+  iothreads: 2
+additional_disks:
+  - type: nvme
+    size: 20
+    driver:
+      cache: writeback
+`)
+	env.runSteps(t, "createVM")
+
+	disks := domainDisks(t, env.lv)
+
+	assert.Equal(t, &libvirtxml.DomainDiskDriver{
+		Name:        "qemu",
+		Type:        "qcow2",
+		Cache:       "none",
+		IO:          "native",
+		Discard:     "unmap",
+		DetectZeros: "unmap",
+		IOThreads: &libvirtxml.DomainDiskIOThreads{
+			IOThread: []libvirtxml.DomainDiskIOThread{{ID: 1}, {ID: 2}},
+		},
+	}, disks[0].Driver)
+
+	// native io bypasses the host page cache, the cached disks default to threads
+	assert.Equal(t, &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2", Cache: "writeback", IO: "threads"}, disks[1].Driver)
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+	assert.Equal(t, uint(2), dom.Definition.IOThreads)
+}
+
+func TestDiskIOTune(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, testProviderData+`
+disk_iotune:
+  total_bytes_sec: 104857600
+  total_iops_sec: 1000
+  total_iops_sec_max: 5000
+  total_iops_sec_max_length: 60
+additional_disks:
+  - type: nvme
+    size: 20
+    iotune:
+      read_bytes_sec: 52428800
+      write_bytes_sec: 10485760
+`)
+	env.runSteps(t, "createVM")
+
+	disks := domainDisks(t, env.lv)
+
+	assert.Equal(t, &libvirtxml.DomainDiskIOTune{
+		TotalBytesSec:         104857600,
+		TotalIopsSec:          1000,
+		TotalIopsSecMax:       5000,
+		TotalIopsSecMaxLength: 60,
+	}, disks[0].IOTune)
+	assert.Equal(t, &libvirtxml.DomainDiskIOTune{
+		ReadBytesSec:  52428800,
+		WriteBytesSec: 10485760,
+	}, disks[1].IOTune)
+	assert.Nil(t, disks[2].IOTune)
+}
+
+func TestDiskBuses(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, testProviderData+`
+additional_disks:
+  - type: sata
+    size: 10
+  - type: virtio-scsi
+    size: 10
+  - type: virtio-blk
+    size: 10
+    driver:
+      iothreads: 1
+  - type: nvme
+    size: 10
+  - type: sata
+    size: 10
+  - type: virtio-scsi
+    size: 10
+`)
+	env.runSteps(t, "createVM")
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+
+	disks := dom.Definition.Devices.Disks
+	require.Len(t, disks, 8)
+
+	type target struct {
+		unit     *uint
+		dev, bus string
+		wwn      bool
+	}
+
+	unit := func(u uint) *uint { return &u }
+
+	targets := make([]target, 0, len(disks))
+
+	for _, disk := range disks {
+		tgt := target{dev: disk.Target.Dev, bus: disk.Target.Bus, wwn: disk.WWN != ""}
+
+		if disk.Address != nil {
+			tgt.unit = disk.Address.Drive.Unit
+		}
+
+		targets = append(targets, tgt)
+	}
+
+	// the sata and scsi disks share the sd names, after the cidata cdrom on sda
+	assert.Equal(t, []target{
+		{dev: "vda", bus: "virtio"},
+		{dev: "sdb", bus: "sata", unit: unit(1)},
+		{dev: "sdc", bus: "scsi", unit: unit(0), wwn: true},
+		{dev: "vdb", bus: "virtio"},
+		{dev: "nvme0n1", bus: "nvme"},
+		{dev: "sdd", bus: "sata", unit: unit(2)},
+		{dev: "sde", bus: "scsi", unit: unit(1), wwn: true},
+		{dev: "sda", bus: "sata"},
+	}, targets)
+
+	assert.Equal(t, env.spec().Value.AdditionalDisks[1].Wwn, disks[2].WWN)
+	assert.Equal(t, uint(1), dom.Definition.IOThreads)
+
+	require.Len(t, dom.Definition.Devices.Controllers, 1)
+	assert.Equal(t, "scsi", dom.Definition.Devices.Controllers[0].Type)
+	assert.Equal(t, "virtio-scsi", dom.Definition.Devices.Controllers[0].Model)
+}
+
+func TestDiskTuningErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{
+			name:     "unknown cache mode",
+			data:     "disk_driver:\n  cache: fast\n",
+			expected: `disk_driver: unknown cache mode "fast"`,
+		},
+		{
+			name:     "native io with the page cache",
+			data:     "disk_driver:\n  cache: writeback\n  io: native\n",
+			expected: `disk_driver: io mode "native" requires the cache mode "none" or "directsync"`,
+		},
+		{
+			name:     "detect zeroes unmap without discard",
+			data:     "disk_driver:\n  detect_zeroes: unmap\n",
+			expected: `disk_driver: detect_zeroes "unmap" requires the discard mode "unmap"`,
+		},
+		{
+			name:     "iothreads on nvme",
+			data:     "additional_disks:\n  - type: nvme\n    size: 20\n    driver:\n      iothreads: 1\n",
+			expected: "additional_disks[0].driver: iothreads are only supported on the virtio bus, not on nvme",
+		},
+		{
+			name:     "too many sata disks",
+			data:     "additional_disks:\n" + strings.Repeat("  - type: sata\n    size: 10\n", 6),
+			expected: "additional_disks[5]: more than 5 sata disks, the q35 machine type has 6 sata ports and the first one is used by the cidata cdrom",
+		},
+		{
+			name:     "too many PCIe disks",
+			data:     "additional_disks:\n" + strings.Repeat("  - type: virtio-blk\n    size: 10\n", 114) + strings.Repeat("  - type: nvme\n    size: 10\n", 114),
+			expected: "the domain has 233 PCIe devices, more than the 232 root ports of the q35 machine type",
+		},
+		{
+			name:     "iothreads on virtio-scsi",
+			data:     "additional_disks:\n  - type: virtio-scsi\n    size: 20\n    driver:\n      iothreads: 1\n",
+			expected: "additional_disks[0].driver: iothreads are only supported on the virtio bus, not on scsi",
+		},
+		{
+			name:     "burst without limit",
+			data:     "disk_iotune:\n  read_iops_sec_max: 100\n",
+			expected: "disk_iotune: read_iops_sec_max requires read_iops_sec",
+		},
+		{
+			name:     "burst lower than limit",
+			data:     "disk_iotune:\n  total_bytes_sec: 100\n  total_bytes_sec_max: 10\n",
+			expected: "disk_iotune: total_bytes_sec_max is lower than total_bytes_sec",
+		},
+		{
+			name:     "burst length without burst",
+			data:     "disk_iotune:\n  write_bytes_sec: 100\n  write_bytes_sec_max_length: 10\n",
+			expected: "disk_iotune: write_bytes_sec_max_length requires write_bytes_sec_max",
+		},
+		{
+			name:     "total and read limits",
+			data:     "additional_disks:\n  - type: nvme\n    size: 20\n    iotune:\n      total_iops_sec: 100\n      read_iops_sec: 50\n",
+			expected: "additional_disks[0].iotune: total_iops_sec can't be combined with read_iops_sec and write_iops_sec",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := provider.Render(provider.Policy{}, provider.RenderRequest{
+				ProviderData: testProviderData + test.data,
+				RequestID:    testRequestID,
+			})
+			assert.EqualError(t, err, test.expected)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"libvirt.org/go/libvirtxml"
+)
+
+// encryptionFormat is the format of the encrypted volumes, a LUKS container holding the raw disk.
+const encryptionFormat = "luks"
+
+// checkEncryption verifies the encrypted volumes can be created in the pool.
+//
+// libvirt only creates the LUKS volumes of the pools of files, with qemu-img.
+func (p storagePool) checkEncryption() error {
+	if p.poolType.kind != poolFile {
+		return fmt.Errorf("encrypted volumes require a storage pool of files, e.g. dir, %q is of type %q", p.Name, p.Type)
+	}
+
+	return nil
+}
+
+// encryptedVolumeXML renders the XML of a raw volume of the pool encrypted with the passphrase of the secret,
+// the capacity is in bytes.
+func (p storagePool) encryptedVolumeXML(volumeName string, capacity uint64, secretUUID string) (string, error) {
+	if err := p.checkEncryption(); err != nil {
+		return "", err
+	}
+
+	volData := p.volume(volumeName, diskFormatRaw, capacity)
+	volData.Target.Encryption = &libvirtxml.StorageEncryption{
+		Format: encryptionFormat,
+		Secret: &libvirtxml.StorageEncryptionSecret{
+			Type: "passphrase",
+			UUID: secretUUID,
+		},
+	}
+
+	return volData.Marshal()
+}
+
+// diskEncryption returns the encryption of the source of the domain disk backed by the encrypted volume.
+func diskEncryption(secretUUID string) *libvirtxml.DomainDiskEncryption {
+	return &libvirtxml.DomainDiskEncryption{
+		Format: encryptionFormat,
+		Secrets: []libvirtxml.DomainDiskSecret{
+			{
+				Type: "passphrase",
+				UUID: secretUUID,
+			},
+		},
+	}
+}
+
+// createEncryptedVolume creates the encrypted volume in the storage pool, unless it already exists.
+//
+// The passphrase of a new volume is generated, and stored in the libvirt secret with the given UUID: it never
+// leaves the host. The secret of an existing volume is left as is, its passphrase opens the volume.
+func createEncryptedVolume(lc LibvirtClient, pool storagePool, volumeName string, capacity uint64, secretUUID string) (libvirt.StorageVol, error) {
+	if vol, err := getVol(lc, pool.Name, volumeName); err == nil {
+		return vol, nil
+	}
+
+	var vol libvirt.StorageVol
+
+	poolRef, err := lc.StoragePoolLookupByName(pool.Name)
+	if err != nil {
+		return vol, fmt.Errorf("%w: %w", errCreateVol, err)
+	}
+
+	volXML, err := pool.encryptedVolumeXML(volumeName, capacity, secretUUID)
+	if err != nil {
+		return vol, fmt.Errorf("%w, error rendering XML: %w", errCreateVol, err)
+	}
+
+	secret, err := defineVolumeSecret(lc, pool, volumeName, secretUUID)
+	if err != nil {
+		return vol, fmt.Errorf("%w: %w", errCreateVol, err)
+	}
+
+	vol, err = lc.StorageVolCreateXML(poolRef, volXML, 0)
+	if err != nil {
+		// the next attempt generates a new passphrase
+		if undefineErr := lc.SecretUndefine(secret); undefineErr != nil {
+			err = errors.Join(err, fmt.Errorf("error removing secret %s: %w", secretUUID, undefineErr))
+		}
+
+		return vol, fmt.Errorf("%w: error creating volume: %w", errCreateVol, err)
+	}
+
+	return vol, nil
+}
+
+// defineVolumeSecret defines the private secret of the volume, and sets its value to a new random passphrase.
+func defineVolumeSecret(lc LibvirtClient, pool storagePool, volumeName, secretUUID string) (libvirt.Secret, error) {
+	var targetPath string
+
+	if pool.Target != nil {
+		targetPath = pool.Target.Path
+	}
+
+	secretXML, err := (&libvirtxml.Secret{
+		Ephemeral:   "no",
+		Private:     "yes",
+		Description: "LUKS passphrase of the volume " + volumeName + " of the storage pool " + pool.Name,
+		UUID:        secretUUID,
+		Usage: &libvirtxml.SecretUsage{
+			Type:   "volume",
+			Volume: path.Join(targetPath, volumeName),
+		},
+	}).Marshal()
+	if err != nil {
+		return libvirt.Secret{}, fmt.Errorf("error rendering XML of secret: %w", err)
+	}
+
+	secret, err := lc.SecretDefineXML(secretXML, 0)
+	if err != nil {
+		return libvirt.Secret{}, fmt.Errorf("error defining secret: %w", err)
+	}
+
+	if err = lc.SecretSetValue(secret, []byte(rand.Text()), 0); err != nil {
+		err = fmt.Errorf("error setting value of secret: %w", err)
+
+		// the secret isn't recorded in the machine state yet, neither rollback nor Deprovision would remove it
+		if undefineErr := lc.SecretUndefine(secret); undefineErr != nil {
+			err = errors.Join(err, fmt.Errorf("error removing secret %s: %w", secretUUID, undefineErr))
+		}
+
+		return libvirt.Secret{}, err
+	}
+
+	return secret, nil
+}
+
+// removeVolumeSecret deletes the secret of the passphrase of an encrypted volume.
+func removeVolumeSecret(lc LibvirtClient, secretUUID string, logger *zap.Logger) error {
+	id, err := uuid.Parse(secretUUID)
+	if err != nil {
+		return fmt.Errorf("invalid secret UUID %q: %w", secretUUID, err)
+	}
+
+	secret, err := lc.SecretLookupByUUID(libvirt.UUID(id))
+	if err != nil {
+		if isLibvirtError(err, libvirt.ErrNoSecret) {
+			logger.Info("secret was removed already: " + secretUUID)
+
+			return nil
+		}
+
+		return fmt.Errorf("fetching secret %s: %w", secretUUID, err)
+	}
+
+	if err = lc.SecretUndefine(secret); err != nil {
+		return fmt.Errorf("deleting secret %s: %w", secretUUID, err)
+	}
+
+	logger.Info("removed secret: " + secretUUID)
+
+	return nil
+}
@@ -0,0 +1,192 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+const testEncryptedDisks = "additional_disks:\n  - type: nvme\n    size: 20\n    encrypted: true\n  - type: virtio-blk\n    size: 10\n"
+
+// domainDisk returns the disk of the domain defined for the test request with the given target.
+func domainDisk(t *testing.T, env *testEnv, target string) libvirtxml.DomainDisk {
+	t.Helper()
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+
+	for _, disk := range dom.Definition.Devices.Disks {
+		if disk.Target.Dev == target {
+			return disk
+		}
+	}
+
+	require.FailNow(t, "disk not found", target)
+
+	return libvirtxml.DomainDisk{}
+}
+
+func TestEncryptedDisk(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, testProviderData+testEncryptedDisks)
+	env.runSteps(t, "startVM")
+
+	disks := env.spec().Value.AdditionalDisks
+	require.Len(t, disks, 2)
+	assert.Equal(t, "raw", disks[0].Format)
+	assert.Empty(t, disks[1].SecretUuid)
+
+	secretUUID := disks[0].SecretUuid
+	require.Equal(t, []string{secretUUID}, env.lv.Secrets())
+
+	secret, ok := env.lv.Secret(secretUUID)
+	require.True(t, ok)
+	assert.Equal(t, "yes", secret.Definition.Private)
+	assert.Equal(t, "no", secret.Definition.Ephemeral)
+	assert.Equal(t, &libvirtxml.SecretUsage{Type: "volume", Volume: "/var/lib/libvirt/images/" + testRequestID + "-0-nvme.raw"}, secret.Definition.Usage)
+	assert.Len(t, secret.Value, 26)
+
+	vol, ok := env.lv.Volume(testPool, testRequestID+"-0-nvme.raw")
+	require.True(t, ok)
+	assert.Equal(t, "raw", vol.Format)
+	assert.Equal(t, secretUUID, vol.Secret)
+
+	encrypted := domainDisk(t, env, "nvme0n1")
+	assert.Equal(t, "raw", encrypted.Driver.Type)
+	assert.Equal(t, &libvirtxml.DomainDiskEncryption{
+		Format:  "luks",
+		Secrets: []libvirtxml.DomainDiskSecret{{Type: "passphrase", UUID: secretUUID}},
+	}, encrypted.Source.Encryption)
+	assert.Nil(t, domainDisk(t, env, "vdb").Source.Encryption)
+
+	// the passphrase of the existing volume is kept
+	require.NoError(t, env.runStep(t, "provisionAdditionalDisks"))
+	assert.Equal(t, 1, env.lv.Calls("SecretSetValue"))
+
+	again, ok := env.lv.Secret(secretUUID)
+	require.True(t, ok)
+	assert.Equal(t, secret.Value, again.Value)
+
+	// the overlay of the encrypted disk wouldn't be encrypted
+	snapshot, err := env.provisioner.CreateSnapshot(t.Context(), testRequestID, provider.SnapshotOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vda", "vdb"}, snapshot.Disks)
+
+	deprovision := func() error {
+		return env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request)
+	}
+
+	// the running domain is destroyed first
+	require.True(t, isRetry(deprovision()))
+	require.NoError(t, deprovision())
+
+	assert.Empty(t, env.lv.Volumes(testPool))
+	assert.Empty(t, env.lv.Secrets())
+
+	require.NoError(t, deprovision())
+}
+
+func TestRenderEncryptedDisk(t *testing.T) {
+	t.Parallel()
+
+	rendered, err := provider.Render(provider.Policy{}, provider.RenderRequest{
+		ProviderData: testProviderData + testEncryptedDisks,
+		RequestID:    testRequestID,
+	})
+	require.NoError(t, err)
+	require.Len(t, rendered.Volumes, 4)
+
+	encrypted := rendered.Volumes[1]
+	require.NotEmpty(t, encrypted.Secret)
+	assert.Empty(t, rendered.Volumes[2].Secret)
+
+	var volume libvirtxml.StorageVolume
+
+	require.NoError(t, volume.Unmarshal(encrypted.XML))
+	assert.Equal(t, "raw", volume.Target.Format.Type)
+	assert.Equal(t, &libvirtxml.StorageEncryption{
+		Format: "luks",
+		Secret: &libvirtxml.StorageEncryptionSecret{Type: "passphrase", UUID: encrypted.Secret},
+	}, volume.Target.Encryption)
+
+	assert.Contains(t, rendered.DomainXML, encrypted.Secret)
+}
+
+func TestEncryptedDiskErrors(t *testing.T) {
+	logicalPoolData := strings.Replace(testProviderData, "storage_pool: "+testPool, "storage_pool: "+testLogicalPool.Name, 1)
+
+	runStepTests(t, "provisionAdditionalDisks", []stepTest{
+		{
+			name:         "pool of block devices",
+			providerData: logicalPoolData + testEncryptedDisks,
+			setup: func(t *testing.T, env *testEnv) {
+				env.lv.DefinePool(testLogicalPool)
+			},
+			wantErr: `additional_disks[0]: encrypted volumes require a storage pool of files, e.g. dir, "vg0" is of type "logical"`,
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.lv.Secrets())
+			},
+		},
+		{
+			name:         "existing volume",
+			providerData: withExistingDisk("    volume: " + testDataset + "\n    encrypted: true\n"),
+			wantErr:      "additional_disks[1]: encrypted can't be set for the existing disks, they are attached as is",
+		},
+		{
+			name:         "retained",
+			providerData: testProviderData + "additional_disks:\n  - type: nvme\n    size: 20\n    encrypted: true\n    retain: retain\n",
+			wantErr:      "additional_disks[0]: retain can't be set for the encrypted disks, their passphrase is deleted on deprovision",
+		},
+		{
+			name:         "volume creation failure",
+			providerData: testProviderData + testEncryptedDisks,
+			setup: func(t *testing.T, env *testEnv) {
+				env.lv.InjectError("StorageVolCreateXML", 0, errors.New("qemu-img: Could not create LUKS volume"))
+			},
+			wantErr: "qemu-img: Could not create LUKS volume",
+			check: func(t *testing.T, env *testEnv) {
+				// the secret is defined for the volume only
+				assert.Equal(t, 1, env.lv.Calls("SecretDefineXML"))
+				assert.Empty(t, env.lv.Secrets())
+			},
+		},
+		{
+			name:         "passphrase failure",
+			providerData: testProviderData + testEncryptedDisks,
+			setup: func(t *testing.T, env *testEnv) {
+				env.lv.InjectError("SecretSetValue", 0, errors.New("internal error: cannot write secret value"))
+			},
+			wantErr: "error setting value of secret: internal error: cannot write secret value",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, 1, env.lv.Calls("SecretDefineXML"))
+				assert.Empty(t, env.lv.Secrets())
+				assert.Empty(t, env.lv.Volumes(testPool))
+			},
+		},
+		{
+			name:         "rolled back",
+			providerData: testProviderData + testEncryptedDisks,
+			setup: func(t *testing.T, env *testEnv) {
+				env.lv.InjectError("StorageVolCreateXML", 1, errors.New("No space left on device"))
+			},
+			wantErr: "No space left on device",
+			check: func(t *testing.T, env *testEnv) {
+				// the encrypted volume created before the failure is rolled back with its secret
+				assert.Empty(t, env.lv.Volumes(testPool))
+				assert.Empty(t, env.lv.Secrets())
+			},
+		},
+	})
+}
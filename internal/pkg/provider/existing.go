@@ -0,0 +1,221 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/digitalocean/go-libvirt"
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/api/specs"
+)
+
+// existingDisk returns the machine state of the existing volume or host block device attached as the additional disk.
+//
+// The volume has to exist, and no other managed domain may use the volume or the block device.
+func existingDisk(lc LibvirtClient, vmName string, data Data, disk additionalDisk) (*specs.AdditionalDisk, error) {
+	if disk.BlockDevice != "" {
+		if err := checkDiskUnused(lc, vmName, []string{diskSourceKey(blockDiskSource(disk.BlockDevice))}); err != nil {
+			return nil, fmt.Errorf("block device %q: %w", disk.BlockDevice, err)
+		}
+
+		return &specs.AdditionalDisk{
+			Type:        disk.Type,
+			Existing:    true,
+			BlockDevice: disk.BlockDevice,
+			Format:      diskFormatRaw,
+		}, nil
+	}
+
+	poolName := disk.pool(data)
+
+	pool, err := lookupVolumePool(lc, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	def, keys, err := existingVolume(lc, pool, disk.Volume)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkDiskUnused(lc, vmName, keys); err != nil {
+		return nil, fmt.Errorf("volume %q of storage pool %q: %w", disk.Volume, poolName, err)
+	}
+
+	// only the image files have a format, the other volumes are raw devices
+	format := pool.diskFormat()
+
+	if pool.poolType.kind == poolFile && def.Target != nil && def.Target.Format != nil && def.Target.Format.Type != "" {
+		format = def.Target.Format.Type
+	}
+
+	return &specs.AdditionalDisk{
+		Type:     disk.Type,
+		VolName:  disk.Volume,
+		Existing: true,
+		PoolName: poolName,
+		Format:   format,
+	}, nil
+}
+
+// existingVolume fetches the definition of the existing volume of the pool, and the keys of the sources
+// of the domain disks which may refer to it, see diskSourceKey.
+func existingVolume(lc LibvirtClient, pool storagePool, volName string) (libvirtxml.StorageVolume, []string, error) {
+	var def libvirtxml.StorageVolume
+
+	vol, err := getVol(lc, pool.Name, volName)
+	if err != nil {
+		if errors.Is(err, errVolNoExist) {
+			return def, nil, fmt.Errorf("volume %q doesn't exist in storage pool %q", volName, pool.Name)
+		}
+
+		return def, nil, fmt.Errorf("error fetching volume %q: %w", volName, err)
+	}
+
+	volXML, err := lc.StorageVolGetXMLDesc(vol, 0)
+	if err != nil {
+		return def, nil, fmt.Errorf("error fetching XML of volume %q: %w", volName, err)
+	}
+
+	if err = def.Unmarshal(volXML); err != nil {
+		return def, nil, fmt.Errorf("error parsing XML of volume %q: %w", volName, err)
+	}
+
+	// the disks refer to the volume by its pool, its path or its device, depending on the pool type
+	keys := []string{
+		diskSourceKey(&libvirtxml.DomainDiskSource{Volume: &libvirtxml.DomainDiskSourceVolume{Pool: pool.Name, Volume: volName}}),
+		diskSourceKey(pool.diskSource(volName)),
+		"path:" + vol.Key,
+	}
+
+	if def.Target != nil && def.Target.Path != "" {
+		keys = append(keys, "path:"+def.Target.Path)
+	}
+
+	return def, keys, nil
+}
+
+// checkExistingDisksUnused verifies again that no other managed domain uses the existing disks of the machine,
+// the pools are the ones of machinePools.
+//
+// The check of provisionAdditionalDisks is outdated once the other requests define their domains,
+// so it's repeated right before the domain of the machine is defined.
+func checkExistingDisksUnused(lc LibvirtClient, vmName string, pools map[string]storagePool, disks []*specs.AdditionalDisk) error {
+	for idx, disk := range disks {
+		if !disk.Existing {
+			continue
+		}
+
+		if disk.BlockDevice != "" {
+			if err := checkDiskUnused(lc, vmName, []string{diskSourceKey(blockDiskSource(disk.BlockDevice))}); err != nil {
+				return fmt.Errorf("additional_disks[%d]: block device %q: %w", idx, disk.BlockDevice, err)
+			}
+
+			continue
+		}
+
+		pool, ok := pools[disk.PoolName]
+		if !ok {
+			return fmt.Errorf("additional_disks[%d]: storage pool %q not found", idx, disk.PoolName)
+		}
+
+		_, keys, err := existingVolume(lc, pool, disk.VolName)
+		if err != nil {
+			return fmt.Errorf("additional_disks[%d]: %w", idx, err)
+		}
+
+		if err = checkDiskUnused(lc, vmName, keys); err != nil {
+			return fmt.Errorf("additional_disks[%d]: volume %q of storage pool %q: %w", idx, disk.VolName, disk.PoolName, err)
+		}
+	}
+
+	return nil
+}
+
+// defineDomain defines the domain of the machine, once no other managed domain uses its existing disks.
+//
+// The check and the definition are serialized, two requests can't claim the same disk concurrently.
+func (p *Provisioner) defineDomain(lc LibvirtClient, vmName string, pools map[string]storagePool, disks []*specs.AdditionalDisk, domXML string) error {
+	p.diskClaims.Lock()
+	defer p.diskClaims.Unlock()
+
+	if err := checkExistingDisksUnused(lc, vmName, pools, disks); err != nil {
+		return err
+	}
+
+	if _, err := lc.DomainDefineXML(domXML); err != nil {
+		return fmt.Errorf("creating domain: %w", err)
+	}
+
+	return nil
+}
+
+// checkDiskUnused returns an error if a managed domain, other than the one of the machine, has a disk
+// with one of the sources, see diskSourceKey.
+func checkDiskUnused(lc LibvirtClient, vmName string, keys []string) error {
+	domains, _, err := lc.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive|libvirt.ConnectListDomainsInactive)
+	if err != nil {
+		return fmt.Errorf("error listing domains: %w", err)
+	}
+
+	for _, dom := range domains {
+		if dom.Name == vmName {
+			continue
+		}
+
+		_, managed, err := domainOwnerOf(lc, dom)
+		if err != nil {
+			if libvirt.IsNotFound(err) {
+				continue
+			}
+
+			return fmt.Errorf("error reading metadata of domain %q: %w", dom.Name, err)
+		}
+
+		if !managed {
+			continue
+		}
+
+		raw, err := lc.DomainGetXMLDesc(dom, libvirt.DomainXMLInactive)
+		if err != nil {
+			if libvirt.IsNotFound(err) {
+				continue
+			}
+
+			return fmt.Errorf("error fetching XML of domain %q: %w", dom.Name, err)
+		}
+
+		var def libvirtxml.Domain
+
+		if err = def.Unmarshal(raw); err != nil {
+			return fmt.Errorf("error parsing XML of domain %q: %w", dom.Name, err)
+		}
+
+		if def.Devices == nil {
+			continue
+		}
+
+		for _, disk := range def.Devices.Disks {
+			if key := diskSourceKey(disk.Source); key != "" && slices.Contains(keys, key) {
+				return fmt.Errorf("already used by the managed domain %q", dom.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// blockDiskSource is the source of the domain disk backed by the host block device.
+func blockDiskSource(dev string) *libvirtxml.DomainDiskSource {
+	return &libvirtxml.DomainDiskSource{
+		Block: &libvirtxml.DomainDiskSourceBlock{
+			Dev: dev,
+		},
+	}
+}
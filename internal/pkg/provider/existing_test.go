@@ -0,0 +1,266 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/libvirtfake"
+)
+
+const testDataset = "dataset"
+
+// withExistingDisk returns the provider data with the additional disk, after a new one.
+func withExistingDisk(disk string) string {
+	return testProviderData + "additional_disks:\n  - type: nvme\n    size: 10\n  - type: virtio-blk\n" + disk
+}
+
+// allowBlockDevices allows the machines to attach the block devices of the volume group vg1.
+func allowBlockDevices(_ *testing.T, env *testEnv) {
+	env.provisioner.SetPolicy(provider.Policy{AllowedBlockDevices: []string{"/dev/vg1"}})
+}
+
+// defineDomainWithDisk defines a domain created by the provider for another machine request, which uses the disk.
+func defineDomainWithDisk(t *testing.T, lv *libvirtfake.Libvirt, requestID, diskXML string) {
+	t.Helper()
+
+	_, err := lv.DomainDefineXML(fmt.Sprintf(`<domain type='kvm'><name>%s</name><metadata>
+<omni:machine xmlns:omni="%s"><omni:provider-id>libvirt</omni:provider-id><omni:request-id>%s</omni:request-id></omni:machine>
+</metadata><memory unit='MiB'>1024</memory><devices>%s</devices></domain>`, requestID, testMetadataNamespace, requestID, diskXML))
+	require.NoError(t, err)
+}
+
+func TestAttachExistingVolume(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withExistingDisk("    volume: "+testDataset+"\n"))
+	env.lv.AddVolume(testPool, libvirtfake.Volume{Name: testDataset, Format: "raw", Capacity: 100 * provider.GiB})
+
+	env.runSteps(t, "createVM")
+
+	disk := env.spec().Value.AdditionalDisks[1]
+	assert.True(t, disk.Existing)
+	assert.Equal(t, testDataset, disk.VolName)
+	assert.Equal(t, testPool, disk.PoolName)
+	assert.Equal(t, "raw", disk.Format)
+	assert.NotEmpty(t, disk.Serial)
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+
+	attached := dom.Definition.Devices.Disks[2]
+	assert.Equal(t, &libvirtxml.DomainDiskSourceVolume{Pool: testPool, Volume: testDataset}, attached.Source.Volume)
+	assert.Equal(t, "raw", attached.Driver.Type)
+	assert.Equal(t, "vdb", attached.Target.Dev)
+
+	vol, ok := env.lv.Volume(testPool, testDataset)
+	require.True(t, ok)
+	assert.Equal(t, 100*provider.GiB, vol.Capacity, "the existing volume is not resized")
+
+	require.NoError(t, env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request))
+
+	_, ok = env.lv.Volume(testPool, testDataset)
+	assert.True(t, ok, "the existing volume is kept")
+
+	_, ok = env.lv.Volume(testPool, testRequestID+"-0-nvme.qcow2")
+	assert.False(t, ok)
+}
+
+func TestAttachExistingVolumeOtherPool(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withExistingDisk("    volume: data\n    pool: "+testLogicalPool.Name+"\n"))
+	env.lv.DefinePool(testLogicalPool)
+	env.lv.AddVolume(testLogicalPool.Name, libvirtfake.Volume{Name: "data", Capacity: 100 * provider.GiB})
+
+	env.runSteps(t, "createVM")
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+
+	attached := dom.Definition.Devices.Disks[2]
+	require.NotNil(t, attached.Source.Block)
+	assert.Equal(t, "/dev/vg0/data", attached.Source.Block.Dev)
+	assert.Equal(t, "raw", attached.Driver.Type)
+
+	// the new disks are still created in the storage pool of the machine
+	_, ok = env.lv.Volume(testPool, testRequestID+"-0-nvme.qcow2")
+	assert.True(t, ok)
+}
+
+func TestAttachBlockDevice(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withExistingDisk("    block_device: /dev/vg1/data\n"))
+	allowBlockDevices(t, env)
+
+	env.runSteps(t, "createVM")
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+
+	attached := dom.Definition.Devices.Disks[2]
+	assert.Equal(t, &libvirtxml.DomainDiskSourceBlock{Dev: "/dev/vg1/data"}, attached.Source.Block)
+	assert.Equal(t, "raw", attached.Driver.Type)
+
+	require.NoError(t, env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request))
+	assert.Equal(t, 3, env.lv.Calls("StorageVolDelete"), "only the created volumes are deleted")
+}
+
+func TestAttachExistingDiskErrors(t *testing.T) {
+	runStepTests(t, "provisionAdditionalDisks", []stepTest{
+		{
+			name:         "missing volume",
+			providerData: withExistingDisk("    volume: missing\n"),
+			wantErr:      `additional_disks[1]: volume "missing" doesn't exist in storage pool "default"`,
+			check: func(t *testing.T, env *testEnv) {
+				// the new disk is rolled back
+				_, ok := env.lv.Volume(testPool, testRequestID+"-0-nvme.qcow2")
+				assert.False(t, ok)
+				assert.Empty(t, env.spec().Value.AdditionalDisks)
+			},
+		},
+		{
+			name:         "volume used by another machine",
+			providerData: withExistingDisk("    volume: " + testDataset + "\n"),
+			setup: func(t *testing.T, env *testEnv) {
+				env.lv.AddVolume(testPool, libvirtfake.Volume{Name: testDataset, Capacity: provider.GiB})
+
+				defineDomainWithDisk(t, env.lv, "request-0", `<disk type='volume' device='disk'><source pool='default' volume='dataset'/><target dev='vdb' bus='virtio'/></disk>`)
+			},
+			wantErr: `additional_disks[1]: volume "dataset" of storage pool "default": already used by the managed domain "request-0"`,
+			check: func(t *testing.T, env *testEnv) {
+				_, ok := env.lv.Volume(testPool, testDataset)
+				assert.True(t, ok, "the existing volume is not rolled back")
+			},
+		},
+		{
+			name:         "volume used by its path",
+			providerData: withExistingDisk("    volume: " + testDataset + "\n"),
+			setup: func(t *testing.T, env *testEnv) {
+				env.lv.AddVolume(testPool, libvirtfake.Volume{Name: testDataset, Capacity: provider.GiB})
+
+				defineDomainWithDisk(t, env.lv, "request-0", `<disk type='file' device='disk'><source file='/default/dataset'/><target dev='vdb' bus='virtio'/></disk>`)
+			},
+			wantErr: `already used by the managed domain "request-0"`,
+		},
+		{
+			name:         "volume used by an unmanaged domain",
+			providerData: withExistingDisk("    volume: " + testDataset + "\n"),
+			setup: func(t *testing.T, env *testEnv) {
+				env.lv.AddVolume(testPool, libvirtfake.Volume{Name: testDataset, Capacity: provider.GiB})
+
+				_, err := env.lv.DomainDefineXML(`<domain type='kvm'><name>backup</name><devices><disk type='volume' device='disk'>` +
+					`<source pool='default' volume='dataset'/><target dev='vdb' bus='virtio'/></disk></devices></domain>`)
+				require.NoError(t, err)
+			},
+		},
+		{
+			name:         "block device used by another machine",
+			providerData: withExistingDisk("    block_device: /dev/vg1/data\n"),
+			setup: func(t *testing.T, env *testEnv) {
+				defineDomainWithDisk(t, env.lv, "request-0", `<disk type='block' device='disk'><source dev='/dev/vg1/data'/><target dev='vdb' bus='virtio'/></disk>`)
+			},
+			wantErr: `additional_disks[1]: block device "/dev/vg1/data": already used by the managed domain "request-0"`,
+		},
+		{
+			name:         "volume and block device",
+			providerData: withExistingDisk("    volume: " + testDataset + "\n    block_device: /dev/vg1/data\n"),
+			wantErr:      "additional_disks[1]: volume and block_device can't be both set",
+		},
+		{
+			name:         "relative block device",
+			providerData: withExistingDisk("    block_device: vg1/data\n"),
+			wantErr:      `additional_disks[1]: block_device "vg1/data" is not an absolute path`,
+		},
+		{
+			name:         "retained existing volume",
+			providerData: withExistingDisk("    volume: " + testDataset + "\n    retain: retain\n"),
+			wantErr:      "additional_disks[1]: retain can't be set for the existing disks, they are never deleted",
+		},
+	})
+}
+
+func TestExistingVolumePoolNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	_, err := provider.Render(provider.Policy{AllowedPools: []string{testPool}}, provider.RenderRequest{
+		ProviderData: withExistingDisk("    volume: data\n    pool: backups\n"),
+		RequestID:    testRequestID,
+	})
+	require.EqualError(t, err, `storage pool "backups" of additional_disks[1] is not allowed by the provider config`)
+}
+
+func TestBlockDeviceNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	policy := provider.Policy{AllowedBlockDevices: []string{"/dev/vg1", "/dev/disk/by-id/"}}
+
+	for _, tt := range []struct {
+		name        string
+		blockDevice string
+		expected    string
+	}{
+		{
+			name:        "under a prefix",
+			blockDevice: "/dev/vg1/data",
+		},
+		{
+			name:        "under a prefix with a trailing slash",
+			blockDevice: "/dev/disk/by-id/wwn-0x5000c500a0b1c2d3",
+		},
+		{
+			name:        "sibling of a prefix",
+			blockDevice: "/dev/vg10/data",
+			expected:    `block device "/dev/vg10/data" of additional_disks[1] is not allowed by the provider config`,
+		},
+		{
+			name:        "escaping a prefix",
+			blockDevice: "/dev/vg1/../sda",
+			expected:    `block device "/dev/vg1/../sda" of additional_disks[1] is not allowed by the provider config`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := provider.Render(policy, provider.RenderRequest{
+				ProviderData: withExistingDisk("    block_device: " + tt.blockDevice + "\n"),
+				RequestID:    testRequestID,
+			})
+
+			if tt.expected == "" {
+				require.NoError(t, err)
+
+				return
+			}
+
+			require.EqualError(t, err, tt.expected)
+		})
+	}
+}
+
+func TestExistingDiskClaimedConcurrently(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withExistingDisk("    block_device: /dev/vg1/data\n"))
+	allowBlockDevices(t, env)
+	env.runSteps(t, "provisionCidata")
+
+	// another request attached the device after the disks of the machine were provisioned
+	defineDomainWithDisk(t, env.lv, "request-0", `<disk type='block' device='disk'><source dev='/dev/vg1/data'/><target dev='vdb' bus='virtio'/></disk>`)
+
+	err := env.runStep(t, "createVM")
+	require.ErrorContains(t, err, `additional_disks[1]: block device "/dev/vg1/data": already used by the managed domain "request-0"`)
+
+	_, ok := env.lv.Domain(testRequestID)
+	assert.False(t, ok)
+}
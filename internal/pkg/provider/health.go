@@ -0,0 +1,319 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/siderolabs/omni/client/pkg/constants"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultHeartbeatTimeout is the default time without a heartbeat after which the Omni stream is considered stalled.
+	DefaultHeartbeatTimeout = 3 * constants.InfraProviderHealthCheckInterval
+
+	// healthCheckTimeout is how long a single component check may take.
+	healthCheckTimeout = 5 * time.Second
+
+	// omniWatchRetryInterval is how long to wait before restarting a broken watch of the health status.
+	omniWatchRetryInterval = 5 * time.Second
+)
+
+// ComponentHealth is the health of a component the provider depends on.
+type ComponentHealth struct {
+	Name    string `json:"name"`
+	Error   string `json:"error,omitempty"`
+	Healthy bool   `json:"healthy"`
+}
+
+// HealthReport is the health of all the components.
+type HealthReport struct {
+	Components []ComponentHealth `json:"components"`
+	Healthy    bool              `json:"healthy"`
+}
+
+// Health checks the components the provider depends on: the libvirt connections, the storage pools,
+// the image cache directory and the stream of the Omni controllers.
+//
+// The Omni stream is checked through the heartbeats recorded by WatchOmni: the health status of the provider
+// is written to Omni by the infra provider controllers periodically, each update read back is a heartbeat.
+type Health struct {
+	started       time.Time
+	lastHeartbeat atomic.Pointer[time.Time]
+	provisioner   *Provisioner
+	imageCache    *ImageCache
+	// How long the Omni stream may stay without a heartbeat
+	HeartbeatTimeout time.Duration
+}
+
+// NewHealth creates a new Health checking the provisioner hosts and the image cache.
+func NewHealth(provisioner *Provisioner, imageCache *ImageCache) *Health {
+	return &Health{
+		started:          time.Now(),
+		provisioner:      provisioner,
+		imageCache:       imageCache,
+		HeartbeatTimeout: DefaultHeartbeatTimeout,
+	}
+}
+
+// HealthCheck reports the disconnected libvirt hosts to Omni.
+//
+// It is passed to the infra provider with infra.WithHealthCheckFunc. It runs before the health status is written
+// to Omni, so it doesn't tell whether Omni is reachable.
+func (h *Health) HealthCheck(context.Context) error {
+	var errs []error
+
+	for _, host := range h.provisioner.hostList() {
+		if _, err := host.Connection.Client(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// WatchOmni records a heartbeat for each update of the health status of the provider read from Omni,
+// until the context is canceled.
+//
+// The updates prove the round-trip: the infra provider controllers wrote the status, and the watch read it back.
+// A broken watch is restarted, the heartbeats stop meanwhile.
+func (h *Health) WatchOmni(ctx context.Context, st state.State, providerID string, logger *zap.Logger) error {
+	for {
+		err := h.watchOmni(ctx, st, providerID)
+		if ctx.Err() != nil {
+			return nil //nolint:nilerr
+		}
+
+		logger.Warn("Omni health status watch failed, restarting", zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(omniWatchRetryInterval):
+		}
+	}
+}
+
+func (h *Health) watchOmni(ctx context.Context, st state.State, providerID string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan state.Event)
+
+	if err := st.Watch(ctx, infra.NewProviderHealthStatus(providerID).Metadata(), events); err != nil {
+		return fmt.Errorf("error watching the provider health status: %w", err)
+	}
+
+	for {
+		var event state.Event
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event = <-events:
+		}
+
+		switch event.Type { //nolint:exhaustive
+		case state.Created, state.Updated:
+			now := time.Now()
+
+			h.lastHeartbeat.Store(&now)
+		case state.Errored:
+			return event.Error
+		}
+	}
+}
+
+// Check runs the component checks in parallel.
+func (h *Health) Check(ctx context.Context) HealthReport {
+	checks := []func(context.Context) ComponentHealth{h.checkOmni}
+
+	if h.imageCache != nil {
+		checks = append(checks, h.checkImageCache)
+	}
+
+	pools := h.provisioner.healthCheckedPools()
+
+	for _, host := range h.provisioner.hostList() {
+		checks = append(checks, func(ctx context.Context) ComponentHealth {
+			return checkComponent(ctx, "libvirt/"+host.Name, func() error {
+				_, err := host.Connection.Client()
+
+				return err
+			})
+		})
+
+		for _, pool := range pools {
+			checks = append(checks, func(ctx context.Context) ComponentHealth {
+				return checkComponent(ctx, "storage_pool/"+host.Name+"/"+pool, func() error {
+					return checkPool(host, pool)
+				})
+			})
+		}
+	}
+
+	report := HealthReport{
+		Components: make([]ComponentHealth, len(checks)),
+		Healthy:    true,
+	}
+
+	var wg sync.WaitGroup
+
+	for i, check := range checks {
+		wg.Go(func() {
+			report.Components[i] = check(ctx)
+		})
+	}
+
+	wg.Wait()
+
+	for _, component := range report.Components {
+		report.Healthy = report.Healthy && component.Healthy
+	}
+
+	return report
+}
+
+func (h *Health) checkOmni(context.Context) ComponentHealth {
+	component := ComponentHealth{Name: "omni", Healthy: true}
+
+	last := h.lastHeartbeat.Load()
+
+	switch {
+	case last == nil && time.Since(h.started) < h.HeartbeatTimeout:
+		component.Healthy = false
+		component.Error = "waiting for the first heartbeat"
+	case last == nil:
+		component.Healthy = false
+		component.Error = fmt.Sprintf("no heartbeat since the start %s ago", time.Since(h.started).Round(time.Second))
+	case time.Since(*last) > h.HeartbeatTimeout:
+		component.Healthy = false
+		component.Error = fmt.Sprintf("no heartbeat for %s", time.Since(*last).Round(time.Second))
+	}
+
+	return component
+}
+
+func (h *Health) checkImageCache(ctx context.Context) ComponentHealth {
+	return checkComponent(ctx, "image_cache", h.imageCache.checkWritable)
+}
+
+// checkComponent runs the check with a timeout, a hanging check is reported as unhealthy.
+func checkComponent(ctx context.Context, name string, check func() error) ComponentHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- check()
+	}()
+
+	component := ComponentHealth{Name: name}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			component.Error = err.Error()
+		}
+	case <-ctx.Done():
+		component.Error = fmt.Sprintf("check timed out: %s", ctx.Err())
+	}
+
+	component.Healthy = component.Error == ""
+
+	return component
+}
+
+// checkPool verifies that the storage pool exists on the host, is active, and is of a type the provider supports.
+func checkPool(host Host, poolName string) error {
+	lc, err := host.Connection.Client()
+	if err != nil {
+		return err
+	}
+
+	pool, err := lc.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return fmt.Errorf("error looking up storage pool: %w", err)
+	}
+
+	state, _, _, _, err := lc.StoragePoolGetInfo(pool) //nolint:dogsled
+	if err != nil {
+		return fmt.Errorf("error fetching storage pool info: %w", err)
+	}
+
+	if libvirt.StoragePoolState(state) != libvirt.StoragePoolRunning {
+		return errors.New("storage pool is not active")
+	}
+
+	// the provider can't create volumes in the pools of some types, e.g. iSCSI
+	if _, err = lookupStoragePool(lc, poolName); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// healthCheckedPools returns the storage pools of the policy: the allowed ones and the default one.
+func (p *Provisioner) healthCheckedPools() []string {
+	policy := p.policy.Load()
+	pools := slices.Clone(policy.AllowedPools)
+
+	if defaults, err := policy.merge(nil); err == nil && defaults.StoragePool != "" && !slices.Contains(pools, defaults.StoragePool) {
+		pools = append(pools, defaults.StoragePool)
+	}
+
+	return pools
+}
+
+// checkWritable verifies that images can be written to the cache directory.
+func (c *ImageCache) checkWritable() error {
+	// the temporary file extension keeps the file out of the cleanup
+	f, err := os.CreateTemp(c.CachePath, ".healthz-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	closeErr := f.Close()
+
+	if err = os.Remove(f.Name()); err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// Handler serves the health report as JSON.
+//
+// It fails if any component is unhealthy, unless live is set: the provider is live as long as it answers,
+// as none of the components recover by restarting it, e.g. while Omni or a libvirt host is unreachable.
+func (h *Health) Handler(live bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.Check(r.Context())
+
+		ok := report.Healthy || live
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(w).Encode(report) //nolint:errcheck,errchkjson
+	})
+}
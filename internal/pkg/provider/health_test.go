@@ -0,0 +1,149 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/impl/inmem"
+	"github.com/cosi-project/runtime/pkg/state/impl/namespaced"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/meta"
+)
+
+func serveHealth(t *testing.T, health *provider.Health, path string, live bool) (int, provider.HealthReport) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+
+	health.Handler(live).ServeHTTP(recorder, httptest.NewRequestWithContext(t.Context(), http.MethodGet, path, nil))
+
+	var report provider.HealthReport
+
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+
+	return recorder.Code, report
+}
+
+// watchOmni runs the watch of the health status of the provider in the returned Omni state.
+func watchOmni(t *testing.T, health *provider.Health) state.State {
+	t.Helper()
+
+	st := state.WrapCore(namespaced.NewState(inmem.Build))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- health.WatchOmni(ctx, st, meta.ProviderID, zaptest.NewLogger(t))
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	return st
+}
+
+func TestHealth(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	env.provisioner.SetPolicy(provider.Policy{AllowedPools: []string{testPool}})
+
+	health := provider.NewHealth(env.provisioner, provider.NewImageCache(zaptest.NewLogger(t), t.TempDir()))
+
+	// not ready until the infra provider controllers are running
+	code, report := serveHealth(t, health, "/readyz", false)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, provider.ComponentHealth{Name: "omni", Error: "waiting for the first heartbeat"}, report.Components[0])
+
+	code, _ = serveHealth(t, health, "/healthz", true)
+	assert.Equal(t, http.StatusOK, code)
+
+	// the health check runs before the status is written to Omni, it isn't a heartbeat
+	require.NoError(t, health.HealthCheck(t.Context()))
+
+	code, _ = serveHealth(t, health, "/readyz", false)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	st := watchOmni(t, health)
+
+	// the infra provider controllers wrote the health status
+	require.NoError(t, st.Create(t.Context(), infra.NewProviderHealthStatus(meta.ProviderID)))
+
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		code, report = serveHealth(t, health, "/readyz", false)
+		assert.Equal(c, http.StatusOK, code)
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, provider.HealthReport{
+		Healthy: true,
+		Components: []provider.ComponentHealth{
+			{Name: "omni", Healthy: true},
+			{Name: "image_cache", Healthy: true},
+			{Name: "libvirt/default", Healthy: true},
+			{Name: "storage_pool/default/default", Healthy: true},
+			{Name: "libvirt/secondary", Healthy: true},
+			{Name: "storage_pool/secondary/default", Healthy: true},
+		},
+	}, report)
+}
+
+func TestHealthUnhealthy(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	env.provisioner.SetPolicy(provider.Policy{AllowedPools: []string{"fast"}})
+	env.provisioner.SetHosts([]provider.Host{{Name: "default", Connection: &flakyConnector{client: env.lv}}})
+
+	health := provider.NewHealth(env.provisioner, provider.NewImageCache(zaptest.NewLogger(t), filepath.Join(t.TempDir(), "missing")))
+	health.HeartbeatTimeout = 10 * time.Millisecond
+
+	st := watchOmni(t, health)
+
+	require.NoError(t, st.Create(t.Context(), infra.NewProviderHealthStatus(meta.ProviderID)))
+
+	// the heartbeats stop, e.g. the health status can't be written anymore
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		_, report := serveHealth(t, health, "/readyz", false)
+		assert.Contains(c, report.Components[0].Error, "no heartbeat for")
+	}, time.Second, 10*time.Millisecond)
+
+	code, report := serveHealth(t, health, "/readyz", false)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, report.Healthy)
+
+	problems := map[string]string{}
+
+	for _, component := range report.Components {
+		assert.False(t, component.Healthy, component.Name)
+
+		problems[component.Name] = component.Error
+	}
+
+	assert.Contains(t, problems["omni"], "no heartbeat for")
+	assert.Contains(t, problems["image_cache"], "no such file or directory")
+	assert.Equal(t, "disconnected", problems["libvirt/default"])
+	assert.Equal(t, "disconnected", problems["storage_pool/default/fast"])
+
+	// restarting the provider doesn't help, e.g. while Omni is unreachable
+	code, report = serveHealth(t, health, "/healthz", true)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, report.Healthy)
+
+	assert.EqualError(t, health.HealthCheck(t.Context()), "disconnected")
+}
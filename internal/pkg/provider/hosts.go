@@ -0,0 +1,153 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
+)
+
+// Host is a libvirt host the provider places machines on.
+type Host struct {
+	Connection Connector
+	Labels     map[string]string
+	Name       string
+	Overcommit Overcommit
+}
+
+var errNoHosts = errors.New("no libvirt hosts configured")
+
+// SetHosts replaces the hosts machines are placed on.
+//
+// The machines already placed on a removed host can't be provisioned nor deprovisioned until it is added back.
+func (p *Provisioner) SetHosts(hosts []Host) {
+	instrumented := make([]Host, 0, len(hosts))
+
+	for _, host := range hosts {
+		host.Connection = instrumentedConnector{Connector: host.Connection, metrics: p.metrics, host: host.Name}
+		instrumented = append(instrumented, host)
+	}
+
+	p.hosts.Store(&instrumented)
+}
+
+func (p *Provisioner) hostList() []Host {
+	return *p.hosts.Load()
+}
+
+// host returns the host with the given name.
+//
+// An empty name refers to the host of the top level libvirt URI: machines provisioned before
+// multiple hosts were supported don't have the host recorded in their state. Once the hosts are configured
+// as a list, one of them has to be named after it to reach these machines.
+func (p *Provisioner) host(name string) (Host, error) {
+	hosts := p.hostList()
+	if len(hosts) == 0 {
+		return Host{}, errNoHosts
+	}
+
+	recorded := name != ""
+	if !recorded {
+		name = config.DefaultHostName
+	}
+
+	for _, host := range hosts {
+		if host.Name == name {
+			return host, nil
+		}
+	}
+
+	if !recorded {
+		return Host{}, fmt.Errorf("the machine has no libvirt host recorded, and no libvirt host named %q is configured", name)
+	}
+
+	return Host{}, fmt.Errorf("unknown libvirt host %q", name)
+}
+
+// client returns the libvirt client connected to the host with the given name.
+//
+// It returns a retry error while the host is disconnected.
+func (p *Provisioner) client(ctx context.Context, hostName string) (LibvirtClient, error) {
+	host, err := p.host(hostName)
+	if err != nil {
+		return nil, err
+	}
+
+	return hostClient(ctx, host)
+}
+
+// place picks the host for the machine using the scheduler.
+//
+// A host selected in the provider data is the only candidate, the host selector narrows down the candidates.
+// Hosts which can't be queried, or don't have the storage pool, are skipped.
+func (p *Provisioner) place(ctx context.Context, logger *zap.Logger, owner domainOwner, data Data) (Host, error) {
+	hosts := p.hostList()
+	if len(hosts) == 0 {
+		return Host{}, errNoHosts
+	}
+
+	if data.Host != "" {
+		host, err := p.host(data.Host)
+		if err != nil {
+			return Host{}, err
+		}
+
+		hosts = []Host{host}
+	}
+
+	if data.HostSelector != nil {
+		if err := data.HostSelector.validate(); err != nil {
+			return Host{}, fmt.Errorf("invalid host_selector: %w", err)
+		}
+
+		hosts = slices.DeleteFunc(slices.Clone(hosts), func(host Host) bool { return !data.HostSelector.matches(host.Labels) })
+		if len(hosts) == 0 {
+			return Host{}, errors.New("host_selector matches no configured libvirt host")
+		}
+	}
+
+	req, err := placementRequest(data, owner)
+	if err != nil {
+		return Host{}, err
+	}
+
+	// nothing to choose from, and no rules to check
+	if len(hosts) == 1 && len(req.Rules) == 0 {
+		return hosts[0], nil
+	}
+
+	candidates := make([]placement.Host, 0, len(hosts))
+
+	for _, host := range hosts {
+		usage, err := collectHostUsage(ctx, host, data.StoragePool, owner.RequestID)
+		if err != nil {
+			logger.Warn("skipping host for placement", zap.String("host", host.Name), zap.Error(err))
+
+			continue
+		}
+
+		candidates = append(candidates, usage.placementHost())
+	}
+
+	if len(candidates) == 0 {
+		return Host{}, provision.NewRetryErrorf(time.Minute, "no libvirt host with storage pool %q is available", data.StoragePool)
+	}
+
+	name, err := p.scheduler.Schedule(owner.RequestID, candidates, req)
+	if err != nil {
+		return Host{}, err
+	}
+
+	return p.host(name)
+}
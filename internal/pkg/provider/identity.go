@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/google/uuid"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/meta"
+)
+
+const (
+	// maxUUIDAttempts is the number of alternative UUIDs tried when the derived one is already taken.
+	maxUUIDAttempts = 16
+
+	// diskSerialLength is the maximum serial length QEMU passes to virtio-blk and NVMe disks.
+	diskSerialLength = 20
+)
+
+// machineNamespace is the UUID namespace the machine UUIDs are derived in.
+var machineNamespace = uuid.MustParse("61ed1c56-7eab-4772-9d75-d551dda8d63b")
+
+// machineUUID derives the domain UUID from the provider ID and the machine request ID.
+//
+// A non-zero attempt derives an alternative UUID, used when the previous one collides with a foreign domain.
+func machineUUID(requestID string, attempt int) uuid.UUID {
+	name := meta.ProviderID + "/" + requestID
+	if attempt > 0 {
+		name += "/" + strconv.Itoa(attempt)
+	}
+
+	return uuid.NewSHA1(machineNamespace, []byte(name))
+}
+
+// diskIdentity derives the serial number and the WWN of the additional disk with the given index.
+//
+// Both are derived from the machine UUID, so they survive re-runs of the provisioning steps,
+// and they inherit the collision handling of the machine UUID.
+func diskIdentity(machineUUID string, idx int) (serial, wwn string) {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s/disk/%d", machineUUID, idx))
+	digest := hex.EncodeToString(sum[:])
+
+	// NAA type 5 (IEEE registered) WWN: 16 hex digits, the first one being the NAA type
+	return digest[:diskSerialLength], "5" + digest[diskSerialLength:diskSerialLength+15]
+}
+
+// volumeSecretUUID derives the UUID of the libvirt secret of the passphrase of the encrypted additional disk
+// with the given index.
+//
+// It is derived from the machine UUID like the disk identity, so a re-run of the provisioning steps
+// redefines the same secret.
+func volumeSecretUUID(machineUUID string, idx int) uuid.UUID {
+	return uuid.NewSHA1(machineNamespace, fmt.Appendf(nil, "%s/secret/%d", machineUUID, idx))
+}
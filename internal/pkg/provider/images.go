@@ -5,6 +5,8 @@
 package provider
 
 import (
+	"cmp"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -13,10 +15,17 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/siderolabs/omni/client/pkg/constants"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/sync/singleflight"
 )
@@ -43,39 +52,99 @@ type ImageCache struct {
 	// Reference counter for images
 	refs map[string]int
 	// Reset whenever Acquire() is called on a given image key
-	lastUsed  map[string]time.Time
-	logger    *zap.Logger
-	CachePath string
+	lastUsed map[string]time.Time
+	// Open files of the images in use, holding their shared locks, see hold
+	held map[string]*os.File
+	// Signals Run that the cleanup interval was changed
+	reconfigured chan struct{}
+	metrics      *cacheMetrics
+	logger       *zap.Logger
+	CachePath    string
+	// Base URL of the image factory to download images from
+	ImageFactoryURL string
 	// How often to run the cleanup job
 	CleanupInterval time.Duration
 	// Maximum age for locally cached images before they get cleaned up.
 	// Takes effect only if the related refCount is zero.
 	MaxAge time.Duration
-	mu     sync.Mutex
+	// Maximum size of the cache in bytes, zero means unlimited.
+	// Takes effect only for the images whose refCount is zero.
+	MaxSize uint64
+	mu      sync.Mutex
 }
 
 // NewImageCache creates a new ImageCache with default settings.
 func NewImageCache(logger *zap.Logger, imageCachePath string) *ImageCache {
 	return &ImageCache{
 		CachePath:       imageCachePath,
+		ImageFactoryURL: constants.ImageFactoryBaseURL,
 		CleanupInterval: DefaultCleanupInterval,
 		MaxAge:          DefaultMaxAge,
 		refs:            make(map[string]int),
 		lastUsed:        make(map[string]time.Time),
+		held:            make(map[string]*os.File),
+		reconfigured:    make(chan struct{}, 1),
+		metrics:         newCacheMetrics(),
 		logger:          logger,
 	}
 }
 
+// CacheSettings are the image cache settings which can be changed while it runs.
+//
+// Zero values keep the defaults.
+type CacheSettings struct {
+	ImageFactoryURL string
+	CleanupInterval time.Duration
+	MaxAge          time.Duration
+	MaxSize         uint64
+}
+
+// Reconfigure applies the settings; the images in use are not affected.
+func (c *ImageCache) Reconfigure(settings CacheSettings) {
+	c.mu.Lock()
+
+	c.ImageFactoryURL = cmp.Or(settings.ImageFactoryURL, constants.ImageFactoryBaseURL)
+	c.CleanupInterval = cmp.Or(settings.CleanupInterval, DefaultCleanupInterval)
+	c.MaxAge = cmp.Or(settings.MaxAge, DefaultMaxAge)
+	c.MaxSize = settings.MaxSize
+
+	c.mu.Unlock()
+
+	select {
+	case c.reconfigured <- struct{}{}:
+	default:
+	}
+}
+
+// ImageFormat is the format of the disk images downloaded from the image factory.
+type ImageFormat string
+
+const (
+	// ImageFormatQcow2 is the gzip compressed qcow2 image, used by the storage pools backed by a directory.
+	ImageFormatQcow2 ImageFormat = "qcow2.gz"
+	// ImageFormatRaw is the zstd compressed raw image, used by the block and network storage pools.
+	ImageFormatRaw ImageFormat = "raw.zst"
+)
+
+var imageFormats = []ImageFormat{ImageFormatQcow2, ImageFormatRaw}
+
 // cacheKey generates a unique cache key for an image.
-func cacheKey(schematicID, talosVersion string) string {
-	return fmt.Sprintf("%s-%s.qcow2.gz", schematicID, talosVersion)
+func cacheKey(schematicID, talosVersion string, format ImageFormat) string {
+	return fmt.Sprintf("%s-%s.%s", schematicID, talosVersion, format)
 }
 
 // Acquire increments the reference count for an image and downloads it, if necessary.
-// Returns the path to the cached image file.
+// Returns the path to the cached image file, see openImage.
 // The caller must call Release() when done with the image.
-func (c *ImageCache) Acquire(ctx context.Context, schematicID, talosVersion string) (string, error) {
-	key := cacheKey(schematicID, talosVersion)
+func (c *ImageCache) Acquire(ctx context.Context, schematicID, talosVersion string, format ImageFormat) (_ string, err error) {
+	ctx, span := tracer().Start(ctx, "image_cache.acquire", trace.WithAttributes(
+		attribute.String(attrSchematicID, schematicID),
+		attribute.String(attrTalosVersion, talosVersion),
+		attribute.String(attrImageFormat, string(format)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	key := cacheKey(schematicID, talosVersion, format)
 	filePath := filepath.Join(c.CachePath, key)
 
 	// Increment reference count
@@ -83,51 +152,144 @@ func (c *ImageCache) Acquire(ctx context.Context, schematicID, talosVersion stri
 	c.refs[key]++
 	c.mu.Unlock()
 
+	cached, err := c.fetch(ctx, key, filePath, schematicID, talosVersion, format)
+	if err == nil {
+		// the image was pruned by an image cache command between the lookup and the lock, it is downloaded again
+		if err = c.hold(key, filePath); errors.Is(err, errImagePruned) {
+			if cached, err = c.fetch(ctx, key, filePath, schematicID, talosVersion, format); err == nil {
+				err = c.hold(key, filePath)
+			}
+		}
+	}
+
+	span.SetAttributes(attribute.Bool(attrCacheHit, cached))
+
+	if err != nil {
+		// Decrement reference count on error
+		c.mu.Lock()
+		c.release(key)
+		c.mu.Unlock()
+
+		return "", err
+	}
+
+	return filePath, nil
+}
+
+// fetch downloads the image unless it is cached already, and reports whether it was.
+func (c *ImageCache) fetch(ctx context.Context, key, filePath, schematicID, talosVersion string, format ImageFormat) (bool, error) {
 	// Use singleflight to deduplicate concurrent downloads
-	_, err, _ := c.downloadGroup.Do(key, func() (any, error) {
+	hit, err, _ := c.downloadGroup.Do(key, func() (any, error) {
 		// Check if already cached
 		if _, statErr := os.Stat(filePath); statErr == nil {
+			c.metrics.hits.Inc()
+
+			// the modification time tells the image cache commands when the image was last used
+			os.Chtimes(filePath, time.Time{}, time.Now()) //nolint:errcheck
+
 			c.logger.Info(
 				"image already cached",
 				zap.String("key", key),
 				zap.String("filePath", filePath),
 			)
 
-			return "", nil
+			return true, nil
 		}
 
+		c.metrics.misses.Inc()
+
 		// Download the image
-		err := c.download(ctx, key, schematicID, talosVersion)
+		start := time.Now()
 
-		return nil, err
+		err := c.download(ctx, key, schematicID, talosVersion, format)
+		if err == nil {
+			c.metrics.downloadDuration.Observe(time.Since(start).Seconds())
+		}
+
+		return false, err
 	})
-	if err != nil {
-		// Decrement reference count on error
-		c.mu.Lock()
 
-		c.refs[key]--
-		if c.refs[key] <= 0 {
-			delete(c.refs, key)
+	cached, _ := hit.(bool)
+
+	return cached, err
+}
+
+// errImagePruned is returned by hold if the image was removed by an image cache command.
+var errImagePruned = errors.New("cached image was pruned")
+
+// hold takes a shared lock on the image while it is in use, so that the image cache commands, which run in other processes,
+// don't remove it, see Prune.
+func (c *ImageCache) hold(key, filePath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.held[key]; ok {
+		return nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errImagePruned
 		}
 
-		c.mu.Unlock()
+		return fmt.Errorf("error opening cached image: %w", err)
+	}
 
-		return "", err
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		f.Close() //nolint:errcheck
+
+		return fmt.Errorf("error locking cached image: %w", err)
 	}
 
-	return filePath, nil
+	// the image may have been removed between opening and locking it
+	opened, err := f.Stat()
+	if err != nil {
+		f.Close() //nolint:errcheck
+
+		return fmt.Errorf("error reading cached image info: %w", err)
+	}
+
+	if current, err := os.Stat(filePath); err != nil || !os.SameFile(opened, current) {
+		f.Close() //nolint:errcheck
+
+		return errImagePruned
+	}
+
+	c.held[key] = f
+
+	return nil
+}
+
+// release decrements the reference count for an image, and releases its lock once it isn't used anymore;
+// must be called with mu held.
+//
+// It reports whether the image isn't used anymore.
+func (c *ImageCache) release(key string) bool {
+	c.refs[key]--
+	if c.refs[key] > 0 {
+		return false
+	}
+
+	delete(c.refs, key)
+
+	if f, ok := c.held[key]; ok {
+		f.Close() //nolint:errcheck // closing the file releases the lock
+
+		delete(c.held, key)
+	}
+
+	return true
 }
 
 // Release decrements the reference count for an image and updates the last used time.
-func (c *ImageCache) Release(schematicID, talosVersion string) {
-	key := cacheKey(schematicID, talosVersion)
+func (c *ImageCache) Release(schematicID, talosVersion string, format ImageFormat) {
+	key := cacheKey(schematicID, talosVersion, format)
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.refs[key]--
-	if c.refs[key] <= 0 {
-		delete(c.refs, key)
+	if c.release(key) {
 		c.lastUsed[key] = time.Now()
 	}
 }
@@ -135,39 +297,53 @@ func (c *ImageCache) Release(schematicID, talosVersion string) {
 // Run starts the background cleanup goroutine.
 // It should be run in an errgroup alongside other components.
 func (c *ImageCache) Run(ctx context.Context) error {
-	ticker := time.NewTicker(c.CleanupInterval)
+	ticker := time.NewTicker(c.cleanupInterval())
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
+		case <-c.reconfigured:
+			ticker.Reset(c.cleanupInterval())
 		case <-ticker.C:
 			c.cleanup()
 		}
 	}
 }
 
+func (c *ImageCache) cleanupInterval() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.CleanupInterval
+}
+
 // cleanup removes cached images that are no longer in use and have exceeded MaxAge.
+//
+// If the cache is still larger than MaxSize, the least recently used images are removed as well.
 func (c *ImageCache) cleanup() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	now := time.Now()
 
-	entries, err := os.ReadDir(c.CachePath)
+	dirEntries, err := os.ReadDir(c.CachePath)
 	if err != nil {
 		c.logger.Warn("failed to read cache directory", zap.Error(err))
 
 		return
 	}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+	entries := make(map[string]os.DirEntry, len(dirEntries))
+
+	for _, entry := range dirEntries {
+		if !entry.IsDir() {
+			entries[entry.Name()] = entry
 		}
+	}
 
-		key := entry.Name()
+	for key := range entries {
 		filePath := filepath.Join(c.CachePath, key)
 
 		// Skip if still in use
@@ -196,37 +372,122 @@ func (c *ImageCache) cleanup() {
 			continue
 		}
 
-		// Remove the file
-		if err := os.Remove(filePath); err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				c.logger.Warn("failed to remove cached image",
-					zap.String("file", filePath),
-					zap.Error(err))
-			}
+		if c.remove(key) {
+			c.metrics.evictions.WithLabelValues("age").Inc()
+
+			delete(entries, key)
+		}
+	}
+
+	if c.MaxSize > 0 {
+		c.evict(entries)
+	}
+}
+
+// evict removes the least recently used images which are not in use, until the cache fits into MaxSize; must be called with mu held.
+func (c *ImageCache) evict(entries map[string]os.DirEntry) {
+	var (
+		size       uint64
+		candidates []string
+	)
 
+	for key, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
 			continue
 		}
 
-		delete(c.lastUsed, key)
-		c.logger.Info(
-			"removed cached image",
-			zap.String("key", key),
-			zap.String("filepath", filePath),
-		)
+		size += uint64(info.Size())
+
+		// downloads in progress are not images yet
+		if c.refs[key] == 0 && filepath.Ext(key) != ".tmp" {
+			candidates = append(candidates, key)
+		}
+	}
+
+	slices.SortFunc(candidates, func(a, b string) int {
+		return c.lastUsed[a].Compare(c.lastUsed[b])
+	})
+
+	for _, key := range candidates {
+		if size <= c.MaxSize {
+			return
+		}
+
+		info, err := entries[key].Info()
+		if err != nil {
+			continue
+		}
+
+		if c.remove(key) {
+			c.metrics.evictions.WithLabelValues("size").Inc()
+
+			size -= uint64(info.Size())
+		}
+	}
+}
+
+// remove deletes the cached image; must be called with mu held.
+func (c *ImageCache) remove(key string) bool {
+	filePath := filepath.Join(c.CachePath, key)
+
+	if err := os.Remove(filePath); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			c.logger.Warn("failed to remove cached image",
+				zap.String("file", filePath),
+				zap.Error(err))
+		}
+
+		return false
 	}
+
+	delete(c.lastUsed, key)
+	c.logger.Info(
+		"removed cached image",
+		zap.String("key", key),
+		zap.String("filepath", filePath),
+	)
+
+	return true
+}
+
+// removeUnused deletes the cached image unless a provider holds its lock; must be called with mu held.
+//
+// The image is removed while it is locked, so that a provider acquiring it in the meantime notices.
+func (c *ImageCache) removeUnused(key string) bool {
+	f, err := os.Open(filepath.Join(c.CachePath, key))
+	if err != nil {
+		return false
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		c.logger.Info("cached image in use by a provider, skip pruning", zap.String("key", key))
+
+		return false
+	}
+
+	return c.remove(key)
 }
 
 // download fetches an image from the image factory and saves it to the cache.
 // It uses a temporary file and atomic rename to prevent partial downloads.
-func (c *ImageCache) download(ctx context.Context, key, schematicID, talosVersion string) error {
-	imageURL, err := url.Parse(constants.ImageFactoryBaseURL)
+func (c *ImageCache) download(ctx context.Context, key, schematicID, talosVersion string, format ImageFormat) (err error) {
+	ctx, span := tracer().Start(ctx, "image_cache.download")
+	defer func() { endSpan(span, err) }()
+
+	c.mu.Lock()
+	factoryURL := c.ImageFactoryURL
+	c.mu.Unlock()
+
+	imageURL, err := url.Parse(factoryURL)
 	if err != nil {
 		return fmt.Errorf("failed to parse image factory URL: %w", err)
 	}
 
 	const (
 		arch     = "amd64"
-		format   = "qcow2.gz"
 		platform = "nocloud"
 	)
 
@@ -286,7 +547,10 @@ func (c *ImageCache) download(ctx context.Context, key, schematicID, talosVersio
 	}()
 
 	// Download to temp file
-	_, err = io.Copy(tempFile, res.Body)
+	written, err := io.Copy(tempFile, &countingReader{Reader: res.Body, counter: c.metrics.downloadBytes})
+
+	span.SetAttributes(attribute.Int64(attrBytes, written))
+
 	if err != nil {
 		tempFile.Close() //nolint:errcheck
 
@@ -315,3 +579,184 @@ func (c *ImageCache) download(ctx context.Context, key, schematicID, talosVersio
 
 	return nil
 }
+
+// openImage opens the cached image, and decompresses it.
+func openImage(filePath string, format ImageFormat) (io.ReadCloser, error) {
+	fh, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening local disk image: %w", err)
+	}
+
+	switch format {
+	case ImageFormatQcow2:
+		r, err := gzip.NewReader(fh)
+		if err != nil {
+			fh.Close() //nolint:errcheck
+
+			return nil, fmt.Errorf("error opening gzip image reader: %w", err)
+		}
+
+		return &imageReader{Reader: r, closers: []io.Closer{r, fh}}, nil
+	case ImageFormatRaw:
+		r, err := zstd.NewReader(fh)
+		if err != nil {
+			fh.Close() //nolint:errcheck
+
+			return nil, fmt.Errorf("error opening zstd image reader: %w", err)
+		}
+
+		return &imageReader{Reader: r, closers: []io.Closer{r.IOReadCloser(), fh}}, nil
+	default:
+		fh.Close() //nolint:errcheck
+
+		return nil, fmt.Errorf("unknown image format %q", format)
+	}
+}
+
+// imageReader reads the decompressed image, and closes the decompressor and the image file.
+type imageReader struct {
+	io.Reader
+
+	closers []io.Closer
+}
+
+func (r *imageReader) Close() error {
+	var errs []error
+
+	for _, closer := range r.closers {
+		errs = append(errs, closer.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// CachedImage is an image in the cache directory.
+type CachedImage struct {
+	// LastUsed is when the image was downloaded, or last found in the cache.
+	LastUsed     time.Time   `json:"last_used"`
+	File         string      `json:"file"`
+	SchematicID  string      `json:"schematic_id"`
+	TalosVersion string      `json:"talos_version"`
+	Format       ImageFormat `json:"format"`
+	Size         int64       `json:"size"`
+}
+
+// Images lists the images in the cache directory, the least recently used first.
+//
+// The downloads in progress are not listed.
+func (c *ImageCache) Images() ([]CachedImage, error) {
+	entries, err := os.ReadDir(c.CachePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cache directory: %w", err)
+	}
+
+	images := make([]CachedImage, 0, len(entries))
+
+	for _, entry := range entries {
+		schematicID, talosVersion, format, ok := parseCacheKey(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			// removed in the meantime
+			continue
+		}
+
+		images = append(images, CachedImage{
+			File:         entry.Name(),
+			SchematicID:  schematicID,
+			TalosVersion: talosVersion,
+			Format:       format,
+			Size:         info.Size(),
+			LastUsed:     info.ModTime(),
+		})
+	}
+
+	slices.SortFunc(images, func(a, b CachedImage) int { return a.LastUsed.Compare(b.LastUsed) })
+
+	return images, nil
+}
+
+// Prune removes the images which were not used for longer than maxAge, and returns them.
+//
+// A zero maxAge removes all the images. The images in use are kept: the ones acquired through this cache,
+// and the ones locked by the running providers sharing the cache directory, see hold.
+func (c *ImageCache) Prune(maxAge time.Duration) ([]CachedImage, error) {
+	images, err := c.Images()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var pruned []CachedImage
+
+	for _, image := range images {
+		if c.refs[image.File] > 0 || time.Since(image.LastUsed) < maxAge {
+			continue
+		}
+
+		if c.removeUnused(image.File) {
+			pruned = append(pruned, image)
+		}
+	}
+
+	return pruned, nil
+}
+
+// parseCacheKey returns the schematic ID, the Talos version and the format of the cached image file, see cacheKey.
+func parseCacheKey(key string) (schematicID, talosVersion string, format ImageFormat, ok bool) {
+	for _, format = range imageFormats {
+		name, found := strings.CutSuffix(key, "."+string(format))
+		if !found {
+			continue
+		}
+
+		// the schematic ID is a hex digest, the Talos version may contain dashes
+		schematicID, talosVersion, ok = strings.Cut(name, "-")
+
+		return schematicID, talosVersion, format, ok
+	}
+
+	return "", "", "", false
+}
+
+// Describe implements prometheus.Collector.
+func (c *ImageCache) Describe(ch chan<- *prometheus.Desc) {
+	c.metrics.hits.Describe(ch)
+	c.metrics.misses.Describe(ch)
+	c.metrics.evictions.Describe(ch)
+	c.metrics.downloadBytes.Describe(ch)
+	c.metrics.downloadDuration.Describe(ch)
+
+	ch <- c.metrics.bytesDesc
+}
+
+// Collect implements prometheus.Collector.
+//
+// The size of the cache is read from the cache directory on each scrape.
+func (c *ImageCache) Collect(ch chan<- prometheus.Metric) {
+	c.metrics.hits.Collect(ch)
+	c.metrics.misses.Collect(ch)
+	c.metrics.evictions.Collect(ch)
+	c.metrics.downloadBytes.Collect(ch)
+	c.metrics.downloadDuration.Collect(ch)
+
+	entries, err := os.ReadDir(c.CachePath)
+	if err != nil {
+		return
+	}
+
+	var size int64
+
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && !entry.IsDir() {
+			size += info.Size()
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.metrics.bytesDesc, prometheus.GaugeValue, float64(size))
+}
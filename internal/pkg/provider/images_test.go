@@ -0,0 +1,187 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+func TestImageCacheMaxSize(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	imageCache := provider.NewImageCache(zaptest.NewLogger(t), cacheDir)
+	imageCache.CleanupInterval = 10 * time.Millisecond
+	imageCache.MaxSize = 2048
+
+	versions := []string{"v1.10.0", "v1.11.0", "v1.12.0"}
+
+	for _, version := range versions {
+		require.NoError(t, os.WriteFile(filepath.Join(cacheDir, testSchematicID+"-"+version+".qcow2.gz"), make([]byte, 1024), 0o644))
+	}
+
+	// the oldest image is used least recently, the newest is still in use
+	for _, version := range versions {
+		_, err := imageCache.Acquire(t.Context(), testSchematicID, version, provider.ImageFormatQcow2)
+		require.NoError(t, err)
+
+		if version != versions[2] {
+			imageCache.Release(testSchematicID, version, provider.ImageFormatQcow2)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		assert.NoError(t, imageCache.Run(ctx))
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		entries, err := os.ReadDir(cacheDir)
+		require.NoError(collect, err)
+
+		names := make([]string, 0, len(entries))
+
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+
+		assert.Equal(collect, []string{
+			testSchematicID + "-v1.11.0.qcow2.gz",
+			testSchematicID + "-v1.12.0.qcow2.gz",
+		}, names)
+	}, time.Second, 10*time.Millisecond)
+
+	assert.EqualValues(t, 3, gather(t, imageCache, "omni_libvirt_provider_image_cache_hits_total", nil))
+	assert.EqualValues(t, 1, gather(t, imageCache, "omni_libvirt_provider_image_cache_evictions_total", map[string]string{"reason": "size"}))
+	assert.EqualValues(t, 2048, gather(t, imageCache, "omni_libvirt_provider_image_cache_bytes", nil))
+}
+
+func TestImageCacheReconfigure(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	imageCache := provider.NewImageCache(zaptest.NewLogger(t), cacheDir)
+
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, testSchematicID+"-v1.12.0.qcow2.gz"), make([]byte, 1024), 0o644))
+
+	_, err := imageCache.Acquire(t.Context(), testSchematicID, "v1.12.0", provider.ImageFormatQcow2)
+	require.NoError(t, err)
+
+	imageCache.Release(testSchematicID, "v1.12.0", provider.ImageFormatQcow2)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		assert.NoError(t, imageCache.Run(ctx))
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// the running cache picks up the shorter cleanup interval and the size limit
+	imageCache.Reconfigure(provider.CacheSettings{CleanupInterval: 10 * time.Millisecond, MaxSize: 512})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		entries, err := os.ReadDir(cacheDir)
+		require.NoError(collect, err)
+		assert.Empty(collect, entries)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestImageCachePrune(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	imageCache := provider.NewImageCache(zaptest.NewLogger(t), cacheDir)
+
+	for _, version := range []string{"v1.11.0", "v1.12.0", "v1.13.0-alpha.1"} {
+		require.NoError(t, os.WriteFile(filepath.Join(cacheDir, testSchematicID+"-"+version+".qcow2.gz"), make([]byte, 1024), 0o644))
+	}
+
+	// a download in progress
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "download-1.tmp"), nil, 0o644))
+
+	old := time.Now().Add(-2 * time.Hour)
+
+	for _, version := range []string{"v1.11.0", "v1.12.0"} {
+		require.NoError(t, os.Chtimes(filepath.Join(cacheDir, testSchematicID+"-"+version+".qcow2.gz"), old, old))
+	}
+
+	// a hit marks the image as used
+	_, err := imageCache.Acquire(t.Context(), testSchematicID, "v1.12.0", provider.ImageFormatQcow2)
+	require.NoError(t, err)
+
+	images, err := imageCache.Images()
+	require.NoError(t, err)
+	require.Len(t, images, 3)
+
+	assert.Equal(t, "v1.11.0", images[0].TalosVersion)
+	assert.Equal(t, testSchematicID, images[0].SchematicID)
+	assert.EqualValues(t, 1024, images[0].Size)
+
+	pruned, err := imageCache.Prune(time.Hour)
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, "v1.11.0", pruned[0].TalosVersion)
+
+	// the acquired image is kept
+	pruned, err = imageCache.Prune(0)
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, "v1.13.0-alpha.1", pruned[0].TalosVersion)
+
+	imageCache.Release(testSchematicID, "v1.12.0", provider.ImageFormatQcow2)
+
+	entries, err := os.ReadDir(cacheDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestImageCachePruneInUse(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, testSchematicID+"-"+testTalosVersion+".qcow2.gz"), make([]byte, 1024), 0o644))
+
+	imageCache := provider.NewImageCache(zaptest.NewLogger(t), cacheDir)
+
+	_, err := imageCache.Acquire(t.Context(), testSchematicID, testTalosVersion, provider.ImageFormatQcow2)
+	require.NoError(t, err)
+
+	// the cache command runs in another process
+	command := provider.NewImageCache(zaptest.NewLogger(t), cacheDir)
+
+	pruned, err := command.Prune(0)
+	require.NoError(t, err)
+	assert.Empty(t, pruned, "the image is in use by the provider")
+
+	imageCache.Release(testSchematicID, testTalosVersion, provider.ImageFormatQcow2)
+
+	pruned, err = command.Prune(0)
+	require.NoError(t, err)
+	assert.Len(t, pruned, 1)
+}
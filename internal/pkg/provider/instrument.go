@@ -0,0 +1,339 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentedConnector records the metrics of the libvirt calls made through the clients it provides.
+type instrumentedConnector struct {
+	Connector
+
+	metrics *metrics
+	host    string
+}
+
+// Client implements Connector.
+func (c instrumentedConnector) Client() (LibvirtClient, error) {
+	return c.clientContext(context.Background())
+}
+
+// clientContext returns the client which also traces the calls, as children of the span of the context.
+func (c instrumentedConnector) clientContext(ctx context.Context) (LibvirtClient, error) {
+	client, err := c.Connector.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return instrumentedClient{ctx: ctx, client: client, metrics: c.metrics, host: c.host}, nil
+}
+
+// hostClient returns the client of the host, the calls are traced as children of the span of the context.
+func hostClient(ctx context.Context, host Host) (LibvirtClient, error) {
+	if connector, ok := host.Connection.(instrumentedConnector); ok {
+		return connector.clientContext(ctx)
+	}
+
+	return host.Connection.Client()
+}
+
+// uninstrumentedClient returns the client of the host which neither records nor traces the calls.
+func uninstrumentedClient(host Host) (LibvirtClient, error) {
+	if connector, ok := host.Connection.(instrumentedConnector); ok {
+		return connector.Connector.Client()
+	}
+
+	return host.Connection.Client()
+}
+
+// instrumentedClient records the latency and the errors of the libvirt calls.
+//
+// The calls are traced only within a span, e.g. not the ones made by the health checks.
+type instrumentedClient struct {
+	ctx     context.Context //nolint:containedctx
+	client  LibvirtClient
+	metrics *metrics
+	host    string
+}
+
+// observe starts the measurement of the call, the returned function ends it with the call result.
+func (c instrumentedClient) observe(method string) func(err *error) {
+	_, end := c.observeSpan(method)
+
+	return end
+}
+
+// observeSpan is observe, which also returns the span of the call; it is a no-op span if the call isn't traced.
+func (c instrumentedClient) observeSpan(method string) (trace.Span, func(err *error)) {
+	start := time.Now()
+	span := trace.SpanFromContext(context.Background())
+
+	if trace.SpanContextFromContext(c.ctx).IsValid() {
+		_, span = tracer().Start(c.ctx, "libvirt."+method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String(attrHost, c.host)),
+		)
+	}
+
+	return span, func(err *error) {
+		c.metrics.rpcDuration.WithLabelValues(c.host, method).Observe(time.Since(start).Seconds())
+
+		if *err != nil {
+			c.metrics.rpcErrors.WithLabelValues(c.host, method).Inc()
+		}
+
+		endSpan(span, *err)
+	}
+}
+
+func (c instrumentedClient) ConnectGetLibVersion() (_ uint64, err error) {
+	defer c.observe("ConnectGetLibVersion")(&err)
+
+	return c.client.ConnectGetLibVersion()
+}
+
+//nolint:gocritic
+func (c instrumentedClient) NodeGetInfo() (rModel [32]int8, rMemory uint64, rCpus int32, rMhz int32, rNodes int32, rSockets int32, rCores int32, rThreads int32, err error) {
+	defer c.observe("NodeGetInfo")(&err)
+
+	return c.client.NodeGetInfo()
+}
+
+func (c instrumentedClient) NodeGetFreeMemory() (_ uint64, err error) {
+	defer c.observe("NodeGetFreeMemory")(&err)
+
+	return c.client.NodeGetFreeMemory()
+}
+
+func (c instrumentedClient) ConnectListAllDomains(needResults int32, flags libvirt.ConnectListAllDomainsFlags) (_ []libvirt.Domain, _ uint32, err error) {
+	defer c.observe("ConnectListAllDomains")(&err)
+
+	return c.client.ConnectListAllDomains(needResults, flags)
+}
+
+func (c instrumentedClient) DomainLookupByUUID(uuid libvirt.UUID) (_ libvirt.Domain, err error) {
+	defer c.observe("DomainLookupByUUID")(&err)
+
+	return c.client.DomainLookupByUUID(uuid)
+}
+
+func (c instrumentedClient) DomainLookupByName(name string) (_ libvirt.Domain, err error) {
+	defer c.observe("DomainLookupByName")(&err)
+
+	return c.client.DomainLookupByName(name)
+}
+
+func (c instrumentedClient) DomainGetState(dom libvirt.Domain, flags uint32) (_, _ int32, err error) {
+	defer c.observe("DomainGetState")(&err)
+
+	return c.client.DomainGetState(dom, flags)
+}
+
+func (c instrumentedClient) DomainGetMetadata(dom libvirt.Domain, typ int32, uri libvirt.OptString, flags libvirt.DomainModificationImpact) (_ string, err error) {
+	defer c.observe("DomainGetMetadata")(&err)
+
+	return c.client.DomainGetMetadata(dom, typ, uri, flags)
+}
+
+//nolint:gocritic
+func (c instrumentedClient) DomainGetInfo(dom libvirt.Domain) (rState uint8, rMaxMem uint64, rMemory uint64, rNrVirtCPU uint16, rCPUTime uint64, err error) {
+	defer c.observe("DomainGetInfo")(&err)
+
+	return c.client.DomainGetInfo(dom)
+}
+
+func (c instrumentedClient) DomainGetXMLDesc(dom libvirt.Domain, flags libvirt.DomainXMLFlags) (_ string, err error) {
+	defer c.observe("DomainGetXMLDesc")(&err)
+
+	return c.client.DomainGetXMLDesc(dom, flags)
+}
+
+func (c instrumentedClient) DomainDefineXML(xml string) (_ libvirt.Domain, err error) {
+	defer c.observe("DomainDefineXML")(&err)
+
+	return c.client.DomainDefineXML(xml)
+}
+
+func (c instrumentedClient) DomainCreate(dom libvirt.Domain) (err error) {
+	defer c.observe("DomainCreate")(&err)
+
+	return c.client.DomainCreate(dom)
+}
+
+func (c instrumentedClient) DomainDestroy(dom libvirt.Domain) (err error) {
+	defer c.observe("DomainDestroy")(&err)
+
+	return c.client.DomainDestroy(dom)
+}
+
+func (c instrumentedClient) DomainUndefine(dom libvirt.Domain) (err error) {
+	defer c.observe("DomainUndefine")(&err)
+
+	return c.client.DomainUndefine(dom)
+}
+
+func (c instrumentedClient) DomainSnapshotCreateXML(dom libvirt.Domain, xml string, flags uint32) (_ libvirt.DomainSnapshot, err error) {
+	defer c.observe("DomainSnapshotCreateXML")(&err)
+
+	return c.client.DomainSnapshotCreateXML(dom, xml, flags)
+}
+
+func (c instrumentedClient) DomainListAllSnapshots(dom libvirt.Domain, needResults int32, flags uint32) (_ []libvirt.DomainSnapshot, _ int32, err error) {
+	defer c.observe("DomainListAllSnapshots")(&err)
+
+	return c.client.DomainListAllSnapshots(dom, needResults, flags)
+}
+
+func (c instrumentedClient) DomainSnapshotLookupByName(dom libvirt.Domain, name string, flags uint32) (_ libvirt.DomainSnapshot, err error) {
+	defer c.observe("DomainSnapshotLookupByName")(&err)
+
+	return c.client.DomainSnapshotLookupByName(dom, name, flags)
+}
+
+func (c instrumentedClient) DomainSnapshotGetXMLDesc(snap libvirt.DomainSnapshot, flags uint32) (_ string, err error) {
+	defer c.observe("DomainSnapshotGetXMLDesc")(&err)
+
+	return c.client.DomainSnapshotGetXMLDesc(snap, flags)
+}
+
+func (c instrumentedClient) DomainSnapshotDelete(snap libvirt.DomainSnapshot, flags libvirt.DomainSnapshotDeleteFlags) (err error) {
+	defer c.observe("DomainSnapshotDelete")(&err)
+
+	return c.client.DomainSnapshotDelete(snap, flags)
+}
+
+func (c instrumentedClient) StoragePoolLookupByName(name string) (_ libvirt.StoragePool, err error) {
+	defer c.observe("StoragePoolLookupByName")(&err)
+
+	return c.client.StoragePoolLookupByName(name)
+}
+
+//nolint:gocritic
+func (c instrumentedClient) StoragePoolGetInfo(pool libvirt.StoragePool) (rState uint8, rCapacity uint64, rAllocation uint64, rAvailable uint64, err error) {
+	defer c.observe("StoragePoolGetInfo")(&err)
+
+	return c.client.StoragePoolGetInfo(pool)
+}
+
+func (c instrumentedClient) StoragePoolGetXMLDesc(pool libvirt.StoragePool, flags libvirt.StorageXMLFlags) (_ string, err error) {
+	defer c.observe("StoragePoolGetXMLDesc")(&err)
+
+	return c.client.StoragePoolGetXMLDesc(pool, flags)
+}
+
+func (c instrumentedClient) StoragePoolListAllVolumes(pool libvirt.StoragePool, needResults int32, flags uint32) (_ []libvirt.StorageVol, _ uint32, err error) {
+	defer c.observe("StoragePoolListAllVolumes")(&err)
+
+	return c.client.StoragePoolListAllVolumes(pool, needResults, flags)
+}
+
+func (c instrumentedClient) StorageVolLookupByName(pool libvirt.StoragePool, name string) (_ libvirt.StorageVol, err error) {
+	defer c.observe("StorageVolLookupByName")(&err)
+
+	return c.client.StorageVolLookupByName(pool, name)
+}
+
+func (c instrumentedClient) StorageVolCreateXML(pool libvirt.StoragePool, xml string, flags libvirt.StorageVolCreateFlags) (_ libvirt.StorageVol, err error) {
+	defer c.observe("StorageVolCreateXML")(&err)
+
+	return c.client.StorageVolCreateXML(pool, xml, flags)
+}
+
+func (c instrumentedClient) StorageVolCreateXMLFrom(pool libvirt.StoragePool, xml string, clonevol libvirt.StorageVol, flags libvirt.StorageVolCreateFlags) (_ libvirt.StorageVol, err error) {
+	defer c.observe("StorageVolCreateXMLFrom")(&err)
+
+	return c.client.StorageVolCreateXMLFrom(pool, xml, clonevol, flags)
+}
+
+//nolint:gocritic
+func (c instrumentedClient) StorageVolGetInfo(vol libvirt.StorageVol) (rType int8, rCapacity uint64, rAllocation uint64, err error) {
+	defer c.observe("StorageVolGetInfo")(&err)
+
+	return c.client.StorageVolGetInfo(vol)
+}
+
+func (c instrumentedClient) StorageVolGetXMLDesc(vol libvirt.StorageVol, flags uint32) (_ string, err error) {
+	defer c.observe("StorageVolGetXMLDesc")(&err)
+
+	return c.client.StorageVolGetXMLDesc(vol, flags)
+}
+
+func (c instrumentedClient) StorageVolDelete(vol libvirt.StorageVol, flags libvirt.StorageVolDeleteFlags) (err error) {
+	defer c.observe("StorageVolDelete")(&err)
+
+	return c.client.StorageVolDelete(vol, flags)
+}
+
+// StorageVolUpload also counts the uploaded bytes, the upload throughput is their rate.
+//
+// The span records the time spent reading the stream, i.e. decoding the image, apart from the upload itself.
+func (c instrumentedClient) StorageVolUpload(vol libvirt.StorageVol, outStream io.Reader, offset, length uint64, flags libvirt.StorageVolUploadFlags) (err error) {
+	span, end := c.observeSpan("StorageVolUpload")
+	defer end(&err)
+
+	stream := &timedReader{Reader: &countingReader{Reader: outStream, counter: c.metrics.uploadBytes.WithLabelValues(c.host)}}
+
+	defer func() {
+		span.SetAttributes(attribute.Int64(attrBytes, stream.n), attribute.Float64(attrDecodeTime, stream.elapsed.Seconds()))
+	}()
+
+	return c.client.StorageVolUpload(vol, stream, offset, length, flags)
+}
+
+// timedReader measures the time spent in the reads.
+type timedReader struct {
+	io.Reader
+
+	n       int64
+	elapsed time.Duration
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+
+	n, err := r.Reader.Read(p)
+
+	r.elapsed += time.Since(start)
+	r.n += int64(n)
+
+	return n, err
+}
+
+func (c instrumentedClient) StorageVolResize(vol libvirt.StorageVol, capacity uint64, flags libvirt.StorageVolResizeFlags) (err error) {
+	defer c.observe("StorageVolResize")(&err)
+
+	return c.client.StorageVolResize(vol, capacity, flags)
+}
+
+func (c instrumentedClient) SecretLookupByUUID(id libvirt.UUID) (_ libvirt.Secret, err error) {
+	defer c.observe("SecretLookupByUUID")(&err)
+
+	return c.client.SecretLookupByUUID(id)
+}
+
+func (c instrumentedClient) SecretDefineXML(xml string, flags uint32) (_ libvirt.Secret, err error) {
+	defer c.observe("SecretDefineXML")(&err)
+
+	return c.client.SecretDefineXML(xml, flags)
+}
+
+func (c instrumentedClient) SecretSetValue(secret libvirt.Secret, value []byte, flags uint32) (err error) {
+	defer c.observe("SecretSetValue")(&err)
+
+	return c.client.SecretSetValue(secret, value, flags)
+}
+
+func (c instrumentedClient) SecretUndefine(secret libvirt.Secret) (err error) {
+	defer c.observe("SecretUndefine")(&err)
+
+	return c.client.SecretUndefine(secret)
+}
@@ -0,0 +1,440 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/digitalocean/go-libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// VM is a domain managed by the provider.
+type VM struct {
+	Name       string   `json:"name"`
+	Host       string   `json:"host"`
+	RequestID  string   `json:"request_id"`
+	Cluster    string   `json:"cluster,omitempty"`
+	MachineSet string   `json:"machine_set,omitempty"`
+	State      string   `json:"state"`
+	UUID       string   `json:"uuid"`
+	Disks      []VMDisk `json:"disks"`
+	// Memory is in bytes.
+	Memory uint64 `json:"memory"`
+	VCPUs  uint   `json:"vcpus"`
+}
+
+// VMDisk is a disk attached to a VM.
+type VMDisk struct {
+	Target string `json:"target"`
+	Bus    string `json:"bus,omitempty"`
+	Device string `json:"device"`
+	Pool   string `json:"pool,omitempty"`
+	Volume string `json:"volume,omitempty"`
+	// Path is the source of the disks which are not storage pool volumes.
+	Path string `json:"path,omitempty"`
+	// Capacity is in bytes, zero if the volume can't be found.
+	Capacity uint64 `json:"capacity,omitempty"`
+}
+
+// OrphanVolume is a volume named like the ones the provider creates, which no domain on its host uses.
+type OrphanVolume struct {
+	Host      string `json:"host"`
+	Pool      string `json:"pool"`
+	Name      string `json:"name"`
+	RequestID string `json:"request_id"`
+	// Capacity is in bytes.
+	Capacity uint64 `json:"capacity"`
+}
+
+// ErrVMNotFound is returned by VM when no host has the managed domain.
+var ErrVMNotFound = errors.New("VM not found")
+
+// volumeNamePattern matches the names of the volumes created for a machine request:
+// the primary disk, the additional disks and the cidata ISO.
+var volumeNamePattern = regexp.MustCompile(`^(.+?)(?:-\d+-[a-z0-9]+\.(?:qcow2|raw)|-cidata\.iso|\.(?:qcow2|raw))$`)
+
+// VMs lists the domains managed by the provider on all the hosts.
+//
+// The hosts which can't be queried are reported in the error, the VMs of the other hosts are still returned.
+func (p *Provisioner) VMs(ctx context.Context) ([]VM, error) {
+	var (
+		vms  []VM
+		errs []error
+	)
+
+	for _, host := range p.hostList() {
+		hostVMs, err := listVMs(ctx, host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("libvirt host %q: %w", host.Name, err))
+
+			continue
+		}
+
+		vms = append(vms, hostVMs...)
+	}
+
+	return vms, errors.Join(errs...)
+}
+
+// VM returns the managed domain with the given name, which is the machine request ID.
+func (p *Provisioner) VM(ctx context.Context, name string) (VM, error) {
+	var errs []error
+
+	for _, host := range p.hostList() {
+		vm, found, err := lookupVM(ctx, host, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("libvirt host %q: %w", host.Name, err))
+
+			continue
+		}
+
+		if found {
+			return vm, nil
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return VM{}, err
+	}
+
+	return VM{}, fmt.Errorf("%w: %q", ErrVMNotFound, name)
+}
+
+// OrphanVolumes lists the volumes which are named like the volumes of a machine request, but which no domain uses.
+//
+// The storage pools of the policy and the ones used by the managed domains are searched.
+// The volumes are only listed, it is up to the operator to check that they can be removed.
+func (p *Provisioner) OrphanVolumes(ctx context.Context) ([]OrphanVolume, error) {
+	var (
+		orphans []OrphanVolume
+		errs    []error
+	)
+
+	pools := p.healthCheckedPools()
+
+	for _, host := range p.hostList() {
+		hostOrphans, err := listOrphanVolumes(ctx, host, pools)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("libvirt host %q: %w", host.Name, err))
+
+			continue
+		}
+
+		orphans = append(orphans, hostOrphans...)
+	}
+
+	return orphans, errors.Join(errs...)
+}
+
+func listVMs(ctx context.Context, host Host) ([]VM, error) {
+	lc, err := hostClient(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	domains, _, err := lc.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive|libvirt.ConnectListDomainsInactive)
+	if err != nil {
+		return nil, fmt.Errorf("error listing domains: %w", err)
+	}
+
+	vms := make([]VM, 0, len(domains))
+
+	for _, dom := range domains {
+		vm, ok, err := describeVM(lc, host.Name, dom)
+		if err != nil {
+			if libvirt.IsNotFound(err) {
+				// removed in the meantime
+				continue
+			}
+
+			return nil, fmt.Errorf("error describing domain %q: %w", dom.Name, err)
+		}
+
+		if ok {
+			vms = append(vms, vm)
+		}
+	}
+
+	slices.SortFunc(vms, func(a, b VM) int { return cmp.Compare(a.Name, b.Name) })
+
+	return vms, nil
+}
+
+func lookupVM(ctx context.Context, host Host, name string) (VM, bool, error) {
+	lc, err := hostClient(ctx, host)
+	if err != nil {
+		return VM{}, false, err
+	}
+
+	dom, err := lc.DomainLookupByName(name)
+	if err != nil {
+		if libvirt.IsNotFound(err) {
+			return VM{}, false, nil
+		}
+
+		return VM{}, false, fmt.Errorf("error looking up domain: %w", err)
+	}
+
+	vm, ok, err := describeVM(lc, host.Name, dom)
+	if err != nil && libvirt.IsNotFound(err) {
+		return VM{}, false, nil
+	}
+
+	return vm, ok, err
+}
+
+// describeVM returns the VM of the domain, or false if the domain is not managed by the provider.
+func describeVM(lc LibvirtClient, hostName string, dom libvirt.Domain) (VM, bool, error) {
+	owner, ok, err := domainOwnerOf(lc, dom)
+	if err != nil || !ok {
+		return VM{}, false, err
+	}
+
+	state, _, err := lc.DomainGetState(dom, 0)
+	if err != nil {
+		return VM{}, false, fmt.Errorf("error fetching domain state: %w", err)
+	}
+
+	raw, err := lc.DomainGetXMLDesc(dom, libvirt.DomainXMLInactive)
+	if err != nil {
+		return VM{}, false, fmt.Errorf("error fetching domain XML: %w", err)
+	}
+
+	var def libvirtxml.Domain
+
+	if err = def.Unmarshal(raw); err != nil {
+		return VM{}, false, fmt.Errorf("error parsing domain XML: %w", err)
+	}
+
+	vm := VM{
+		Name:       dom.Name,
+		Host:       hostName,
+		RequestID:  owner.RequestID,
+		Cluster:    owner.Cluster,
+		MachineSet: owner.MachineSet,
+		State:      domainStateName(libvirt.DomainState(state)),
+		UUID:       def.UUID,
+		Disks:      []VMDisk{},
+	}
+
+	if def.Memory != nil {
+		vm.Memory = memoryBytes(def.Memory.Value, def.Memory.Unit)
+	}
+
+	if def.VCPU != nil {
+		vm.VCPUs = def.VCPU.Value
+	}
+
+	if def.Devices != nil {
+		for _, disk := range def.Devices.Disks {
+			vm.Disks = append(vm.Disks, describeDisk(lc, disk))
+		}
+	}
+
+	return vm, true, nil
+}
+
+func describeDisk(lc LibvirtClient, disk libvirtxml.DomainDisk) VMDisk {
+	vmDisk := VMDisk{Device: cmp.Or(disk.Device, "disk")}
+
+	if disk.Target != nil {
+		vmDisk.Target = disk.Target.Dev
+		vmDisk.Bus = disk.Target.Bus
+	}
+
+	if disk.Source == nil {
+		return vmDisk
+	}
+
+	switch {
+	case disk.Source.Volume != nil:
+		vmDisk.Pool = disk.Source.Volume.Pool
+		vmDisk.Volume = disk.Source.Volume.Volume
+
+		if vol, err := getVol(lc, vmDisk.Pool, vmDisk.Volume); err == nil {
+			if _, capacity, _, err := lc.StorageVolGetInfo(vol); err == nil {
+				vmDisk.Capacity = capacity
+			}
+		}
+	case disk.Source.File != nil:
+		vmDisk.Path = disk.Source.File.File
+	case disk.Source.Block != nil:
+		vmDisk.Path = disk.Source.Block.Dev
+	case disk.Source.Network != nil:
+		vmDisk.Path = disk.Source.Network.Protocol + ":" + disk.Source.Network.Name
+	}
+
+	return vmDisk
+}
+
+// diskSourceKey identifies the volume, the file, the block device or the network disk of the disk source.
+func diskSourceKey(source *libvirtxml.DomainDiskSource) string {
+	switch {
+	case source == nil:
+		return ""
+	case source.Volume != nil:
+		return "volume:" + source.Volume.Pool + "/" + source.Volume.Volume
+	case source.File != nil:
+		return "path:" + source.File.File
+	case source.Block != nil:
+		return "path:" + source.Block.Dev
+	case source.Network != nil:
+		return "network:" + source.Network.Protocol + ":" + source.Network.Name
+	default:
+		return ""
+	}
+}
+
+// domainStateName returns the name of the domain state, as used by the domains metric.
+func domainStateName(state libvirt.DomainState) string {
+	if name, ok := domainStates[state]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// memoryBytes converts the memory size of the domain XML to bytes, the unit defaults to KiB.
+func memoryBytes(value uint, unit string) uint64 {
+	switch unit {
+	case "b", "bytes":
+		return uint64(value)
+	case "", "k", "KiB":
+		return uint64(value) * 1024
+	case "M", "MiB":
+		return uint64(value) * MiB
+	case "G", "GiB":
+		return uint64(value) * GiB
+	default:
+		return 0
+	}
+}
+
+// listOrphanVolumes lists the orphan volumes of the host in the given pools, and in the pools used by the managed domains.
+//
+//nolint:gocognit
+func listOrphanVolumes(ctx context.Context, host Host, pools []string) ([]OrphanVolume, error) {
+	lc, err := hostClient(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	domains, _, err := lc.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive|libvirt.ConnectListDomainsInactive)
+	if err != nil {
+		return nil, fmt.Errorf("error listing domains: %w", err)
+	}
+
+	pools = slices.Clone(pools)
+	// the sources of the disks of any domain, see diskSourceKey
+	usedSources := map[string]struct{}{}
+
+	for _, dom := range domains {
+		raw, err := lc.DomainGetXMLDesc(dom, libvirt.DomainXMLInactive)
+		if err != nil {
+			if libvirt.IsNotFound(err) {
+				continue
+			}
+
+			return nil, fmt.Errorf("error fetching XML of domain %q: %w", dom.Name, err)
+		}
+
+		var def libvirtxml.Domain
+
+		if err = def.Unmarshal(raw); err != nil {
+			return nil, fmt.Errorf("error parsing XML of domain %q: %w", dom.Name, err)
+		}
+
+		if def.Devices == nil {
+			continue
+		}
+
+		for _, disk := range def.Devices.Disks {
+			if key := diskSourceKey(disk.Source); key != "" {
+				usedSources[key] = struct{}{}
+			}
+
+			if disk.Source != nil && disk.Source.Volume != nil && !slices.Contains(pools, disk.Source.Volume.Pool) {
+				pools = append(pools, disk.Source.Volume.Pool)
+			}
+		}
+	}
+
+	var orphans []OrphanVolume
+
+	for _, poolName := range pools {
+		pool, err := lc.StoragePoolLookupByName(poolName)
+		if err != nil {
+			if isLibvirtError(err, libvirt.ErrNoStoragePool) {
+				continue
+			}
+
+			return nil, fmt.Errorf("error looking up storage pool %q: %w", poolName, err)
+		}
+
+		// the disks backed by the block and network pools refer to the volumes by their device or image name
+		poolDef, poolErr := lookupStoragePool(lc, poolName)
+
+		volumes, _, err := lc.StoragePoolListAllVolumes(pool, 1, 0)
+		if err != nil {
+			return nil, fmt.Errorf("error listing volumes of storage pool %q: %w", poolName, err)
+		}
+
+		for _, vol := range volumes {
+			match := volumeNamePattern.FindStringSubmatch(vol.Name)
+			if match == nil {
+				continue
+			}
+
+			keys := []string{
+				diskSourceKey(&libvirtxml.DomainDiskSource{Volume: &libvirtxml.DomainDiskSourceVolume{Pool: poolName, Volume: vol.Name}}),
+				"path:" + vol.Key,
+			}
+
+			if poolErr == nil {
+				keys = append(keys, diskSourceKey(poolDef.diskSource(vol.Name)))
+			}
+
+			if slices.ContainsFunc(keys, func(key string) bool {
+				_, ok := usedSources[key]
+
+				return ok
+			}) {
+				continue
+			}
+
+			_, capacity, _, err := lc.StorageVolGetInfo(vol)
+			if err != nil {
+				if isLibvirtError(err, libvirt.ErrNoStorageVol) {
+					continue
+				}
+
+				return nil, fmt.Errorf("error fetching info of volume %q: %w", vol.Name, err)
+			}
+
+			orphans = append(orphans, OrphanVolume{
+				Host:      host.Name,
+				Pool:      poolName,
+				Name:      vol.Name,
+				RequestID: match[1],
+				Capacity:  capacity,
+			})
+		}
+	}
+
+	return orphans, nil
+}
+
+// isLibvirtError reports whether the error is a libvirt error with the given code.
+func isLibvirtError(err error, code libvirt.ErrorNumber) bool {
+	var libvirtErr libvirt.Error
+
+	return errors.As(err, &libvirtErr) && libvirtErr.Code == uint32(code)
+}
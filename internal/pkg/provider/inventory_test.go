@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/libvirtfake"
+)
+
+func TestVMs(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "createVM")
+
+	// not managed by the provider
+	_, err := env.lv.DomainDefineXML(`<domain type="kvm"><name>other</name><memory>1024</memory></domain>`)
+	require.NoError(t, err)
+
+	vms, err := env.provisioner.VMs(t.Context())
+	require.NoError(t, err)
+	require.Len(t, vms, 1)
+
+	vm := vms[0]
+
+	assert.Equal(t, testRequestID, vm.Name)
+	assert.Equal(t, testRequestID, vm.RequestID)
+	assert.Equal(t, config.DefaultHostName, vm.Host)
+	assert.Equal(t, testCluster, vm.Cluster)
+	assert.Equal(t, testMachineSet, vm.MachineSet)
+	assert.Equal(t, "shutoff", vm.State)
+	assert.Equal(t, env.spec().Value.Uuid, vm.UUID)
+	assert.EqualValues(t, 4096*provider.MiB, vm.Memory)
+	assert.EqualValues(t, 2, vm.VCPUs)
+
+	require.Len(t, vm.Disks, 2)
+	assert.Equal(t, provider.VMDisk{Target: "vda", Bus: "virtio", Device: "disk", Pool: testPool, Volume: testRequestID + ".qcow2", Capacity: 10 * provider.GiB}, vm.Disks[0])
+	assert.Equal(t, "cdrom", vm.Disks[1].Device)
+	assert.Equal(t, testRequestID+"-cidata.iso", vm.Disks[1].Volume)
+
+	shown, err := env.provisioner.VM(t.Context(), testRequestID)
+	require.NoError(t, err)
+	assert.Equal(t, vm, shown)
+
+	_, err = env.provisioner.VM(t.Context(), "other")
+	require.ErrorIs(t, err, provider.ErrVMNotFound)
+
+	_, err = env.provisioner.VM(t.Context(), "missing")
+	require.ErrorIs(t, err, provider.ErrVMNotFound)
+}
+
+func TestVMsDisconnected(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "createVM")
+
+	env.provisioner = provider.NewProvisioner([]provider.Host{
+		{Name: config.DefaultHostName, Connection: provider.Connected(env.lv)},
+		{Name: testSecondaryHost, Connection: &flakyConnector{client: env.secondary}},
+	}, env.scheduler, nil)
+
+	// the first call of the flaky connector succeeds
+	_, err := env.provisioner.VMs(t.Context())
+	require.NoError(t, err)
+
+	vms, err := env.provisioner.VMs(t.Context())
+	require.ErrorContains(t, err, `libvirt host "secondary"`)
+	require.Len(t, vms, 1)
+}
+
+func TestOrphanVolumes(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "createVM")
+
+	env.lv.AddVolume(testPool, libvirtfake.Volume{Name: "request-0.qcow2", Capacity: provider.GiB})
+	env.lv.AddVolume(testPool, libvirtfake.Volume{Name: "request-0-0-ssd.qcow2", Capacity: provider.GiB})
+	env.lv.AddVolume(testPool, libvirtfake.Volume{Name: "request-0-cidata.iso", Capacity: provider.MiB})
+	// not named like the volumes of the provider
+	env.lv.AddVolume(testPool, libvirtfake.Volume{Name: "debian.img", Capacity: provider.GiB})
+
+	orphans, err := env.provisioner.OrphanVolumes(t.Context())
+	require.NoError(t, err)
+
+	assert.Equal(t, []provider.OrphanVolume{
+		{Host: config.DefaultHostName, Pool: testPool, Name: "request-0-0-ssd.qcow2", RequestID: "request-0", Capacity: provider.GiB},
+		{Host: config.DefaultHostName, Pool: testPool, Name: "request-0-cidata.iso", RequestID: "request-0", Capacity: provider.MiB},
+		{Host: config.DefaultHostName, Pool: testPool, Name: "request-0.qcow2", RequestID: "request-0", Capacity: provider.GiB},
+	}, orphans)
+}
@@ -0,0 +1,1652 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package libvirtfake implements a stateful in-memory fake of the libvirt RPC API used by the provider.
+//
+// The fake models storage pools, volumes and domains closely enough to exercise the provisioning
+// and deprovisioning logic: lookups fail with the same error codes and messages as a real libvirtd,
+// domains move through the defined/running/shut off states, and volume uploads are stored in memory.
+package libvirtfake
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+	"libvirt.org/go/libvirtxml"
+)
+
+// Volume is a storage volume held by the fake.
+type Volume struct {
+	Name   string
+	Format string
+	// Secret is the UUID of the secret of the passphrase of a LUKS encrypted volume.
+	Secret   string
+	Data     []byte
+	Capacity uint64
+}
+
+// Domain is a domain held by the fake.
+type Domain struct {
+	Definition *libvirtxml.Domain
+	Name       string
+	XML        string
+	// Snapshots are in the order they were created.
+	Snapshots []Snapshot
+	// current is the name of the current snapshot, the parent of the next one.
+	current string
+	State   libvirt.DomainState
+	UUID    libvirt.UUID
+	ID      int32
+}
+
+// Snapshot is a domain snapshot held by the fake.
+type Snapshot struct {
+	Definition *libvirtxml.DomainSnapshot
+	Name       string
+	Parent     string
+}
+
+// Secret is a secret held by the fake.
+type Secret struct {
+	Definition libvirtxml.Secret
+	Value      []byte
+}
+
+// Node is the host capacity reported by the fake.
+type Node struct {
+	// Memory is in bytes.
+	Memory uint64
+	CPUs   int32
+}
+
+// DefaultNode is the capacity of the host, unless changed with SetNode.
+var DefaultNode = Node{
+	Memory: 32 << 30,
+	CPUs:   8,
+}
+
+// DefaultLibVersion is the libvirt version reported by the fake, unless changed with SetLibVersion.
+const DefaultLibVersion = 12_002_000
+
+// DefaultPoolCapacity is the capacity of the storage pools, unless changed with SetPoolCapacity.
+const DefaultPoolCapacity = 1 << 40
+
+type pool struct {
+	volumes  map[string]*Volume
+	def      libvirtxml.StoragePool
+	uuid     libvirt.UUID
+	capacity uint64
+}
+
+type injectedError struct {
+	err  error
+	skip int
+}
+
+// Libvirt is an in-memory fake of the libvirt RPC API.
+//
+// All methods are safe for concurrent use.
+type Libvirt struct {
+	node         Node
+	libVersion   uint64
+	pools        map[string]*pool
+	domains      map[string]*Domain
+	secrets      map[libvirt.UUID]*Secret
+	errors       map[string][]*injectedError
+	calls        map[string]int
+	disconnected chan struct{}
+	nextID       int32
+	mu           sync.Mutex
+}
+
+// New creates a new fake with the given storage pools defined.
+func New(pools ...string) *Libvirt {
+	l := &Libvirt{
+		node:       DefaultNode,
+		libVersion: DefaultLibVersion,
+		pools:      make(map[string]*pool),
+		domains:    make(map[string]*Domain),
+		secrets:    make(map[libvirt.UUID]*Secret),
+		errors:     make(map[string][]*injectedError),
+		calls:      make(map[string]int),
+		nextID:     1,
+
+		disconnected: make(chan struct{}),
+	}
+
+	for _, name := range pools {
+		l.AddPool(name)
+	}
+
+	return l
+}
+
+// AddPool defines a new empty directory storage pool.
+func (l *Libvirt) AddPool(name string) {
+	l.DefinePool(libvirtxml.StoragePool{
+		Type:   "dir",
+		Name:   name,
+		Target: &libvirtxml.StoragePoolTarget{Path: "/var/lib/libvirt/images"},
+	})
+}
+
+// DefinePool defines a new empty storage pool, e.g. a logical or an RBD one.
+//
+// Only raw volumes can be created in the pools which are not backed by a directory, and none in the
+// pools of existing LUNs, such as the iSCSI ones.
+func (l *Libvirt) DefinePool(def libvirtxml.StoragePool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.pools[def.Name]; ok {
+		return
+	}
+
+	l.pools[def.Name] = &pool{
+		def:      def,
+		uuid:     libvirt.UUID(uuid.New()),
+		volumes:  make(map[string]*Volume),
+		capacity: DefaultPoolCapacity,
+	}
+}
+
+// SetNode changes the host capacity.
+//
+// The free memory of the host is its memory minus the memory of the running domains.
+func (l *Libvirt) SetNode(node Node) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.node = node
+}
+
+// SetLibVersion changes the libvirt version of the host, as major * 1,000,000 + minor * 1,000 + release.
+func (l *Libvirt) SetLibVersion(version uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.libVersion = version
+}
+
+// SetPoolCapacity changes the capacity of the storage pool.
+//
+// Volumes are fully allocated: the available space is the capacity minus the capacity of all volumes.
+func (l *Libvirt) SetPoolCapacity(name string, capacity uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if p, ok := l.pools[name]; ok {
+		p.capacity = capacity
+	}
+}
+
+// InjectError makes the given method fail with err once, after skip successful calls.
+//
+// Several errors can be queued for the same method, they are consumed in order.
+func (l *Libvirt) InjectError(method string, skip int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.errors[method] = append(l.errors[method], &injectedError{err: err, skip: skip})
+}
+
+// Calls returns how many times the given method was called.
+func (l *Libvirt) Calls(method string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.calls[method]
+}
+
+// Volume returns a copy of the volume with the given name.
+func (l *Libvirt) Volume(poolName, volName string) (Volume, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.pools[poolName]
+	if !ok {
+		return Volume{}, false
+	}
+
+	vol, ok := p.volumes[volName]
+	if !ok {
+		return Volume{}, false
+	}
+
+	return *vol, true
+}
+
+// Volumes returns the sorted names of all volumes in the pool.
+func (l *Libvirt) Volumes(poolName string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.pools[poolName]
+	if !ok {
+		return nil
+	}
+
+	names := make([]string, 0, len(p.volumes))
+
+	for name := range p.volumes {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// AddVolume adds a volume to the pool, bypassing the RPC API.
+func (l *Libvirt) AddVolume(poolName string, vol Volume) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if p, ok := l.pools[poolName]; ok {
+		p.volumes[vol.Name] = &vol
+	}
+}
+
+// Domain returns a copy of the domain with the given name.
+func (l *Libvirt) Domain(name string) (Domain, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dom, ok := l.domains[name]
+	if !ok {
+		return Domain{}, false
+	}
+
+	d := *dom
+	d.Snapshots = slices.Clone(dom.Snapshots)
+
+	return d, true
+}
+
+// Domains returns the sorted names of all defined domains.
+func (l *Libvirt) Domains() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	names := make([]string, 0, len(l.domains))
+
+	for name := range l.domains {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// Secret returns a copy of the secret with the given UUID.
+func (l *Libvirt) Secret(id string) (Secret, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return Secret{}, false
+	}
+
+	secret, ok := l.secrets[libvirt.UUID(parsed)]
+	if !ok {
+		return Secret{}, false
+	}
+
+	return Secret{Definition: secret.Definition, Value: slices.Clone(secret.Value)}, true
+}
+
+// Secrets returns the sorted UUIDs of all defined secrets.
+func (l *Libvirt) Secrets() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ids := make([]string, 0, len(l.secrets))
+
+	for id := range l.secrets {
+		ids = append(ids, uuid.UUID(id).String())
+	}
+
+	slices.Sort(ids)
+
+	return ids
+}
+
+// SetDomainState forces the state of a domain, e.g. to simulate a guest which is shutting down.
+func (l *Libvirt) SetDomainState(name string, state libvirt.DomainState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if dom, ok := l.domains[name]; ok {
+		dom.State = state
+	}
+}
+
+// Reconnect reopens the connection closed by Disconnect, the state of the fake is kept like over a libvirtd restart.
+func (l *Libvirt) Reconnect() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.isConnected() {
+		l.disconnected = make(chan struct{})
+	}
+}
+
+// Disconnect implements provider.Conn.
+//
+// All calls fail once the connection is closed, until Reconnect is called.
+func (l *Libvirt) Disconnect() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.isConnected() {
+		close(l.disconnected)
+	}
+
+	return nil
+}
+
+// Disconnected implements provider.Conn.
+func (l *Libvirt) Disconnected() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.disconnected
+}
+
+// isConnected must be called with mu held.
+func (l *Libvirt) isConnected() bool {
+	select {
+	case <-l.disconnected:
+		return false
+	default:
+		return true
+	}
+}
+
+// call records a method call and returns the injected error, if any; must be called with mu held.
+//
+// Calls over a closed connection fail like in go-libvirt.
+func (l *Libvirt) call(method string) error {
+	l.calls[method]++
+
+	if !l.isConnected() {
+		return syscall.EINVAL
+	}
+
+	queue := l.errors[method]
+	if len(queue) == 0 {
+		return nil
+	}
+
+	if queue[0].skip > 0 {
+		queue[0].skip--
+
+		return nil
+	}
+
+	err := queue[0].err
+	l.errors[method] = queue[1:]
+
+	return err
+}
+
+func libvirtError(code libvirt.ErrorNumber, format string, args ...any) error {
+	return libvirt.Error{
+		Code:    uint32(code),
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// checkDiskTargets rejects the disks with the same target device, or the same drive address on a bus, like libvirt.
+func checkDiskTargets(def libvirtxml.Domain) error {
+	if def.Devices == nil {
+		return nil
+	}
+
+	var (
+		targets   = map[string]struct{}{}
+		addresses = map[string]struct{}{}
+	)
+
+	for _, disk := range def.Devices.Disks {
+		if disk.Target == nil {
+			continue
+		}
+
+		if _, ok := targets[disk.Target.Dev]; ok {
+			return libvirtError(libvirt.ErrXMLError, "XML error: target '%s' duplicated for disk sources", disk.Target.Dev)
+		}
+
+		targets[disk.Target.Dev] = struct{}{}
+
+		if disk.Address == nil || disk.Address.Drive == nil {
+			continue
+		}
+
+		drive := disk.Address.Drive
+		address := fmt.Sprintf("%s:%d:%d:%d:%d", disk.Target.Bus, valueOf(drive.Controller), valueOf(drive.Bus), valueOf(drive.Target), valueOf(drive.Unit))
+
+		if _, ok := addresses[address]; ok {
+			return libvirtError(libvirt.ErrOperationFailed, "operation failed: domain has two disks with the same address %s", address)
+		}
+
+		addresses[address] = struct{}{}
+	}
+
+	return nil
+}
+
+func valueOf(p *uint) uint {
+	if p == nil {
+		return 0
+	}
+
+	return *p
+}
+
+func (l *Libvirt) lookupDomain(dom libvirt.Domain) (*Domain, error) {
+	d, ok := l.domains[dom.Name]
+	if !ok || d.UUID != dom.UUID {
+		return nil, libvirtError(libvirt.ErrNoDomain, "Domain not found: no domain with matching name '%s'", dom.Name)
+	}
+
+	return d, nil
+}
+
+func (l *Libvirt) lookupSnapshot(snap libvirt.DomainSnapshot) (*Domain, *Snapshot, error) {
+	d, err := l.lookupDomain(snap.Dom)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := d.snapshot(snap.Name)
+	if s == nil {
+		return nil, nil, libvirtError(libvirt.ErrNoDomainSnapshot, "Domain snapshot not found: no domain snapshot with matching name '%s'", snap.Name)
+	}
+
+	return d, s, nil
+}
+
+func (l *Libvirt) lookupPool(name string) (*pool, error) {
+	p, ok := l.pools[name]
+	if !ok {
+		return nil, libvirtError(libvirt.ErrNoStoragePool, "Storage pool not found: no storage pool with matching name '%s'", name)
+	}
+
+	return p, nil
+}
+
+func (l *Libvirt) lookupVolume(vol libvirt.StorageVol) (*pool, *Volume, error) {
+	p, err := l.lookupPool(vol.Pool)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	v, ok := p.volumes[vol.Name]
+	if !ok {
+		return nil, nil, libvirtError(libvirt.ErrNoStorageVol, "Storage volume not found: no storage vol with matching name '%s'", vol.Name)
+	}
+
+	return p, v, nil
+}
+
+func (l *Libvirt) lookupSecret(id libvirt.UUID) (*Secret, error) {
+	secret, ok := l.secrets[id]
+	if !ok {
+		return nil, libvirtError(libvirt.ErrNoSecret, "Secret not found: no secret with matching uuid '%s'", uuid.UUID(id))
+	}
+
+	return secret, nil
+}
+
+// checkSecretValue fails unless the secret with the given UUID exists and has a value, like libvirt does
+// when the passphrase of an encrypted volume is needed.
+func (l *Libvirt) checkSecretValue(id string) error {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return libvirtError(libvirt.ErrXMLError, "XML error: malformed secret uuid '%s'", id)
+	}
+
+	secret, err := l.lookupSecret(libvirt.UUID(parsed))
+	if err != nil {
+		return err
+	}
+
+	if secret.Value == nil {
+		return libvirtError(libvirt.ErrNoSecret, "Secret not found: secret '%s' does not have a value", id)
+	}
+
+	return nil
+}
+
+// checkDiskSecrets fails unless the passphrases of the encrypted disks of the domain are set, qemu needs them to open the disks.
+func (l *Libvirt) checkDiskSecrets(d *Domain) error {
+	if d.Definition == nil || d.Definition.Devices == nil {
+		return nil
+	}
+
+	for _, disk := range d.Definition.Devices.Disks {
+		if disk.Source == nil || disk.Source.Encryption == nil {
+			continue
+		}
+
+		for _, secret := range disk.Source.Encryption.Secrets {
+			if err := l.checkSecretValue(secret.UUID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// memory returns the memory of the domain in bytes.
+func (d *Domain) memory() uint64 {
+	if d.Definition == nil || d.Definition.Memory == nil {
+		return 0
+	}
+
+	value := uint64(d.Definition.Memory.Value)
+
+	switch d.Definition.Memory.Unit {
+	case "b", "bytes":
+		return value
+	case "MiB", "M":
+		return value << 20
+	case "GiB", "G":
+		return value << 30
+	default:
+		return value << 10
+	}
+}
+
+// vcpus returns the number of vCPUs of the domain.
+func (d *Domain) vcpus() uint16 {
+	if d.Definition == nil || d.Definition.VCPU == nil {
+		return 1
+	}
+
+	return uint16(d.Definition.VCPU.Value)
+}
+
+// volumeType returns the type of the volumes of the pool.
+func (p *pool) volumeType() libvirt.StorageVolType {
+	switch p.def.Type {
+	case "dir", "fs", "netfs":
+		return libvirt.StorageVolFile
+	case "rbd", "gluster", "iscsi-direct":
+		return libvirt.StorageVolNetwork
+	default:
+		return libvirt.StorageVolBlock
+	}
+}
+
+// fixedVolumes reports whether the volumes of the pool are existing LUNs, which can't be created.
+func (p *pool) fixedVolumes() bool {
+	switch p.def.Type {
+	case "iscsi", "iscsi-direct", "scsi", "mpath":
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *pool) allocation() uint64 {
+	var allocation uint64
+
+	for _, vol := range p.volumes {
+		allocation += vol.Capacity
+	}
+
+	return allocation
+}
+
+func (d *Domain) snapshot(name string) *Snapshot {
+	for i := range d.Snapshots {
+		if d.Snapshots[i].Name == name {
+			return &d.Snapshots[i]
+		}
+	}
+
+	return nil
+}
+
+func (d *Domain) hasChildren(name string) bool {
+	return slices.ContainsFunc(d.Snapshots, func(snap Snapshot) bool { return snap.Parent == name })
+}
+
+func (d *Domain) hasDisk(target string) bool {
+	if d.Definition == nil || d.Definition.Devices == nil {
+		return false
+	}
+
+	return slices.ContainsFunc(d.Definition.Devices.Disks, func(disk libvirtxml.DomainDisk) bool {
+		return disk.Target != nil && disk.Target.Dev == target
+	})
+}
+
+func (d *Domain) ref() libvirt.Domain {
+	id := int32(-1)
+	if d.State == libvirt.DomainRunning {
+		id = d.ID
+	}
+
+	return libvirt.Domain{Name: d.Name, UUID: d.UUID, ID: id}
+}
+
+func volumeRef(poolName string, vol *Volume) libvirt.StorageVol {
+	return libvirt.StorageVol{Pool: poolName, Name: vol.Name, Key: "/" + poolName + "/" + vol.Name}
+}
+
+// ConnectGetLibVersion implements provider.LibvirtClient.
+func (l *Libvirt) ConnectGetLibVersion() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("ConnectGetLibVersion"); err != nil {
+		return 0, err
+	}
+
+	return l.libVersion, nil
+}
+
+// NodeGetInfo implements provider.LibvirtClient.
+func (l *Libvirt) NodeGetInfo() (rModel [32]int8, rMemory uint64, rCpus, rMhz, rNodes, rSockets, rCores, rThreads int32, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err = l.call("NodeGetInfo"); err != nil {
+		return rModel, 0, 0, 0, 0, 0, 0, 0, err
+	}
+
+	for i, c := range "x86_64" {
+		rModel[i] = int8(c)
+	}
+
+	return rModel, l.node.Memory >> 10, l.node.CPUs, 2000, 1, 1, l.node.CPUs, 1, nil
+}
+
+// NodeGetFreeMemory implements provider.LibvirtClient.
+func (l *Libvirt) NodeGetFreeMemory() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("NodeGetFreeMemory"); err != nil {
+		return 0, err
+	}
+
+	free := l.node.Memory
+
+	for _, dom := range l.domains {
+		if dom.State == libvirt.DomainRunning {
+			free -= min(free, dom.memory())
+		}
+	}
+
+	return free, nil
+}
+
+// ConnectListAllDomains implements provider.LibvirtClient.
+//
+// Only the active and inactive flags are supported; no flags lists all domains.
+func (l *Libvirt) ConnectListAllDomains(_ int32, flags libvirt.ConnectListAllDomainsFlags) ([]libvirt.Domain, uint32, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("ConnectListAllDomains"); err != nil {
+		return nil, 0, err
+	}
+
+	if flags&(libvirt.ConnectListDomainsActive|libvirt.ConnectListDomainsInactive) == 0 {
+		flags |= libvirt.ConnectListDomainsActive | libvirt.ConnectListDomainsInactive
+	}
+
+	names := make([]string, 0, len(l.domains))
+
+	for name := range l.domains {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	domains := make([]libvirt.Domain, 0, len(names))
+
+	for _, name := range names {
+		dom := l.domains[name]
+		active := dom.State != libvirt.DomainShutoff
+
+		if (active && flags&libvirt.ConnectListDomainsActive != 0) || (!active && flags&libvirt.ConnectListDomainsInactive != 0) {
+			domains = append(domains, dom.ref())
+		}
+	}
+
+	return domains, uint32(len(domains)), nil
+}
+
+// DomainLookupByUUID implements provider.LibvirtClient.
+func (l *Libvirt) DomainLookupByUUID(id libvirt.UUID) (libvirt.Domain, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainLookupByUUID"); err != nil {
+		return libvirt.Domain{}, err
+	}
+
+	for _, dom := range l.domains {
+		if dom.UUID == id {
+			return dom.ref(), nil
+		}
+	}
+
+	return libvirt.Domain{}, libvirtError(libvirt.ErrNoDomain, "Domain not found: no domain with matching uuid '%s'", uuid.UUID(id))
+}
+
+// DomainLookupByName implements provider.LibvirtClient.
+func (l *Libvirt) DomainLookupByName(name string) (libvirt.Domain, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainLookupByName"); err != nil {
+		return libvirt.Domain{}, err
+	}
+
+	dom, ok := l.domains[name]
+	if !ok {
+		return libvirt.Domain{}, libvirtError(libvirt.ErrNoDomain, "Domain not found: no domain with matching name '%s'", name)
+	}
+
+	return dom.ref(), nil
+}
+
+// DomainGetState implements provider.LibvirtClient.
+func (l *Libvirt) DomainGetState(dom libvirt.Domain, _ uint32) (int32, int32, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainGetState"); err != nil {
+		return 0, 0, err
+	}
+
+	d, err := l.lookupDomain(dom)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int32(d.State), 0, nil
+}
+
+// DomainGetInfo implements provider.LibvirtClient.
+func (l *Libvirt) DomainGetInfo(dom libvirt.Domain) (rState uint8, rMaxMem, rMemory uint64, rNrVirtCPU uint16, rCPUTime uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err = l.call("DomainGetInfo"); err != nil {
+		return 0, 0, 0, 0, 0, err
+	}
+
+	d, err := l.lookupDomain(dom)
+	if err != nil {
+		return 0, 0, 0, 0, 0, err
+	}
+
+	memory := d.memory() >> 10
+
+	return uint8(d.State), memory, memory, d.vcpus(), 0, nil
+}
+
+// DomainGetMetadata implements provider.LibvirtClient.
+//
+// Only custom metadata elements are supported, they are looked up by their namespace.
+func (l *Libvirt) DomainGetMetadata(dom libvirt.Domain, _ int32, uri libvirt.OptString, _ libvirt.DomainModificationImpact) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainGetMetadata"); err != nil {
+		return "", err
+	}
+
+	d, err := l.lookupDomain(dom)
+	if err != nil {
+		return "", err
+	}
+
+	notFound := libvirtError(libvirt.ErrNoDomainMetadata, "metadata not found: Requested metadata element is not present")
+
+	if d.Definition == nil || d.Definition.Metadata == nil || len(uri) == 0 {
+		return "", notFound
+	}
+
+	raw := d.Definition.Metadata.XML
+	decoder := xml.NewDecoder(strings.NewReader(raw))
+
+	for {
+		start := decoder.InputOffset()
+
+		token, err := decoder.Token()
+		if err != nil {
+			return "", notFound
+		}
+
+		if element, ok := token.(xml.StartElement); ok {
+			if element.Name.Space == uri[0] {
+				if err = decoder.Skip(); err != nil {
+					return "", notFound
+				}
+
+				return raw[start:decoder.InputOffset()], nil
+			}
+
+			if err = decoder.Skip(); err != nil {
+				return "", notFound
+			}
+		}
+	}
+}
+
+// DomainGetXMLDesc implements provider.LibvirtClient.
+//
+// It returns the XML the domain was defined with.
+func (l *Libvirt) DomainGetXMLDesc(dom libvirt.Domain, _ libvirt.DomainXMLFlags) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainGetXMLDesc"); err != nil {
+		return "", err
+	}
+
+	d, err := l.lookupDomain(dom)
+	if err != nil {
+		return "", err
+	}
+
+	return d.XML, nil
+}
+
+// DomainDefineXML implements provider.LibvirtClient.
+//
+// Redefining an existing domain with the same name and UUID replaces its definition, like libvirt does.
+func (l *Libvirt) DomainDefineXML(xml string) (libvirt.Domain, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainDefineXML"); err != nil {
+		return libvirt.Domain{}, err
+	}
+
+	var def libvirtxml.Domain
+
+	if err := def.Unmarshal(xml); err != nil {
+		return libvirt.Domain{}, libvirtError(libvirt.ErrXMLError, "XML error: %s", err)
+	}
+
+	if def.Name == "" {
+		return libvirt.Domain{}, libvirtError(libvirt.ErrXMLError, "XML error: missing domain name")
+	}
+
+	if err := checkDiskTargets(def); err != nil {
+		return libvirt.Domain{}, err
+	}
+
+	id := uuid.New()
+
+	if def.UUID != "" {
+		var err error
+
+		if id, err = uuid.Parse(def.UUID); err != nil {
+			return libvirt.Domain{}, libvirtError(libvirt.ErrXMLError, "XML error: malformed uuid element")
+		}
+	}
+
+	for _, dom := range l.domains {
+		switch {
+		case dom.Name == def.Name && dom.UUID != libvirt.UUID(id):
+			return libvirt.Domain{}, libvirtError(libvirt.ErrOperationFailed, "operation failed: domain '%s' already exists with uuid %s", dom.Name, uuid.UUID(dom.UUID))
+		case dom.Name != def.Name && dom.UUID == libvirt.UUID(id):
+			return libvirt.Domain{}, libvirtError(libvirt.ErrOperationFailed, "operation failed: domain '%s' is already defined with uuid %s", dom.Name, id)
+		}
+	}
+
+	dom, ok := l.domains[def.Name]
+	if !ok {
+		dom = &Domain{
+			Name:  def.Name,
+			UUID:  libvirt.UUID(id),
+			State: libvirt.DomainShutoff,
+		}
+
+		l.domains[def.Name] = dom
+	}
+
+	dom.XML = xml
+	dom.Definition = &def
+
+	return dom.ref(), nil
+}
+
+// DomainCreate implements provider.LibvirtClient.
+func (l *Libvirt) DomainCreate(dom libvirt.Domain) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainCreate"); err != nil {
+		return err
+	}
+
+	d, err := l.lookupDomain(dom)
+	if err != nil {
+		return err
+	}
+
+	if d.State == libvirt.DomainRunning {
+		return libvirtError(libvirt.ErrOperationInvalid, "Requested operation is not valid: domain is already running")
+	}
+
+	if err = l.checkDiskSecrets(d); err != nil {
+		return err
+	}
+
+	d.State = libvirt.DomainRunning
+	d.ID = l.nextID
+	l.nextID++
+
+	return nil
+}
+
+// DomainDestroy implements provider.LibvirtClient.
+func (l *Libvirt) DomainDestroy(dom libvirt.Domain) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainDestroy"); err != nil {
+		return err
+	}
+
+	d, err := l.lookupDomain(dom)
+	if err != nil {
+		return err
+	}
+
+	if d.State == libvirt.DomainShutoff {
+		return libvirtError(libvirt.ErrOperationInvalid, "Requested operation is not valid: domain is not running")
+	}
+
+	d.State = libvirt.DomainShutoff
+
+	return nil
+}
+
+// DomainUndefine implements provider.LibvirtClient.
+func (l *Libvirt) DomainUndefine(dom libvirt.Domain) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainUndefine"); err != nil {
+		return err
+	}
+
+	d, err := l.lookupDomain(dom)
+	if err != nil {
+		return err
+	}
+
+	if len(d.Snapshots) > 0 {
+		return libvirtError(libvirt.ErrOperationInvalid, "Requested operation is not valid: cannot delete inactive domain with %d snapshots", len(d.Snapshots))
+	}
+
+	delete(l.domains, dom.Name)
+
+	return nil
+}
+
+// DomainSnapshotCreateXML implements provider.LibvirtClient.
+//
+// Only the disks of the snapshot XML are checked, the disks of the domain keep their sources.
+func (l *Libvirt) DomainSnapshotCreateXML(dom libvirt.Domain, xml string, flags uint32) (libvirt.DomainSnapshot, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainSnapshotCreateXML"); err != nil {
+		return libvirt.DomainSnapshot{}, err
+	}
+
+	d, err := l.lookupDomain(dom)
+	if err != nil {
+		return libvirt.DomainSnapshot{}, err
+	}
+
+	var def libvirtxml.DomainSnapshot
+
+	if err = def.Unmarshal(xml); err != nil {
+		return libvirt.DomainSnapshot{}, libvirtError(libvirt.ErrXMLError, "XML error: %s", err)
+	}
+
+	if def.Name == "" {
+		def.Name = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+
+	if d.snapshot(def.Name) != nil {
+		return libvirt.DomainSnapshot{}, libvirtError(libvirt.ErrOperationInvalid, "Requested operation is not valid: domain snapshot '%s' already exists", def.Name)
+	}
+
+	memory := def.Memory != nil && def.Memory.Snapshot == "external"
+
+	switch {
+	case memory && flags&uint32(libvirt.DomainSnapshotCreateDiskOnly) != 0:
+		return libvirt.DomainSnapshot{}, libvirtError(libvirt.ErrConfigUnsupported, "unsupported configuration: disk-only snapshot requests require memory snapshot='no'")
+	case memory && d.State != libvirt.DomainRunning:
+		return libvirt.DomainSnapshot{}, libvirtError(libvirt.ErrConfigUnsupported, "unsupported configuration: memory state cannot be saved with offline or disk-only snapshot")
+	}
+
+	if def.Disks != nil {
+		for _, disk := range def.Disks.Disks {
+			if !d.hasDisk(disk.Name) {
+				return libvirt.DomainSnapshot{}, libvirtError(libvirt.ErrInvalidArg, "invalid argument: no disk named '%s'", disk.Name)
+			}
+		}
+	}
+
+	def.CreationTime = strconv.FormatInt(time.Now().Unix(), 10)
+	def.State = "shutoff"
+
+	if d.State == libvirt.DomainRunning {
+		def.State = "running"
+	}
+
+	if d.current != "" {
+		def.Parent = &libvirtxml.DomainSnapshotParent{Name: d.current}
+	}
+
+	d.Snapshots = append(d.Snapshots, Snapshot{Name: def.Name, Parent: d.current, Definition: &def})
+	d.current = def.Name
+
+	return libvirt.DomainSnapshot{Name: def.Name, Dom: d.ref()}, nil
+}
+
+// DomainListAllSnapshots implements provider.LibvirtClient.
+//
+// Only the leaves flag is supported.
+func (l *Libvirt) DomainListAllSnapshots(dom libvirt.Domain, _ int32, flags uint32) ([]libvirt.DomainSnapshot, int32, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainListAllSnapshots"); err != nil {
+		return nil, 0, err
+	}
+
+	d, err := l.lookupDomain(dom)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	snapshots := make([]libvirt.DomainSnapshot, 0, len(d.Snapshots))
+
+	for _, snap := range d.Snapshots {
+		if flags&uint32(libvirt.DomainSnapshotListLeaves) != 0 && d.hasChildren(snap.Name) {
+			continue
+		}
+
+		snapshots = append(snapshots, libvirt.DomainSnapshot{Name: snap.Name, Dom: d.ref()})
+	}
+
+	return snapshots, int32(len(snapshots)), nil
+}
+
+// DomainSnapshotLookupByName implements provider.LibvirtClient.
+func (l *Libvirt) DomainSnapshotLookupByName(dom libvirt.Domain, name string, _ uint32) (libvirt.DomainSnapshot, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainSnapshotLookupByName"); err != nil {
+		return libvirt.DomainSnapshot{}, err
+	}
+
+	d, err := l.lookupDomain(dom)
+	if err != nil {
+		return libvirt.DomainSnapshot{}, err
+	}
+
+	if d.snapshot(name) == nil {
+		return libvirt.DomainSnapshot{}, libvirtError(libvirt.ErrNoDomainSnapshot, "Domain snapshot not found: no domain snapshot with matching name '%s'", name)
+	}
+
+	return libvirt.DomainSnapshot{Name: name, Dom: d.ref()}, nil
+}
+
+// DomainSnapshotGetXMLDesc implements provider.LibvirtClient.
+func (l *Libvirt) DomainSnapshotGetXMLDesc(snap libvirt.DomainSnapshot, _ uint32) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainSnapshotGetXMLDesc"); err != nil {
+		return "", err
+	}
+
+	_, s, err := l.lookupSnapshot(snap)
+	if err != nil {
+		return "", err
+	}
+
+	return s.Definition.Marshal()
+}
+
+// DomainSnapshotDelete implements provider.LibvirtClient.
+//
+// The children of the snapshot are reparented to its parent, like libvirt does when the snapshot is merged.
+func (l *Libvirt) DomainSnapshotDelete(snap libvirt.DomainSnapshot, _ libvirt.DomainSnapshotDeleteFlags) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("DomainSnapshotDelete"); err != nil {
+		return err
+	}
+
+	d, s, err := l.lookupSnapshot(snap)
+	if err != nil {
+		return err
+	}
+
+	parent := s.Parent
+
+	d.Snapshots = slices.DeleteFunc(d.Snapshots, func(other Snapshot) bool { return other.Name == snap.Name })
+
+	for i := range d.Snapshots {
+		if d.Snapshots[i].Parent != snap.Name {
+			continue
+		}
+
+		d.Snapshots[i].Parent = parent
+		d.Snapshots[i].Definition.Parent = nil
+
+		if parent != "" {
+			d.Snapshots[i].Definition.Parent = &libvirtxml.DomainSnapshotParent{Name: parent}
+		}
+	}
+
+	if d.current == snap.Name {
+		d.current = parent
+	}
+
+	return nil
+}
+
+// StoragePoolLookupByName implements provider.LibvirtClient.
+func (l *Libvirt) StoragePoolLookupByName(name string) (libvirt.StoragePool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("StoragePoolLookupByName"); err != nil {
+		return libvirt.StoragePool{}, err
+	}
+
+	p, err := l.lookupPool(name)
+	if err != nil {
+		return libvirt.StoragePool{}, err
+	}
+
+	return libvirt.StoragePool{Name: name, UUID: p.uuid}, nil
+}
+
+// StoragePoolGetInfo implements provider.LibvirtClient.
+func (l *Libvirt) StoragePoolGetInfo(sp libvirt.StoragePool) (rState uint8, rCapacity, rAllocation, rAvailable uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err = l.call("StoragePoolGetInfo"); err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	p, err := l.lookupPool(sp.Name)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	allocation := p.allocation()
+
+	return uint8(libvirt.StoragePoolRunning), p.capacity, allocation, p.capacity - min(p.capacity, allocation), nil
+}
+
+// StoragePoolGetXMLDesc implements provider.LibvirtClient.
+func (l *Libvirt) StoragePoolGetXMLDesc(sp libvirt.StoragePool, _ libvirt.StorageXMLFlags) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("StoragePoolGetXMLDesc"); err != nil {
+		return "", err
+	}
+
+	p, err := l.lookupPool(sp.Name)
+	if err != nil {
+		return "", err
+	}
+
+	def := p.def
+	def.UUID = uuid.UUID(p.uuid).String()
+
+	return def.Marshal()
+}
+
+// StoragePoolListAllVolumes implements provider.LibvirtClient.
+func (l *Libvirt) StoragePoolListAllVolumes(sp libvirt.StoragePool, _ int32, _ uint32) ([]libvirt.StorageVol, uint32, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("StoragePoolListAllVolumes"); err != nil {
+		return nil, 0, err
+	}
+
+	p, err := l.lookupPool(sp.Name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	names := make([]string, 0, len(p.volumes))
+
+	for name := range p.volumes {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	volumes := make([]libvirt.StorageVol, 0, len(names))
+
+	for _, name := range names {
+		volumes = append(volumes, volumeRef(sp.Name, p.volumes[name]))
+	}
+
+	return volumes, uint32(len(volumes)), nil
+}
+
+// StorageVolGetInfo implements provider.LibvirtClient.
+//
+// Volumes are fully allocated.
+func (l *Libvirt) StorageVolGetInfo(vol libvirt.StorageVol) (rType int8, rCapacity, rAllocation uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err = l.call("StorageVolGetInfo"); err != nil {
+		return 0, 0, 0, err
+	}
+
+	p, v, err := l.lookupVolume(vol)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return int8(p.volumeType()), v.Capacity, v.Capacity, nil
+}
+
+// StorageVolGetXMLDesc implements provider.LibvirtClient.
+func (l *Libvirt) StorageVolGetXMLDesc(vol libvirt.StorageVol, _ uint32) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("StorageVolGetXMLDesc"); err != nil {
+		return "", err
+	}
+
+	_, v, err := l.lookupVolume(vol)
+	if err != nil {
+		return "", err
+	}
+
+	def := libvirtxml.StorageVolume{
+		Name:     v.Name,
+		Key:      volumeRef(vol.Pool, v).Key,
+		Capacity: &libvirtxml.StorageVolumeSize{Unit: "bytes", Value: v.Capacity},
+		Target: &libvirtxml.StorageVolumeTarget{
+			Path:   volumeRef(vol.Pool, v).Key,
+			Format: &libvirtxml.StorageVolumeTargetFormat{Type: cmp.Or(v.Format, "raw")},
+		},
+	}
+
+	return def.Marshal()
+}
+
+// StorageVolLookupByName implements provider.LibvirtClient.
+func (l *Libvirt) StorageVolLookupByName(sp libvirt.StoragePool, name string) (libvirt.StorageVol, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("StorageVolLookupByName"); err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	_, vol, err := l.lookupVolume(libvirt.StorageVol{Pool: sp.Name, Name: name})
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	return volumeRef(sp.Name, vol), nil
+}
+
+// StorageVolCreateXML implements provider.LibvirtClient.
+func (l *Libvirt) StorageVolCreateXML(sp libvirt.StoragePool, xml string, _ libvirt.StorageVolCreateFlags) (libvirt.StorageVol, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("StorageVolCreateXML"); err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	p, err := l.lookupPool(sp.Name)
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	var def libvirtxml.StorageVolume
+
+	if err = def.Unmarshal(xml); err != nil {
+		return libvirt.StorageVol{}, libvirtError(libvirt.ErrXMLError, "XML error: %s", err)
+	}
+
+	if p.fixedVolumes() {
+		return libvirt.StorageVol{}, libvirtError(libvirt.ErrNoSupport, "this function is not supported by the connection driver: storage pool does not support volume creation")
+	}
+
+	if _, ok := p.volumes[def.Name]; ok {
+		return libvirt.StorageVol{}, libvirtError(libvirt.ErrStorageVolExist, "storage volume name '%s' already in use.", def.Name)
+	}
+
+	vol := &Volume{
+		Name:   def.Name,
+		Format: "raw",
+	}
+
+	if def.Capacity != nil {
+		vol.Capacity = def.Capacity.Value
+	}
+
+	if def.Target != nil && def.Target.Format != nil {
+		vol.Format = def.Target.Format.Type
+	}
+
+	if p.volumeType() != libvirt.StorageVolFile && vol.Format != "raw" {
+		return libvirt.StorageVol{}, libvirtError(libvirt.ErrNoSupport, "this function is not supported by the connection driver: only RAW volumes are supported by this storage pool")
+	}
+
+	if def.Target != nil && def.Target.Encryption != nil {
+		encryption := def.Target.Encryption
+
+		switch {
+		case p.volumeType() != libvirt.StorageVolFile:
+			return libvirt.StorageVol{}, libvirtError(libvirt.ErrNoSupport, "this function is not supported by the connection driver: storage pool does not support encrypted volumes")
+		case encryption.Format != "luks" || vol.Format != "raw":
+			return libvirt.StorageVol{}, libvirtError(libvirt.ErrNoSupport, "this function is not supported by the connection driver: unsupported volume encryption format %s for the %s format", encryption.Format, vol.Format)
+		case encryption.Secret == nil:
+			return libvirt.StorageVol{}, libvirtError(libvirt.ErrXMLError, "XML error: missing encryption secret")
+		}
+
+		if err = l.checkSecretValue(encryption.Secret.UUID); err != nil {
+			return libvirt.StorageVol{}, err
+		}
+
+		vol.Secret = encryption.Secret.UUID
+	}
+
+	p.volumes[vol.Name] = vol
+
+	return volumeRef(sp.Name, vol), nil
+}
+
+// StorageVolCreateXMLFrom implements provider.LibvirtClient.
+func (l *Libvirt) StorageVolCreateXMLFrom(sp libvirt.StoragePool, xml string, clonevol libvirt.StorageVol, _ libvirt.StorageVolCreateFlags) (libvirt.StorageVol, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("StorageVolCreateXMLFrom"); err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	p, err := l.lookupPool(sp.Name)
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	_, source, err := l.lookupVolume(clonevol)
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	var def libvirtxml.StorageVolume
+
+	if err = def.Unmarshal(xml); err != nil {
+		return libvirt.StorageVol{}, libvirtError(libvirt.ErrXMLError, "XML error: %s", err)
+	}
+
+	if p.fixedVolumes() {
+		return libvirt.StorageVol{}, libvirtError(libvirt.ErrNoSupport, "this function is not supported by the connection driver: storage pool does not support volume creation")
+	}
+
+	if _, ok := p.volumes[def.Name]; ok {
+		return libvirt.StorageVol{}, libvirtError(libvirt.ErrStorageVolExist, "storage volume name '%s' already in use.", def.Name)
+	}
+
+	vol := &Volume{
+		Name:     def.Name,
+		Format:   cmp.Or(source.Format, "raw"),
+		Data:     slices.Clone(source.Data),
+		Capacity: source.Capacity,
+	}
+
+	if def.Capacity != nil {
+		vol.Capacity = max(vol.Capacity, def.Capacity.Value)
+	}
+
+	if def.Target != nil && def.Target.Format != nil {
+		vol.Format = def.Target.Format.Type
+	}
+
+	p.volumes[vol.Name] = vol
+
+	return volumeRef(sp.Name, vol), nil
+}
+
+// StorageVolDelete implements provider.LibvirtClient.
+func (l *Libvirt) StorageVolDelete(vol libvirt.StorageVol, _ libvirt.StorageVolDeleteFlags) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("StorageVolDelete"); err != nil {
+		return err
+	}
+
+	p, _, err := l.lookupVolume(vol)
+	if err != nil {
+		return err
+	}
+
+	delete(p.volumes, vol.Name)
+
+	return nil
+}
+
+// StorageVolUpload implements provider.LibvirtClient.
+//
+// The uploaded data replaces the volume contents; offset and length are ignored.
+func (l *Libvirt) StorageVolUpload(vol libvirt.StorageVol, outStream io.Reader, _, _ uint64, _ libvirt.StorageVolUploadFlags) error {
+	l.mu.Lock()
+
+	if err := l.call("StorageVolUpload"); err != nil {
+		l.mu.Unlock()
+
+		return err
+	}
+
+	if _, _, err := l.lookupVolume(vol); err != nil {
+		l.mu.Unlock()
+
+		return err
+	}
+
+	l.mu.Unlock()
+
+	// read the stream without holding the lock, uploads might be slow
+	data, err := io.ReadAll(outStream)
+	if err != nil {
+		return libvirtError(libvirt.ErrRPC, "stream error: %s", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, v, err := l.lookupVolume(vol)
+	if err != nil {
+		return err
+	}
+
+	// the image files grow with the upload, the block devices don't
+	if p.volumeType() != libvirt.StorageVolFile && uint64(len(data)) > v.Capacity {
+		return libvirtError(libvirt.ErrOperationFailed, "operation failed: cannot write to volume '%s': No space left on device", vol.Name)
+	}
+
+	v.Data = data
+
+	return nil
+}
+
+// StorageVolResize implements provider.LibvirtClient.
+func (l *Libvirt) StorageVolResize(vol libvirt.StorageVol, capacity uint64, flags libvirt.StorageVolResizeFlags) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("StorageVolResize"); err != nil {
+		return err
+	}
+
+	_, v, err := l.lookupVolume(vol)
+	if err != nil {
+		return err
+	}
+
+	if capacity < v.Capacity && flags&libvirt.StorageVolResizeShrink == 0 {
+		return libvirtError(libvirt.ErrInvalidArg, "invalid argument: Can't shrink capacity below current capacity unless shrink flag explicitly specified")
+	}
+
+	v.Capacity = capacity
+
+	return nil
+}
+
+// SecretLookupByUUID implements provider.LibvirtClient.
+func (l *Libvirt) SecretLookupByUUID(id libvirt.UUID) (libvirt.Secret, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("SecretLookupByUUID"); err != nil {
+		return libvirt.Secret{}, err
+	}
+
+	secret, err := l.lookupSecret(id)
+	if err != nil {
+		return libvirt.Secret{}, err
+	}
+
+	return secretRef(id, secret), nil
+}
+
+// SecretDefineXML implements provider.LibvirtClient.
+//
+// Redefining a secret keeps its value, like libvirt.
+func (l *Libvirt) SecretDefineXML(xml string, _ uint32) (libvirt.Secret, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("SecretDefineXML"); err != nil {
+		return libvirt.Secret{}, err
+	}
+
+	var def libvirtxml.Secret
+
+	if err := def.Unmarshal(xml); err != nil {
+		return libvirt.Secret{}, libvirtError(libvirt.ErrXMLError, "XML error: %s", err)
+	}
+
+	id := uuid.New()
+
+	if def.UUID != "" {
+		var err error
+
+		if id, err = uuid.Parse(def.UUID); err != nil {
+			return libvirt.Secret{}, libvirtError(libvirt.ErrXMLError, "XML error: malformed uuid element")
+		}
+	}
+
+	def.UUID = id.String()
+
+	for otherID, other := range l.secrets {
+		if otherID != libvirt.UUID(id) && def.Usage != nil && other.Definition.Usage != nil && *def.Usage == *other.Definition.Usage {
+			return libvirt.Secret{}, libvirtError(libvirt.ErrInternalError, "internal error: a secret with UUID %s already defined for use with %s", uuid.UUID(otherID), def.Usage.Volume)
+		}
+	}
+
+	secret, ok := l.secrets[libvirt.UUID(id)]
+	if !ok {
+		secret = &Secret{}
+		l.secrets[libvirt.UUID(id)] = secret
+	}
+
+	secret.Definition = def
+
+	return secretRef(libvirt.UUID(id), secret), nil
+}
+
+// SecretSetValue implements provider.LibvirtClient.
+func (l *Libvirt) SecretSetValue(secret libvirt.Secret, value []byte, _ uint32) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("SecretSetValue"); err != nil {
+		return err
+	}
+
+	s, err := l.lookupSecret(secret.UUID)
+	if err != nil {
+		return err
+	}
+
+	s.Value = slices.Clone(value)
+
+	return nil
+}
+
+// SecretUndefine implements provider.LibvirtClient.
+func (l *Libvirt) SecretUndefine(secret libvirt.Secret) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.call("SecretUndefine"); err != nil {
+		return err
+	}
+
+	if _, err := l.lookupSecret(secret.UUID); err != nil {
+		return err
+	}
+
+	delete(l.secrets, secret.UUID)
+
+	return nil
+}
+
+func secretRef(id libvirt.UUID, secret *Secret) libvirt.Secret {
+	ref := libvirt.Secret{UUID: id}
+
+	if usage := secret.Definition.Usage; usage != nil && usage.Type == "volume" {
+		ref.UsageType = int32(libvirt.SecretUsageTypeVolume)
+		ref.UsageID = usage.Volume
+	}
+
+	return ref
+}
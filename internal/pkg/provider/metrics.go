@@ -0,0 +1,452 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/resources"
+)
+
+// metricsNamespace prefixes the names of all the metrics of the provider.
+const metricsNamespace = "omni_libvirt_provider"
+
+const (
+	// domainCountInterval is how often the domains managed by the provider are counted for the metrics.
+	domainCountInterval = 30 * time.Second
+
+	// domainCountTimeout is how long counting the domains of the hosts may take.
+	domainCountTimeout = 10 * time.Second
+)
+
+const (
+	outcomeSuccess = "success"
+	outcomeRetry   = "retry"
+	outcomeError   = "error"
+)
+
+// retry is a machine request whose provision step is being retried.
+type retry struct {
+	since time.Time
+	step  string
+}
+
+// metrics are the metrics of the provisioner, and of the libvirt calls it makes.
+type metrics struct {
+	stepDuration        *prometheus.HistogramVec
+	deprovisionDuration *prometheus.HistogramVec
+	rpcDuration         *prometheus.HistogramVec
+	rpcErrors           *prometheus.CounterVec
+	uploadBytes         *prometheus.CounterVec
+	retryingDesc        *prometheus.Desc
+	retryingSecondsDesc *prometheus.Desc
+	domainsDesc         *prometheus.Desc
+	retrying            map[string]retry
+	// domains are the numbers of the managed domains by host and state, counted by Provisioner.CountDomains
+	domains map[string]map[string]int
+	// counting are the hosts whose domains are being counted
+	counting map[string]bool
+	mu       sync.Mutex
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "provision_step_duration_seconds",
+			Help:      "Duration of the provision step runs by step and outcome (success, retry or error).",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 9),
+		}, []string{"step", "outcome"}),
+		deprovisionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "deprovision_duration_seconds",
+			Help:      "Duration of the deprovision runs by outcome (success, retry or error).",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 9),
+		}, []string{"outcome"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "libvirt_rpc_duration_seconds",
+			Help:      "Latency of the libvirt calls by host and method.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"host", "method"}),
+		rpcErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "libvirt_rpc_errors_total",
+			Help:      "Number of the libvirt calls which failed by host and method.",
+		}, []string{"host", "method"}),
+		uploadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_bytes_total",
+			Help:      "Number of the image bytes uploaded to the storage pools by host.",
+		}, []string{"host"}),
+		retryingDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "provision_retrying_requests"),
+			"Number of the machine requests whose last provision step run was retried, by step.",
+			[]string{"step"}, nil,
+		),
+		retryingSecondsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "provision_retrying_seconds"),
+			"Longest time a machine request has been retrying the provision step, by step.",
+			[]string{"step"}, nil,
+		),
+		domainsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "domains"),
+			"Number of the domains managed by the provider by host and state.",
+			[]string{"host", "state"}, nil,
+		),
+		retrying: map[string]retry{},
+		domains:  map[string]map[string]int{},
+		counting: map[string]bool{},
+	}
+}
+
+// cacheMetrics are the metrics of the image cache.
+type cacheMetrics struct {
+	hits             prometheus.Counter
+	misses           prometheus.Counter
+	evictions        *prometheus.CounterVec
+	downloadBytes    prometheus.Counter
+	downloadDuration prometheus.Histogram
+	bytesDesc        *prometheus.Desc
+}
+
+func newCacheMetrics() *cacheMetrics {
+	return &cacheMetrics{
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "image_cache_hits_total",
+			Help:      "Number of the images found in the cache.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "image_cache_misses_total",
+			Help:      "Number of the images downloaded from the image factory.",
+		}),
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "image_cache_evictions_total",
+			Help:      "Number of the images removed from the cache by reason (age or size).",
+		}, []string{"reason"}),
+		downloadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "download_bytes_total",
+			Help:      "Number of the image bytes downloaded from the image factory.",
+		}),
+		downloadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "download_duration_seconds",
+			Help:      "Duration of the successful image downloads.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		bytesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "image_cache_bytes"),
+			"Size of the image cache directory.",
+			nil, nil,
+		),
+	}
+}
+
+// outcome classifies the result of a step run.
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return outcomeSuccess
+	case isRetryError(err):
+		return outcomeRetry
+	default:
+		return outcomeError
+	}
+}
+
+// observeStep records the step run, and tracks the requests which are being retried.
+func (m *metrics) observeStep(requestID, step string, start time.Time, err error) {
+	result := outcome(err)
+
+	m.stepDuration.WithLabelValues(step, result).Observe(time.Since(start).Seconds())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if result != outcomeRetry {
+		delete(m.retrying, requestID)
+
+		return
+	}
+
+	if current, ok := m.retrying[requestID]; !ok || current.step != step {
+		m.retrying[requestID] = retry{step: step, since: start}
+	}
+}
+
+// observeDeprovision records the deprovision run, the request is no longer retried.
+func (m *metrics) observeDeprovision(requestID string, start time.Time, err error) {
+	m.deprovisionDuration.WithLabelValues(outcome(err)).Observe(time.Since(start).Seconds())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.retrying, requestID)
+}
+
+// instrument wraps the steps to record their duration and outcome, and to trace them.
+func (p *Provisioner) instrument(steps []provision.Step[*resources.Machine]) []provision.Step[*resources.Machine] {
+	wrapped := make([]provision.Step[*resources.Machine], 0, len(steps))
+
+	for i, step := range steps {
+		last := i == len(steps)-1
+
+		wrapped = append(wrapped, provision.NewStep(
+			step.Name(),
+			func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+				requestID := pctx.GetRequestID()
+				start := time.Now()
+
+				ctx, span := tracer().Start(p.spans.context(ctx, requestID), "provision."+step.Name(),
+					trace.WithAttributes(attribute.String(attrRequestID, requestID), attribute.String(attrStep, step.Name())),
+				)
+
+				err := step.Run(ctx, logger, pctx)
+
+				endSpan(span, err)
+				p.metrics.observeStep(requestID, step.Name(), start, err)
+
+				// the retried steps run again, the provisioning is over once the last step succeeds or a step fails
+				if (err == nil && last) || (err != nil && !isRetryError(err)) {
+					p.spans.end(requestID, err)
+				}
+
+				return err
+			},
+		))
+	}
+
+	return wrapped
+}
+
+// Describe implements prometheus.Collector.
+func (p *Provisioner) Describe(ch chan<- *prometheus.Desc) {
+	p.metrics.stepDuration.Describe(ch)
+	p.metrics.deprovisionDuration.Describe(ch)
+	p.metrics.rpcDuration.Describe(ch)
+	p.metrics.rpcErrors.Describe(ch)
+	p.metrics.uploadBytes.Describe(ch)
+
+	ch <- p.metrics.retryingDesc
+
+	ch <- p.metrics.retryingSecondsDesc
+
+	ch <- p.metrics.domainsDesc
+}
+
+// Collect implements prometheus.Collector.
+//
+// The managed domains are not counted on scrape, but periodically by RunDomainCounts.
+func (p *Provisioner) Collect(ch chan<- prometheus.Metric) {
+	p.metrics.stepDuration.Collect(ch)
+	p.metrics.deprovisionDuration.Collect(ch)
+	p.metrics.rpcDuration.Collect(ch)
+	p.metrics.rpcErrors.Collect(ch)
+	p.metrics.uploadBytes.Collect(ch)
+
+	p.metrics.collectRetrying(ch)
+	p.metrics.collectDomains(ch)
+}
+
+func (m *metrics) collectDomains(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for host, states := range m.domains {
+		for state, count := range states {
+			ch <- prometheus.MustNewConstMetric(m.domainsDesc, prometheus.GaugeValue, float64(count), host, state)
+		}
+	}
+}
+
+func (m *metrics) collectRetrying(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	requests := map[string]int{}
+	longest := map[string]time.Duration{}
+
+	for _, r := range m.retrying {
+		requests[r.step]++
+		longest[r.step] = max(longest[r.step], now.Sub(r.since))
+	}
+
+	for step, count := range requests {
+		ch <- prometheus.MustNewConstMetric(m.retryingDesc, prometheus.GaugeValue, float64(count), step)
+
+		ch <- prometheus.MustNewConstMetric(m.retryingSecondsDesc, prometheus.GaugeValue, longest[step].Seconds(), step)
+	}
+}
+
+// domainStates are the names of the libvirt domain states.
+var domainStates = map[libvirt.DomainState]string{
+	libvirt.DomainNostate:     "nostate",
+	libvirt.DomainRunning:     "running",
+	libvirt.DomainBlocked:     "blocked",
+	libvirt.DomainPaused:      "paused",
+	libvirt.DomainShutdown:    "shutdown",
+	libvirt.DomainShutoff:     "shutoff",
+	libvirt.DomainCrashed:     "crashed",
+	libvirt.DomainPmsuspended: "pmsuspended",
+}
+
+// RunDomainCounts counts the domains managed by the provider for the metrics until the context is canceled.
+func (p *Provisioner) RunDomainCounts(ctx context.Context) error {
+	ticker := time.NewTicker(domainCountInterval)
+	defer ticker.Stop()
+
+	for {
+		p.CountDomains(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// CountDomains counts the domains managed by the provider on each host by state, for the metrics.
+//
+// The hosts are counted concurrently, within domainCountTimeout or the deadline of the context.
+// The libvirt calls can't be canceled: a host which doesn't answer in time, or fails, has no count,
+// and isn't counted again until its calls return.
+func (p *Provisioner) CountDomains(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, domainCountTimeout)
+	defer cancel()
+
+	type count struct {
+		states map[string]int
+		err    error
+		host   string
+	}
+
+	hosts := p.hostList()
+	counts := make(chan count, len(hosts))
+	pending := 0
+
+	for _, host := range hosts {
+		if !p.metrics.startCount(host.Name) {
+			continue
+		}
+
+		pending++
+
+		go func() {
+			defer p.metrics.endCount(host.Name)
+
+			states, err := countDomains(host)
+
+			counts <- count{host: host.Name, states: states, err: err}
+		}()
+	}
+
+	domains := map[string]map[string]int{}
+
+	for ; pending > 0; pending-- {
+		select {
+		case <-ctx.Done():
+			p.metrics.setDomains(domains)
+
+			return
+		case c := <-counts:
+			if c.err == nil {
+				domains[c.host] = c.states
+			}
+		}
+	}
+
+	p.metrics.setDomains(domains)
+}
+
+// startCount reports whether the domains of the host can be counted, i.e. they are not being counted already.
+func (m *metrics) startCount(host string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.counting[host] {
+		return false
+	}
+
+	m.counting[host] = true
+
+	return true
+}
+
+func (m *metrics) endCount(host string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.counting, host)
+}
+
+func (m *metrics) setDomains(domains map[string]map[string]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.domains = domains
+}
+
+// countDomains returns the number of the domains managed by the provider on the host by state.
+//
+// The calls are not instrumented: they would be counted in the metrics of the libvirt calls of the provisioning.
+func countDomains(host Host) (map[string]int, error) {
+	lc, err := uninstrumentedClient(host)
+	if err != nil {
+		return nil, err
+	}
+
+	domains, _, err := lc.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive|libvirt.ConnectListDomainsInactive)
+	if err != nil {
+		return nil, err
+	}
+
+	states := map[string]int{}
+
+	for _, dom := range domains {
+		if _, ok, err := domainOwnerOf(lc, dom); err != nil || !ok {
+			continue
+		}
+
+		state, _, err := lc.DomainGetState(dom, 0)
+		if err != nil {
+			continue
+		}
+
+		states[domainStateName(libvirt.DomainState(state))]++
+	}
+
+	return states, nil
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	io.Reader
+
+	counter prometheus.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+
+	r.counter.Add(float64(n))
+
+	return n, err
+}
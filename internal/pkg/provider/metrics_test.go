@@ -0,0 +1,178 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+// gather returns the value of the metric with the given labels, the sample count for histograms.
+func gather(t *testing.T, collector prometheus.Collector, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			if !hasLabels(metric, labels) {
+				continue
+			}
+
+			switch {
+			case metric.GetHistogram() != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			case metric.GetCounter() != nil:
+				return metric.GetCounter().GetValue()
+			default:
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
+
+	return 0
+}
+
+func hasLabels(metric *dto.Metric, labels map[string]string) bool {
+	found := 0
+
+	for _, pair := range metric.GetLabel() {
+		if value, ok := labels[pair.GetName()]; ok && value == pair.GetValue() {
+			found++
+		}
+	}
+
+	return found == len(labels)
+}
+
+func TestMetrics(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "createVM")
+
+	assert.EqualValues(t, 1, gather(t, env.provisioner, "omni_libvirt_provider_provision_step_duration_seconds", map[string]string{"step": "createVM", "outcome": "success"}))
+	assert.EqualValues(t, 1, gather(t, env.provisioner, "omni_libvirt_provider_libvirt_rpc_duration_seconds", map[string]string{"host": config.DefaultHostName, "method": "DomainDefineXML"}))
+	// the primary disk image and the cidata ISO
+	assert.Greater(t, gather(t, env.provisioner, "omni_libvirt_provider_upload_bytes_total", map[string]string{"host": config.DefaultHostName}), float64(len(testImage)))
+
+	calls := gather(t, env.provisioner, "omni_libvirt_provider_libvirt_rpc_duration_seconds", map[string]string{"host": config.DefaultHostName, "method": "ConnectListAllDomains"})
+
+	env.provisioner.CountDomains(t.Context())
+
+	// counting the domains isn't a libvirt call of the provisioning
+	assert.Equal(t, calls, gather(t, env.provisioner, "omni_libvirt_provider_libvirt_rpc_duration_seconds", map[string]string{"host": config.DefaultHostName, "method": "ConnectListAllDomains"}))
+
+	require.NoError(t, testutil.GatherAndCompare(prometheusRegistry(t, env.provisioner), strings.NewReader(`
+# HELP omni_libvirt_provider_domains Number of the domains managed by the provider by host and state.
+# TYPE omni_libvirt_provider_domains gauge
+omni_libvirt_provider_domains{host="default",state="shutoff"} 1
+`), "omni_libvirt_provider_domains"))
+
+	env.lv.InjectError("DomainUndefine", 0, assert.AnError)
+
+	require.Error(t, env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request))
+
+	assert.EqualValues(t, 1, gather(t, env.provisioner, "omni_libvirt_provider_libvirt_rpc_errors_total", map[string]string{"host": config.DefaultHostName, "method": "DomainUndefine"}))
+	assert.EqualValues(t, 1, gather(t, env.provisioner, "omni_libvirt_provider_deprovision_duration_seconds", map[string]string{"outcome": "error"}))
+}
+
+func TestMetricsRetrying(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "provisionCidata")
+
+	// the host is disconnected
+	connector := &flakyConnector{client: env.lv}
+	connector.calls.Store(1)
+
+	env.provisioner = provider.NewProvisioner([]provider.Host{{Name: config.DefaultHostName, Connection: connector}}, env.scheduler, nil)
+
+	for range 2 {
+		require.Error(t, env.runStep(t, "createVM"))
+	}
+
+	assert.EqualValues(t, 2, gather(t, env.provisioner, "omni_libvirt_provider_provision_step_duration_seconds", map[string]string{"step": "createVM", "outcome": "retry"}))
+	assert.EqualValues(t, 1, gather(t, env.provisioner, "omni_libvirt_provider_provision_retrying_requests", map[string]string{"step": "createVM"}))
+	assert.Positive(t, gather(t, env.provisioner, "omni_libvirt_provider_provision_retrying_seconds", map[string]string{"step": "createVM"}))
+
+	// the request is no longer retried once it is deprovisioned
+	require.Error(t, env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request))
+
+	assert.Zero(t, gather(t, env.provisioner, "omni_libvirt_provider_provision_retrying_requests", map[string]string{"step": "createVM"}))
+}
+
+// hangingClient blocks listing the domains until it is released.
+type hangingClient struct {
+	provider.LibvirtClient
+
+	release chan struct{}
+}
+
+func (c hangingClient) ConnectListAllDomains(needResults int32, flags libvirt.ConnectListAllDomainsFlags) ([]libvirt.Domain, uint32, error) {
+	<-c.release
+
+	return c.LibvirtClient.ConnectListAllDomains(needResults, flags)
+}
+
+func TestMetricsDomainsHostHanging(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "createVM")
+
+	release := make(chan struct{})
+	hosts := env.hosts()
+	hosts[0].Connection = provider.Connected(hangingClient{LibvirtClient: env.lv, release: release})
+
+	env.provisioner.SetHosts(hosts)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	// the hanging host has no count
+	env.provisioner.CountDomains(ctx)
+	assert.Zero(t, testutil.CollectAndCount(env.provisioner, "omni_libvirt_provider_domains"))
+
+	// and isn't counted again while its calls hang
+	env.provisioner.CountDomains(t.Context())
+	assert.Zero(t, testutil.CollectAndCount(env.provisioner, "omni_libvirt_provider_domains"))
+
+	close(release)
+
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		env.provisioner.CountDomains(t.Context())
+
+		assert.Equal(c, 1, testutil.CollectAndCount(env.provisioner, "omni_libvirt_provider_domains"))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func prometheusRegistry(t *testing.T, collectors ...prometheus.Collector) *prometheus.Registry {
+	t.Helper()
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collectors...)
+
+	return registry
+}
@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/meta"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/resources"
+)
+
+// metadataNamespace is the XML namespace of the domain ownership metadata.
+const metadataNamespace = "https://github.com/siderolabs/omni-infra-provider-libvirt"
+
+// domainOwner is the ownership metadata stored in the domains created by the provider.
+//
+// It links the domain to the machine request, and to the cluster and the machine set the machine is allocated for.
+type domainOwner struct {
+	ProviderID string `xml:"provider-id"`
+	RequestID  string `xml:"request-id"`
+	Cluster    string `xml:"cluster,omitempty"`
+	MachineSet string `xml:"machine-set,omitempty"`
+	// Snapshots is the snapshot schedule of the machine.
+	Snapshots *snapshotSchedule `xml:"snapshots"`
+}
+
+// metadata renders the owner as the custom metadata element of the domain XML.
+func (o domainOwner) metadata() string {
+	var sb strings.Builder
+
+	sb.WriteString(`<omni:machine xmlns:omni="` + metadataNamespace + `">`)
+
+	for _, field := range []struct{ name, value string }{
+		{"provider-id", o.ProviderID},
+		{"request-id", o.RequestID},
+		{"cluster", o.Cluster},
+		{"machine-set", o.MachineSet},
+	} {
+		if field.value == "" {
+			continue
+		}
+
+		sb.WriteString("<omni:" + field.name + ">")
+		xml.EscapeText(&sb, []byte(field.value)) //nolint:errcheck
+		sb.WriteString("</omni:" + field.name + ">")
+	}
+
+	if s := o.Snapshots; s != nil {
+		sb.WriteString(`<omni:snapshots interval="`)
+		xml.EscapeText(&sb, []byte(s.Interval)) //nolint:errcheck
+		sb.WriteString(`" keep="` + strconv.FormatUint(uint64(s.Keep), 10) + `"`)
+
+		if s.Memory {
+			sb.WriteString(` memory="true"`)
+		}
+
+		sb.WriteString("/>")
+	}
+
+	sb.WriteString("</omni:machine>")
+
+	return sb.String()
+}
+
+// placementGroups returns the placement groups of the machine, see placementRules.
+func (o domainOwner) placementGroups() []string {
+	var groups []string
+
+	if o.Cluster != "" {
+		groups = append(groups, clusterGroup(o.Cluster))
+	}
+
+	if o.MachineSet != "" {
+		groups = append(groups, machineSetGroup(o.MachineSet))
+	}
+
+	return groups
+}
+
+func clusterGroup(cluster string) string {
+	return "cluster/" + cluster
+}
+
+func machineSetGroup(machineSet string) string {
+	return "machine-set/" + machineSet
+}
+
+// requestOwner returns the owner of the domain created for the machine request.
+//
+// Omni copies the labels of the machine request to its status.
+func requestOwner(pctx provision.Context[*resources.Machine]) domainOwner {
+	labels := pctx.MachineRequestStatus.Metadata().Labels()
+
+	cluster, _ := labels.Get(omni.LabelCluster)
+	machineSet, _ := labels.Get(omni.LabelMachineSet)
+
+	return domainOwner{
+		ProviderID: meta.ProviderID,
+		RequestID:  pctx.GetRequestID(),
+		Cluster:    cluster,
+		MachineSet: machineSet,
+	}
+}
+
+// domainOwnerOf reads the ownership metadata of the domain.
+//
+// Domains which were not created by this provider return false.
+func domainOwnerOf(lc LibvirtClient, dom libvirt.Domain) (domainOwner, bool, error) {
+	raw, err := lc.DomainGetMetadata(dom, int32(libvirt.DomainMetadataElement), libvirt.OptString{metadataNamespace}, libvirt.DomainAffectCurrent)
+	if err != nil {
+		var libvirtErr libvirt.Error
+
+		if errors.As(err, &libvirtErr) && libvirtErr.Code == uint32(libvirt.ErrNoDomainMetadata) {
+			return domainOwner{}, false, nil
+		}
+
+		return domainOwner{}, false, err
+	}
+
+	var owner domainOwner
+
+	if err = xml.Unmarshal([]byte(raw), &owner); err != nil {
+		return domainOwner{}, false, fmt.Errorf("error parsing ownership metadata: %w", err)
+	}
+
+	return owner, owner.ProviderID == meta.ProviderID, nil
+}
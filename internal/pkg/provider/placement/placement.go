@@ -0,0 +1,421 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package placement implements the choice of the libvirt host a machine is created on.
+//
+// The scheduler scores the candidate hosts by their free capacity using a pluggable strategy,
+// and reserves the capacity of the chosen host until the machine shows up in the host statistics.
+package placement
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReservationTTL is how long the capacity of a placed request is reserved if it is never released.
+const ReservationTTL = 30 * time.Minute
+
+// Strategy names, as used in the provider config.
+const (
+	StrategySpread         = "spread"
+	StrategyBinPack        = "bin-pack"
+	StrategyWeightedRandom = "weighted-random"
+)
+
+// Request is the capacity requested by a machine, along with its placement rules.
+type Request struct {
+	// Groups are the groups the machine belongs to, e.g. its cluster.
+	Groups []string
+	Rules  []Rule
+	// Memory and Disk are in bytes.
+	Memory uint64
+	Disk   uint64
+	Cores  uint
+}
+
+// Rule is an affinity or anti-affinity rule of a machine to the other machines of a group.
+type Rule struct {
+	Group string
+	// Affinity places the machine together with the machines of the group, instead of apart from them.
+	Affinity bool
+	// Required rules fail the placement, instead of being ignored, when no host satisfies them.
+	Required bool
+}
+
+func (r Rule) String() string {
+	kind := "anti-affinity"
+	if r.Affinity {
+		kind = "affinity"
+	}
+
+	if !r.Required {
+		kind = "preferred " + kind
+	}
+
+	return kind + " to " + r.Group
+}
+
+// ErrUnsatisfiable is returned when no host satisfies a required rule.
+var ErrUnsatisfiable = errors.New("placement rule can't be satisfied")
+
+// Host is a candidate host along with its capacity.
+type Host struct {
+	Name string
+	// Memory and FreeMemory are in bytes.
+	Memory     uint64
+	FreeMemory uint64
+	// FreeDisk is the space available in the storage pool the machine volumes are created in, in bytes.
+	FreeDisk uint64
+	// Groups is the number of machines on the host in each group.
+	Groups map[string]int
+	// Cores is the number of host CPUs, AllocatedCores the number of vCPUs of the domains defined on the host.
+	Cores          uint
+	AllocatedCores uint
+}
+
+// Fits returns true if the request fits into the free memory and disk space of the host.
+//
+// vCPUs are not considered, overcommitting them is the norm.
+func (h Host) Fits(req Request) bool {
+	return h.FreeMemory >= req.Memory && h.FreeDisk >= req.Disk
+}
+
+// Load returns the load of the host after placing the request on it.
+//
+// The load is the highest of the memory and the vCPU utilization ratios, it is above 1 for overcommitted hosts.
+func (h Host) Load(req Request) float64 {
+	var memoryLoad, coresLoad float64
+
+	if h.Memory > 0 {
+		memoryLoad = (float64(h.Memory) - float64(h.FreeMemory) + float64(req.Memory)) / float64(h.Memory)
+	}
+
+	if h.Cores > 0 {
+		coresLoad = float64(h.AllocatedCores+req.Cores) / float64(h.Cores)
+	}
+
+	return max(memoryLoad, coresLoad)
+}
+
+func (h Host) reserve(req Request) Host {
+	h.FreeMemory -= min(h.FreeMemory, req.Memory)
+	h.FreeDisk -= min(h.FreeDisk, req.Disk)
+	h.AllocatedCores += req.Cores
+
+	if len(req.Groups) > 0 {
+		groups := maps.Clone(h.Groups)
+		if groups == nil {
+			groups = make(map[string]int, len(req.Groups))
+		}
+
+		for _, group := range req.Groups {
+			groups[group]++
+		}
+
+		h.Groups = groups
+	}
+
+	return h
+}
+
+// applyRules returns the hosts satisfying the rules of the request.
+//
+// Required rules filter out the hosts violating them. Preferred rules narrow down the hosts
+// to the best matching ones, but never to an empty list.
+func applyRules(hosts []Host, req Request) ([]Host, error) {
+	for _, rule := range req.Rules {
+		if !rule.Required {
+			continue
+		}
+
+		if rule.Affinity && !slices.ContainsFunc(hosts, func(h Host) bool { return h.Groups[rule.Group] > 0 }) {
+			// the first machine of the group
+			continue
+		}
+
+		var violating []string
+
+		hosts = slices.DeleteFunc(slices.Clone(hosts), func(h Host) bool {
+			if (h.Groups[rule.Group] > 0) != rule.Affinity {
+				violating = append(violating, h.Name)
+
+				return true
+			}
+
+			return false
+		})
+
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("%w: %s, violated by hosts %s", ErrUnsatisfiable, rule, strings.Join(violating, ", "))
+		}
+	}
+
+	for _, rule := range req.Rules {
+		if rule.Required {
+			continue
+		}
+
+		best := hosts[0].Groups[rule.Group]
+
+		for _, host := range hosts[1:] {
+			count := host.Groups[rule.Group]
+
+			if (rule.Affinity && count > best) || (!rule.Affinity && count < best) {
+				best = count
+			}
+		}
+
+		hosts = slices.DeleteFunc(slices.Clone(hosts), func(h Host) bool { return h.Groups[rule.Group] != best })
+	}
+
+	return hosts, nil
+}
+
+// Strategy picks the host for a request.
+type Strategy interface {
+	// Pick returns the index of the chosen host.
+	//
+	// The hosts are sorted by name, and the capacity reserved for in-flight requests is already subtracted.
+	Pick(hosts []Host, req Request) int
+}
+
+// ParseStrategy returns the strategy with the given name; an empty name selects the spread strategy.
+func ParseStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", StrategySpread:
+		return Spread{}, nil
+	case StrategyBinPack:
+		return BinPack{}, nil
+	case StrategyWeightedRandom:
+		return NewWeightedRandom(rand.NewPCG(rand.Uint64(), rand.Uint64())), nil
+	default:
+		return nil, fmt.Errorf("unknown placement strategy %q, expected one of %s", name,
+			strings.Join([]string{StrategySpread, StrategyBinPack, StrategyWeightedRandom}, ", "))
+	}
+}
+
+// Spread places the request on the least loaded host which fits it.
+type Spread struct{}
+
+// Pick implements Strategy.
+func (Spread) Pick(hosts []Host, req Request) int {
+	return pickBy(hosts, req, func(a, b float64) bool { return a < b })
+}
+
+// BinPack places the request on the most loaded host which fits it, keeping other hosts free for large machines.
+//
+// If no host fits the request, the least loaded one is chosen.
+type BinPack struct{}
+
+// Pick implements Strategy.
+func (BinPack) Pick(hosts []Host, req Request) int {
+	if !slices.ContainsFunc(hosts, func(h Host) bool { return h.Fits(req) }) {
+		return Spread{}.Pick(hosts, req)
+	}
+
+	return pickBy(hosts, req, func(a, b float64) bool { return a > b })
+}
+
+// WeightedRandom places the request on a random host which fits it, weighted by the free capacity of the hosts.
+type WeightedRandom struct {
+	rand *rand.Rand
+	mu   sync.Mutex
+}
+
+// NewWeightedRandom creates a weighted random strategy using the given source of randomness.
+func NewWeightedRandom(src rand.Source) *WeightedRandom {
+	return &WeightedRandom{rand: rand.New(src)}
+}
+
+// minWeight keeps fully loaded hosts selectable when no other host is available.
+const minWeight = 0.01
+
+// Pick implements Strategy.
+func (w *WeightedRandom) Pick(hosts []Host, req Request) int {
+	fits := slices.ContainsFunc(hosts, func(h Host) bool { return h.Fits(req) })
+	weights := make([]float64, len(hosts))
+
+	var total float64
+
+	for i, host := range hosts {
+		if fits && !host.Fits(req) {
+			continue
+		}
+
+		weights[i] = max(1-host.Load(req), minWeight)
+		total += weights[i]
+	}
+
+	w.mu.Lock()
+	r := w.rand.Float64() * total
+	w.mu.Unlock()
+
+	for i, weight := range weights {
+		if weight == 0 {
+			continue
+		}
+
+		if r < weight {
+			return i
+		}
+
+		r -= weight
+	}
+
+	// rounding errors, pick the last candidate
+	for i := len(weights) - 1; i > 0; i-- {
+		if weights[i] > 0 {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// pickBy returns the host with the best load according to better, preferring the hosts which fit the request.
+//
+// Ties are broken by the order of the hosts.
+func pickBy(hosts []Host, req Request, better func(a, b float64) bool) int {
+	best := -1
+
+	for i, host := range hosts {
+		if best == -1 {
+			best = i
+
+			continue
+		}
+
+		bestFits, fits := hosts[best].Fits(req), host.Fits(req)
+
+		switch {
+		case fits && !bestFits:
+			best = i
+		case fits == bestFits && better(host.Load(req), hosts[best].Load(req)):
+			best = i
+		}
+	}
+
+	return best
+}
+
+type reservation struct {
+	expires time.Time
+	host    string
+	req     Request
+}
+
+// Scheduler places requests on hosts.
+//
+// The capacity of a placed request is reserved until it is released, so that concurrent requests
+// see each other before the machines are created. It is safe for concurrent use.
+type Scheduler struct {
+	strategy     Strategy
+	reservations map[string]reservation
+	mu           sync.Mutex
+}
+
+// NewScheduler creates a new scheduler using the given strategy.
+func NewScheduler(strategy Strategy) *Scheduler {
+	return &Scheduler{
+		strategy:     strategy,
+		reservations: make(map[string]reservation),
+	}
+}
+
+// Schedule picks the host for the request with the given ID, and reserves the requested capacity on it.
+//
+// The rules of the request are applied before the strategy, the machines of the in-flight requests
+// are taken into account. Scheduling the same request again replaces its reservation.
+func (s *Scheduler) Schedule(requestID string, hosts []Host, req Request) (string, error) {
+	if len(hosts) == 0 {
+		return "", errors.New("no candidate hosts")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	candidates := slices.Clone(hosts)
+
+	slices.SortFunc(candidates, func(a, b Host) int { return strings.Compare(a.Name, b.Name) })
+
+	for id, r := range s.reservations {
+		if now.After(r.expires) {
+			delete(s.reservations, id)
+
+			continue
+		}
+
+		if id == requestID {
+			continue
+		}
+
+		for i := range candidates {
+			if candidates[i].Name == r.host {
+				candidates[i] = candidates[i].reserve(r.req)
+			}
+		}
+	}
+
+	candidates, err := applyRules(candidates, req)
+	if err != nil {
+		return "", err
+	}
+
+	host := candidates[s.strategy.Pick(candidates, req)].Name
+
+	s.reservations[requestID] = reservation{
+		host:    host,
+		req:     req,
+		expires: now.Add(ReservationTTL),
+	}
+
+	return host, nil
+}
+
+// SetStrategy replaces the strategy used for the next requests.
+func (s *Scheduler) SetStrategy(strategy Strategy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.strategy = strategy
+}
+
+// Reserved returns the capacity reserved on the host by the in-flight requests, other than the given one.
+func (s *Scheduler) Reserved(host, exceptRequestID string) Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		now      = time.Now()
+		reserved Request
+	)
+
+	for id, r := range s.reservations {
+		if id == exceptRequestID || r.host != host || now.After(r.expires) {
+			continue
+		}
+
+		reserved.Memory += r.req.Memory
+		reserved.Disk += r.req.Disk
+		reserved.Cores += r.req.Cores
+	}
+
+	return reserved
+}
+
+// Release drops the reservation of the request, once its machine is accounted for by the host statistics.
+func (s *Scheduler) Release(requestID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.reservations, requestID)
+}
@@ -0,0 +1,292 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package placement_test
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
+)
+
+const gib = uint64(1 << 30)
+
+func host(name string, freeMemory uint64, allocatedCores uint) placement.Host {
+	return placement.Host{
+		Name:           name,
+		Memory:         64 * gib,
+		FreeMemory:     freeMemory * gib,
+		FreeDisk:       1000 * gib,
+		Cores:          16,
+		AllocatedCores: allocatedCores,
+	}
+}
+
+var request = placement.Request{
+	Memory: 4 * gib,
+	Disk:   20 * gib,
+	Cores:  2,
+}
+
+func TestStrategies(t *testing.T) {
+	for _, tt := range []struct {
+		strategy placement.Strategy
+		name     string
+		hosts    []placement.Host
+		want     string
+	}{
+		{
+			name:     "spread picks the least loaded host",
+			strategy: placement.Spread{},
+			hosts:    []placement.Host{host("a", 16, 2), host("b", 48, 2), host("c", 32, 2)},
+			want:     "b",
+		},
+		{
+			name:     "spread considers vcpus",
+			strategy: placement.Spread{},
+			hosts:    []placement.Host{host("a", 48, 14), host("b", 40, 2)},
+			want:     "b",
+		},
+		{
+			name:     "spread breaks ties by order",
+			strategy: placement.Spread{},
+			hosts:    []placement.Host{host("a", 32, 2), host("b", 32, 2)},
+			want:     "a",
+		},
+		{
+			name:     "bin-pack picks the most loaded host which fits",
+			strategy: placement.BinPack{},
+			hosts:    []placement.Host{host("a", 2, 2), host("b", 48, 2), host("c", 8, 2)},
+			want:     "c",
+		},
+		{
+			name:     "bin-pack falls back to the least loaded host",
+			strategy: placement.BinPack{},
+			hosts:    []placement.Host{host("a", 2, 2), host("b", 3, 2)},
+			want:     "b",
+		},
+		{
+			name:     "weighted random skips hosts which don't fit",
+			strategy: placement.NewWeightedRandom(rand.NewPCG(1, 2)),
+			hosts:    []placement.Host{host("a", 2, 2), host("b", 3, 2), host("c", 8, 2)},
+			want:     "c",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.hosts[tt.strategy.Pick(tt.hosts, request)].Name)
+		})
+	}
+}
+
+func TestWeightedRandomIsDeterministic(t *testing.T) {
+	hosts := []placement.Host{host("a", 16, 2), host("b", 48, 2), host("c", 32, 2)}
+
+	pick := func() []string {
+		strategy := placement.NewWeightedRandom(rand.NewPCG(42, 42))
+		picks := make([]string, 0, 100)
+
+		for range 100 {
+			picks = append(picks, hosts[strategy.Pick(hosts, request)].Name)
+		}
+
+		return picks
+	}
+
+	picks := pick()
+
+	assert.Equal(t, picks, pick())
+
+	counts := map[string]int{}
+
+	for _, name := range picks {
+		counts[name]++
+	}
+
+	// the host with the most free capacity is picked most often
+	assert.Greater(t, counts["b"], counts["c"])
+	assert.Greater(t, counts["c"], counts["a"])
+}
+
+func TestSchedulerReservesCapacity(t *testing.T) {
+	scheduler := placement.NewScheduler(placement.Spread{})
+	hosts := []placement.Host{host("b", 24, 0), host("a", 24, 0), host("c", 32, 0)}
+
+	var placed []string
+
+	// the host statistics don't change until the machines are created
+	for i := range 5 {
+		name, err := scheduler.Schedule(fmt.Sprintf("request-%d", i), hosts, request)
+		require.NoError(t, err)
+
+		placed = append(placed, name)
+	}
+
+	assert.Equal(t, []string{"c", "c", "a", "b", "c"}, placed)
+
+	// scheduling a request again replaces its reservation
+	name, err := scheduler.Schedule("request-4", hosts, request)
+	require.NoError(t, err)
+	assert.Equal(t, "c", name)
+
+	scheduler.Release("request-0")
+	scheduler.Release("request-1")
+	scheduler.Release("request-4")
+
+	name, err = scheduler.Schedule("request-5", hosts, request)
+	require.NoError(t, err)
+	assert.Equal(t, "c", name)
+}
+
+func TestSchedulerReserved(t *testing.T) {
+	scheduler := placement.NewScheduler(placement.Spread{})
+	hosts := []placement.Host{host("a", 24, 0)}
+
+	for i := range 3 {
+		_, err := scheduler.Schedule(fmt.Sprintf("request-%d", i), hosts, request)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, placement.Request{Memory: 8 * gib, Disk: 40 * gib, Cores: 4}, scheduler.Reserved("a", "request-0"))
+	assert.Equal(t, placement.Request{}, scheduler.Reserved("b", ""))
+
+	scheduler.Release("request-1")
+
+	assert.Equal(t, placement.Request{Memory: 8 * gib, Disk: 40 * gib, Cores: 4}, scheduler.Reserved("a", ""))
+}
+
+func TestSchedulerSetStrategy(t *testing.T) {
+	scheduler := placement.NewScheduler(placement.Spread{})
+	hosts := []placement.Host{host("a", 8, 2), host("b", 48, 2)}
+
+	name, err := scheduler.Schedule("request-0", hosts, request)
+	require.NoError(t, err)
+	assert.Equal(t, "b", name)
+
+	scheduler.SetStrategy(placement.BinPack{})
+
+	name, err = scheduler.Schedule("request-1", hosts, request)
+	require.NoError(t, err)
+	assert.Equal(t, "a", name)
+}
+
+func TestSchedulerNoHosts(t *testing.T) {
+	_, err := placement.NewScheduler(placement.Spread{}).Schedule("request", nil, request)
+	require.Error(t, err)
+}
+
+func TestParseStrategy(t *testing.T) {
+	for name, want := range map[string]placement.Strategy{
+		"":         placement.Spread{},
+		"spread":   placement.Spread{},
+		"bin-pack": placement.BinPack{},
+	} {
+		strategy, err := placement.ParseStrategy(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, strategy)
+	}
+
+	strategy, err := placement.ParseStrategy("weighted-random")
+	require.NoError(t, err)
+	assert.IsType(t, &placement.WeightedRandom{}, strategy)
+
+	_, err = placement.ParseStrategy("round-robin")
+	require.ErrorContains(t, err, `unknown placement strategy "round-robin"`)
+}
+
+func TestSchedulerRules(t *testing.T) {
+	withGroups := func(h placement.Host, groups map[string]int) placement.Host {
+		h.Groups = groups
+
+		return h
+	}
+
+	for _, tt := range []struct {
+		name    string
+		wantErr string
+		want    string
+		rules   []placement.Rule
+		hosts   []placement.Host
+	}{
+		{
+			name:  "required anti-affinity",
+			rules: []placement.Rule{{Group: "cluster/a", Required: true}},
+			hosts: []placement.Host{withGroups(host("a", 48, 0), map[string]int{"cluster/a": 1}), host("b", 8, 0)},
+			want:  "b",
+		},
+		{
+			name:    "required anti-affinity can't be satisfied",
+			rules:   []placement.Rule{{Group: "cluster/a", Required: true}},
+			hosts:   []placement.Host{withGroups(host("a", 48, 0), map[string]int{"cluster/a": 1})},
+			wantErr: "placement rule can't be satisfied: anti-affinity to cluster/a, violated by hosts a",
+		},
+		{
+			name:  "preferred anti-affinity",
+			rules: []placement.Rule{{Group: "cluster/a"}},
+			hosts: []placement.Host{
+				withGroups(host("a", 48, 0), map[string]int{"cluster/a": 2}),
+				withGroups(host("b", 8, 0), map[string]int{"cluster/a": 1}),
+				withGroups(host("c", 16, 0), map[string]int{"cluster/a": 1}),
+			},
+			want: "c",
+		},
+		{
+			name:  "required affinity",
+			rules: []placement.Rule{{Group: "cluster/a", Affinity: true, Required: true}},
+			hosts: []placement.Host{host("a", 48, 0), withGroups(host("b", 8, 0), map[string]int{"cluster/a": 1})},
+			want:  "b",
+		},
+		{
+			name:  "required affinity of the first machine",
+			rules: []placement.Rule{{Group: "cluster/a", Affinity: true, Required: true}},
+			hosts: []placement.Host{host("a", 48, 0), host("b", 8, 0)},
+			want:  "a",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := request
+			req.Rules = tt.rules
+
+			name, err := placement.NewScheduler(placement.Spread{}).Schedule("request", tt.hosts, req)
+
+			if tt.wantErr != "" {
+				require.ErrorIs(t, err, placement.ErrUnsatisfiable)
+				require.EqualError(t, err, tt.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, name)
+		})
+	}
+}
+
+func TestSchedulerRulesReserveGroups(t *testing.T) {
+	scheduler := placement.NewScheduler(placement.BinPack{})
+	hosts := []placement.Host{host("a", 48, 0), host("b", 48, 0), host("c", 48, 0)}
+
+	req := request
+	req.Groups = []string{"cluster/a"}
+	req.Rules = []placement.Rule{{Group: "cluster/a", Required: true}}
+
+	var placed []string
+
+	// none of the machines exist yet, the reservations keep them apart
+	for i := range 3 {
+		name, err := scheduler.Schedule(fmt.Sprintf("request-%d", i), hosts, req)
+		require.NoError(t, err)
+
+		placed = append(placed, name)
+	}
+
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, placed)
+
+	_, err := scheduler.Schedule("request-3", hosts, req)
+	require.ErrorIs(t, err, placement.ErrUnsatisfiable)
+}
@@ -0,0 +1,133 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/resources"
+)
+
+// Policy is the provider side configuration applied to all machine requests.
+type Policy struct {
+	// Defaults are the provider data fields used when the machine class doesn't set them.
+	Defaults map[string]any
+	// AllowedPools limits the storage pools the machines can use, an empty list allows all.
+	AllowedPools []string
+	// AllowedNetworks limits the networks the machines can be attached to, an empty list allows all.
+	AllowedNetworks []string
+	// AllowedBlockDevices are the path prefixes of the host block devices the machines can attach,
+	// an empty list allows none.
+	AllowedBlockDevices []string
+}
+
+// check verifies that the provider data only uses the allowed storage pools, networks and block devices.
+//
+// The volumes of the existing additional disks have to be in an allowed storage pool too.
+func (p Policy) check(data Data) error {
+	if len(p.AllowedPools) > 0 && !slices.Contains(p.AllowedPools, data.StoragePool) {
+		return fmt.Errorf("storage pool %q is not allowed by the provider config", data.StoragePool)
+	}
+
+	for idx, disk := range data.AdditionalDisks {
+		if disk.BlockDevice != "" && !p.blockDeviceAllowed(disk.BlockDevice) {
+			return fmt.Errorf("block device %q of additional_disks[%d] is not allowed by the provider config", disk.BlockDevice, idx)
+		}
+
+		if disk.Volume == "" || len(p.AllowedPools) == 0 {
+			continue
+		}
+
+		if pool := disk.pool(data); !slices.Contains(p.AllowedPools, pool) {
+			return fmt.Errorf("storage pool %q of additional_disks[%d] is not allowed by the provider config", pool, idx)
+		}
+	}
+
+	if len(p.AllowedNetworks) > 0 {
+		for _, iface := range data.NetworkInterfaces {
+			if !slices.Contains(p.AllowedNetworks, iface.NetworkName) {
+				return fmt.Errorf("network %q is not allowed by the provider config", iface.NetworkName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// blockDeviceAllowed reports whether the block device is under one of the allowed path prefixes.
+//
+// The path is cleaned first, so "/dev/vg1/../sda" isn't under "/dev/vg1".
+func (p Policy) blockDeviceAllowed(dev string) bool {
+	dev = path.Clean(dev)
+
+	return slices.ContainsFunc(p.AllowedBlockDevices, func(prefix string) bool {
+		prefix = path.Clean(prefix)
+
+		return dev == prefix || strings.HasPrefix(dev, strings.TrimSuffix(prefix, "/")+"/")
+	})
+}
+
+// CheckDefaults verifies that the defaults only use the allowed storage pools and networks.
+func (p Policy) CheckDefaults() error {
+	data, err := p.merge(nil)
+	if err != nil {
+		return err
+	}
+
+	if data.StoragePool == "" && len(p.AllowedPools) > 0 {
+		// the storage pool is left to the machine classes
+		data.StoragePool = p.AllowedPools[0]
+	}
+
+	return p.check(data)
+}
+
+// merge returns the provider data with the defaults for the fields it doesn't set.
+//
+// A field set in the provider data replaces the default as a whole, lists and selectors are not merged.
+func (p Policy) merge(fields map[string]any) (Data, error) {
+	merged := maps.Clone(p.Defaults)
+	if merged == nil {
+		merged = make(map[string]any, len(fields))
+	}
+
+	maps.Copy(merged, fields)
+
+	raw, err := yaml.Marshal(merged)
+	if err != nil {
+		return Data{}, err
+	}
+
+	var data Data
+
+	if err = yaml.Unmarshal(raw, &data); err != nil {
+		return Data{}, err
+	}
+
+	return data, nil
+}
+
+// SetPolicy replaces the policy applied to the machine requests.
+func (p *Provisioner) SetPolicy(policy Policy) {
+	p.policy.Store(&policy)
+}
+
+// providerData returns the provider data of the machine request, with the defaults of the policy.
+func (p *Provisioner) providerData(pctx provision.Context[*resources.Machine]) (Data, error) {
+	var fields map[string]any
+
+	if err := pctx.UnmarshalProviderData(&fields); err != nil {
+		return Data{}, err
+	}
+
+	return p.policy.Load().merge(fields)
+}
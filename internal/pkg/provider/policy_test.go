@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+func TestPolicy(t *testing.T) {
+	withPolicy := func(policy provider.Policy) func(*testing.T, *testEnv) {
+		return func(_ *testing.T, env *testEnv) {
+			env.provisioner.SetPolicy(policy)
+		}
+	}
+
+	runStepTests(t, "selectHost", []stepTest{
+		{
+			name:  "allowed",
+			setup: withPolicy(provider.Policy{AllowedPools: []string{"fast", testPool}, AllowedNetworks: []string{"default"}}),
+		},
+		{
+			name:    "storage pool not allowed",
+			setup:   withPolicy(provider.Policy{AllowedPools: []string{"fast"}}),
+			wantErr: `storage pool "default" is not allowed by the provider config`,
+		},
+		{
+			name:    "network not allowed",
+			setup:   withPolicy(provider.Policy{AllowedNetworks: []string{"isolated"}}),
+			wantErr: `network "default" is not allowed by the provider config`,
+		},
+		{
+			name:         "default storage pool not allowed",
+			providerData: "cores: 2\nmemory: 4096\ndisk_size: 10\n",
+			setup: withPolicy(provider.Policy{
+				Defaults:     map[string]any{"storage_pool": "other"},
+				AllowedPools: []string{testPool},
+			}),
+			wantErr: `storage pool "other" is not allowed by the provider config`,
+		},
+		{
+			name:         "block devices not allowed by default",
+			providerData: testProviderData + "additional_disks:\n  - type: virtio-blk\n    block_device: /dev/vg1/data\n",
+			setup:        withPolicy(provider.Policy{}),
+			wantErr:      `block device "/dev/vg1/data" of additional_disks[0] is not allowed by the provider config`,
+		},
+		{
+			name:         "block device allowed",
+			providerData: testProviderData + "additional_disks:\n  - type: virtio-blk\n    block_device: /dev/vg1/data\n",
+			setup:        withPolicy(provider.Policy{AllowedBlockDevices: []string{"/dev/vg1"}}),
+		},
+	})
+}
+
+func TestPolicyDefaults(t *testing.T) {
+	env := newTestEnv(t, "cores: 4\nnetwork_interfaces:\n  - driver: e1000e\n    network_name: isolated\n")
+
+	env.provisioner.SetPolicy(provider.Policy{
+		Defaults: map[string]any{
+			"cores":        2,
+			"memory":       2048,
+			"disk_size":    10,
+			"storage_pool": testPool,
+			"network_interfaces": []any{
+				map[string]any{"driver": "virtio", "network_name": "default"},
+				map[string]any{"driver": "virtio", "network_name": "storage"},
+			},
+		},
+	})
+
+	env.runSteps(t, "createVM")
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+
+	// the machine class fields replace the defaults as a whole
+	assert.Equal(t, uint(4), dom.Definition.VCPU.Value)
+	assert.Equal(t, uint(2048), dom.Definition.Memory.Value)
+	require.Len(t, dom.Definition.Devices.Interfaces, 1)
+	assert.Equal(t, "isolated", dom.Definition.Devices.Interfaces[0].Source.Network.Network)
+}
+
+func TestPolicyCheckDefaults(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		wantErr string
+		policy  provider.Policy
+	}{
+		{
+			name:   "no defaults",
+			policy: provider.Policy{AllowedPools: []string{testPool}},
+		},
+		{
+			name: "allowed",
+			policy: provider.Policy{
+				Defaults:        map[string]any{"storage_pool": testPool, "network_interfaces": []any{map[string]any{"network_name": "default"}}},
+				AllowedPools:    []string{testPool},
+				AllowedNetworks: []string{"default"},
+			},
+		},
+		{
+			name: "network not allowed",
+			policy: provider.Policy{
+				Defaults:        map[string]any{"network_interfaces": []any{map[string]any{"network_name": "isolated"}}},
+				AllowedPools:    []string{testPool},
+				AllowedNetworks: []string{"default"},
+			},
+			wantErr: `network "isolated" is not allowed by the provider config`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.CheckDefaults()
+
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,307 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+	"path"
+	"slices"
+
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/api/specs"
+)
+
+// poolKind is how the volumes of a storage pool are accessed by the domains.
+type poolKind int
+
+const (
+	// poolFile volumes are image files, any disk format is supported.
+	poolFile poolKind = iota
+	// poolBlock volumes are raw block devices of the host.
+	poolBlock
+	// poolNetwork volumes are raw disks qemu accesses over the network.
+	poolNetwork
+	// poolLUN volumes are the existing LUNs of the pool, which libvirt resolves from the pool and the volume name.
+	poolLUN
+)
+
+// poolType describes the volumes of a storage pool type, see https://libvirt.org/storage.html.
+type poolType struct {
+	kind poolKind
+	// thin volumes are created with a zero allocation, the others are fully allocated.
+	//
+	// A logical volume with a smaller allocation than its capacity is a snapshot, which is not wanted.
+	thin bool
+}
+
+// poolTypes are the storage pool types the volumes of the machines can be created in.
+//
+// The disk pools are left out: libvirt names their volumes after the partitions, e.g. sdb1.
+var poolTypes = map[string]poolType{
+	"dir":      {kind: poolFile, thin: true},
+	"fs":       {kind: poolFile, thin: true},
+	"netfs":    {kind: poolFile, thin: true},
+	"vstorage": {kind: poolFile, thin: true},
+	"logical":  {kind: poolBlock},
+	"zfs":      {kind: poolBlock, thin: true},
+	"rbd":      {kind: poolNetwork},
+}
+
+// lunPoolTypes are the types of the storage pools which only have existing LUNs.
+var lunPoolTypes = []string{"iscsi", "iscsi-direct", "scsi", "mpath"}
+
+// storagePool is the storage pool the volumes of a machine are created in.
+type storagePool struct {
+	libvirtxml.StoragePool
+
+	poolType poolType
+}
+
+// lookupStoragePool returns the storage pool, as defined on the host.
+func lookupStoragePool(lc LibvirtClient, name string) (storagePool, error) {
+	def, err := fetchStoragePool(lc, name)
+	if err != nil {
+		return storagePool{}, err
+	}
+
+	return newStoragePool(def)
+}
+
+// lookupVolumePool returns the storage pool of existing volumes, as defined on the host.
+//
+// Unlike lookupStoragePool, it accepts the pools which only have existing LUNs.
+func lookupVolumePool(lc LibvirtClient, name string) (storagePool, error) {
+	def, err := fetchStoragePool(lc, name)
+	if err != nil {
+		return storagePool{}, err
+	}
+
+	if slices.Contains(lunPoolTypes, def.Type) {
+		return storagePool{StoragePool: def, poolType: poolType{kind: poolLUN}}, nil
+	}
+
+	return newStoragePool(def)
+}
+
+// machinePools returns the storage pools of the volumes of the machine, by name:
+// its storage pool, and the ones of its existing volumes.
+func machinePools(lc LibvirtClient, spec *specs.MachineSpec) (map[string]storagePool, error) {
+	pool, err := lookupStoragePool(lc, spec.PoolName)
+	if err != nil {
+		return nil, err
+	}
+
+	pools := map[string]storagePool{spec.PoolName: pool}
+
+	for _, disk := range spec.AdditionalDisks {
+		if _, ok := pools[disk.PoolName]; ok || disk.PoolName == "" {
+			continue
+		}
+
+		if pools[disk.PoolName], err = lookupVolumePool(lc, disk.PoolName); err != nil {
+			return nil, err
+		}
+	}
+
+	return pools, nil
+}
+
+func fetchStoragePool(lc LibvirtClient, name string) (libvirtxml.StoragePool, error) {
+	pool, err := lc.StoragePoolLookupByName(name)
+	if err != nil {
+		return libvirtxml.StoragePool{}, fmt.Errorf("error looking up storage pool: %w", err)
+	}
+
+	poolXML, err := lc.StoragePoolGetXMLDesc(pool, 0)
+	if err != nil {
+		return libvirtxml.StoragePool{}, fmt.Errorf("error fetching storage pool XML: %w", err)
+	}
+
+	var def libvirtxml.StoragePool
+
+	if err = def.Unmarshal(poolXML); err != nil {
+		return libvirtxml.StoragePool{}, fmt.Errorf("error parsing storage pool XML: %w", err)
+	}
+
+	return def, nil
+}
+
+// parseStoragePool parses the XML of the storage pool, as printed by virsh pool-dumpxml.
+func parseStoragePool(poolXML string) (storagePool, error) {
+	var def libvirtxml.StoragePool
+
+	if err := def.Unmarshal(poolXML); err != nil {
+		return storagePool{}, fmt.Errorf("error parsing storage pool XML: %w", err)
+	}
+
+	return newStoragePool(def)
+}
+
+// newStoragePool returns the storage pool, unless the provider can't create volumes of its type.
+func newStoragePool(def libvirtxml.StoragePool) (storagePool, error) {
+	typ, ok := poolTypes[def.Type]
+	if !ok {
+		if slices.Contains(lunPoolTypes, def.Type) {
+			return storagePool{}, fmt.Errorf("storage pool %q of type %q only has existing LUNs, volumes can't be created in it", def.Name, def.Type)
+		}
+
+		return storagePool{}, fmt.Errorf("storage pool %q has the unsupported type %q", def.Name, def.Type)
+	}
+
+	return storagePool{StoragePool: def, poolType: typ}, nil
+}
+
+// dirStoragePool is the directory storage pool with the given name, the pool type of a default libvirt install.
+func dirStoragePool(name string) storagePool {
+	return storagePool{
+		StoragePool: libvirtxml.StoragePool{
+			Type:   "dir",
+			Name:   name,
+			Target: &libvirtxml.StoragePoolTarget{Path: "/var/lib/libvirt/images"},
+		},
+		poolType: poolTypes["dir"],
+	}
+}
+
+// diskFormat is the format of the disks of the machines: the block and network volumes are raw.
+func (p storagePool) diskFormat() string {
+	if p.poolType.kind == poolFile {
+		return diskFormatQcow2
+	}
+
+	return diskFormatRaw
+}
+
+// primaryDiskCapacity returns the capacity the primary disk volume is created with, and the one it is resized to
+// after the upload, in bytes.
+//
+// The image files are replaced by the upload and resized after it, while the block and network volumes
+// are created with their final size, as the image is written into them.
+func (p storagePool) primaryDiskCapacity(diskSize uint64) (capacity, resizeTo uint64) {
+	if p.poolType.kind == poolFile {
+		return diskSize, diskSize * GiB
+	}
+
+	return diskSize * GiB, 0
+}
+
+// imageFormat is the format of the Talos image uploaded to the primary disk.
+func (p storagePool) imageFormat() ImageFormat {
+	if p.poolType.kind == poolFile {
+		return ImageFormatQcow2
+	}
+
+	return ImageFormatRaw
+}
+
+// volumeXML renders the XML of a volume of the pool, the capacity is in bytes.
+func (p storagePool) volumeXML(volumeName, format string, capacity uint64) (string, error) {
+	volData := p.volume(volumeName, format, capacity)
+
+	return volData.Marshal()
+}
+
+// volume returns the definition of a volume of the pool, the capacity is in bytes.
+func (p storagePool) volume(volumeName, format string, capacity uint64) libvirtxml.StorageVolume {
+	volData := libvirtxml.StorageVolume{
+		Name: volumeName,
+		Capacity: &libvirtxml.StorageVolumeSize{
+			Unit:  "bytes",
+			Value: capacity,
+		},
+	}
+
+	if p.poolType.thin {
+		// thin provision: allocate zero bytes at time of creation
+		volData.Allocation = &libvirtxml.StorageVolumeSize{
+			Unit:  "bytes",
+			Value: 0,
+		}
+	}
+
+	// the block and network volumes only support the raw format, which is the default
+	if p.poolType.kind == poolFile {
+		volData.Type = "file"
+		volData.Target = &libvirtxml.StorageVolumeTarget{
+			Format: &libvirtxml.StorageVolumeTargetFormat{
+				Type: format,
+			},
+		}
+	}
+
+	return volData
+}
+
+// diskSource returns the source of the domain disk backed by the volume of the pool.
+func (p storagePool) diskSource(volumeName string) *libvirtxml.DomainDiskSource {
+	switch p.poolType.kind {
+	case poolBlock:
+		// the logical, disk and ZFS volumes are the block devices named after the volume in the target directory
+		var targetPath string
+
+		if p.Target != nil {
+			targetPath = p.Target.Path
+		}
+
+		return &libvirtxml.DomainDiskSource{
+			Block: &libvirtxml.DomainDiskSourceBlock{
+				Dev: path.Join(targetPath, volumeName),
+			},
+		}
+	case poolNetwork:
+		return &libvirtxml.DomainDiskSource{
+			Network: p.networkSource(volumeName),
+		}
+	default:
+		// the image files, and the LUNs which libvirt resolves
+		return &libvirtxml.DomainDiskSource{
+			Volume: &libvirtxml.DomainDiskSourceVolume{
+				Pool:   p.Name,
+				Volume: volumeName,
+			},
+		}
+	}
+}
+
+// networkSource returns the RBD image of the volume, with the monitors and the credentials of the pool.
+func (p storagePool) networkSource(volumeName string) *libvirtxml.DomainDiskSourceNetwork {
+	source := &libvirtxml.DomainDiskSourceNetwork{
+		Protocol: p.Type,
+		Name:     volumeName,
+	}
+
+	if p.Source == nil {
+		return source
+	}
+
+	// the RBD pool name is the Ceph pool, which can differ from the libvirt pool name
+	if p.Source.Name != "" {
+		source.Name = p.Source.Name + "/" + volumeName
+	}
+
+	for _, host := range p.Source.Host {
+		source.Hosts = append(source.Hosts, libvirtxml.DomainDiskSourceHost{
+			Name: host.Name,
+			Port: host.Port,
+		})
+	}
+
+	if auth := p.Source.Auth; auth != nil {
+		source.Auth = &libvirtxml.DomainDiskAuth{
+			Username: auth.Username,
+		}
+
+		if auth.Secret != nil {
+			source.Auth.Secret = &libvirtxml.DomainDiskSecret{
+				Type:  auth.Type,
+				Usage: auth.Secret.Usage,
+				UUID:  auth.Secret.UUID,
+			}
+		}
+	}
+
+	return source
+}
@@ -0,0 +1,177 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/libvirtfake"
+)
+
+const testCephSecretUUID = "2a5b08e4-3dee-4ff2-a7a6-6a1ac9e5b2a0"
+
+var (
+	testLogicalPool = libvirtxml.StoragePool{
+		Type:   "logical",
+		Name:   "vg0",
+		Source: &libvirtxml.StoragePoolSource{Name: "vg0"},
+		Target: &libvirtxml.StoragePoolTarget{Path: "/dev/vg0"},
+	}
+
+	testRBDPool = libvirtxml.StoragePool{
+		Type: "rbd",
+		Name: "ceph",
+		Source: &libvirtxml.StoragePoolSource{
+			Name: "libvirt-pool",
+			Host: []libvirtxml.StoragePoolSourceHost{{Name: "mon1.example.com", Port: "6789"}},
+			Auth: &libvirtxml.StoragePoolSourceAuth{
+				Type:     "ceph",
+				Username: "libvirt",
+				Secret:   &libvirtxml.StoragePoolSourceAuthSecret{UUID: testCephSecretUUID},
+			},
+		},
+	}
+)
+
+// withStoragePool returns the provider data using the pool, with an additional disk.
+func withStoragePool(pool string) string {
+	return strings.Replace(testProviderData, "storage_pool: "+testPool, "storage_pool: "+pool, 1) + "additional_disks:\n  - type: nvme\n    size: 20\n"
+}
+
+// domainDisks returns the disks of the domain defined for the test request.
+func domainDisks(t *testing.T, lv *libvirtfake.Libvirt) []libvirtxml.DomainDisk {
+	t.Helper()
+
+	dom, ok := lv.Domain(testRequestID)
+	require.True(t, ok)
+	require.Len(t, dom.Definition.Devices.Disks, 3)
+
+	return dom.Definition.Devices.Disks
+}
+
+func TestLogicalStoragePool(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withStoragePool(testLogicalPool.Name))
+	env.lv.DefinePool(testLogicalPool)
+
+	env.runSteps(t, "createVM")
+
+	primary, ok := env.lv.Volume(testLogicalPool.Name, testRequestID+".raw")
+	require.True(t, ok)
+
+	// the raw image is written into the volume, which is created with its final size
+	assert.Equal(t, "raw", primary.Format)
+	assert.Equal(t, 10*provider.GiB, primary.Capacity)
+	assert.Equal(t, testImage, primary.Data)
+	assert.Zero(t, env.lv.Calls("StorageVolResize"))
+
+	additional, ok := env.lv.Volume(testLogicalPool.Name, testRequestID+"-0-nvme.raw")
+	require.True(t, ok)
+	assert.Equal(t, "raw", additional.Format)
+
+	disks := domainDisks(t, env.lv)
+
+	for i, dev := range []string{"/dev/vg0/request-1.raw", "/dev/vg0/request-1-0-nvme.raw", "/dev/vg0/request-1-cidata.iso"} {
+		require.NotNil(t, disks[i].Source.Block, dev)
+		assert.Equal(t, dev, disks[i].Source.Block.Dev)
+		assert.Equal(t, "raw", disks[i].Driver.Type)
+	}
+}
+
+func TestRBDStoragePool(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withStoragePool(testRBDPool.Name))
+	env.lv.DefinePool(testRBDPool)
+
+	env.runSteps(t, "createVM")
+
+	primary, ok := env.lv.Volume(testRBDPool.Name, testRequestID+".raw")
+	require.True(t, ok)
+	assert.Equal(t, "raw", primary.Format)
+	assert.Equal(t, testImage, primary.Data)
+
+	disks := domainDisks(t, env.lv)
+
+	source := disks[0].Source.Network
+	require.NotNil(t, source)
+
+	assert.Equal(t, &libvirtxml.DomainDiskSourceNetwork{
+		Protocol: "rbd",
+		Name:     "libvirt-pool/request-1.raw",
+		Hosts:    []libvirtxml.DomainDiskSourceHost{{Name: "mon1.example.com", Port: "6789"}},
+		Auth: &libvirtxml.DomainDiskAuth{
+			Username: "libvirt",
+			Secret:   &libvirtxml.DomainDiskSecret{Type: "ceph", UUID: testCephSecretUUID},
+		},
+	}, source)
+	assert.Equal(t, "raw", disks[0].Driver.Type)
+
+	require.NotNil(t, disks[2].Source.Network)
+	assert.Equal(t, "libvirt-pool/request-1-cidata.iso", disks[2].Source.Network.Name)
+}
+
+func TestUnsupportedStoragePool(t *testing.T) {
+	runStepTests(t, "provisionPrimaryDisk", []stepTest{
+		{
+			name:         "iscsi",
+			providerData: withStoragePool("lun"),
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.DefinePool(libvirtxml.StoragePool{Type: "iscsi", Name: "lun"})
+			},
+			wantErr: `storage pool "lun" of type "iscsi" only has existing LUNs`,
+		},
+		{
+			name:         "sheepdog",
+			providerData: withStoragePool("sheep"),
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.DefinePool(libvirtxml.StoragePool{Type: "sheepdog", Name: "sheep"})
+			},
+			wantErr: `storage pool "sheep" has the unsupported type "sheepdog"`,
+		},
+		{
+			name:         "disk",
+			providerData: withStoragePool("sdb"),
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.DefinePool(libvirtxml.StoragePool{Type: "disk", Name: "sdb"})
+			},
+			wantErr: `storage pool "sdb" has the unsupported type "disk"`,
+		},
+		{
+			name:         "snapshot of a logical volume",
+			providerData: withStoragePool(testLogicalPool.Name) + "retain: snapshot-then-delete\n",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.DefinePool(testLogicalPool)
+			},
+			wantErr: `retain: snapshot-then-delete requires a storage pool of files, e.g. dir, "vg0" is of type "logical"`,
+		},
+	})
+}
+
+func TestOrphanVolumesLogicalPool(t *testing.T) {
+	env := newTestEnv(t, withStoragePool(testLogicalPool.Name))
+	env.lv.DefinePool(testLogicalPool)
+	env.provisioner.SetPolicy(provider.Policy{AllowedPools: []string{testPool, testLogicalPool.Name}})
+
+	env.runSteps(t, "createVM")
+
+	env.lv.AddVolume(testLogicalPool.Name, libvirtfake.Volume{Name: "request-0.raw", Capacity: provider.GiB})
+
+	// the volumes of the domain are attached by their device path
+	orphans, err := env.provisioner.OrphanVolumes(t.Context())
+	require.NoError(t, err)
+
+	assert.Equal(t, []provider.OrphanVolume{
+		{Host: config.DefaultHostName, Pool: testLogicalPool.Name, Name: "request-0.raw", RequestID: "request-0", Capacity: provider.GiB},
+	}, orphans)
+}
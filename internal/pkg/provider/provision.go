@@ -7,22 +7,21 @@ package provider
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/digitalocean/go-libvirt"
-	"github.com/google/uuid"
 	"github.com/siderolabs/omni/client/pkg/infra/provision"
 	"go.uber.org/zap"
-	"libvirt.org/go/libvirtxml"
 
 	"github.com/siderolabs/omni-infra-provider-libvirt/api/specs"
 	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/cidata"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
 	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/resources"
 )
 
@@ -35,16 +34,31 @@ const (
 
 // Provisioner implements Talos emulator infra provider.
 type Provisioner struct {
-	libvirtClient *libvirt.Libvirt
-	imageCache    *ImageCache
+	imageCache *ImageCache
+	scheduler  *placement.Scheduler
+	metrics    *metrics
+	spans      *requestSpans
+	policy     atomic.Pointer[Policy]
+	hosts      atomic.Pointer[[]Host]
+	// diskClaims serializes the checks of the existing disks with the definitions of the domains claiming them
+	diskClaims sync.Mutex
 }
 
 // NewProvisioner creates a new provisioner.
-func NewProvisioner(libvirtClient *libvirt.Libvirt, imageCache *ImageCache) *Provisioner {
-	return &Provisioner{
-		libvirtClient: libvirtClient,
-		imageCache:    imageCache,
+//
+// Machines are placed on the hosts by the scheduler, unless the provider data selects a host.
+func NewProvisioner(hosts []Host, scheduler *placement.Scheduler, imageCache *ImageCache) *Provisioner {
+	p := &Provisioner{
+		scheduler:  scheduler,
+		imageCache: imageCache,
+		metrics:    newMetrics(),
+		spans:      newRequestSpans(),
 	}
+
+	p.SetHosts(hosts)
+	p.policy.Store(&Policy{})
+
+	return p
 }
 
 var errUploadImage = errors.New("error uploading image")
@@ -53,26 +67,105 @@ var errUploadImage = errors.New("error uploading image")
 //
 //nolint:gocognit,gocyclo,cyclop,maintidx
 func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
-	return []provision.Step[*resources.Machine]{
+	return p.instrument(p.withRollback([]provision.Step[*resources.Machine]{
 		provision.NewStep(
-			"generateUUID",
+			"selectHost",
 			func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
-				newUUID := uuid.New()
+				// keep the host chosen by an earlier run, the machine might already have resources there
+				if pctx.State.TypedSpec().Value.Host != "" {
+					return nil
+				}
+
+				data, err := p.providerData(pctx)
+				if err != nil {
+					return err
+				}
 
-				dom, err := p.libvirtClient.DomainLookupByUUID(libvirt.UUID(newUUID))
+				if err = p.policy.Load().check(data); err != nil {
+					return err
+				}
+
+				host, err := p.place(ctx, logger, requestOwner(pctx), data)
 				if err != nil {
-					if dom.UUID != libvirt.UUID(newUUID) {
-						// found unused UUID
+					return err
+				}
+
+				logger.Info("selected libvirt host", zap.String("host", host.Name))
+
+				pctx.State.TypedSpec().Value.Host = host.Name
+
+				return nil
+			},
+		),
+		provision.NewStep(
+			"admitMachine",
+			func(ctx context.Context, _ *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+				host, err := p.host(pctx.State.TypedSpec().Value.Host)
+				if err != nil {
+					return err
+				}
+
+				data, err := p.providerData(pctx)
+				if err != nil {
+					return err
+				}
+
+				if data.Snapshots != nil {
+					lc, clientErr := hostClient(ctx, host)
+					if clientErr != nil {
+						return clientErr
+					}
+
+					if err = checkSnapshotSupport(lc); err != nil {
+						return fmt.Errorf("snapshots: %w", err)
+					}
+				}
+
+				usage, err := collectHostUsage(ctx, host, data.StoragePool, pctx.GetRequestID())
+				if err != nil {
+					return provision.NewRetryErrorf(time.Second*10, "error collecting host capacity: %w", err)
+				}
+
+				// the machines of the requests placed on the host in the meantime aren't defined yet
+				usage = usage.reserve(p.scheduler.Reserved(host.Name, pctx.GetRequestID()))
+
+				return admit(usage, host.Overcommit, data)
+			},
+		),
+		provision.NewStep(
+			"generateUUID",
+			func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+				lc, err := p.client(ctx, pctx.State.TypedSpec().Value.Host)
+				if err != nil {
+					return err
+				}
+
+				vmName := pctx.GetRequestID()
+
+				for attempt := range maxUUIDAttempts {
+					newUUID := machineUUID(vmName, attempt)
+
+					dom, lookupErr := lc.DomainLookupByUUID(libvirt.UUID(newUUID))
+					if lookupErr != nil && !libvirt.IsNotFound(lookupErr) {
+						return provision.NewRetryErrorf(time.Second*10, "error looking up domain by UUID: %w", lookupErr)
+					}
+
+					// either the UUID is unused, or it belongs to the domain defined by an earlier run
+					if lookupErr != nil || dom.Name == vmName {
 						pctx.State.TypedSpec().Value.Uuid = newUUID.String()
 						pctx.SetMachineUUID(pctx.State.TypedSpec().Value.Uuid)
 
 						return nil
 					}
 
-					return provision.NewRetryError(err, time.Second*10)
+					logger.Warn("derived UUID is used by another domain",
+						zap.String("uuid", newUUID.String()),
+						zap.String("domain", dom.Name),
+						zap.Int("attempt", attempt),
+					)
 				}
 
-				return provision.NewRetryInterval(time.Second * 1)
+				return fmt.Errorf("no unused UUID found after %d attempts", maxUUIDAttempts)
 			},
 		),
 
@@ -94,58 +187,75 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 		provision.NewStep(
 			"provisionPrimaryDisk",
 			func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
-				var data Data
+				lc, err := p.client(ctx, pctx.State.TypedSpec().Value.Host)
+				if err != nil {
+					return err
+				}
+
+				data, err := p.providerData(pctx)
+				if err != nil {
+					return err
+				}
+
+				if err = validateRetain(data.Retain); err != nil {
+					return fmt.Errorf("retain: %w", err)
+				}
 
-				err := pctx.UnmarshalProviderData(&data)
+				pool, err := lookupStoragePool(lc, data.StoragePool)
 				if err != nil {
 					return err
 				}
 
+				if data.Retain == retainSnapshot {
+					if err = pool.checkSnapshot(); err != nil {
+						return fmt.Errorf("retain: %w", err)
+					}
+				}
+
 				schematicID := pctx.State.TypedSpec().Value.SchematicId
 				talosVersion := pctx.GetTalosVersion()
+				imageFormat := pool.imageFormat()
 
 				// Acquire image from cache (downloads if needed, deduplicates concurrent requests)
-				filePath, err := p.imageCache.Acquire(ctx, schematicID, talosVersion)
+				filePath, err := p.imageCache.Acquire(ctx, schematicID, talosVersion, imageFormat)
 				if err != nil {
 					return provision.NewRetryErrorf(time.Second*10, "error fetching image: %w", err)
 				}
-				defer p.imageCache.Release(schematicID, talosVersion)
+				defer p.imageCache.Release(schematicID, talosVersion, imageFormat)
 
 				vmName := pctx.GetRequestID()
-				volName := fmt.Sprintf("%s.qcow2", vmName)
-				pctx.State.TypedSpec().Value.PoolName = data.StoragePool
+				volName := primaryVolumeName(vmName, pool.diskFormat())
+				capacity, volSize := pool.primaryDiskCapacity(data.DiskSize)
 
-				vol, err := createVolume(p.libvirtClient, data.StoragePool, volName, diskFormatQcow2, data.DiskSize)
+				vol, err := createVolume(lc, pool, volName, pool.diskFormat(), capacity)
 				if err != nil {
 					return fmt.Errorf("error creating disk: %w", err)
 				}
 
-				fh, err := os.Open(filePath)
-				if err != nil {
-					return fmt.Errorf("error opening local disk image: %w", err)
-				}
-				defer fh.Close() //nolint:errcheck
+				pctx.State.TypedSpec().Value.PoolName = data.StoragePool
+				pctx.State.TypedSpec().Value.VmVolName = volName
+				pctx.State.TypedSpec().Value.VmVolRetain = data.Retain
 
-				r, err := gzip.NewReader(fh)
+				r, err := openImage(filePath, imageFormat)
 				if err != nil {
-					return fmt.Errorf("error opening gzip image reader: %w", err)
+					return err
 				}
 				defer r.Close() //nolint:errcheck
 
-				err = p.libvirtClient.StorageVolUpload(vol, r, 0, 0, 0)
+				err = lc.StorageVolUpload(vol, r, 0, 0, 0)
 				if err != nil {
 					return fmt.Errorf("%w: %w", errUploadImage, err)
 				}
 
-				volSize := data.DiskSize * GiB
+				if volSize == 0 {
+					return nil
+				}
 
-				err = p.libvirtClient.StorageVolResize(vol, volSize, 0)
+				err = lc.StorageVolResize(vol, volSize, 0)
 				if err != nil {
 					return fmt.Errorf("expanding volume %s to size %d failed", volName, volSize)
 				}
 
-				pctx.State.TypedSpec().Value.VmVolName = volName
-
 				return nil
 			},
 		),
@@ -153,38 +263,83 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 		provision.NewStep(
 			"provisionAdditionalDisks",
 			func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
-				var data Data
+				lc, err := p.client(ctx, pctx.State.TypedSpec().Value.Host)
+				if err != nil {
+					return err
+				}
 
-				err := pctx.UnmarshalProviderData(&data)
+				data, err := p.providerData(pctx)
 				if err != nil {
 					return err
 				}
 
-				if len(data.AdditionalDisks) > 0 {
-					var (
-						additionalDisks []*specs.AdditionalDisk
-						vmName          = pctx.GetRequestID()
-					)
+				pool, err := lookupStoragePool(lc, data.StoragePool)
+				if err != nil {
+					return err
+				}
+
+				vmName := pctx.GetRequestID()
 
-					for idx, additionalDiskSpec := range data.AdditionalDisks {
-						volName := fmt.Sprintf("%s-%d-%s.qcow2", vmName, idx, additionalDiskSpec.Type)
-						volSize := additionalDiskSpec.Size * GiB
+				// rebuilt from scratch, each disk is recorded as soon as its volume exists
+				pctx.State.TypedSpec().Value.AdditionalDisks = nil
+
+				for idx, additionalDiskSpec := range data.AdditionalDisks {
+					if err = additionalDiskSpec.validate(); err != nil {
+						return fmt.Errorf("additional_disks[%d]: %w", idx, err)
+					}
 
-						_, err = createVolume(p.libvirtClient, data.StoragePool, volName, diskFormatQcow2, volSize)
+					serial, wwn := diskIdentity(pctx.State.TypedSpec().Value.Uuid, idx)
+
+					if additionalDiskSpec.isExisting() {
+						disk, err := existingDisk(lc, vmName, data, additionalDiskSpec)
 						if err != nil {
-							return fmt.Errorf("error creating disk: %w", err)
+							return fmt.Errorf("additional_disks[%d]: %w", idx, err)
+						}
+
+						disk.Serial, disk.Wwn = serial, wwn
+
+						pctx.State.TypedSpec().Value.AdditionalDisks = append(pctx.State.TypedSpec().Value.AdditionalDisks, disk)
+
+						continue
+					}
+
+					format := additionalDiskSpec.format(pool)
+					volName := additionalVolumeName(vmName, idx, additionalDiskSpec.Type, format)
+					volSize := additionalDiskSpec.Size * GiB
+
+					disk := &specs.AdditionalDisk{
+						Type:    additionalDiskSpec.Type,
+						VolName: volName,
+						Serial:  serial,
+						Wwn:     wwn,
+						Retain:  additionalDiskSpec.Retain,
+					}
+
+					if additionalDiskSpec.Retain == retainSnapshot {
+						if err = pool.checkSnapshot(); err != nil {
+							return fmt.Errorf("additional_disks[%d]: retain: %w", idx, err)
 						}
+					}
+
+					if additionalDiskSpec.Encrypted {
+						if err = pool.checkEncryption(); err != nil {
+							return fmt.Errorf("additional_disks[%d]: %w", idx, err)
+						}
+
+						disk.SecretUuid = volumeSecretUUID(pctx.State.TypedSpec().Value.Uuid, idx).String()
+						disk.Format = format
 
-						additionalDisks = append(
-							additionalDisks,
-							&specs.AdditionalDisk{
-								Type:    additionalDiskSpec.Type,
-								VolName: volName,
-							},
-						)
+						_, err = createEncryptedVolume(lc, pool, volName, volSize, disk.SecretUuid)
+					} else {
+						_, err = createVolume(lc, pool, volName, format, volSize)
 					}
 
-					pctx.State.TypedSpec().Value.AdditionalDisks = additionalDisks
+					if err != nil {
+						return fmt.Errorf("error creating disk: %w", err)
+					}
+
+					pctx.State.TypedSpec().Value.PoolName = data.StoragePool
+					pctx.State.TypedSpec().Value.AdditionalDisks = append(pctx.State.TypedSpec().Value.AdditionalDisks, disk)
 				}
 
 				logger.Info("provisioned additional disks", zap.Int("count", len(data.AdditionalDisks)))
@@ -196,22 +351,25 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 		provision.NewStep(
 			"provisionCidata",
 			func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+				lc, err := p.client(ctx, pctx.State.TypedSpec().Value.Host)
+				if err != nil {
+					return err
+				}
+
 				// create CIDATA for nocloud, contains the hostname
 				// docs: https://docs.siderolabs.com/talos/latest/platform-specific-installations/cloud-platforms/nocloud#cdrom%2Fusb
-				var data Data
-
-				err := pctx.UnmarshalProviderData(&data)
+				data, err := p.providerData(pctx)
 				if err != nil {
 					return err
 				}
 
 				var (
 					vmName  = pctx.GetRequestID()
-					volName = fmt.Sprintf("%s-cidata.iso", vmName)
+					volName = cidataVolumeName(vmName)
 
 					metadata    = bytes.NewReader(cidata.MetaData(vmName))
-					userdata    = bytes.NewReader([]byte("#cloud-config\n")) // empty
-					networkdata = bytes.NewReader(cidata.NetworkData())      // TODO: allow to be passed by user?
+					userdata    = bytes.NewReader(cidata.UserData())
+					networkdata = bytes.NewReader(cidata.NetworkData()) // TODO: allow to be passed by user?
 				)
 
 				isoData, err := cidata.GenerateCidataISO(metadata, userdata, networkdata)
@@ -219,32 +377,33 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 					return fmt.Errorf("error generating cidata ISO: %w", err)
 				}
 
-				pool, err := p.libvirtClient.StoragePoolLookupByName(data.StoragePool)
+				pool, err := lookupStoragePool(lc, data.StoragePool)
 				if err != nil {
-					return fmt.Errorf("error looking up storage pool: %w", err)
+					return err
 				}
 
 				// if volume exists, delete old version
-				if vol, errGetVol := getVol(p.libvirtClient, data.StoragePool, volName); errGetVol == nil {
-					if errVolDel := p.libvirtClient.StorageVolDelete(vol, 0); errVolDel != nil {
+				if vol, errGetVol := getVol(lc, data.StoragePool, volName); errGetVol == nil {
+					if errVolDel := lc.StorageVolDelete(vol, 0); errVolDel != nil {
 						return fmt.Errorf("delete old cidata volume: %w, name: %s", errVolDel, volName)
 					}
 				}
 
 				volSize := uint64(len(isoData))
 
-				vol, err := createVolume(p.libvirtClient, pool.Name, volName, diskFormatRaw, volSize)
+				vol, err := createVolume(lc, pool, volName, diskFormatRaw, volSize)
 				if err != nil {
 					return fmt.Errorf("error creating cidata volume: %w", err)
 				}
 
-				err = p.libvirtClient.StorageVolUpload(vol, bytes.NewReader(isoData), 0, 0, 0)
+				pctx.State.TypedSpec().Value.PoolName = pool.Name
+				pctx.State.TypedSpec().Value.CidataVolName = volName
+
+				err = lc.StorageVolUpload(vol, bytes.NewReader(isoData), 0, 0, 0)
 				if err != nil {
 					return fmt.Errorf("error uploading cidata ISO: %w", err)
 				}
 
-				pctx.State.TypedSpec().Value.CidataVolName = volName
-
 				logger.Info("provisioned cidata ISO", zap.String("volume", volName))
 
 				return nil
@@ -254,238 +413,36 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 		provision.NewStep(
 			"createVM",
 			func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+				lc, err := p.client(ctx, pctx.State.TypedSpec().Value.Host)
+				if err != nil {
+					return err
+				}
+
 				volName := pctx.State.TypedSpec().Value.VmVolName
 				if volName == "" {
 					return provision.NewRetryErrorf(time.Second*10, "waiting for image")
 				}
 
-				var data Data
-
-				err := pctx.UnmarshalProviderData(&data)
+				data, err := p.providerData(pctx)
 				if err != nil {
 					return err
 				}
 
-				vmName := pctx.GetRequestID()
-
-				// assemble primary disk volume
-
-				vol, err := getVol(p.libvirtClient, data.StoragePool, volName)
-				if err != nil {
+				// the primary disk volume has to exist
+				if _, err = getVol(lc, data.StoragePool, volName); err != nil {
 					return provision.NewRetryErrorf(time.Second*10, "error fetching volume: %w", err)
 				}
 
-				disks := []libvirtxml.DomainDisk{
-					{
-						Device: "disk",
-						Driver: &libvirtxml.DomainDiskDriver{
-							Name:  "qemu",
-							Type:  "qcow2",
-							Cache: "none",
-							IO:    "native",
-						},
-						Source: &libvirtxml.DomainDiskSource{
-							Volume: &libvirtxml.DomainDiskSourceVolume{
-								Pool:   vol.Pool,
-								Volume: vol.Name,
-							},
-						},
-						Target: &libvirtxml.DomainDiskTarget{
-							Dev: "vda",
-							Bus: "virtio",
-						},
-					},
-				}
-
-				// assemble additional disk volumes
-
-				var (
-					sataDiskCount = 1 // account for root disk
-					nvmeDiskCount = 0
-				)
-
-				for _, additionalDisk := range pctx.State.TypedSpec().Value.AdditionalDisks {
-					var dev, bus string
-
-					switch additionalDisk.Type {
-					case "nvme":
-						{
-							dev = fmt.Sprintf("nvme%dn1", nvmeDiskCount)
-							bus = "nvme"
-							nvmeDiskCount++
-						}
-					case "sata":
-						{
-							idx := sataDiskCount
-
-							s := ""
-							for idx >= 0 {
-								s = fmt.Sprint(rune('a'+(idx%26))) + s
-								idx = idx/26 - 1
-							}
-
-							dev = fmt.Sprintf("sd%s", s)
-							bus = "virtio"
-							sataDiskCount++
-						}
-					default:
-						{
-							return fmt.Errorf("unknown disk type: %q", additionalDisk.Type)
-						}
-					}
-
-					additionalDisk := libvirtxml.DomainDisk{
-						Device: "disk",
-						Driver: &libvirtxml.DomainDiskDriver{
-							Name:  "qemu",
-							Type:  "qcow2",
-							Cache: "none",
-							IO:    "native",
-						},
-						Source: &libvirtxml.DomainDiskSource{
-							Volume: &libvirtxml.DomainDiskSourceVolume{
-								Pool:   data.StoragePool,
-								Volume: additionalDisk.VolName,
-							},
-						},
-						Target: &libvirtxml.DomainDiskTarget{
-							Dev: dev,
-							Bus: bus,
-						},
-						Serial: uuid.NewString(),
-					}
-
-					disks = append(disks, additionalDisk)
-				}
-
-				// add cidata ISO as cdrom, if present
-				cidataVolName := pctx.State.TypedSpec().Value.CidataVolName
-				if cidataVolName != "" {
-					cidataDisk := libvirtxml.DomainDisk{
-						Device: "cdrom",
-						Driver: &libvirtxml.DomainDiskDriver{
-							Name: "qemu",
-							Type: "raw",
-						},
-						Source: &libvirtxml.DomainDiskSource{
-							Volume: &libvirtxml.DomainDiskSourceVolume{
-								Pool:   data.StoragePool,
-								Volume: cidataVolName,
-							},
-						},
-						Target: &libvirtxml.DomainDiskTarget{
-							Dev: "sda",
-							Bus: "sata",
-						},
-						ReadOnly: &libvirtxml.DomainDiskReadOnly{},
-					}
-
-					disks = append(disks, cidataDisk)
+				pools, err := machinePools(lc, pctx.State.TypedSpec().Value)
+				if err != nil {
+					return err
 				}
 
-				// assemble network interfaces
-
-				var networkInterfaces []libvirtxml.DomainInterface
-
-				for _, ifaceData := range data.NetworkInterfaces {
-					iface := libvirtxml.DomainInterface{
-						Model: &libvirtxml.DomainInterfaceModel{
-							Type: ifaceData.Driver,
-						},
-						Source: &libvirtxml.DomainInterfaceSource{
-							Network: &libvirtxml.DomainInterfaceSourceNetwork{
-								Network: ifaceData.NetworkName,
-							},
-						},
-					}
+				vmName := pctx.GetRequestID()
 
-					networkInterfaces = append(networkInterfaces, iface)
-				}
-
-				// generate libvirt XML spec
-				// https://libvirt.org/html/libvirt-libvirt-domain.html#virDomainCreateXML
-				domData := libvirtxml.Domain{
-					Type: "kvm",
-					Name: vmName,
-					// this one is really important, it has to match the UUID in omni
-					UUID: pctx.State.TypedSpec().Value.Uuid,
-					Memory: &libvirtxml.DomainMemory{
-						Unit:  "MiB",
-						Value: data.Memory,
-					},
-					VCPU: &libvirtxml.DomainVCPU{
-						Placement: "static",
-						Value:     data.Cores,
-					},
-					OS: &libvirtxml.DomainOS{
-						Type: &libvirtxml.DomainOSType{
-							Arch:    "x86_64",
-							Machine: "q35",
-							Type:    "hvm",
-						},
-						BootDevices: []libvirtxml.DomainBootDevice{
-							{Dev: "hd"},
-						},
-					},
-					CPU: &libvirtxml.DomainCPU{
-						Mode: "host-passthrough",
-					},
-					Features: &libvirtxml.DomainFeatureList{
-						ACPI: &libvirtxml.DomainFeature{},
-						APIC: &libvirtxml.DomainFeatureAPIC{},
-					},
-					Devices: &libvirtxml.DomainDeviceList{
-						Channels: []libvirtxml.DomainChannel{
-							{
-								Source: &libvirtxml.DomainChardevSource{
-									UNIX: &libvirtxml.DomainChardevSourceUNIX{
-										Mode: "bind",
-										Path: "/var/lib/libvirt/qemu/channel/target/omni-node-001.org.qemu.guest_agent.0",
-									},
-								},
-								Target: &libvirtxml.DomainChannelTarget{
-									VirtIO: &libvirtxml.DomainChannelTargetVirtIO{
-										Name: "org.qemu.guest_agent.0",
-									},
-								},
-							},
-						},
-						Emulator:   "", // let libvirt pick qemu-system-x86_64
-						Disks:      disks,
-						Interfaces: networkInterfaces,
-						MemBalloon: &libvirtxml.DomainMemBalloon{
-							Model: "virtio",
-						},
-						Serials: []libvirtxml.DomainSerial{
-							// { Target: &libvirtxml.DomainSerialTarget{Type: "pty",}},
-						},
-						Consoles: []libvirtxml.DomainConsole{
-							{
-								Target: &libvirtxml.DomainConsoleTarget{
-									Type: "serial",
-								},
-							},
-							// {Target: &libvirtxml.DomainConsoleTarget{Type: "virtio"}},
-						},
-						Videos: []libvirtxml.DomainVideo{
-							{
-								Model: libvirtxml.DomainVideoModel{
-									Type: "virtio",
-									Resolution: &libvirtxml.DomainVideoResolution{
-										X: 1920,
-										Y: 1080,
-									},
-								},
-							},
-						},
-						Graphics: []libvirtxml.DomainGraphic{
-							{
-								Spice: &libvirtxml.DomainGraphicSpice{
-									AutoPort: "yes",
-								},
-							},
-						},
-					},
+				domData, err := buildDomain(vmName, requestOwner(pctx), data, pools, pctx.State.TypedSpec().Value)
+				if err != nil {
+					return err
 				}
 
 				domXML, err := domData.Marshal()
@@ -495,10 +452,8 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 
 				logger.Debug("domain XML", zap.String("xml_data", domXML))
 
-				// create domain
-				_, err = p.libvirtClient.DomainDefineXML(domXML)
-				if err != nil {
-					return fmt.Errorf("creating domain: %w", err)
+				if err = p.defineDomain(lc, vmName, pools, pctx.State.TypedSpec().Value.AdditionalDisks, domXML); err != nil {
+					return err
 				}
 
 				// set VM id in omni
@@ -511,31 +466,41 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 		provision.NewStep(
 			"startVM",
 			func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+				lc, err := p.client(ctx, pctx.State.TypedSpec().Value.Host)
+				if err != nil {
+					return err
+				}
+
 				vmName := pctx.State.TypedSpec().Value.VmName
 
-				dom, err := p.libvirtClient.DomainLookupByName(vmName)
+				dom, err := lc.DomainLookupByName(vmName)
 				if err != nil {
 					return provision.NewRetryErrorf(time.Second*10, "VM lookup failed: %w", err)
 				}
 
-				domState, _, err := p.libvirtClient.DomainGetState(dom, 0)
+				domState, _, err := lc.DomainGetState(dom, 0)
 				if err != nil {
 					return provision.NewRetryErrorf(time.Second*10, "error fetching domain state: %w", err)
 				}
 
 				if libvirt.DomainState(domState) == libvirt.DomainRunning {
+					p.scheduler.Release(pctx.GetRequestID())
+
 					return nil
 				}
 
-				err = p.libvirtClient.DomainCreate(dom)
+				err = lc.DomainCreate(dom)
 				if err != nil {
 					if !strings.Contains(err.Error(), "domain is already running") {
 						return provision.NewRetryErrorf(time.Second*10, "failed to start VM: %w", err)
 					}
 				}
 
+				// the running domain is accounted for by the host statistics from now on
+				p.scheduler.Release(pctx.GetRequestID())
+
 				return nil
 			},
 		),
-	}
+	}))
 }
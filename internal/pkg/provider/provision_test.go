@@ -0,0 +1,1186 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/controller"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+	"github.com/siderolabs/image-factory/pkg/schematic"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/api/specs"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/libvirtfake"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/resources"
+)
+
+const (
+	testRequestID    = "request-1"
+	testSchematicID  = "376567988ad370138ad8b2698212367b8edcb69b5fd68c80be1f2ec7d603b4ba"
+	testTalosVersion = "v1.12.0"
+	testPool         = "default"
+
+	testSecondaryHost = "secondary"
+
+	testCluster           = "talos-default"
+	testMachineSet        = "talos-default-control-planes"
+	testMetadataNamespace = "https://github.com/siderolabs/omni-infra-provider-libvirt"
+
+	testProviderData = `
+cores: 2
+memory: 4096
+disk_size: 10
+storage_pool: default
+network_interfaces:
+  - driver: virtio
+    network_name: default
+`
+)
+
+var (
+	testImage = []byte("talos nocloud image")
+
+	_ provider.Conn = (*libvirtfake.Libvirt)(nil)
+)
+
+type factoryMock struct {
+	err error
+}
+
+func (f factoryMock) EnsureSchematic(context.Context, schematic.Schematic) (string, error) {
+	return testSchematicID, f.err
+}
+
+type testEnv struct {
+	lv          *libvirtfake.Libvirt
+	secondary   *libvirtfake.Libvirt
+	scheduler   *placement.Scheduler
+	provisioner *provider.Provisioner
+	factory     *factoryMock
+	request     *infra.MachineRequest
+	status      *infra.MachineRequestStatus
+	machine     *resources.Machine
+}
+
+func newTestEnv(t *testing.T, providerData string) *testEnv {
+	t.Helper()
+
+	cacheDir := t.TempDir()
+
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+
+	_, err := gz.Write(testImage)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, testSchematicID+"-"+testTalosVersion+".qcow2.gz"), buf.Bytes(), 0o644))
+
+	// the raw image is uploaded to the volumes of the block and network storage pools
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, testSchematicID+"-"+testTalosVersion+".raw.zst"), encoder.EncodeAll(testImage, nil), 0o644))
+
+	request := infra.NewMachineRequest(testRequestID)
+	request.TypedSpec().Value.ProviderData = providerData
+	request.TypedSpec().Value.TalosVersion = testTalosVersion
+
+	env := &testEnv{
+		lv:        libvirtfake.New(testPool),
+		secondary: libvirtfake.New(testPool),
+		scheduler: placement.NewScheduler(placement.Spread{}),
+		factory:   &factoryMock{},
+		request:   request,
+		status:    infra.NewMachineRequestStatus(testRequestID),
+		machine:   resources.NewMachine("", testRequestID),
+	}
+
+	env.provisioner = env.newProvisioner(provider.NewImageCache(zaptest.NewLogger(t), cacheDir))
+
+	// Omni copies the labels of the machine request to its status
+	env.status.Metadata().Labels().Set(omni.LabelCluster, testCluster)
+	env.status.Metadata().Labels().Set(omni.LabelMachineSet, testMachineSet)
+
+	return env
+}
+
+// hosts returns the hosts: env.lv is the default host, env.secondary has fast storage.
+func (env *testEnv) hosts() []provider.Host {
+	return []provider.Host{
+		{Name: config.DefaultHostName, Connection: provider.Connected(env.lv), Labels: map[string]string{"rack": "a", "storage": "hdd"}},
+		{Name: testSecondaryHost, Connection: provider.Connected(env.secondary), Labels: map[string]string{"rack": "b", "storage": "nvme"}},
+	}
+}
+
+// newProvisioner creates a provisioner placing machines on env.lv by default, and on env.secondary on request.
+func (env *testEnv) newProvisioner(imageCache *provider.ImageCache) *provider.Provisioner {
+	return provider.NewProvisioner(env.hosts(), env.scheduler, imageCache)
+}
+
+func (env *testEnv) context() provision.Context[*resources.Machine] {
+	return provision.NewContext(env.request, env.status, env.machine, provision.ConnectionParams{}, env.factory, nil)
+}
+
+func (env *testEnv) spec() *resources.MachineSpec {
+	return env.machine.TypedSpec()
+}
+
+// runStep runs a single provision step by name.
+func (env *testEnv) runStep(t *testing.T, name string) error {
+	t.Helper()
+
+	for _, step := range env.provisioner.ProvisionSteps() {
+		if step.Name() == name {
+			return step.Run(t.Context(), zaptest.NewLogger(t), env.context())
+		}
+	}
+
+	require.FailNow(t, "step not found", name)
+
+	return nil
+}
+
+// runSteps runs all provision steps up to and including the named one, failing on any error.
+func (env *testEnv) runSteps(t *testing.T, last string) {
+	t.Helper()
+
+	for _, step := range env.provisioner.ProvisionSteps() {
+		require.NoError(t, step.Run(t.Context(), zaptest.NewLogger(t), env.context()), step.Name())
+
+		if step.Name() == last {
+			return
+		}
+	}
+}
+
+func isRetry(err error) bool {
+	var requeueErr *controller.RequeueError
+
+	return errors.As(err, &requeueErr)
+}
+
+type stepTest struct {
+	setup        func(t *testing.T, env *testEnv)
+	check        func(t *testing.T, env *testEnv)
+	name         string
+	providerData string
+	wantErr      string
+	wantRetry    bool
+}
+
+func runStepTests(t *testing.T, step string, tests []stepTest) {
+	t.Helper()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providerData := tt.providerData
+			if providerData == "" {
+				providerData = testProviderData
+			}
+
+			env := newTestEnv(t, providerData)
+
+			if tt.setup != nil {
+				tt.setup(t, env)
+			}
+
+			err := env.runStep(t, step)
+
+			switch {
+			case tt.wantErr != "":
+				require.ErrorContains(t, err, tt.wantErr)
+				assert.Equal(t, tt.wantRetry, isRetry(err), "retry error mismatch: %v", err)
+			case tt.wantRetry:
+				require.Error(t, err)
+				assert.True(t, isRetry(err), "expected retry error, got %v", err)
+			default:
+				require.NoError(t, err)
+			}
+
+			if tt.check != nil {
+				tt.check(t, env)
+			}
+		})
+	}
+}
+
+const (
+	placementCluster    = "cluster"
+	placementMachineSet = "machine_set"
+)
+
+func withAntiAffinity(scope string, required bool) string {
+	return testProviderData + fmt.Sprintf("placement_rules:\n  - type: anti_affinity\n    scope: %s\n    required: %t\n", scope, required)
+}
+
+// defineOwnedDomain defines a domain created by the provider for another machine request.
+func defineOwnedDomain(t *testing.T, lv *libvirtfake.Libvirt, requestID, cluster, machineSet string) {
+	t.Helper()
+
+	_, err := lv.DomainDefineXML(fmt.Sprintf(`<domain type='kvm'><name>%s</name><metadata>
+<omni:machine xmlns:omni="%s"><omni:provider-id>libvirt</omni:provider-id><omni:request-id>%s</omni:request-id>
+<omni:cluster>%s</omni:cluster><omni:machine-set>%s</omni:machine-set></omni:machine>
+</metadata><memory unit='MiB'>1024</memory></domain>`, requestID, testMetadataNamespace, requestID, cluster, machineSet))
+	require.NoError(t, err)
+}
+
+func TestSelectHost(t *testing.T) {
+	runStepTests(t, "selectHost", []stepTest{
+		{
+			name: "default host",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, config.DefaultHostName, env.spec().Value.Host)
+			},
+		},
+		{
+			name:         "explicit host",
+			providerData: testProviderData + "host: " + testSecondaryHost + "\n",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, testSecondaryHost, env.spec().Value.Host)
+			},
+		},
+		{
+			name: "hosts replaced",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.provisioner.SetHosts(env.hosts()[1:])
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, testSecondaryHost, env.spec().Value.Host)
+			},
+		},
+		{
+			name:         "unknown host",
+			providerData: testProviderData + "host: missing\n",
+			wantErr:      `unknown libvirt host "missing"`,
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.spec().Value.Host)
+			},
+		},
+		{
+			name: "least loaded host",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.SetNode(libvirtfake.Node{Memory: 8 << 30, CPUs: 4})
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, testSecondaryHost, env.spec().Value.Host)
+			},
+		},
+		{
+			name: "host without free disk space",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.SetNode(libvirtfake.Node{Memory: 128 << 30, CPUs: 64})
+				env.lv.SetPoolCapacity(testPool, 5<<30)
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, testSecondaryHost, env.spec().Value.Host)
+			},
+		},
+		{
+			name: "host without storage pool",
+			providerData: `
+cores: 2
+memory: 4096
+disk_size: 10
+storage_pool: fast
+`,
+			setup: func(_ *testing.T, env *testEnv) {
+				env.secondary.AddPool("fast")
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, testSecondaryHost, env.spec().Value.Host)
+			},
+		},
+		{
+			name: "unreachable hosts",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.InjectError("NodeGetInfo", 0, errors.New("connection reset"))
+				env.secondary.InjectError("NodeGetFreeMemory", 0, errors.New("connection reset"))
+			},
+			wantErr:   `no libvirt host with storage pool "default" is available`,
+			wantRetry: true,
+		},
+		{
+			name: "capacity reserved for in-flight requests",
+			setup: func(t *testing.T, env *testEnv) {
+				// another request was placed on the default host, but its VM doesn't exist yet
+				host, err := env.scheduler.Schedule("request-0", []placement.Host{
+					{Name: config.DefaultHostName, Memory: 32 << 30, FreeMemory: 32 << 30, FreeDisk: 1 << 40, Cores: 8},
+				}, placement.Request{Memory: 4 << 30, Cores: 2})
+				require.NoError(t, err)
+				require.Equal(t, config.DefaultHostName, host)
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, testSecondaryHost, env.spec().Value.Host)
+			},
+		},
+		{
+			name:         "required anti-affinity",
+			providerData: withAntiAffinity(placementCluster, true),
+			setup: func(t *testing.T, env *testEnv) {
+				// the default host is less loaded, but already runs a machine of the cluster
+				env.secondary.SetNode(libvirtfake.Node{Memory: 16 << 30, CPUs: 4})
+				defineOwnedDomain(t, env.lv, "request-0", testCluster, "talos-default-workers")
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, testSecondaryHost, env.spec().Value.Host)
+			},
+		},
+		{
+			name:         "preferred anti-affinity",
+			providerData: withAntiAffinity(placementMachineSet, false),
+			setup: func(t *testing.T, env *testEnv) {
+				defineOwnedDomain(t, env.lv, "request-0", testCluster, testMachineSet)
+				defineOwnedDomain(t, env.secondary, "request-2", testCluster, testMachineSet)
+				defineOwnedDomain(t, env.secondary, "request-3", testCluster, testMachineSet)
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, config.DefaultHostName, env.spec().Value.Host)
+			},
+		},
+		{
+			name:         "anti-affinity ignores other clusters and own domain",
+			providerData: withAntiAffinity(placementCluster, true),
+			setup: func(t *testing.T, env *testEnv) {
+				defineOwnedDomain(t, env.lv, "request-0", "other", "other-control-planes")
+				defineOwnedDomain(t, env.lv, testRequestID, testCluster, testMachineSet)
+				defineOwnedDomain(t, env.secondary, "request-2", testCluster, testMachineSet)
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, config.DefaultHostName, env.spec().Value.Host)
+			},
+		},
+		{
+			name:         "required anti-affinity can't be satisfied",
+			providerData: withAntiAffinity(placementCluster, true),
+			setup: func(t *testing.T, env *testEnv) {
+				defineOwnedDomain(t, env.lv, "request-0", testCluster, testMachineSet)
+				defineOwnedDomain(t, env.secondary, "request-2", testCluster, testMachineSet)
+			},
+			wantErr: "placement rule can't be satisfied: anti-affinity to cluster/talos-default, violated by hosts default, secondary",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.spec().Value.Host)
+			},
+		},
+		{
+			name:         "required anti-affinity with explicit host",
+			providerData: withAntiAffinity(placementCluster, true) + "host: " + testSecondaryHost + "\n",
+			setup: func(t *testing.T, env *testEnv) {
+				defineOwnedDomain(t, env.secondary, "request-2", testCluster, testMachineSet)
+			},
+			wantErr: "violated by hosts secondary",
+		},
+		{
+			name:         "unknown placement rule",
+			providerData: testProviderData + "placement_rules:\n  - type: anti_affinity\n    scope: rack\n",
+			wantErr:      `placement_rules[0]: unknown scope "rack"`,
+		},
+		{
+			name:         "host selector match labels",
+			providerData: testProviderData + "host_selector:\n  match_labels:\n    storage: nvme\n",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, testSecondaryHost, env.spec().Value.Host)
+			},
+		},
+		{
+			name: "host selector match expressions",
+			providerData: testProviderData + `host_selector:
+  match_expressions:
+    - key: storage
+      operator: Exists
+    - key: rack
+      operator: NotIn
+      values: [a, c]
+`,
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, testSecondaryHost, env.spec().Value.Host)
+			},
+		},
+		{
+			name: "host selector narrows down the scheduler candidates",
+			providerData: testProviderData + `host_selector:
+  match_expressions:
+    - key: rack
+      operator: In
+      values: [a, c]
+`,
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.SetNode(libvirtfake.Node{Memory: 8 << 30, CPUs: 4})
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, config.DefaultHostName, env.spec().Value.Host)
+			},
+		},
+		{
+			name:         "host selector matches no host",
+			providerData: testProviderData + "host_selector:\n  match_labels:\n    storage: ssd\n",
+			wantErr:      "host_selector matches no configured libvirt host",
+		},
+		{
+			name:         "host selector excludes explicit host",
+			providerData: testProviderData + "host: secondary\nhost_selector:\n  match_labels:\n    rack: a\n",
+			wantErr:      "host_selector matches no configured libvirt host",
+		},
+		{
+			name: "invalid host selector",
+			providerData: testProviderData + `host_selector:
+  match_expressions:
+    - key: rack
+      operator: In
+`,
+			wantErr: "invalid host_selector: match_expressions[0]: operator In requires values",
+		},
+		{
+			name:         "recorded host is kept",
+			providerData: testProviderData + "host: " + testSecondaryHost + "\n",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.spec().Value.Host = config.DefaultHostName
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, config.DefaultHostName, env.spec().Value.Host)
+			},
+		},
+	})
+}
+
+func TestAdmitMachine(t *testing.T) {
+	onDefaultHost := func(_ *testing.T, env *testEnv) {
+		env.spec().Value.Host = config.DefaultHostName
+	}
+
+	// defineDomain defines a foreign domain using the given vCPUs and memory in GiB
+	defineDomain := func(t *testing.T, env *testEnv, name string, vcpus, memory int) {
+		_, err := env.lv.DomainDefineXML(fmt.Sprintf(
+			"<domain type='kvm'><name>%s</name><memory unit='GiB'>%d</memory><vcpu>%d</vcpu></domain>", name, memory, vcpus))
+		require.NoError(t, err)
+	}
+
+	addVolume := func(env *testEnv, name string, size uint64) {
+		env.lv.AddVolume(testPool, libvirtfake.Volume{Name: name, Format: "qcow2", Capacity: size << 30})
+	}
+
+	runStepTests(t, "admitMachine", []stepTest{
+		{
+			name:  "fits",
+			setup: onDefaultHost,
+		},
+		{
+			name:         "more cores than host CPUs",
+			providerData: "cores: 16\nmemory: 4096\ndisk_size: 10\nstorage_pool: default\n",
+			setup:        onDefaultHost,
+			wantErr:      `machine doesn't fit on host "default": requested 16 cores, but the host has 8 CPUs`,
+		},
+		{
+			name: "vcpus overcommitted",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				defineDomain(t, env, "foreign", 31, 1)
+			},
+			wantErr: "requested 2 cores, but 31 of 32 vCPUs are allocated (8 CPUs, overcommit ratio 4)",
+		},
+		{
+			name: "memory",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				defineDomain(t, env, "foreign", 1, 30)
+			},
+			wantErr: "requested 4096 MiB of memory, but 30720 of 32768 MiB are allocated (overcommit ratio 1)",
+		},
+		{
+			name: "memory overcommit",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				defineDomain(t, env, "foreign", 1, 30)
+
+				hosts := env.hosts()
+				hosts[0].Overcommit = provider.Overcommit{Memory: 1.5}
+
+				env.provisioner = provider.NewProvisioner(hosts, env.scheduler, nil)
+			},
+		},
+		{
+			name:         "disks",
+			providerData: testProviderData + "additional_disks:\n  - type: nvme\n    size: 20\n",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				env.lv.SetPoolCapacity(testPool, 100<<30)
+				addVolume(env, "foreign.qcow2", 80)
+			},
+			wantErr: `requested 30 GiB of disks, but 80 of 100 GiB of the storage pool "default" are allocated (overcommit ratio 1)`,
+		},
+		{
+			name: "all problems are reported",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				defineDomain(t, env, "foreign", 31, 30)
+				env.lv.SetPoolCapacity(testPool, 5<<30)
+			},
+			wantErr: "vCPUs are allocated (8 CPUs, overcommit ratio 4); requested 4096 MiB of memory, but 30720 of 32768 MiB are allocated (overcommit ratio 1); requested 10 GiB",
+		},
+		{
+			name: "resources of the machine are not counted",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				defineDomain(t, env, testRequestID, 32, 32)
+				env.lv.SetPoolCapacity(testPool, 10<<30)
+				addVolume(env, testRequestID+".qcow2", 10)
+				addVolume(env, testRequestID+"-cidata.iso", 1)
+			},
+		},
+		{
+			name: "volumes of requests with a longer ID are counted",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				env.lv.SetPoolCapacity(testPool, 100<<30)
+				addVolume(env, testRequestID+"0.qcow2", 40)
+				addVolume(env, testRequestID+"-1.qcow2", 41)
+				addVolume(env, testRequestID+"-1-cidata.iso", 10)
+			},
+			wantErr: `requested 10 GiB of disks, but 91 of 100 GiB of the storage pool "default" are allocated (overcommit ratio 1)`,
+		},
+		{
+			name: "capacity reserved for in-flight requests",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				defineDomain(t, env, "foreign", 1, 24)
+
+				// another request was placed on the host, but its VM isn't defined yet
+				_, err := env.scheduler.Schedule("request-0", []placement.Host{
+					{Name: config.DefaultHostName, Memory: 32 << 30, FreeMemory: 32 << 30, FreeDisk: 1 << 40, Cores: 8},
+				}, placement.Request{Memory: 6 << 30, Cores: 2})
+				require.NoError(t, err)
+			},
+			wantErr: "requested 4096 MiB of memory, but 30720 of 32768 MiB are allocated (overcommit ratio 1)",
+		},
+		{
+			name: "host unreachable",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				env.lv.InjectError("NodeGetInfo", 0, errors.New("connection reset"))
+			},
+			wantErr:   "error collecting host capacity: error fetching node info: connection reset",
+			wantRetry: true,
+		},
+		{
+			name:         "snapshots",
+			providerData: testProviderData + "snapshots:\n  interval: 1h\n  keep: 2\n",
+			setup:        onDefaultHost,
+		},
+		{
+			name:         "snapshots on libvirt without the deletion of external snapshots",
+			providerData: testProviderData + "snapshots:\n  interval: 1h\n  keep: 2\n",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				env.lv.SetLibVersion(8_000_000)
+			},
+			wantErr: "snapshots: snapshots need libvirt 9.0.0 or newer to be deleted, the libvirt host runs 8.0.0",
+		},
+		{
+			name: "no snapshots on libvirt without the deletion of external snapshots",
+			setup: func(t *testing.T, env *testEnv) {
+				onDefaultHost(t, env)
+				env.lv.SetLibVersion(8_000_000)
+			},
+		},
+	})
+}
+
+func TestGenerateUUID(t *testing.T) {
+	// the UUID derived for testRequestID, as seen by a fresh environment
+	derivedUUID := func(t *testing.T) string {
+		env := newTestEnv(t, testProviderData)
+
+		require.NoError(t, env.runStep(t, "generateUUID"))
+
+		return env.spec().Value.Uuid
+	}
+
+	defineDomain := func(t *testing.T, env *testEnv, name, id string) {
+		_, err := env.lv.DomainDefineXML(fmt.Sprintf("<domain type='kvm'><name>%s</name><uuid>%s</uuid></domain>", name, id))
+		require.NoError(t, err)
+	}
+
+	runStepTests(t, "generateUUID", []stepTest{
+		{
+			name: "unused uuid",
+			check: func(t *testing.T, env *testEnv) {
+				id, err := uuid.Parse(env.spec().Value.Uuid)
+				require.NoError(t, err)
+
+				assert.Equal(t, id.String(), env.status.TypedSpec().Value.Id)
+				assert.Equal(t, 1, env.lv.Calls("DomainLookupByUUID"))
+			},
+		},
+		{
+			name: "deterministic",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, derivedUUID(t), env.spec().Value.Uuid)
+			},
+		},
+		{
+			name: "own domain",
+			setup: func(t *testing.T, env *testEnv) {
+				defineDomain(t, env, testRequestID, derivedUUID(t))
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, derivedUUID(t), env.spec().Value.Uuid)
+			},
+		},
+		{
+			name: "collision",
+			setup: func(t *testing.T, env *testEnv) {
+				defineDomain(t, env, "foreign", derivedUUID(t))
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.NotEqual(t, derivedUUID(t), env.spec().Value.Uuid)
+				assert.Equal(t, env.spec().Value.Uuid, env.status.TypedSpec().Value.Id)
+				assert.Equal(t, 2, env.lv.Calls("DomainLookupByUUID"))
+
+				// the alternative UUID is stable as well
+				id := env.spec().Value.Uuid
+
+				require.NoError(t, env.runStep(t, "generateUUID"))
+				assert.Equal(t, id, env.spec().Value.Uuid)
+			},
+		},
+		{
+			name: "lookup failure",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.InjectError("DomainLookupByUUID", 0, errors.New("connection reset"))
+			},
+			wantErr:   "connection reset",
+			wantRetry: true,
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.spec().Value.Uuid)
+			},
+		},
+	})
+}
+
+func TestCreateSchematic(t *testing.T) {
+	runStepTests(t, "createSchematic", []stepTest{
+		{
+			name: "success",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, testSchematicID, env.spec().Value.SchematicId)
+			},
+		},
+		{
+			name: "image factory failure",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.factory.err = errors.New("factory unavailable")
+			},
+			wantErr:   "factory unavailable",
+			wantRetry: true,
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.spec().Value.SchematicId)
+			},
+		},
+	})
+}
+
+func TestProvisionPrimaryDisk(t *testing.T) {
+	withSchematic := func(_ *testing.T, env *testEnv) {
+		env.spec().Value.SchematicId = testSchematicID
+	}
+
+	runStepTests(t, "provisionPrimaryDisk", []stepTest{
+		{
+			name:  "success",
+			setup: withSchematic,
+			check: func(t *testing.T, env *testEnv) {
+				vol, ok := env.lv.Volume(testPool, testRequestID+".qcow2")
+				require.True(t, ok)
+
+				assert.Equal(t, "qcow2", vol.Format)
+				assert.Equal(t, 10*provider.GiB, vol.Capacity)
+				assert.Equal(t, testImage, vol.Data)
+
+				assert.Equal(t, testPool, env.spec().Value.PoolName)
+				assert.Equal(t, testRequestID+".qcow2", env.spec().Value.VmVolName)
+			},
+		},
+		{
+			name: "idempotent",
+			setup: func(t *testing.T, env *testEnv) {
+				withSchematic(t, env)
+
+				require.NoError(t, env.runStep(t, "provisionPrimaryDisk"))
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, []string{testRequestID + ".qcow2"}, env.lv.Volumes(testPool))
+				assert.Equal(t, 1, env.lv.Calls("StorageVolCreateXML"))
+				assert.Equal(t, testRequestID+".qcow2", env.spec().Value.VmVolName)
+			},
+		},
+		{
+			name:         "missing pool",
+			setup:        withSchematic,
+			providerData: "storage_pool: missing\ndisk_size: 10\n",
+			wantErr:      "Storage pool not found",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.spec().Value.VmVolName)
+			},
+		},
+		{
+			name: "upload failure",
+			setup: func(t *testing.T, env *testEnv) {
+				withSchematic(t, env)
+
+				env.lv.InjectError("StorageVolUpload", 0, errors.New("stream closed"))
+			},
+			wantErr: "error uploading image: stream closed",
+			check: func(t *testing.T, env *testEnv) {
+				// the volume created by the failed run is rolled back
+				assert.Empty(t, env.spec().Value.VmVolName)
+				assert.Empty(t, env.spec().Value.PoolName)
+				assert.Empty(t, env.lv.Volumes(testPool))
+
+				require.NoError(t, env.runStep(t, "provisionPrimaryDisk"))
+
+				vol, ok := env.lv.Volume(testPool, testRequestID+".qcow2")
+				require.True(t, ok)
+
+				assert.Equal(t, testImage, vol.Data)
+				assert.Equal(t, 2, env.lv.Calls("StorageVolCreateXML"))
+			},
+		},
+		{
+			name: "resize failure",
+			setup: func(t *testing.T, env *testEnv) {
+				withSchematic(t, env)
+
+				env.lv.InjectError("StorageVolResize", 0, errors.New("no space left"))
+			},
+			wantErr: "expanding volume",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.spec().Value.VmVolName)
+				assert.Empty(t, env.lv.Volumes(testPool))
+			},
+		},
+	})
+}
+
+func TestProvisionAdditionalDisks(t *testing.T) {
+	const twoDisks = testProviderData + `
+additional_disks:
+  - type: nvme
+    size: 20
+  - type: sata
+    size: 30
+`
+
+	const threeDisks = twoDisks + `  - type: nvme
+    size: 40
+`
+
+	runStepTests(t, "provisionAdditionalDisks", []stepTest{
+		{
+			name: "no disks",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.lv.Volumes(testPool))
+				assert.Empty(t, env.spec().Value.AdditionalDisks)
+			},
+		},
+		{
+			name:         "two disks",
+			providerData: twoDisks,
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, []string{testRequestID + "-0-nvme.qcow2", testRequestID + "-1-sata.qcow2"}, env.lv.Volumes(testPool))
+
+				vol, ok := env.lv.Volume(testPool, testRequestID+"-1-sata.qcow2")
+				require.True(t, ok)
+
+				assert.Equal(t, 30*provider.GiB, vol.Capacity)
+				assert.Equal(t, "qcow2", vol.Format)
+
+				disks := env.spec().Value.AdditionalDisks
+				require.Len(t, disks, 2)
+
+				assert.Equal(t, "nvme", disks[0].Type)
+				assert.Equal(t, testRequestID+"-0-nvme.qcow2", disks[0].VolName)
+				assert.Equal(t, "sata", disks[1].Type)
+				assert.Equal(t, testRequestID+"-1-sata.qcow2", disks[1].VolName)
+
+				for _, disk := range disks {
+					assert.Len(t, disk.Serial, 20)
+					assert.Len(t, disk.Wwn, 16)
+				}
+
+				assert.NotEqual(t, disks[0].Serial, disks[1].Serial)
+				assert.NotEqual(t, disks[0].Wwn, disks[1].Wwn)
+			},
+		},
+		{
+			name:         "stable disk identity",
+			providerData: twoDisks,
+			setup: func(t *testing.T, env *testEnv) {
+				require.NoError(t, env.runStep(t, "generateUUID"))
+			},
+			check: func(t *testing.T, env *testEnv) {
+				other := newTestEnv(t, twoDisks)
+				other.runSteps(t, "provisionAdditionalDisks")
+
+				for i, disk := range env.spec().Value.AdditionalDisks {
+					assert.Equal(t, other.spec().Value.AdditionalDisks[i].Serial, disk.Serial)
+					assert.Equal(t, other.spec().Value.AdditionalDisks[i].Wwn, disk.Wwn)
+				}
+			},
+		},
+		{
+			name:         "idempotent",
+			providerData: twoDisks,
+			setup: func(t *testing.T, env *testEnv) {
+				require.NoError(t, env.runStep(t, "provisionAdditionalDisks"))
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Len(t, env.lv.Volumes(testPool), 2)
+				assert.Len(t, env.spec().Value.AdditionalDisks, 2)
+				assert.Equal(t, 2, env.lv.Calls("StorageVolCreateXML"))
+			},
+		},
+		{
+			name:         "partial failure",
+			providerData: threeDisks,
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.InjectError("StorageVolCreateXML", 2, errors.New("pool is full"))
+			},
+			wantErr: "pool is full",
+			check: func(t *testing.T, env *testEnv) {
+				// the disks created by the failed run are rolled back
+				assert.Empty(t, env.lv.Volumes(testPool))
+				assert.Empty(t, env.spec().Value.AdditionalDisks)
+
+				require.NoError(t, env.runStep(t, "provisionAdditionalDisks"))
+
+				assert.Len(t, env.lv.Volumes(testPool), 3)
+				assert.Len(t, env.spec().Value.AdditionalDisks, 3)
+				assert.Equal(t, 6, env.lv.Calls("StorageVolCreateXML"))
+			},
+		},
+		{
+			name:         "partial failure after earlier run",
+			providerData: threeDisks,
+			setup: func(t *testing.T, env *testEnv) {
+				require.NoError(t, env.runStep(t, "provisionAdditionalDisks"))
+
+				// the disks recorded by the successful run are kept
+				env.lv.InjectError("StorageVolLookupByName", 1, errors.New("connection reset"))
+			},
+			wantErr: "error creating disk",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Len(t, env.lv.Volumes(testPool), 3)
+				assert.Len(t, env.spec().Value.AdditionalDisks, 3)
+			},
+		},
+		{
+			name:         "rollback failure",
+			providerData: threeDisks,
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.InjectError("StorageVolCreateXML", 2, errors.New("pool is full"))
+				env.lv.InjectError("StorageVolDelete", 0, errors.New("device or resource busy"))
+			},
+			wantErr: "pool is full; rollback failed: deleting volume: device or resource busy",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, []string{testRequestID + "-0-nvme.qcow2"}, env.lv.Volumes(testPool))
+			},
+		},
+		{
+			name:         "missing pool",
+			providerData: "storage_pool: missing\nadditional_disks:\n  - type: nvme\n    size: 20\n",
+			wantErr:      "Storage pool not found",
+		},
+	})
+}
+
+func TestProvisionCidata(t *testing.T) {
+	const volName = testRequestID + "-cidata.iso"
+
+	runStepTests(t, "provisionCidata", []stepTest{
+		{
+			name: "success",
+			check: func(t *testing.T, env *testEnv) {
+				vol, ok := env.lv.Volume(testPool, volName)
+				require.True(t, ok)
+
+				assert.Equal(t, "raw", vol.Format)
+				assert.EqualValues(t, len(vol.Data), vol.Capacity)
+				assert.Contains(t, string(vol.Data), "local-hostname: "+testRequestID)
+
+				assert.Equal(t, volName, env.spec().Value.CidataVolName)
+			},
+		},
+		{
+			name: "replaces stale volume",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.AddVolume(testPool, libvirtfake.Volume{Name: volName, Format: "raw", Data: []byte("stale")})
+			},
+			check: func(t *testing.T, env *testEnv) {
+				vol, ok := env.lv.Volume(testPool, volName)
+				require.True(t, ok)
+
+				assert.NotEqual(t, []byte("stale"), vol.Data)
+				assert.Equal(t, 1, env.lv.Calls("StorageVolDelete"))
+			},
+		},
+		{
+			name:         "missing pool",
+			providerData: "storage_pool: missing\n",
+			wantErr:      "error looking up storage pool",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.spec().Value.CidataVolName)
+			},
+		},
+		{
+			name: "upload failure",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.lv.InjectError("StorageVolUpload", 0, errors.New("stream closed"))
+			},
+			wantErr: "error uploading cidata ISO",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.spec().Value.CidataVolName)
+				assert.Empty(t, env.lv.Volumes(testPool))
+			},
+		},
+	})
+}
+
+func TestCreateVM(t *testing.T) {
+	const withDisks = testProviderData + `
+additional_disks:
+  - type: nvme
+    size: 20
+  - type: sata
+    size: 30
+`
+
+	provisioned := func(t *testing.T, env *testEnv) {
+		env.runSteps(t, "provisionCidata")
+	}
+
+	runStepTests(t, "createVM", []stepTest{
+		{
+			name:      "waiting for image",
+			wantErr:   "waiting for image",
+			wantRetry: true,
+		},
+		{
+			name: "missing volume",
+			setup: func(_ *testing.T, env *testEnv) {
+				env.spec().Value.PoolName = testPool
+				env.spec().Value.VmVolName = testRequestID + ".qcow2"
+			},
+			wantErr:   "error fetching volume",
+			wantRetry: true,
+		},
+		{
+			name:         "success",
+			providerData: withDisks,
+			setup:        provisioned,
+			check: func(t *testing.T, env *testEnv) {
+				dom, ok := env.lv.Domain(testRequestID)
+				require.True(t, ok)
+
+				assert.Equal(t, libvirt.DomainShutoff, dom.State)
+				assert.Equal(t, env.spec().Value.Uuid, uuid.UUID(dom.UUID).String())
+				assert.Equal(t, testRequestID, env.spec().Value.VmName)
+
+				def := dom.Definition
+
+				assert.Equal(t, uint(4096), def.Memory.Value)
+				assert.Equal(t, uint(2), def.VCPU.Value)
+				require.Len(t, def.Devices.Interfaces, 1)
+				assert.Equal(t, "default", def.Devices.Interfaces[0].Source.Network.Network)
+
+				disks := def.Devices.Disks
+				require.Len(t, disks, 4)
+
+				assert.Equal(t, "vda", disks[0].Target.Dev)
+				assert.Equal(t, testRequestID+".qcow2", disks[0].Source.Volume.Volume)
+				assert.Equal(t, "nvme0n1", disks[1].Target.Dev)
+				assert.Equal(t, testRequestID+"-0-nvme.qcow2", disks[1].Source.Volume.Volume)
+				assert.Equal(t, env.spec().Value.AdditionalDisks[0].Serial, disks[1].Serial)
+				assert.Equal(t, testRequestID+"-1-sata.qcow2", disks[2].Source.Volume.Volume)
+				assert.Equal(t, "cdrom", disks[3].Device)
+				assert.Equal(t, testRequestID+"-cidata.iso", disks[3].Source.Volume.Volume)
+
+				owner, err := env.lv.DomainGetMetadata(libvirt.Domain{Name: dom.Name, UUID: dom.UUID},
+					int32(libvirt.DomainMetadataElement), libvirt.OptString{testMetadataNamespace}, libvirt.DomainAffectCurrent)
+				require.NoError(t, err)
+				assert.Contains(t, owner, "<omni:request-id>"+testRequestID+"</omni:request-id>")
+				assert.Contains(t, owner, "<omni:cluster>"+testCluster+"</omni:cluster>")
+			},
+		},
+		{
+			name: "idempotent",
+			setup: func(t *testing.T, env *testEnv) {
+				provisioned(t, env)
+
+				require.NoError(t, env.runStep(t, "createVM"))
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Equal(t, []string{testRequestID}, env.lv.Domains())
+				assert.Equal(t, 2, env.lv.Calls("DomainDefineXML"))
+			},
+		},
+		{
+			name: "unknown disk type",
+			setup: func(t *testing.T, env *testEnv) {
+				provisioned(t, env)
+
+				env.spec().Value.AdditionalDisks = append(env.spec().Value.AdditionalDisks, &specs.AdditionalDisk{Type: "floppy", VolName: "floppy.img"})
+			},
+			wantErr: `unknown disk type: "floppy"`,
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.lv.Domains())
+				assert.Empty(t, env.spec().Value.VmName)
+			},
+		},
+		{
+			name: "define failure",
+			setup: func(t *testing.T, env *testEnv) {
+				provisioned(t, env)
+
+				env.lv.InjectError("DomainDefineXML", 0, errors.New("unsupported configuration"))
+			},
+			wantErr: "creating domain: unsupported configuration",
+			check: func(t *testing.T, env *testEnv) {
+				assert.Empty(t, env.spec().Value.VmName)
+			},
+		},
+	})
+}
+
+func TestStartVM(t *testing.T) {
+	created := func(t *testing.T, env *testEnv) {
+		env.runSteps(t, "createVM")
+	}
+
+	runStepTests(t, "startVM", []stepTest{
+		{
+			name:      "domain not defined",
+			wantErr:   "VM lookup failed",
+			wantRetry: true,
+		},
+		{
+			name:  "start",
+			setup: created,
+			check: func(t *testing.T, env *testEnv) {
+				dom, ok := env.lv.Domain(testRequestID)
+				require.True(t, ok)
+
+				assert.Equal(t, libvirt.DomainRunning, dom.State)
+			},
+		},
+		{
+			name: "already running",
+			setup: func(t *testing.T, env *testEnv) {
+				created(t, env)
+
+				env.lv.SetDomainState(testRequestID, libvirt.DomainRunning)
+			},
+			check: func(t *testing.T, env *testEnv) {
+				assert.Zero(t, env.lv.Calls("DomainCreate"))
+			},
+		},
+		{
+			name: "start failure",
+			setup: func(t *testing.T, env *testEnv) {
+				created(t, env)
+
+				env.lv.InjectError("DomainCreate", 0, errors.New("cannot allocate memory"))
+			},
+			wantErr:   "failed to start VM",
+			wantRetry: true,
+		},
+		{
+			name: "state failure",
+			setup: func(t *testing.T, env *testEnv) {
+				created(t, env)
+
+				env.lv.InjectError("DomainGetState", 0, errors.New("connection reset"))
+			},
+			wantErr:   "error fetching domain state",
+			wantRetry: true,
+		},
+	})
+}
+
+func TestProvisionAllSteps(t *testing.T) {
+	env := newTestEnv(t, testProviderData+`
+additional_disks:
+  - type: nvme
+    size: 20
+`)
+
+	env.runSteps(t, "startVM")
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+
+	assert.Equal(t, libvirt.DomainRunning, dom.State)
+	assert.Len(t, env.lv.Volumes(testPool), 3)
+}
+
+func TestRollbackReleasesReservation(t *testing.T) {
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "provisionCidata")
+
+	host := env.spec().Value.Host
+	assert.NotZero(t, env.scheduler.Reserved(host, ""))
+
+	env.lv.InjectError("DomainDefineXML", 0, errors.New("XML error: unsupported configuration"))
+
+	err := env.runStep(t, "createVM")
+	require.ErrorContains(t, err, "unsupported configuration")
+	require.False(t, isRetry(err))
+
+	assert.Zero(t, env.scheduler.Reserved(host, ""), "the capacity isn't reserved for the failed request")
+}
+
+func TestProvisionSecondaryHost(t *testing.T) {
+	env := newTestEnv(t, testProviderData+"host: "+testSecondaryHost+"\n")
+
+	env.runSteps(t, "startVM")
+
+	dom, ok := env.secondary.Domain(testRequestID)
+	require.True(t, ok)
+
+	assert.Equal(t, libvirt.DomainRunning, dom.State)
+	assert.Len(t, env.secondary.Volumes(testPool), 2)
+
+	assert.Empty(t, env.lv.Domains())
+	assert.Empty(t, env.lv.Volumes(testPool))
+
+	logger := zaptest.NewLogger(t)
+
+	err := env.provisioner.Deprovision(t.Context(), logger, env.machine, env.request)
+	require.True(t, isRetry(err), "expected retry error, got %v", err)
+
+	require.NoError(t, env.provisioner.Deprovision(t.Context(), logger, env.machine, env.request))
+
+	assert.Empty(t, env.secondary.Domains())
+	assert.Empty(t, env.secondary.Volumes(testPool))
+}
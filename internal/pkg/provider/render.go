@@ -0,0 +1,252 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"bytes"
+	"fmt"
+
+	"go.yaml.in/yaml/v3"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/api/specs"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/cidata"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/meta"
+)
+
+// RenderRequest is the machine request to render.
+type RenderRequest struct {
+	ProviderData string
+	RequestID    string
+	Cluster      string
+	MachineSet   string
+	// StoragePoolXML is the storage pool of the provider data, as printed by virsh pool-dumpxml.
+	// A directory pool is assumed if it's empty.
+	StoragePoolXML string
+}
+
+// RenderedVolume is a volume the provisioner creates.
+type RenderedVolume struct {
+	Pool string `json:"pool"`
+	Name string `json:"name"`
+	XML  string `json:"xml"`
+	// Content is what is uploaded to the volume.
+	Content string `json:"content,omitempty"`
+	// ResizeTo is the capacity in bytes the volume is resized to after the upload.
+	ResizeTo uint64 `json:"resize_to,omitempty"`
+	// Retain is the retain policy of the volume on deprovision, it is deleted if empty.
+	Retain string `json:"retain,omitempty"`
+	// Secret is the UUID of the libvirt secret of the passphrase of the encrypted volume.
+	Secret string `json:"secret,omitempty"`
+}
+
+// Rendered is what the provisioner sends to libvirt for a machine request.
+type Rendered struct {
+	// Cidata are the files of the cidata ISO by name.
+	Cidata    map[string]string `json:"cidata"`
+	DomainXML string            `json:"domain_xml"`
+	Volumes   []RenderedVolume  `json:"volumes"`
+}
+
+// Render renders the volumes, the cidata files and the domain of the machine request, as the provision steps do.
+//
+// The defaults and the allowlists of the policy apply. Neither libvirt nor the image factory are accessed:
+// the UUID is the one derived for the request, unless it collides with another domain, and the storage pool
+// is the one of the request.
+func Render(policy Policy, req RenderRequest) (Rendered, error) {
+	var fields map[string]any
+
+	if err := yaml.Unmarshal([]byte(req.ProviderData), &fields); err != nil {
+		return Rendered{}, fmt.Errorf("error parsing provider data: %w", err)
+	}
+
+	data, err := policy.merge(fields)
+	if err != nil {
+		return Rendered{}, fmt.Errorf("error parsing provider data: %w", err)
+	}
+
+	if err = policy.check(data); err != nil {
+		return Rendered{}, err
+	}
+
+	if data.HostSelector != nil {
+		if err = data.HostSelector.validate(); err != nil {
+			return Rendered{}, fmt.Errorf("invalid host_selector: %w", err)
+		}
+	}
+
+	if err = validateRetain(data.Retain); err != nil {
+		return Rendered{}, fmt.Errorf("retain: %w", err)
+	}
+
+	owner := domainOwner{
+		ProviderID: meta.ProviderID,
+		RequestID:  req.RequestID,
+		Cluster:    req.Cluster,
+		MachineSet: req.MachineSet,
+	}
+
+	if _, err = placementRequest(data, owner); err != nil {
+		return Rendered{}, err
+	}
+
+	pool := dirStoragePool(data.StoragePool)
+
+	if req.StoragePoolXML != "" {
+		if pool, err = parseStoragePool(req.StoragePoolXML); err != nil {
+			return Rendered{}, err
+		}
+
+		if pool.Name != data.StoragePool {
+			return Rendered{}, fmt.Errorf("the storage pool XML is the one of %q, not of the storage pool %q of the provider data", pool.Name, data.StoragePool)
+		}
+	}
+
+	vmName := req.RequestID
+	spec := &specs.MachineSpec{
+		Uuid:          machineUUID(vmName, 0).String(),
+		PoolName:      data.StoragePool,
+		VmVolName:     primaryVolumeName(vmName, pool.diskFormat()),
+		CidataVolName: cidataVolumeName(vmName),
+		VmVolRetain:   data.Retain,
+	}
+
+	rendered := Rendered{
+		Cidata: map[string]string{
+			"meta-data":      string(cidata.MetaData(vmName)),
+			"user-data":      string(cidata.UserData()),
+			"network-config": string(cidata.NetworkData()),
+		},
+	}
+
+	capacity, resizeTo := pool.primaryDiskCapacity(data.DiskSize)
+
+	if err = rendered.addVolume(pool, spec.VmVolName, pool.diskFormat(), capacity); err != nil {
+		return Rendered{}, err
+	}
+
+	rendered.Volumes[0].Content = fmt.Sprintf("Talos nocloud image of the schematic, downloaded as %s and decompressed", pool.imageFormat())
+	rendered.Volumes[0].ResizeTo = resizeTo
+	rendered.Volumes[0].Retain = data.Retain
+
+	pools := map[string]storagePool{pool.Name: pool}
+
+	for idx, disk := range data.AdditionalDisks {
+		if err = disk.validate(); err != nil {
+			return Rendered{}, fmt.Errorf("additional_disks[%d]: %w", idx, err)
+		}
+
+		serial, wwn := diskIdentity(spec.Uuid, idx)
+
+		if disk.isExisting() {
+			spec.AdditionalDisks = append(spec.AdditionalDisks, renderExistingDisk(disk, data, pools, serial, wwn))
+
+			continue
+		}
+
+		format := disk.format(pool)
+		volName := additionalVolumeName(vmName, idx, disk.Type, format)
+		diskSpec := &specs.AdditionalDisk{
+			Type:    disk.Type,
+			VolName: volName,
+			Serial:  serial,
+			Wwn:     wwn,
+			Retain:  disk.Retain,
+		}
+
+		if disk.Encrypted {
+			diskSpec.SecretUuid = volumeSecretUUID(spec.Uuid, idx).String()
+			diskSpec.Format = format
+
+			if err = rendered.addEncryptedVolume(pool, volName, disk.Size*GiB, diskSpec.SecretUuid); err != nil {
+				return Rendered{}, fmt.Errorf("additional_disks[%d]: %w", idx, err)
+			}
+		} else if err = rendered.addVolume(pool, volName, format, disk.Size*GiB); err != nil {
+			return Rendered{}, err
+		}
+
+		rendered.Volumes[len(rendered.Volumes)-1].Retain = disk.Retain
+
+		spec.AdditionalDisks = append(spec.AdditionalDisks, diskSpec)
+	}
+
+	isoData, err := cidata.GenerateCidataISO(
+		bytes.NewReader([]byte(rendered.Cidata["meta-data"])),
+		bytes.NewReader([]byte(rendered.Cidata["user-data"])),
+		bytes.NewReader([]byte(rendered.Cidata["network-config"])),
+	)
+	if err != nil {
+		return Rendered{}, fmt.Errorf("error generating cidata ISO: %w", err)
+	}
+
+	if err = rendered.addVolume(pool, spec.CidataVolName, diskFormatRaw, uint64(len(isoData))); err != nil {
+		return Rendered{}, err
+	}
+
+	rendered.Volumes[len(rendered.Volumes)-1].Content = "cidata ISO"
+
+	domain, err := buildDomain(vmName, owner, data, pools, spec)
+	if err != nil {
+		return Rendered{}, err
+	}
+
+	if rendered.DomainXML, err = domain.Marshal(); err != nil {
+		return Rendered{}, fmt.Errorf("error rendering domain XML: %w", err)
+	}
+
+	return rendered, nil
+}
+
+// renderExistingDisk returns the machine state of the existing additional disk, which isn't looked up.
+//
+// The storage pools of the volumes, other than the one of the storage pool XML, are assumed to be directory pools,
+// and the volumes to have the disk format of their pool.
+func renderExistingDisk(disk additionalDisk, data Data, pools map[string]storagePool, serial, wwn string) *specs.AdditionalDisk {
+	spec := &specs.AdditionalDisk{
+		Type:     disk.Type,
+		Serial:   serial,
+		Wwn:      wwn,
+		Existing: true,
+	}
+
+	if disk.BlockDevice != "" {
+		spec.BlockDevice = disk.BlockDevice
+		spec.Format = diskFormatRaw
+
+		return spec
+	}
+
+	spec.VolName = disk.Volume
+	spec.PoolName = disk.pool(data)
+
+	if _, ok := pools[spec.PoolName]; !ok {
+		pools[spec.PoolName] = dirStoragePool(spec.PoolName)
+	}
+
+	spec.Format = pools[spec.PoolName].diskFormat()
+
+	return spec
+}
+
+func (r *Rendered) addVolume(pool storagePool, name, format string, capacity uint64) error {
+	volXML, err := pool.volumeXML(name, format, capacity)
+	if err != nil {
+		return fmt.Errorf("error rendering XML of volume %q: %w", name, err)
+	}
+
+	r.Volumes = append(r.Volumes, RenderedVolume{Pool: pool.Name, Name: name, XML: volXML})
+
+	return nil
+}
+
+func (r *Rendered) addEncryptedVolume(pool storagePool, name string, capacity uint64, secretUUID string) error {
+	volXML, err := pool.encryptedVolumeXML(name, capacity, secretUUID)
+	if err != nil {
+		return err
+	}
+
+	r.Volumes = append(r.Volumes, RenderedVolume{Pool: pool.Name, Name: name, XML: volXML, Secret: secretUUID})
+
+	return nil
+}
@@ -0,0 +1,166 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"cmp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+
+	providerData := testProviderData + `
+additional_disks:
+  - type: nvme
+    size: 20
+  - type: sata
+    size: 5
+`
+
+	env := newTestEnv(t, providerData)
+	env.runSteps(t, "createVM")
+
+	rendered, err := provider.Render(provider.Policy{}, provider.RenderRequest{
+		ProviderData: providerData,
+		RequestID:    testRequestID,
+		Cluster:      testCluster,
+		MachineSet:   testMachineSet,
+	})
+	require.NoError(t, err)
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+
+	assert.Equal(t, dom.XML, rendered.DomainXML)
+
+	require.Len(t, rendered.Volumes, 4)
+
+	for _, renderedVol := range rendered.Volumes {
+		vol, ok := env.lv.Volume(renderedVol.Pool, renderedVol.Name)
+		require.True(t, ok, renderedVol.Name)
+
+		var volXML libvirtxml.StorageVolume
+
+		require.NoError(t, volXML.Unmarshal(renderedVol.XML))
+
+		expected := cmp.Or(renderedVol.ResizeTo, volXML.Capacity.Value)
+
+		assert.Equal(t, expected, vol.Capacity, renderedVol.Name)
+	}
+
+	assert.Equal(t, "local-hostname: "+testRequestID+"\n", rendered.Cidata["meta-data"])
+	assert.Contains(t, rendered.Cidata, "user-data")
+	assert.Contains(t, rendered.Cidata, "network-config")
+}
+
+func TestRenderStoragePool(t *testing.T) {
+	t.Parallel()
+
+	poolXML, err := testLogicalPool.Marshal()
+	require.NoError(t, err)
+
+	rendered, err := provider.Render(provider.Policy{}, provider.RenderRequest{
+		ProviderData:   withStoragePool(testLogicalPool.Name),
+		RequestID:      testRequestID,
+		StoragePoolXML: poolXML,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, rendered.Volumes, 3)
+
+	var primary libvirtxml.StorageVolume
+
+	require.NoError(t, primary.Unmarshal(rendered.Volumes[0].XML))
+
+	// the logical volumes are fully allocated raw volumes, which are not resized
+	assert.Nil(t, primary.Allocation)
+	assert.Nil(t, primary.Target)
+	assert.Equal(t, 10*provider.GiB, primary.Capacity.Value)
+	assert.Zero(t, rendered.Volumes[0].ResizeTo)
+
+	var domain libvirtxml.Domain
+
+	require.NoError(t, domain.Unmarshal(rendered.DomainXML))
+	require.NotNil(t, domain.Devices.Disks[0].Source.Block)
+	assert.Equal(t, "/dev/vg0/request-1.raw", domain.Devices.Disks[0].Source.Block.Dev)
+
+	_, err = provider.Render(provider.Policy{}, provider.RenderRequest{
+		ProviderData:   testProviderData,
+		RequestID:      testRequestID,
+		StoragePoolXML: poolXML,
+	})
+	require.ErrorContains(t, err, `the storage pool XML is the one of "vg0"`)
+}
+
+func TestRenderErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name         string
+		providerData string
+		policy       provider.Policy
+		expected     string
+	}{
+		{
+			name:         "invalid yaml",
+			providerData: "cores: [",
+			expected:     "error parsing provider data",
+		},
+		{
+			name:         "disallowed pool",
+			providerData: testProviderData,
+			policy:       provider.Policy{AllowedPools: []string{"fast"}},
+			expected:     `storage pool "default" is not allowed`,
+		},
+		{
+			name:         "unknown disk type",
+			providerData: testProviderData + "additional_disks:\n  - type: floppy\n    size: 1\n",
+			expected:     `unknown disk type: "floppy"`,
+		},
+		{
+			name:         "invalid host selector",
+			providerData: testProviderData + "host_selector:\n  match_expressions:\n    - key: rack\n      operator: Near\n",
+			expected:     "invalid host_selector",
+		},
+		{
+			name:         "unknown retain policy",
+			providerData: testProviderData + "retain: keep\n",
+			expected:     `retain: unknown retain policy "keep"`,
+		},
+		{
+			name:         "unknown retain policy of an additional disk",
+			providerData: testProviderData + "additional_disks:\n  - type: nvme\n    size: 10\n    retain: archive\n",
+			expected:     `additional_disks[0]: unknown retain policy "archive"`,
+		},
+		{
+			name:         "snapshot interval too short",
+			providerData: testProviderData + "snapshots:\n  interval: 30s\n  keep: 3\n",
+			expected:     "snapshots: interval 30s is shorter than 1m0s",
+		},
+		{
+			name:         "no snapshots kept",
+			providerData: testProviderData + "snapshots:\n  interval: 1h\n  keep: 0\n",
+			expected:     "snapshots: keep must be at least 1",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := provider.Render(test.policy, provider.RenderRequest{
+				ProviderData: test.providerData,
+				RequestID:    testRequestID,
+			})
+			require.Error(t, err)
+			assert.ErrorContains(t, err, test.expected)
+		})
+	}
+}
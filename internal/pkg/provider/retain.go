@@ -0,0 +1,138 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"go.uber.org/zap"
+	"libvirt.org/go/libvirtxml"
+)
+
+// retainedTimeFormat is the format of the creation time of the machine in the names of the kept volumes.
+const retainedTimeFormat = "20060102T150405Z"
+
+// keptVolumeName is the name the volume is kept under by the retain policy of its disk,
+// e.g. "request-1.qcow2.retained-20261018T123000Z" or "request-1.qcow2.snapshot-20261018T123000Z".
+//
+// The name doesn't match volumeNamePattern, so the kept volume is neither listed as an orphan nor reused
+// by a later machine request with the same ID. The creation time of the machine tells apart the volumes
+// kept from the machines with the same request ID.
+func keptVolumeName(volName, retain string, created time.Time) string {
+	kind := "retained"
+
+	if retain == retainSnapshot {
+		kind = "snapshot"
+	}
+
+	return fmt.Sprintf("%s.%s-%s", volName, kind, created.UTC().Format(retainedTimeFormat))
+}
+
+// checkSnapshot verifies the snapshots of the volumes can be created in the pool.
+//
+// The snapshot is a qcow2 volume, only the pools of files hold qcow2 volumes.
+func (p storagePool) checkSnapshot() error {
+	if p.poolType.kind != poolFile {
+		return fmt.Errorf("%s requires a storage pool of files, e.g. dir, %q is of type %q", retainSnapshot, p.Name, p.Type)
+	}
+
+	return nil
+}
+
+// removeVol deletes the volume of a disk, once it is kept under another name if the retain policy of the disk says so.
+func removeVol(lc LibvirtClient, poolName, volName, retain string, created time.Time, logger *zap.Logger) error {
+	vol, err := getVol(lc, poolName, volName)
+	if err != nil {
+		if !errors.Is(err, errVolNoExist) {
+			return fmt.Errorf("fetching volume %s: %w", volName, err)
+		}
+
+		logger.Info("volume was removed already: " + volName)
+
+		return nil
+	}
+
+	if retain == retainKeep || retain == retainSnapshot {
+		if err = keepVol(lc, poolName, vol, retain, keptVolumeName(volName, retain, created), logger); err != nil {
+			return err
+		}
+	}
+
+	if err = lc.StorageVolDelete(vol, 0); err != nil {
+		return fmt.Errorf("deleting volume: %w", err)
+	}
+
+	logger.Info("removed volume: " + volName)
+
+	return nil
+}
+
+// keepVol copies the volume to a new volume of the pool, unless a previous attempt already did.
+//
+// libvirt can't rename volumes, so the volume is copied before it is deleted. The retain policy copies the volume
+// in its own format, the snapshot-then-delete policy into a qcow2 volume, which only holds the allocated data
+// of the volume, without any backing file.
+func keepVol(lc LibvirtClient, poolName string, vol libvirt.StorageVol, retain, name string, logger *zap.Logger) error {
+	if _, err := getVol(lc, poolName, name); err == nil {
+		logger.Info("volume was kept already: " + name)
+
+		return nil
+	} else if !errors.Is(err, errVolNoExist) {
+		return fmt.Errorf("fetching volume %s: %w", name, err)
+	}
+
+	pool, err := lookupStoragePool(lc, poolName)
+	if err != nil {
+		return err
+	}
+
+	volXML, err := lc.StorageVolGetXMLDesc(vol, 0)
+	if err != nil {
+		return fmt.Errorf("error fetching XML of volume %q: %w", vol.Name, err)
+	}
+
+	var def libvirtxml.StorageVolume
+
+	if err = def.Unmarshal(volXML); err != nil {
+		return fmt.Errorf("error parsing XML of volume %q: %w", vol.Name, err)
+	}
+
+	if def.Capacity == nil || def.Target == nil || def.Target.Format == nil {
+		return fmt.Errorf("volume %q has no capacity or format", vol.Name)
+	}
+
+	format := def.Target.Format.Type
+
+	if retain == retainSnapshot {
+		if err = pool.checkSnapshot(); err != nil {
+			return err
+		}
+
+		format = diskFormatQcow2
+	}
+
+	kept := pool.volume(name, format, def.Capacity.Value)
+
+	keptXML, err := kept.Marshal()
+	if err != nil {
+		return fmt.Errorf("error rendering XML of volume %q: %w", name, err)
+	}
+
+	poolRef, err := lc.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return fmt.Errorf("error looking up storage pool: %w", err)
+	}
+
+	if _, err = lc.StorageVolCreateXMLFrom(poolRef, keptXML, vol, 0); err != nil {
+		return fmt.Errorf("error copying volume %s to %s: %w", vol.Name, name, err)
+	}
+
+	logger.Info("kept volume "+vol.Name, zap.String("as", name))
+
+	return nil
+}
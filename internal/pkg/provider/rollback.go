@@ -0,0 +1,151 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/controller"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/api/specs"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/resources"
+)
+
+// withRollback wraps the steps, so that a step which fails permanently removes the resources it created.
+//
+// Omni discards the machine state changes of a step which returns a non-retry error. Resources recorded in
+// the machine state by the failed run would be forgotten, and never removed by Deprovision. Resources
+// recorded by earlier, successful runs are kept: they are persisted, and are reused by the next attempt
+// or removed by Deprovision when the request is canceled.
+//
+// The placement reservation of the request is released as well. A step which fails while its host is
+// disconnected is retried instead.
+func (p *Provisioner) withRollback(steps []provision.Step[*resources.Machine]) []provision.Step[*resources.Machine] {
+	wrapped := make([]provision.Step[*resources.Machine], 0, len(steps))
+
+	for _, step := range steps {
+		wrapped = append(wrapped, provision.NewStep(
+			step.Name(),
+			func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+				before := pctx.State.TypedSpec().Value.CloneVT()
+
+				err := step.Run(ctx, logger, pctx)
+				if err == nil || isRetryError(err) {
+					return err
+				}
+
+				// the step failed because the connection was lost: its resources are kept for the next attempt
+				if _, clientErr := p.client(ctx, pctx.State.TypedSpec().Value.Host); isRetryError(clientErr) {
+					return provision.NewRetryErrorf(disconnectedRetryInterval, "%s: %w", clientErr, err)
+				}
+
+				if rollbackErr := p.rollback(ctx, logger, before, pctx.State.TypedSpec().Value); rollbackErr != nil {
+					err = fmt.Errorf("%w; rollback failed: %w", err, rollbackErr)
+				}
+
+				// mirror what Omni does with the state of a failed step
+				pctx.State.TypedSpec().Value = before
+
+				// the machine won't be created by this attempt, its capacity is available to the other requests
+				p.scheduler.Release(pctx.GetRequestID())
+
+				return err
+			},
+		))
+	}
+
+	return wrapped
+}
+
+// rollback removes the resources which are recorded in the current machine state, but not in the previous one.
+func (p *Provisioner) rollback(ctx context.Context, logger *zap.Logger, previous, current *specs.MachineSpec) error {
+	lc, err := p.client(ctx, current.Host)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	if current.VmName != "" && current.VmName != previous.VmName {
+		logger.Info("rolling back domain", zap.String("domain", current.VmName))
+
+		if err := removeDomain(lc, current.VmName, logger); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	known := make(map[string]struct{})
+
+	for _, volName := range machineVolumes(previous) {
+		known[volName] = struct{}{}
+	}
+
+	for _, volName := range machineVolumes(current) {
+		if _, ok := known[volName]; ok {
+			continue
+		}
+
+		// the volumes are new, they are deleted whatever the retain policy of their disk
+		logger.Info("rolling back volume", zap.String("volume", volName))
+
+		if err := removeVol(lc, current.PoolName, volName, retainDelete, time.Time{}, logger); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	knownSecrets := make(map[string]struct{})
+
+	for _, additionalDisk := range previous.AdditionalDisks {
+		knownSecrets[additionalDisk.SecretUuid] = struct{}{}
+	}
+
+	for _, additionalDisk := range current.AdditionalDisks {
+		if _, ok := knownSecrets[additionalDisk.SecretUuid]; ok || additionalDisk.SecretUuid == "" {
+			continue
+		}
+
+		logger.Info("rolling back secret", zap.String("secret", additionalDisk.SecretUuid))
+
+		if err := removeVolumeSecret(lc, additionalDisk.SecretUuid, logger); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// machineVolumes returns the names of the volumes created for the machine, as recorded in the machine state.
+//
+// The existing volumes attached to the machine are not included, they are never removed.
+func machineVolumes(spec *specs.MachineSpec) []string {
+	var volumes []string
+
+	if spec.VmVolName != "" {
+		volumes = append(volumes, spec.VmVolName)
+	}
+
+	for _, additionalDisk := range spec.AdditionalDisks {
+		if !additionalDisk.Existing {
+			volumes = append(volumes, additionalDisk.VolName)
+		}
+	}
+
+	if spec.CidataVolName != "" {
+		volumes = append(volumes, spec.CidataVolName)
+	}
+
+	return volumes
+}
+
+func isRetryError(err error) bool {
+	var requeueErr *controller.RequeueError
+
+	return errors.As(err, &requeueErr)
+}
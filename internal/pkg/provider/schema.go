@@ -0,0 +1,166 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Schema completes the provider data JSON schema with the configured hosts and the policy.
+//
+// The host field is limited to the host names, and the host selector has to match at least one host.
+// The fields with policy defaults are no longer required, and the storage pools and networks are limited
+// to the allowed ones.
+func Schema(base string, hosts []Host, policy Policy) (string, error) {
+	var schema map[string]any
+
+	if err := json.Unmarshal([]byte(base), &schema); err != nil {
+		return "", fmt.Errorf("error parsing schema: %w", err)
+	}
+
+	properties, ok := schema["properties"].(map[string]any)
+	if !ok {
+		return "", errors.New("schema has no properties")
+	}
+
+	names := make([]any, 0, len(hosts))
+	matchAny := make([]any, 0, len(hosts))
+
+	for _, host := range hosts {
+		names = append(names, host.Name)
+		matchAny = append(matchAny, selectorSchema(host.Labels))
+	}
+
+	if host, ok := properties["host"].(map[string]any); ok {
+		host["enum"] = names
+	}
+
+	if selector, ok := properties["host_selector"].(map[string]any); ok {
+		selector["anyOf"] = matchAny
+	}
+
+	if len(policy.AllowedPools) > 0 {
+		if pool, ok := properties["storage_pool"].(map[string]any); ok {
+			pool["enum"] = policy.AllowedPools
+		}
+
+		if pool, ok := lookup(properties, "additional_disks", "items", "properties", "pool"); ok {
+			pool["enum"] = policy.AllowedPools
+		}
+	}
+
+	if len(policy.AllowedNetworks) > 0 {
+		if network, ok := lookup(properties, "network_interfaces", "items", "properties", "network_name"); ok {
+			network["enum"] = policy.AllowedNetworks
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(policy.Defaults)) {
+		if property, ok := properties[key].(map[string]any); ok {
+			property["default"] = policy.Defaults[key]
+		}
+	}
+
+	if required, ok := schema["required"].([]any); ok {
+		schema["required"] = slices.DeleteFunc(required, func(key any) bool {
+			name, _ := key.(string) //nolint:errcheck
+
+			_, ok := policy.Defaults[name]
+
+			return ok
+		})
+	}
+
+	out, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// lookup returns the nested object at the path of keys.
+func lookup(object map[string]any, path ...string) (map[string]any, bool) {
+	for _, key := range path {
+		child, ok := object[key].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+
+		object = child
+	}
+
+	return object, true
+}
+
+// selectorSchema returns the JSON schema of the host selectors matching the labels, see hostSelector.matches.
+func selectorSchema(labels map[string]string) map[string]any {
+	keys := slices.Sorted(maps.Keys(labels))
+
+	matchLabels := make(map[string]any, len(labels))
+
+	for _, key := range keys {
+		matchLabels[key] = map[string]any{"const": labels[key]}
+	}
+
+	expression := func(properties map[string]any) map[string]any {
+		return map[string]any{"properties": properties}
+	}
+
+	op := func(operator string) map[string]any {
+		return map[string]any{"const": operator}
+	}
+
+	var expressions []any
+
+	for _, key := range keys {
+		expressions = append(expressions,
+			expression(map[string]any{
+				"key":      map[string]any{"const": key},
+				"operator": op(selectorOpIn),
+				"values":   map[string]any{"contains": map[string]any{"const": labels[key]}},
+			}),
+			expression(map[string]any{
+				"key":      map[string]any{"const": key},
+				"operator": op(selectorOpNotIn),
+				"values":   map[string]any{"not": map[string]any{"contains": map[string]any{"const": labels[key]}}},
+			}),
+		)
+	}
+
+	missingKey := map[string]any{}
+
+	if len(keys) > 0 {
+		missingKey = map[string]any{"not": map[string]any{"enum": keys}}
+
+		expressions = append(expressions, expression(map[string]any{
+			"key":      map[string]any{"enum": keys},
+			"operator": op(selectorOpExists),
+		}))
+	}
+
+	expressions = append(expressions,
+		expression(map[string]any{
+			"key":      missingKey,
+			"operator": map[string]any{"enum": []string{selectorOpNotIn, selectorOpDoesNotExist}},
+		}),
+	)
+
+	return map[string]any{
+		"properties": map[string]any{
+			"match_labels": map[string]any{
+				"properties":           matchLabels,
+				"additionalProperties": false,
+			},
+			"match_expressions": map[string]any{
+				"items": map[string]any{"anyOf": expressions},
+			},
+		},
+	}
+}
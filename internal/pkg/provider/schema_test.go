@@ -0,0 +1,241 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+// compileSchema generates the provider data schema for the hosts of the test env and the policy.
+func compileSchema(t *testing.T, policy provider.Policy) *jsonschema.Schema {
+	t.Helper()
+
+	base, err := os.ReadFile("../../../cmd/omni-infra-provider-libvirt/data/schema.json")
+	require.NoError(t, err)
+
+	env := newTestEnv(t, testProviderData)
+
+	raw, err := provider.Schema(string(base), env.hosts(), policy)
+	require.NoError(t, err)
+
+	doc, err := jsonschema.UnmarshalJSON(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	compiler := jsonschema.NewCompiler()
+	require.NoError(t, compiler.AddResource("schema.json", doc))
+
+	schema, err := compiler.Compile("schema.json")
+	require.NoError(t, err)
+
+	return schema
+}
+
+// validate validates the provider data against the schema.
+func validate(t *testing.T, schema *jsonschema.Schema, providerData string) error {
+	t.Helper()
+
+	var data map[string]any
+
+	require.NoError(t, yaml.Unmarshal([]byte(providerData), &data))
+
+	// normalize the values to what the JSON decoder produces
+	encoded, err := json.Marshal(data)
+	require.NoError(t, err)
+
+	value, err := jsonschema.UnmarshalJSON(bytes.NewReader(encoded))
+	require.NoError(t, err)
+
+	return schema.Validate(value)
+}
+
+func TestSchema(t *testing.T) {
+	schema := compileSchema(t, provider.Policy{})
+
+	for _, tt := range []struct {
+		name  string
+		data  string
+		valid bool
+	}{
+		{
+			name:  "no selector",
+			valid: true,
+		},
+		{
+			name:  "known host",
+			data:  "host: secondary",
+			valid: true,
+		},
+		{
+			name: "unknown host",
+			data: "host: missing",
+		},
+		{
+			name:  "matching labels",
+			data:  "host_selector:\n  match_labels:\n    rack: b\n    storage: nvme",
+			valid: true,
+		},
+		{
+			name: "labels of different hosts",
+			data: "host_selector:\n  match_labels:\n    rack: a\n    storage: nvme",
+		},
+		{
+			name: "unknown label",
+			data: "host_selector:\n  match_labels:\n    gpu: 'true'",
+		},
+		{
+			name:  "matching expressions",
+			data:  "host_selector:\n  match_expressions:\n    - {key: rack, operator: In, values: [b, c]}\n    - {key: gpu, operator: DoesNotExist}",
+			valid: true,
+		},
+		{
+			name: "expressions matching different hosts",
+			data: "host_selector:\n  match_expressions:\n    - {key: rack, operator: In, values: [a]}\n    - {key: storage, operator: NotIn, values: [hdd]}",
+		},
+		{
+			name: "expression matching no host",
+			data: "host_selector:\n  match_expressions:\n    - {key: gpu, operator: Exists}",
+		},
+		{
+			name:  "disk driver",
+			data:  "disk_driver:\n  cache: writeback\n  io: io_uring\n  discard: unmap\n  iothreads: 1",
+			valid: true,
+		},
+		{
+			name:  "existing volume",
+			data:  "additional_disks:\n  - type: virtio-blk\n    volume: dataset\n    pool: backups",
+			valid: true,
+		},
+		{
+			name:  "retain policies",
+			data:  "retain: snapshot-then-delete\nadditional_disks:\n  - type: virtio-blk\n    size: 10\n    retain: retain",
+			valid: true,
+		},
+		{
+			name: "unknown retain policy",
+			data: "retain: keep",
+		},
+		{
+			name: "retain of an existing volume",
+			data: "additional_disks:\n  - type: virtio-blk\n    volume: dataset\n    retain: delete",
+		},
+		{
+			name:  "snapshots",
+			data:  "snapshots:\n  interval: 1h30m\n  keep: 24\n  memory: true",
+			valid: true,
+		},
+		{
+			name: "snapshots without keep",
+			data: "snapshots:\n  interval: 6h",
+		},
+		{
+			name: "invalid snapshot interval",
+			data: "snapshots:\n  interval: daily\n  keep: 7",
+		},
+		{
+			name:  "encrypted disk",
+			data:  "additional_disks:\n  - type: virtio-blk\n    size: 10\n    encrypted: true\n    retain: delete",
+			valid: true,
+		},
+		{
+			name: "encrypted existing volume",
+			data: "additional_disks:\n  - type: virtio-blk\n    volume: dataset\n    encrypted: true",
+		},
+		{
+			name: "retained encrypted disk",
+			data: "additional_disks:\n  - type: virtio-blk\n    size: 10\n    encrypted: true\n    retain: retain",
+		},
+		{
+			name: "existing volume and block device",
+			data: "additional_disks:\n  - type: virtio-blk\n    volume: dataset\n    block_device: /dev/vg1/data",
+		},
+		{
+			name: "new disk without size",
+			data: "additional_disks:\n  - type: virtio-blk",
+		},
+		{
+			name:  "disk iotune",
+			data:  "disk_iotune:\n  total_bytes_sec: 1048576\n  total_bytes_sec_max: 2097152\n  total_bytes_sec_max_length: 10",
+			valid: true,
+		},
+		{
+			name: "disk iotune burst without limit",
+			data: "disk_iotune:\n  read_iops_sec_max: 100",
+		},
+		{
+			name: "disk iotune total and write limits",
+			data: "additional_disks:\n  - type: nvme\n    size: 20\n    iotune:\n      total_bytes_sec: 100\n      write_bytes_sec: 50",
+		},
+		{
+			name: "unknown disk cache mode",
+			data: "additional_disks:\n  - type: nvme\n    size: 20\n    driver:\n      cache: fast",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(t, schema, testProviderData+tt.data)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestSchemaPolicy(t *testing.T) {
+	schema := compileSchema(t, provider.Policy{
+		Defaults:        map[string]any{"storage_pool": testPool, "disk_size": 20},
+		AllowedPools:    []string{testPool, "fast"},
+		AllowedNetworks: []string{"default"},
+	})
+
+	for _, tt := range []struct {
+		name  string
+		data  string
+		valid bool
+	}{
+		{
+			name:  "defaults are not required",
+			data:  "cores: 2\nmemory: 4096\n",
+			valid: true,
+		},
+		{
+			name:  "allowed storage pool",
+			data:  "cores: 2\nmemory: 4096\nstorage_pool: fast\n",
+			valid: true,
+		},
+		{
+			name: "storage pool not allowed",
+			data: "cores: 2\nmemory: 4096\nstorage_pool: other\n",
+		},
+		{
+			name: "network not allowed",
+			data: "cores: 2\nmemory: 4096\nnetwork_interfaces:\n  - driver: virtio\n    network_name: isolated\n",
+		},
+		{
+			name: "fields without defaults are required",
+			data: "cores: 2\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(t, schema, tt.data)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,569 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// scheduledSnapshotPrefix is the prefix of the names of the snapshots taken by the schedules, followed by their time.
+	scheduledSnapshotPrefix = "scheduled-"
+	// manualSnapshotPrefix is the prefix of the default names of the on-demand snapshots.
+	manualSnapshotPrefix = "manual-"
+	snapshotTimeFormat   = "20060102T150405Z"
+	// snapshotCheckInterval is how often the snapshot schedules are checked.
+	snapshotCheckInterval = time.Minute
+	// minSnapshotLibVersion is the first libvirt version which deletes external snapshots, 9.0.0.
+	minSnapshotLibVersion = 9_000_000
+	// snapshotRetryInterval is the retry interval of the deprovisioning while the snapshots can't be deleted.
+	snapshotRetryInterval = time.Minute
+)
+
+// snapshotNamePattern matches the snapshot names, which are part of the names of the overlay files.
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// VMSnapshot is a snapshot of a VM.
+type VMSnapshot struct {
+	Name   string `json:"name"`
+	VM     string `json:"vm"`
+	Host   string `json:"host"`
+	Parent string `json:"parent,omitempty"`
+	// State is the state of the VM when the snapshot was taken.
+	State        string    `json:"state"`
+	CreationTime time.Time `json:"creation_time"`
+	// Disks are the targets of the disks in the snapshot.
+	Disks  []string `json:"disks"`
+	Memory bool     `json:"memory"`
+}
+
+// SnapshotOptions are the options of an on-demand snapshot.
+type SnapshotOptions struct {
+	// Name defaults to manual-<time>.
+	Name string
+	// Memory saves the memory of the running VM along with its disks.
+	Memory bool
+}
+
+// CreateSnapshot takes an external snapshot of the disks of the VM, and of its memory if requested.
+//
+// The disks keep their images as the snapshot, and continue on new qcow2 overlay files next to them.
+// Only the disks backed by files are included, the cidata cdrom and the other disks are left out.
+func (p *Provisioner) CreateSnapshot(ctx context.Context, vmName string, opts SnapshotOptions) (VMSnapshot, error) {
+	name := cmp.Or(opts.Name, manualSnapshotPrefix+time.Now().UTC().Format(snapshotTimeFormat))
+
+	if !snapshotNamePattern.MatchString(name) {
+		return VMSnapshot{}, fmt.Errorf("invalid snapshot name %q, only letters, digits, '.', '_' and '-' are allowed", name)
+	}
+
+	if strings.HasPrefix(name, scheduledSnapshotPrefix) {
+		return VMSnapshot{}, fmt.Errorf("invalid snapshot name %q, the %q prefix is reserved for the scheduled snapshots", name, scheduledSnapshotPrefix)
+	}
+
+	host, lc, dom, err := p.managedDomain(ctx, vmName)
+	if err != nil {
+		return VMSnapshot{}, err
+	}
+
+	if err = checkSnapshotSupport(lc); err != nil {
+		return VMSnapshot{}, fmt.Errorf("libvirt host %q: %w", host.Name, err)
+	}
+
+	snap, err := createSnapshot(lc, dom, name, opts.Memory)
+	if err != nil {
+		return VMSnapshot{}, err
+	}
+
+	return describeSnapshot(lc, host.Name, snap)
+}
+
+// Snapshots lists the snapshots of the VM, oldest first.
+func (p *Provisioner) Snapshots(ctx context.Context, vmName string) ([]VMSnapshot, error) {
+	host, lc, dom, err := p.managedDomain(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	snaps, _, err := lc.DomainListAllSnapshots(dom, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error listing snapshots: %w", err)
+	}
+
+	snapshots := make([]VMSnapshot, 0, len(snaps))
+
+	for _, snap := range snaps {
+		snapshot, err := describeSnapshot(lc, host.Name, snap)
+		if err != nil {
+			if isSnapshotNotFound(err) {
+				// deleted in the meantime
+				continue
+			}
+
+			return nil, err
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	slices.SortFunc(snapshots, func(a, b VMSnapshot) int {
+		return cmp.Or(a.CreationTime.Compare(b.CreationTime), cmp.Compare(a.Name, b.Name))
+	})
+
+	return snapshots, nil
+}
+
+// DeleteSnapshot deletes the snapshot of the VM.
+//
+// libvirt merges the overlay files of the snapshot into the images below, and removes them.
+func (p *Provisioner) DeleteSnapshot(ctx context.Context, vmName, name string) error {
+	_, lc, dom, err := p.managedDomain(ctx, vmName)
+	if err != nil {
+		return err
+	}
+
+	snap, err := lc.DomainSnapshotLookupByName(dom, name, 0)
+	if err != nil {
+		return fmt.Errorf("error looking up snapshot %q: %w", name, err)
+	}
+
+	if err = lc.DomainSnapshotDelete(snap, 0); err != nil {
+		return fmt.Errorf("error deleting snapshot %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// RunSnapshots takes the scheduled snapshots of the VMs until the context is canceled.
+func (p *Provisioner) RunSnapshots(ctx context.Context, logger *zap.Logger) error {
+	ticker := time.NewTicker(snapshotCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := p.TakeScheduledSnapshots(ctx, logger, now); err != nil {
+				logger.Warn("failed to take the scheduled snapshots", zap.Error(err))
+			}
+		}
+	}
+}
+
+// TakeScheduledSnapshots takes a snapshot of each running VM with a snapshot schedule, if the last scheduled one
+// is older than the interval of the schedule at the given time, and deletes the oldest scheduled snapshots
+// beyond the number of snapshots the schedule keeps.
+//
+// The schedules are read from the domain metadata, and the time of the scheduled snapshots from their names.
+// The hosts and the VMs which fail are reported in the error, the other ones are still handled.
+func (p *Provisioner) TakeScheduledSnapshots(ctx context.Context, logger *zap.Logger, now time.Time) error {
+	var errs []error
+
+	for _, host := range p.hostList() {
+		if err := takeScheduledSnapshots(ctx, logger, host, now); err != nil {
+			errs = append(errs, fmt.Errorf("libvirt host %q: %w", host.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func takeScheduledSnapshots(ctx context.Context, logger *zap.Logger, host Host, now time.Time) error {
+	lc, err := hostClient(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	domains, _, err := lc.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive)
+	if err != nil {
+		return fmt.Errorf("error listing domains: %w", err)
+	}
+
+	var errs []error
+
+	for _, dom := range domains {
+		owner, managed, err := domainOwnerOf(lc, dom)
+		if err != nil {
+			if !libvirt.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("error reading metadata of domain %q: %w", dom.Name, err))
+			}
+
+			continue
+		}
+
+		if !managed || owner.Snapshots == nil {
+			continue
+		}
+
+		if err = scheduleSnapshot(lc, logger, dom, *owner.Snapshots, now); err != nil {
+			errs = append(errs, fmt.Errorf("domain %q: %w", dom.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// scheduledSnapshot is a snapshot taken by the schedule of the domain.
+type scheduledSnapshot struct {
+	taken time.Time
+	snap  libvirt.DomainSnapshot
+}
+
+func scheduleSnapshot(lc LibvirtClient, logger *zap.Logger, dom libvirt.Domain, schedule snapshotSchedule, now time.Time) error {
+	interval, err := schedule.interval()
+	if err != nil {
+		return err
+	}
+
+	snaps, _, err := lc.DomainListAllSnapshots(dom, 1, 0)
+	if err != nil {
+		return fmt.Errorf("error listing snapshots: %w", err)
+	}
+
+	var scheduled []scheduledSnapshot
+
+	for _, snap := range snaps {
+		timestamp, ok := strings.CutPrefix(snap.Name, scheduledSnapshotPrefix)
+		if !ok {
+			continue
+		}
+
+		taken, err := time.Parse(snapshotTimeFormat, timestamp)
+		if err != nil {
+			continue
+		}
+
+		scheduled = append(scheduled, scheduledSnapshot{taken: taken, snap: snap})
+	}
+
+	slices.SortFunc(scheduled, func(a, b scheduledSnapshot) int { return a.taken.Compare(b.taken) })
+
+	if len(scheduled) == 0 || !now.Before(scheduled[len(scheduled)-1].taken.Add(interval)) {
+		if err = checkSnapshotSupport(lc); err != nil {
+			return err
+		}
+
+		name := scheduledSnapshotPrefix + now.UTC().Format(snapshotTimeFormat)
+
+		snap, err := createSnapshot(lc, dom, name, schedule.Memory)
+		if err != nil {
+			return err
+		}
+
+		logger.Info("took scheduled snapshot", zap.String("domain", dom.Name), zap.String("snapshot", name))
+
+		scheduled = append(scheduled, scheduledSnapshot{taken: now, snap: snap})
+	}
+
+	for len(scheduled) > int(schedule.Keep) {
+		oldest := scheduled[0]
+
+		if err = lc.DomainSnapshotDelete(oldest.snap, 0); err != nil {
+			return fmt.Errorf("error deleting snapshot %q: %w", oldest.snap.Name, err)
+		}
+
+		logger.Info("deleted scheduled snapshot", zap.String("domain", dom.Name), zap.String("snapshot", oldest.snap.Name))
+
+		scheduled = scheduled[1:]
+	}
+
+	return nil
+}
+
+// managedDomain looks up the domain managed by the provider with the given name on all the hosts.
+func (p *Provisioner) managedDomain(ctx context.Context, name string) (Host, LibvirtClient, libvirt.Domain, error) {
+	var errs []error
+
+	for _, host := range p.hostList() {
+		lc, err := hostClient(ctx, host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("libvirt host %q: %w", host.Name, err))
+
+			continue
+		}
+
+		dom, err := lc.DomainLookupByName(name)
+		if err != nil {
+			if !libvirt.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("libvirt host %q: error looking up domain: %w", host.Name, err))
+			}
+
+			continue
+		}
+
+		_, managed, err := domainOwnerOf(lc, dom)
+		if err != nil {
+			if !libvirt.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("libvirt host %q: error reading metadata of domain: %w", host.Name, err))
+			}
+
+			continue
+		}
+
+		if managed {
+			return host, lc, dom, nil
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return Host{}, nil, libvirt.Domain{}, err
+	}
+
+	return Host{}, nil, libvirt.Domain{}, fmt.Errorf("%w: %q", ErrVMNotFound, name)
+}
+
+// createSnapshot takes the external snapshot of the domain, see CreateSnapshot.
+func createSnapshot(lc LibvirtClient, dom libvirt.Domain, name string, memory bool) (libvirt.DomainSnapshot, error) {
+	raw, err := lc.DomainGetXMLDesc(dom, 0)
+	if err != nil {
+		return libvirt.DomainSnapshot{}, fmt.Errorf("error fetching domain XML: %w", err)
+	}
+
+	var def libvirtxml.Domain
+
+	if err = def.Unmarshal(raw); err != nil {
+		return libvirt.DomainSnapshot{}, fmt.Errorf("error parsing domain XML: %w", err)
+	}
+
+	if memory {
+		state, _, err := lc.DomainGetState(dom, 0)
+		if err != nil {
+			return libvirt.DomainSnapshot{}, fmt.Errorf("error fetching domain state: %w", err)
+		}
+
+		if state != int32(libvirt.DomainRunning) && state != int32(libvirt.DomainPaused) {
+			return libvirt.DomainSnapshot{}, fmt.Errorf("the memory can't be saved, the VM is %s", domainStateName(libvirt.DomainState(state)))
+		}
+	}
+
+	snapshotXML, err := snapshotXML(lc, def, name, memory)
+	if err != nil {
+		return libvirt.DomainSnapshot{}, err
+	}
+
+	flags := libvirt.DomainSnapshotCreateAtomic
+
+	if !memory {
+		flags |= libvirt.DomainSnapshotCreateDiskOnly
+	}
+
+	snap, err := lc.DomainSnapshotCreateXML(dom, snapshotXML, uint32(flags))
+	if err != nil {
+		return libvirt.DomainSnapshot{}, fmt.Errorf("error creating snapshot %q: %w", name, err)
+	}
+
+	return snap, nil
+}
+
+// snapshotXML renders the snapshot of the domain.
+//
+// The overlay files of the disks are named <domain>-<target>.<snapshot>, and the memory file <domain>.<snapshot>.mem,
+// in the directory of the current image of the disk, and of the first disk. The names don't match volumeNamePattern.
+func snapshotXML(lc LibvirtClient, def libvirtxml.Domain, name string, memory bool) (string, error) {
+	snapshot := libvirtxml.DomainSnapshot{
+		Name:  name,
+		Disks: &libvirtxml.DomainSnapshotDisks{},
+	}
+
+	var memoryDir string
+
+	if def.Devices != nil {
+		for _, disk := range def.Devices.Disks {
+			if disk.Target == nil {
+				continue
+			}
+
+			dir, err := snapshotDir(lc, disk)
+			if err != nil {
+				return "", fmt.Errorf("disk %s: %w", disk.Target.Dev, err)
+			}
+
+			if dir == "" {
+				snapshot.Disks.Disks = append(snapshot.Disks.Disks, libvirtxml.DomainSnapshotDisk{
+					Name:     disk.Target.Dev,
+					Snapshot: "no",
+				})
+
+				continue
+			}
+
+			memoryDir = cmp.Or(memoryDir, dir)
+
+			snapshot.Disks.Disks = append(snapshot.Disks.Disks, libvirtxml.DomainSnapshotDisk{
+				Name:     disk.Target.Dev,
+				Snapshot: "external",
+				Driver:   &libvirtxml.DomainDiskDriver{Type: diskFormatQcow2},
+				Source: &libvirtxml.DomainDiskSource{
+					File: &libvirtxml.DomainDiskSourceFile{
+						File: path.Join(dir, fmt.Sprintf("%s-%s.%s", def.Name, disk.Target.Dev, name)),
+					},
+				},
+			})
+		}
+	}
+
+	if memoryDir == "" {
+		return "", errors.New("no disk of the VM is backed by a file, snapshots require a storage pool of files, e.g. dir")
+	}
+
+	snapshot.Memory = &libvirtxml.DomainSnapshotMemory{Snapshot: "no"}
+
+	if memory {
+		snapshot.Memory = &libvirtxml.DomainSnapshotMemory{
+			Snapshot: "external",
+			File:     path.Join(memoryDir, fmt.Sprintf("%s.%s.mem", def.Name, name)),
+		}
+	}
+
+	return snapshot.Marshal()
+}
+
+// snapshotDir returns the directory of the overlay file of the disk, or an empty string if the disk is left out
+// of the snapshots: the read-only disks, the disks which are not files, and the encrypted disks, whose overlays
+// would hold their new data in plaintext.
+func snapshotDir(lc LibvirtClient, disk libvirtxml.DomainDisk) (string, error) {
+	if disk.Device == "cdrom" || disk.ReadOnly != nil || disk.Source == nil || disk.Source.Encryption != nil {
+		return "", nil
+	}
+
+	switch {
+	case disk.Source.File != nil:
+		// the overlay of a previous snapshot
+		return path.Dir(disk.Source.File.File), nil
+	case disk.Source.Volume != nil:
+		pool, err := lookupVolumePool(lc, disk.Source.Volume.Pool)
+		if err != nil {
+			return "", err
+		}
+
+		if pool.poolType.kind != poolFile || pool.Target == nil || pool.Target.Path == "" {
+			return "", nil
+		}
+
+		return pool.Target.Path, nil
+	default:
+		return "", nil
+	}
+}
+
+func describeSnapshot(lc LibvirtClient, hostName string, snap libvirt.DomainSnapshot) (VMSnapshot, error) {
+	raw, err := lc.DomainSnapshotGetXMLDesc(snap, 0)
+	if err != nil {
+		return VMSnapshot{}, fmt.Errorf("error fetching XML of snapshot %q: %w", snap.Name, err)
+	}
+
+	var def libvirtxml.DomainSnapshot
+
+	if err = def.Unmarshal(raw); err != nil {
+		return VMSnapshot{}, fmt.Errorf("error parsing XML of snapshot %q: %w", snap.Name, err)
+	}
+
+	snapshot := VMSnapshot{
+		Name:   snap.Name,
+		VM:     snap.Dom.Name,
+		Host:   hostName,
+		State:  def.State,
+		Disks:  []string{},
+		Memory: def.Memory != nil && def.Memory.Snapshot == "external",
+	}
+
+	if def.Parent != nil {
+		snapshot.Parent = def.Parent.Name
+	}
+
+	if created, err := strconv.ParseInt(def.CreationTime, 10, 64); err == nil {
+		snapshot.CreationTime = time.Unix(created, 0).UTC()
+	}
+
+	if def.Disks != nil {
+		for _, disk := range def.Disks.Disks {
+			if disk.Snapshot == "external" {
+				snapshot.Disks = append(snapshot.Disks, disk.Name)
+			}
+		}
+	}
+
+	return snapshot, nil
+}
+
+// checkSnapshotSupport checks that the libvirt host can delete the external snapshots, before any is taken:
+// the machines with snapshots couldn't be deprovisioned otherwise.
+func checkSnapshotSupport(lc LibvirtClient) error {
+	version, err := lc.ConnectGetLibVersion()
+	if err != nil {
+		return fmt.Errorf("error getting libvirt version: %w", err)
+	}
+
+	if version < minSnapshotLibVersion {
+		return fmt.Errorf("snapshots need libvirt %s or newer to be deleted, the libvirt host runs %s",
+			formatLibVersion(minSnapshotLibVersion), formatLibVersion(version))
+	}
+
+	return nil
+}
+
+// formatLibVersion formats the libvirt version, which is major * 1,000,000 + minor * 1,000 + release.
+func formatLibVersion(version uint64) string {
+	return fmt.Sprintf("%d.%d.%d", version/1_000_000, version/1_000%1_000, version%1_000)
+}
+
+// removeSnapshots deletes the snapshots of the domain, newest first: libvirt merges the overlay files of each
+// snapshot into the images below, so that the volumes of the machine hold all of its data again.
+//
+// The errors are retried, with the libvirt error code, e.g. the host was downgraded below the version which deletes
+// the external snapshots.
+func removeSnapshots(lc LibvirtClient, dom libvirt.Domain, logger *zap.Logger) error {
+	for {
+		leaves, _, err := lc.DomainListAllSnapshots(dom, 1, uint32(libvirt.DomainSnapshotListLeaves))
+		if err != nil {
+			return retrySnapshotError("listing snapshots", err)
+		}
+
+		if len(leaves) == 0 {
+			return nil
+		}
+
+		for _, snap := range leaves {
+			if err = lc.DomainSnapshotDelete(snap, 0); err != nil {
+				return retrySnapshotError("deleting snapshot "+snap.Name, err)
+			}
+
+			logger.Info("deleted snapshot " + snap.Name)
+		}
+	}
+}
+
+// retrySnapshotError retries the deprovisioning on the snapshot error, with its libvirt error code.
+func retrySnapshotError(op string, err error) error {
+	var libvirtErr libvirt.Error
+
+	if errors.As(err, &libvirtErr) {
+		code := libvirt.ErrorNumber(libvirtErr.Code)
+
+		return provision.NewRetryErrorf(snapshotRetryInterval, "%s: libvirt error %s (%d): %w", op, code, libvirtErr.Code, err)
+	}
+
+	return provision.NewRetryErrorf(snapshotRetryInterval, "%s: %w", op, err)
+}
+
+func isSnapshotNotFound(err error) bool {
+	var libvirtErr libvirt.Error
+
+	return errors.As(err, &libvirtErr) && libvirtErr.Code == uint32(libvirt.ErrNoDomainSnapshot)
+}
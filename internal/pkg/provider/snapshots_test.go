@@ -0,0 +1,288 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"cmp"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+// withSnapshots returns the provider data with an additional disk and the snapshot schedule.
+func withSnapshots(schedule string) string {
+	return withStoragePool(testPool) + "snapshots:\n" + schedule
+}
+
+// snapshotNames returns the names of the snapshots of the test domain, in the order they were taken.
+func snapshotNames(t *testing.T, env *testEnv) []string {
+	t.Helper()
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+
+	names := make([]string, 0, len(dom.Snapshots))
+
+	for _, snap := range dom.Snapshots {
+		names = append(names, snap.Name)
+	}
+
+	return names
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withStoragePool(testPool))
+	env.runSteps(t, "startVM")
+
+	snapshot, err := env.provisioner.CreateSnapshot(t.Context(), testRequestID, provider.SnapshotOptions{Name: "before-upgrade"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "before-upgrade", snapshot.Name)
+	assert.Equal(t, testRequestID, snapshot.VM)
+	assert.Equal(t, "running", snapshot.State)
+	assert.Equal(t, []string{"vda", "nvme0n1"}, snapshot.Disks)
+	assert.False(t, snapshot.Memory)
+	assert.Empty(t, snapshot.Parent)
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+	require.Len(t, dom.Snapshots, 1)
+
+	def := dom.Snapshots[0].Definition
+	require.Len(t, def.Disks.Disks, 3)
+
+	assert.Equal(t, libvirtxml.DomainSnapshotDisk{
+		Name:     "vda",
+		Snapshot: "external",
+		Driver:   &libvirtxml.DomainDiskDriver{Type: "qcow2"},
+		Source: &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{File: "/var/lib/libvirt/images/" + testRequestID + "-vda.before-upgrade"},
+		},
+	}, def.Disks.Disks[0])
+	assert.Equal(t, "sda", def.Disks.Disks[2].Name)
+	assert.Equal(t, "no", def.Disks.Disks[2].Snapshot, "the cidata cdrom is left out")
+	assert.Equal(t, "no", def.Memory.Snapshot)
+
+	snapshot, err = env.provisioner.CreateSnapshot(t.Context(), testRequestID, provider.SnapshotOptions{Memory: true})
+	require.NoError(t, err)
+
+	assert.Regexp(t, `^manual-\d{8}T\d{6}Z$`, snapshot.Name)
+	assert.True(t, snapshot.Memory)
+	assert.Equal(t, "before-upgrade", snapshot.Parent)
+
+	dom, ok = env.lv.Domain(testRequestID)
+	require.True(t, ok)
+	assert.Equal(t, "/var/lib/libvirt/images/"+testRequestID+"."+snapshot.Name+".mem", dom.Snapshots[1].Definition.Memory.File)
+
+	snapshots, err := env.provisioner.Snapshots(t.Context(), testRequestID)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, "before-upgrade", snapshots[0].Name)
+
+	require.NoError(t, env.provisioner.DeleteSnapshot(t.Context(), testRequestID, "before-upgrade"))
+
+	snapshots, err = env.provisioner.Snapshots(t.Context(), testRequestID)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Empty(t, snapshots[0].Parent)
+
+	require.ErrorContains(t, env.provisioner.DeleteSnapshot(t.Context(), testRequestID, "before-upgrade"), "Domain snapshot not found")
+}
+
+func TestCreateSnapshotErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name     string
+		data     string
+		pool     *libvirtxml.StoragePool
+		step     string
+		vm       string
+		opts     provider.SnapshotOptions
+		expected string
+	}{
+		{
+			name:     "invalid name",
+			opts:     provider.SnapshotOptions{Name: "../etc"},
+			expected: `invalid snapshot name "../etc"`,
+		},
+		{
+			name:     "reserved name",
+			opts:     provider.SnapshotOptions{Name: "scheduled-20261018T120000Z"},
+			expected: `the "scheduled-" prefix is reserved for the scheduled snapshots`,
+		},
+		{
+			name:     "unknown VM",
+			vm:       "request-0",
+			expected: `VM not found: "request-0"`,
+		},
+		{
+			name:     "memory of a stopped VM",
+			step:     "createVM",
+			opts:     provider.SnapshotOptions{Memory: true},
+			expected: "the memory can't be saved, the VM is shutoff",
+		},
+		{
+			name:     "no file disks",
+			data:     withStoragePool(testLogicalPool.Name),
+			pool:     &testLogicalPool,
+			expected: "snapshots require a storage pool of files",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := newTestEnv(t, cmp.Or(tt.data, withStoragePool(testPool)))
+
+			if tt.pool != nil {
+				env.lv.DefinePool(*tt.pool)
+			}
+
+			env.runSteps(t, cmp.Or(tt.step, "startVM"))
+
+			_, err := env.provisioner.CreateSnapshot(t.Context(), cmp.Or(tt.vm, testRequestID), tt.opts)
+			require.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestScheduledSnapshots(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withSnapshots("  interval: 1h\n  keep: 2\n"))
+	env.runSteps(t, "startVM")
+
+	dom, ok := env.lv.Domain(testRequestID)
+	require.True(t, ok)
+	assert.Contains(t, dom.Definition.Metadata.XML, `<omni:snapshots interval="1h" keep="2"/>`)
+
+	_, err := env.provisioner.CreateSnapshot(t.Context(), testRequestID, provider.SnapshotOptions{Name: "manual"})
+	require.NoError(t, err)
+
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	for _, tick := range []struct {
+		expected []string
+		after    time.Duration
+	}{
+		{
+			after:    0,
+			expected: []string{"manual", "scheduled-20261018T120000Z"},
+		},
+		{
+			after:    30 * time.Minute,
+			expected: []string{"manual", "scheduled-20261018T120000Z"},
+		},
+		{
+			after:    time.Hour,
+			expected: []string{"manual", "scheduled-20261018T120000Z", "scheduled-20261018T130000Z"},
+		},
+		{
+			// the oldest scheduled snapshot is deleted, the on-demand one is kept
+			after:    2*time.Hour + 30*time.Second,
+			expected: []string{"manual", "scheduled-20261018T130000Z", "scheduled-20261018T140030Z"},
+		},
+	} {
+		require.NoError(t, env.provisioner.TakeScheduledSnapshots(t.Context(), zaptest.NewLogger(t), start.Add(tick.after)))
+		assert.Equal(t, tick.expected, snapshotNames(t, env), tick.after)
+	}
+}
+
+func TestScheduledSnapshotsSkipped(t *testing.T) {
+	t.Parallel()
+
+	// no schedule
+	env := newTestEnv(t, withStoragePool(testPool))
+	env.runSteps(t, "startVM")
+
+	require.NoError(t, env.provisioner.TakeScheduledSnapshots(t.Context(), zaptest.NewLogger(t), time.Now()))
+	assert.Empty(t, snapshotNames(t, env))
+
+	// stopped
+	env = newTestEnv(t, withSnapshots("  interval: 1h\n  keep: 2\n  memory: true\n"))
+	env.runSteps(t, "createVM")
+
+	require.NoError(t, env.provisioner.TakeScheduledSnapshots(t.Context(), zaptest.NewLogger(t), time.Now()))
+	assert.Empty(t, snapshotNames(t, env))
+}
+
+func TestDeprovisionSnapshots(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withSnapshots("  interval: 1h\n  keep: 3\n"))
+	env.runSteps(t, "startVM")
+
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	for i := range 3 {
+		require.NoError(t, env.provisioner.TakeScheduledSnapshots(t.Context(), zaptest.NewLogger(t), start.Add(time.Duration(i)*time.Hour)))
+	}
+
+	require.Len(t, snapshotNames(t, env), 3)
+
+	deprovision := func() error {
+		return env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request)
+	}
+
+	// the running domain is destroyed first
+	require.True(t, isRetry(deprovision()))
+	require.NoError(t, deprovision())
+
+	assert.Equal(t, 3, env.lv.Calls("DomainSnapshotDelete"))
+	assert.Empty(t, env.lv.Domains())
+	assert.Empty(t, env.lv.Volumes(testPool))
+}
+
+func TestSnapshotsLibvirtTooOld(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withSnapshots("  interval: 1h\n  keep: 2\n"))
+	env.runSteps(t, "startVM")
+
+	// e.g. the host was downgraded after the machine was created
+	env.lv.SetLibVersion(8_010_002)
+
+	_, err := env.provisioner.CreateSnapshot(t.Context(), testRequestID, provider.SnapshotOptions{})
+	require.EqualError(t, err, `libvirt host "default": snapshots need libvirt 9.0.0 or newer to be deleted, the libvirt host runs 8.10.2`)
+
+	err = env.provisioner.TakeScheduledSnapshots(t.Context(), zaptest.NewLogger(t), time.Now())
+	require.ErrorContains(t, err, "the libvirt host runs 8.10.2")
+	assert.Empty(t, snapshotNames(t, env))
+}
+
+func TestDeprovisionSnapshotsUnsupported(t *testing.T) {
+	t.Parallel()
+
+	env := newTestEnv(t, withSnapshots("  interval: 1h\n  keep: 2\n"))
+	env.runSteps(t, "createVM")
+
+	_, err := env.provisioner.CreateSnapshot(t.Context(), testRequestID, provider.SnapshotOptions{Name: "stopped"})
+	require.NoError(t, err)
+
+	env.lv.InjectError("DomainSnapshotDelete", 0, libvirt.Error{
+		Code:    uint32(libvirt.ErrOperationUnsupported),
+		Message: "Operation not supported: deletion of 1 external disk snapshots not supported",
+	})
+
+	deprovision := func() error {
+		return env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request)
+	}
+
+	err = deprovision()
+	require.True(t, isRetry(err), "expected retry error, got %v", err)
+	assert.ErrorContains(t, err, "deleting snapshot stopped: libvirt error ErrOperationUnsupported (84)")
+
+	require.NoError(t, deprovision())
+	assert.Empty(t, env.lv.Domains())
+}
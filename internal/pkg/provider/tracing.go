@@ -0,0 +1,104 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans of the provider.
+const tracerName = "github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+
+// Span attributes.
+const (
+	attrRequestID    = "omni.machine_request.id"
+	attrStep         = "omni.provision.step"
+	attrRetry        = "omni.provision.retry"
+	attrHost         = "libvirt.host"
+	attrSchematicID  = "talos.schematic.id"
+	attrTalosVersion = "talos.version"
+	attrImageFormat  = "talos.image.format"
+	attrCacheHit     = "image_cache.hit"
+	attrBytes        = "bytes"
+	attrDecodeTime   = "image.decode_seconds"
+)
+
+// tracer returns the tracer of the global tracer provider, which is set up by the provider command.
+//
+// It is looked up on each use, so that the tests can replace the tracer provider.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// requestSpans are the root spans of the provisioning of the machine requests.
+//
+// The provision steps run separately, the root span of a request is started by its first step run, and is the parent
+// of the spans of the steps. It is ended once the last step succeeds, a step fails, or the request is deprovisioned.
+type requestSpans struct {
+	spans map[string]trace.Span
+	mu    sync.Mutex
+}
+
+func newRequestSpans() *requestSpans {
+	return &requestSpans{
+		spans: map[string]trace.Span{},
+	}
+}
+
+// context returns the context with the root span of the provisioning of the request, starting it if needed.
+func (r *requestSpans) context(ctx context.Context, requestID string) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	span, ok := r.spans[requestID]
+	if !ok {
+		_, span = tracer().Start(ctx, "provision", trace.WithNewRoot(), trace.WithAttributes(attribute.String(attrRequestID, requestID)))
+
+		r.spans[requestID] = span
+	}
+
+	return trace.ContextWithSpan(ctx, span)
+}
+
+// end ends the root span of the provisioning of the request, and returns its span context.
+//
+// The span context is invalid if no step of the request was run by this process.
+func (r *requestSpans) end(requestID string, err error) trace.SpanContext {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	span, ok := r.spans[requestID]
+	if !ok {
+		return trace.SpanContext{}
+	}
+
+	delete(r.spans, requestID)
+	endSpan(span, err)
+
+	return span.SpanContext()
+}
+
+// endSpan records the result of the operation, and ends the span.
+//
+// Retry errors are not failures, they are recorded as an attribute.
+func endSpan(span trace.Span, err error) {
+	switch {
+	case err == nil:
+	case isRetryError(err):
+		span.SetAttributes(attribute.Bool(attrRetry, true))
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("reason", err.Error())))
+	default:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
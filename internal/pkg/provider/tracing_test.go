@@ -0,0 +1,156 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/tracing"
+)
+
+// recordSpans replaces the global tracer provider with one recording the spans in memory.
+func recordSpans(t *testing.T) func() tracetest.SpanStubs {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider := tracing.NewTracerProvider(exporter, 0)
+	previous := otel.GetTracerProvider()
+
+	otel.SetTracerProvider(tracerProvider)
+
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+
+		require.NoError(t, tracerProvider.Shutdown(context.Background()))
+	})
+
+	return func() tracetest.SpanStubs {
+		require.NoError(t, tracerProvider.ForceFlush(t.Context()))
+
+		return exporter.GetSpans()
+	}
+}
+
+// findSpan returns the first span with the name.
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+
+	require.FailNow(t, "span not found", name)
+
+	return tracetest.SpanStub{}
+}
+
+func spanAttribute(span tracetest.SpanStub, key string) attribute.Value {
+	for _, attr := range span.Attributes {
+		if string(attr.Key) == key {
+			return attr.Value
+		}
+	}
+
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	spans := recordSpans(t)
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "createVM")
+
+	recorded := spans()
+
+	createVM := findSpan(t, recorded, "provision.createVM")
+	assert.Equal(t, testRequestID, spanAttribute(createVM, "omni.machine_request.id").AsString())
+	assert.Equal(t, "createVM", spanAttribute(createVM, "omni.provision.step").AsString())
+
+	defineXML := findSpan(t, recorded, "libvirt.DomainDefineXML")
+	assert.Equal(t, createVM.SpanContext.SpanID(), defineXML.Parent.SpanID())
+	assert.Equal(t, "default", spanAttribute(defineXML, "libvirt.host").AsString())
+
+	acquire := findSpan(t, recorded, "image_cache.acquire")
+	assert.Equal(t, testSchematicID, spanAttribute(acquire, "talos.schematic.id").AsString())
+	assert.True(t, spanAttribute(acquire, "image_cache.hit").AsBool())
+
+	primaryDisk := findSpan(t, recorded, "provision.provisionPrimaryDisk")
+	assert.Equal(t, primaryDisk.SpanContext.SpanID(), acquire.Parent.SpanID())
+
+	upload := findSpan(t, recorded, "libvirt.StorageVolUpload")
+	assert.EqualValues(t, len(testImage), spanAttribute(upload, "bytes").AsInt64())
+
+	// all the steps of the request belong to the same trace
+	for _, span := range recorded {
+		assert.Equal(t, createVM.SpanContext.TraceID(), span.SpanContext.TraceID(), span.Name)
+	}
+
+	env.lv.InjectError("DomainUndefine", 0, assert.AnError)
+
+	require.Error(t, env.provisioner.Deprovision(t.Context(), zaptest.NewLogger(t), env.machine, env.request))
+
+	recorded = spans()
+
+	// the root span of the provisioning is ended by the deprovisioning, as the last step didn't run
+	provisioning := findSpan(t, recorded, "provision")
+	assert.False(t, provisioning.Parent.IsValid())
+	assert.Equal(t, provisioning.SpanContext.SpanID(), createVM.Parent.SpanID())
+	assert.Equal(t, testRequestID, spanAttribute(provisioning, "omni.machine_request.id").AsString())
+
+	deprovision := findSpan(t, recorded, "deprovision")
+	assert.False(t, deprovision.Parent.IsValid())
+	assert.NotEqual(t, createVM.SpanContext.TraceID(), deprovision.SpanContext.TraceID())
+	require.Len(t, deprovision.Links, 1)
+	assert.Equal(t, provisioning.SpanContext, deprovision.Links[0].SpanContext)
+	assert.Equal(t, codes.Error, deprovision.Status.Code)
+}
+
+func TestTracingProvisioned(t *testing.T) {
+	spans := recordSpans(t)
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "startVM")
+
+	recorded := spans()
+
+	provisioning := findSpan(t, recorded, "provision")
+	assert.Equal(t, provisioning.SpanContext.SpanID(), findSpan(t, recorded, "provision.selectHost").Parent.SpanID())
+	assert.Equal(t, provisioning.SpanContext.SpanID(), findSpan(t, recorded, "provision.startVM").Parent.SpanID())
+	assert.Equal(t, codes.Unset, provisioning.Status.Code)
+}
+
+func TestTracingRetry(t *testing.T) {
+	spans := recordSpans(t)
+	env := newTestEnv(t, testProviderData)
+
+	env.runSteps(t, "provisionCidata")
+
+	// the host is disconnected
+	connector := &flakyConnector{client: env.lv}
+	connector.calls.Store(1)
+
+	env.provisioner = provider.NewProvisioner([]provider.Host{{Name: config.DefaultHostName, Connection: connector}}, env.scheduler, nil)
+
+	require.Error(t, env.runStep(t, "createVM"))
+
+	createVM := findSpan(t, spans(), "provision.createVM")
+	assert.True(t, spanAttribute(createVM, "omni.provision.retry").AsBool())
+	assert.Equal(t, codes.Unset, createVM.Status.Code)
+	require.Len(t, createVM.Events, 1)
+	assert.Equal(t, "retry", createVM.Events[0].Name)
+}
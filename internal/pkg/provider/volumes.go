@@ -7,10 +7,12 @@ package provider
 import (
 	"errors"
 	"fmt"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/digitalocean/go-libvirt"
-	"libvirt.org/go/libvirtxml"
 )
 
 var (
@@ -18,7 +20,63 @@ var (
 	errVolNoExist = errors.New("volume does not exist")
 )
 
-func getVol(lc *libvirt.Libvirt, poolName, volName string) (libvirt.StorageVol, error) {
+// primaryVolumeName is the name of the volume of the primary disk of the machine, with the extension of its disk format.
+func primaryVolumeName(vmName, format string) string {
+	return fmt.Sprintf("%s.%s", vmName, format)
+}
+
+// additionalVolumeName is the name of the volume of the additional disk of the machine with the given index,
+// with the extension of its disk format.
+func additionalVolumeName(vmName string, idx int, diskType, format string) string {
+	return fmt.Sprintf("%s-%d-%s.%s", vmName, idx, diskType, format)
+}
+
+// cidataVolumeName is the name of the volume of the cidata ISO of the machine.
+func cidataVolumeName(vmName string) string {
+	return fmt.Sprintf("%s-cidata.iso", vmName)
+}
+
+// isRequestVolume reports whether the volume is one of the volumes created for the machine request.
+//
+// The volumes of the other requests whose IDs start with the request ID, e.g. "<requestID>-1.qcow2", don't match,
+// unless the rest of the ID looks like the index and the type of an additional disk.
+func isRequestVolume(volName, requestID string) bool {
+	if volName == cidataVolumeName(requestID) {
+		return true
+	}
+
+	format := strings.TrimPrefix(path.Ext(volName), ".")
+	if format != diskFormatQcow2 && format != diskFormatRaw {
+		return false
+	}
+
+	if volName == primaryVolumeName(requestID, format) {
+		return true
+	}
+
+	rest, ok := strings.CutPrefix(strings.TrimSuffix(volName, path.Ext(volName)), requestID+"-")
+	if !ok {
+		return false
+	}
+
+	idxStr, diskType, ok := strings.Cut(rest, "-")
+	if !ok {
+		return false
+	}
+
+	if !slices.Contains([]string{diskTypeVirtioBlk, diskTypeVirtioSCSI, diskTypeSATA, diskTypeNVMe}, diskType) {
+		return false
+	}
+
+	idx, err := strconv.Atoi(idxStr)
+	if err != nil {
+		return false
+	}
+
+	return volName == additionalVolumeName(requestID, idx, diskType, format)
+}
+
+func getVol(lc LibvirtClient, poolName, volName string) (libvirt.StorageVol, error) {
 	var vol libvirt.StorageVol
 
 	pool, err := lc.StoragePoolLookupByName(poolName)
@@ -39,43 +97,25 @@ func getVol(lc *libvirt.Libvirt, poolName, volName string) (libvirt.StorageVol,
 	return vol, nil
 }
 
-func createVolume(lc *libvirt.Libvirt, poolName, volumeName, format string, capacity uint64) (libvirt.StorageVol, error) {
-	if vol, err := getVol(lc, poolName, volumeName); err == nil {
+// createVolume creates the volume in the storage pool, unless it already exists.
+func createVolume(lc LibvirtClient, pool storagePool, volumeName, format string, capacity uint64) (libvirt.StorageVol, error) {
+	if vol, err := getVol(lc, pool.Name, volumeName); err == nil {
 		return vol, nil
 	}
 
 	var vol libvirt.StorageVol
 
-	pool, err := lc.StoragePoolLookupByName(poolName)
+	poolRef, err := lc.StoragePoolLookupByName(pool.Name)
 	if err != nil {
 		return vol, fmt.Errorf("%w: %w", errCreateVol, err)
 	}
 
-	volData := libvirtxml.StorageVolume{
-		Type: "file",
-		Name: volumeName,
-		Allocation: &libvirtxml.StorageVolumeSize{
-			// thin provision: allocate zero bytes at time of creation
-			Unit:  "bytes",
-			Value: 0,
-		},
-		Capacity: &libvirtxml.StorageVolumeSize{
-			Unit:  "bytes",
-			Value: capacity,
-		},
-		Target: &libvirtxml.StorageVolumeTarget{
-			Format: &libvirtxml.StorageVolumeTargetFormat{
-				Type: format,
-			},
-		},
-	}
-
-	volXML, err := volData.Marshal()
+	volXML, err := pool.volumeXML(volumeName, format, capacity)
 	if err != nil {
 		return vol, fmt.Errorf("%w, error rendering XML: %w", errCreateVol, err)
 	}
 
-	vol, err = lc.StorageVolCreateXML(pool, volXML, 0)
+	vol, err = lc.StorageVolCreateXML(poolRef, volXML, 0)
 	if err != nil {
 		return vol, fmt.Errorf("%w: error creating volume: %w", errCreateVol, err)
 	}
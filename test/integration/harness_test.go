@@ -0,0 +1,319 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build integration
+
+package integration_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/controller"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/siderolabs/image-factory/pkg/schematic"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/placement"
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider/resources"
+)
+
+const (
+	// defaultURI is libvirt's built-in mock driver, its state lives only as long as the connection.
+	defaultURI = "test:///default"
+
+	// pool and network defined by the test:///default driver.
+	testPool    = "default-pool"
+	testNetwork = "default"
+
+	testSchematicID  = "376567988ad370138ad8b2698212367b8edcb69b5fd68c80be1f2ec7d603b4ba"
+	testTalosVersion = "v1.12.0"
+)
+
+// connect opens a fresh connection to the libvirt test driver.
+//
+// The URI can be overridden with LIBVIRT_TEST_URI, the test is skipped if libvirtd is not reachable.
+func connect(t *testing.T) *libvirt.Libvirt {
+	t.Helper()
+
+	rawURI := os.Getenv("LIBVIRT_TEST_URI")
+	if rawURI == "" {
+		rawURI = defaultURI
+	}
+
+	uri, err := url.Parse(rawURI)
+	require.NoError(t, err)
+
+	lv, err := libvirt.ConnectToURI(uri)
+	if err != nil {
+		t.Skipf("libvirtd is not available at %s: %s", rawURI, err)
+	}
+
+	t.Cleanup(func() {
+		lv.Disconnect() //nolint:errcheck
+	})
+
+	return lv
+}
+
+// testDriverClient adapts the libvirt test driver to what the provisioner expects.
+//
+// The test driver only knows the "test" domain type and the "pc" machine, and it does not implement
+// volume uploads and resizes. Domain definitions are rewritten accordingly, and unsupported volume
+// operations are emulated by keeping the uploaded data and the requested capacity in memory.
+type testDriverClient struct {
+	*libvirt.Libvirt
+
+	uploads    map[string][]byte
+	capacities map[string]uint64
+	mu         sync.Mutex
+}
+
+func newTestDriverClient(lv *libvirt.Libvirt) *testDriverClient {
+	return &testDriverClient{
+		Libvirt:    lv,
+		uploads:    make(map[string][]byte),
+		capacities: make(map[string]uint64),
+	}
+}
+
+func isNotSupported(err error) bool {
+	var libvirtErr libvirt.Error
+
+	return errors.As(err, &libvirtErr) && libvirtErr.Code == uint32(libvirt.ErrNoSupport)
+}
+
+// DomainDefineXML implements provider.LibvirtClient.
+func (c *testDriverClient) DomainDefineXML(xml string) (libvirt.Domain, error) {
+	var dom libvirtxml.Domain
+
+	if err := dom.Unmarshal(xml); err != nil {
+		return libvirt.Domain{}, err
+	}
+
+	dom.Type = "test"
+
+	if dom.OS != nil && dom.OS.Type != nil {
+		dom.OS.Type.Machine = "pc"
+	}
+
+	xml, err := dom.Marshal()
+	if err != nil {
+		return libvirt.Domain{}, err
+	}
+
+	return c.Libvirt.DomainDefineXML(xml)
+}
+
+// StorageVolUpload implements provider.LibvirtClient.
+func (c *testDriverClient) StorageVolUpload(vol libvirt.StorageVol, outStream io.Reader, offset, length uint64, flags libvirt.StorageVolUploadFlags) error {
+	// consume the stream first, so that the upload fails early if the stream is broken
+	data, err := io.ReadAll(outStream)
+	if err != nil {
+		return err
+	}
+
+	err = c.Libvirt.StorageVolUpload(vol, bytes.NewReader(data), offset, length, flags)
+	if err != nil && !isNotSupported(err) {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.uploads[vol.Key] = data
+
+	return nil
+}
+
+// StorageVolResize implements provider.LibvirtClient.
+func (c *testDriverClient) StorageVolResize(vol libvirt.StorageVol, capacity uint64, flags libvirt.StorageVolResizeFlags) error {
+	err := c.Libvirt.StorageVolResize(vol, capacity, flags)
+	if err != nil && !isNotSupported(err) {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacities[vol.Key] = capacity
+
+	return nil
+}
+
+func (c *testDriverClient) uploaded(vol libvirt.StorageVol) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.uploads[vol.Key]
+}
+
+func (c *testDriverClient) capacity(vol libvirt.StorageVol) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.capacities[vol.Key]
+}
+
+// imageFactory is a local stand-in for the image factory.
+//
+// It serves a gzipped fake disk image on the image factory download path, and ensures schematics.
+type imageFactory struct {
+	server    *httptest.Server
+	image     []byte
+	downloads atomic.Int32
+}
+
+func newImageFactory(t *testing.T, image []byte) *imageFactory {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+
+	_, err := gz.Write(image)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	f := &imageFactory{
+		image: image,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /image/{schematic}/{version}/nocloud-amd64.qcow2.gz", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("schematic") != testSchematicID {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		f.downloads.Add(1)
+
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(buf.Bytes()) //nolint:errcheck
+	})
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+// EnsureSchematic implements provision.FactoryClient.
+func (f *imageFactory) EnsureSchematic(context.Context, schematic.Schematic) (string, error) {
+	return testSchematicID, nil
+}
+
+// env ties together a provisioner connected to the test driver and a local image factory.
+type env struct {
+	lv          *testDriverClient
+	factory     *imageFactory
+	provisioner *provider.Provisioner
+}
+
+func newEnv(t *testing.T) *env {
+	t.Helper()
+
+	lv := newTestDriverClient(connect(t))
+	factory := newImageFactory(t, []byte("talos nocloud image"))
+
+	imageCache := provider.NewImageCache(zaptest.NewLogger(t), t.TempDir())
+	imageCache.ImageFactoryURL = factory.server.URL
+
+	hosts := []provider.Host{
+		{
+			Name:       "default",
+			Connection: provider.Connected(lv),
+			// the test driver reports a 3 GiB node, which is already overcommitted by its default domain
+			Overcommit: provider.Overcommit{CPU: 100, Memory: 100, Disk: 100},
+		},
+	}
+
+	return &env{
+		lv:          lv,
+		factory:     factory,
+		provisioner: provider.NewProvisioner(hosts, placement.NewScheduler(placement.Spread{}), imageCache),
+	}
+}
+
+// machine holds the Omni side state of a single machine request.
+type machine struct {
+	request *infra.MachineRequest
+	status  *infra.MachineRequestStatus
+	state   *resources.Machine
+}
+
+func newMachine(id, providerData string) *machine {
+	request := infra.NewMachineRequest(id)
+	request.TypedSpec().Value.TalosVersion = testTalosVersion
+	request.TypedSpec().Value.ProviderData = providerData
+
+	return &machine{
+		request: request,
+		status:  infra.NewMachineRequestStatus(id),
+		state:   resources.NewMachine("", id),
+	}
+}
+
+// provision runs all provision steps the way Omni does: a step is repeated while it asks for a retry.
+func (e *env) provision(ctx context.Context, t *testing.T, m *machine) error {
+	logger := zaptest.NewLogger(t)
+
+	for _, step := range e.provisioner.ProvisionSteps() {
+		if err := retry(ctx, func() error {
+			return step.Run(ctx, logger, provision.NewContext(m.request, m.status, m.state, provision.ConnectionParams{}, e.factory, nil))
+		}); err != nil {
+			return fmt.Errorf("step %s: %w", step.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// deprovision runs Deprovision until it succeeds.
+func (e *env) deprovision(ctx context.Context, t *testing.T, m *machine) {
+	t.Helper()
+
+	logger := zaptest.NewLogger(t)
+
+	require.NoError(t, retry(ctx, func() error {
+		return e.provisioner.Deprovision(ctx, logger, m.state, m.request)
+	}))
+}
+
+// retry calls fn until it returns something else than a retry error, ignoring the requested retry intervals.
+func retry(ctx context.Context, fn func() error) error {
+	for {
+		err := fn()
+
+		var requeueErr *controller.RequeueError
+
+		if !errors.As(err, &requeueErr) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: last error: %w", ctx.Err(), err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
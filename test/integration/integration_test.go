@@ -0,0 +1,150 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build integration
+
+// Package integration_test runs the provisioner against libvirt's test:///default driver.
+//
+// Run with:
+//
+//	go test -tags integration ./test/integration/...
+package integration_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/siderolabs/omni-infra-provider-libvirt/internal/pkg/provider"
+)
+
+var providerData = fmt.Sprintf(`
+cores: 1
+memory: 2048
+disk_size: 10
+storage_pool: %s
+network_interfaces:
+  - driver: virtio
+    network_name: %s
+`, testPool, testNetwork)
+
+func TestProvisionDeprovision(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	e := newEnv(t)
+	m := newMachine("integration-1", providerData)
+
+	require.NoError(t, e.provision(ctx, t, m))
+
+	spec := m.state.TypedSpec().Value
+
+	// the domain is running with the UUID reported to Omni
+	dom, err := e.lv.DomainLookupByName(m.request.Metadata().ID())
+	require.NoError(t, err)
+
+	assert.Equal(t, spec.Uuid, uuid.UUID(dom.UUID).String())
+	assert.Equal(t, spec.Uuid, m.status.TypedSpec().Value.Id)
+
+	state, _, err := e.lv.DomainGetState(dom, 0)
+	require.NoError(t, err)
+	assert.Equal(t, int32(libvirt.DomainRunning), state)
+
+	// the primary disk holds the decompressed image, expanded to the requested size
+	pool, err := e.lv.StoragePoolLookupByName(testPool)
+	require.NoError(t, err)
+
+	vol, err := e.lv.StorageVolLookupByName(pool, spec.VmVolName)
+	require.NoError(t, err)
+
+	assert.Equal(t, e.factory.image, e.lv.uploaded(vol))
+	assert.Equal(t, 10*provider.GiB, e.lv.capacity(vol))
+	assert.EqualValues(t, 1, e.factory.downloads.Load())
+
+	// the cidata ISO is attached as a cdrom
+	cidata, err := e.lv.StorageVolLookupByName(pool, spec.CidataVolName)
+	require.NoError(t, err)
+	assert.Contains(t, string(e.lv.uploaded(cidata)), "local-hostname: integration-1")
+
+	domXML, err := e.lv.DomainGetXMLDesc(dom, 0)
+	require.NoError(t, err)
+	assert.Contains(t, domXML, spec.CidataVolName)
+
+	e.deprovision(ctx, t, m)
+
+	_, err = e.lv.DomainLookupByName(m.request.Metadata().ID())
+	require.Error(t, err)
+	assert.True(t, libvirt.IsNotFound(err))
+
+	for _, volName := range []string{spec.VmVolName, spec.CidataVolName} {
+		_, err = e.lv.StorageVolLookupByName(pool, volName)
+		require.Error(t, err, volName)
+	}
+}
+
+func TestConcurrentProvisionSharesImage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	e := newEnv(t)
+
+	machines := make([]*machine, 3)
+
+	for i := range machines {
+		machines[i] = newMachine(fmt.Sprintf("integration-%d", i), providerData)
+	}
+
+	var eg errgroup.Group
+
+	for _, m := range machines {
+		eg.Go(func() error {
+			return e.provision(ctx, t, m)
+		})
+	}
+
+	require.NoError(t, eg.Wait())
+
+	assert.EqualValues(t, 1, e.factory.downloads.Load(), "the image must be downloaded once")
+
+	domains, _, err := e.lv.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive)
+	require.NoError(t, err)
+
+	var names []string
+
+	for _, dom := range domains {
+		if strings.HasPrefix(dom.Name, "integration-") {
+			names = append(names, dom.Name)
+		}
+	}
+
+	assert.Len(t, names, len(machines))
+
+	for _, m := range machines {
+		e.deprovision(ctx, t, m)
+	}
+}
+
+func TestDeprovisionIsIdempotent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	e := newEnv(t)
+	m := newMachine("integration-1", providerData)
+
+	// nothing was provisioned yet
+	e.deprovision(ctx, t, m)
+
+	require.NoError(t, e.provision(ctx, t, m))
+
+	e.deprovision(ctx, t, m)
+	e.deprovision(ctx, t, m)
+}